@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Ingasti/mailhub-admin/internal/handlers"
+	"github.com/Ingasti/mailhub-admin/internal/services"
+)
+
+// runCommand dispatches one-shot CLI subcommands and returns the exit code
+func runCommand(mail *services.MailService, args []string) int {
+	switch args[0] {
+	case "migrate-passwords":
+		return runMigratePasswords(mail, args[1:])
+	case "openapi":
+		return runOpenAPI()
+	case "audit-verify":
+		return runAuditVerify(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+		fmt.Fprintln(os.Stderr, "available commands: migrate-passwords, openapi, audit-verify")
+		return 2
+	}
+}
+
+// runMigratePasswords rehashes {PLAIN} dovecot passwords and prints a report
+func runMigratePasswords(mail *services.MailService, args []string) int {
+	fs := flag.NewFlagSet("migrate-passwords", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report PLAIN accounts without rewriting them")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := mail.MigratePlainPasswords(*dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "password migration failed: %v\n", err)
+		return 1
+	}
+
+	mode := "applied"
+	if report.DryRun {
+		mode = "dry run"
+	}
+	fmt.Printf("Password migration to %s (%s)\n", report.Scheme, mode)
+	fmt.Printf("Migrated: %d\n", len(report.Migrated))
+	for _, email := range report.Migrated {
+		fmt.Printf("  %s\n", email)
+	}
+
+	fmt.Printf("Still on PLAIN: %d\n", len(report.StillPlain))
+	for _, email := range report.StillPlain {
+		fmt.Printf("  %s\n", email)
+	}
+
+	var schemes []string
+	for scheme, count := range report.Schemes {
+		schemes = append(schemes, fmt.Sprintf("%s=%d", scheme, count))
+	}
+	sort.Strings(schemes)
+	fmt.Printf("Schemes: %s\n", strings.Join(schemes, " "))
+
+	if len(report.StillPlain) > 0 && !report.DryRun {
+		return 1
+	}
+	return 0
+}
+
+// runOpenAPI prints the OpenAPI document of /api/v1
+func runOpenAPI() int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(handlers.OpenAPIDocument()); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write OpenAPI document: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runAuditVerify walks the audit hash chain, optionally against a saved
+// checkpoint, and exits non-zero at the first broken link
+func runAuditVerify(args []string) int {
+	fs := flag.NewFlagSet("audit-verify", flag.ContinueOnError)
+	checkpointPath := fs.String("checkpoint", "", "checkpoint JSON saved from the audit page or API")
+	publicKey := fs.String("public-key", "", "expected base64 signing key of the checkpoint")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var cp *services.AuditCheckpoint
+	if *checkpointPath != "" {
+		data, err := os.ReadFile(*checkpointPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read checkpoint: %v\n", err)
+			return 2
+		}
+		cp = &services.AuditCheckpoint{}
+		if err := json.Unmarshal(data, cp); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid checkpoint: %v\n", err)
+			return 2
+		}
+		if *publicKey != "" && cp.PublicKey != *publicKey {
+			fmt.Fprintln(os.Stderr, "checkpoint was not signed by the expected key")
+			return 1
+		}
+	}
+
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open audit log: %v\n", err)
+		return 1
+	}
+	report, err := auditSvc.VerifyChain(cp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit verification failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Entries: %d\n", report.Entries)
+	fmt.Printf("Head: %d %s\n", report.HeadID, report.HeadHash)
+	if cp != nil {
+		fmt.Printf("Checkpoint: %d %s (signed %s)\n", cp.HeadID, cp.HeadHash, cp.SignedAt.Format(time.RFC3339))
+	}
+	if !report.OK {
+		fmt.Printf("BROKEN at entry %d: %s\n", report.BrokenID, report.Reason)
+		return 1
+	}
+	fmt.Println("Chain intact")
+	return 0
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+"fmt"
 "log"
 "net/http"
 "os"
+"time"
 
 "github.com/Ingasti/mailhub-admin/internal/config"
 "github.com/Ingasti/mailhub-admin/internal/handlers"
@@ -17,88 +19,306 @@ func main() {
 // Load configuration
 cfg := config.Load()
 
-	// Initialize SSH client
-	sshClient := services.NewSSHClient(services.SSHConfig{
-		Host:        cfg.SSH.Host,
-		Port:        cfg.SSH.Port,
-		User:        cfg.SSH.User,
-		KeyPath:     cfg.SSH.KeyPath,
-		JumpHost:    cfg.SSH.JumpHost,
-		JumpUser:    cfg.SSH.JumpUser,
-		JumpKeyPath: cfg.SSH.JumpKeyPath,
-	})// Initialize mail service
-mailService := services.NewMailService(sshClient)
+// Connection settings of the default mail server; other servers fall
+// back to them for anything they leave empty
+defaults := services.ServerSpec{
+Name:                cfg.ServerName,
+Host:                cfg.SSH.Host,
+Port:                cfg.SSH.Port,
+User:                cfg.SSH.User,
+KeyPath:             cfg.SSH.KeyPath,
+JumpHost:            cfg.SSH.JumpHost,
+JumpUser:            cfg.SSH.JumpUser,
+JumpKeyPath:         cfg.SSH.JumpKeyPath,
+KnownHostsPath:      cfg.SSH.KnownHostsPath,
+HostFingerprint:     cfg.SSH.HostFingerprint,
+JumpKnownHostsPath:  cfg.SSH.JumpKnownHostsPath,
+JumpHostFingerprint: cfg.SSH.JumpHostFingerprint,
+RspamdController:    cfg.RspamdController,
+RspamdPassword:      cfg.RspamdPassword,
+}
+setupMail := func(mail *services.MailService) error {
+if err := mail.SetPasswordScheme(cfg.PasswordScheme); err != nil {
+return fmt.Errorf("invalid PASSWORD_SCHEME: %w", err)
+}
+if err := mail.SetArchiveDir(cfg.ArchiveDir); err != nil {
+return fmt.Errorf("invalid CMH_ARCHIVE_DIR: %w", err)
+}
+if err := mail.SetDKIMAlgorithm(cfg.DKIMAlgorithm); err != nil {
+return fmt.Errorf("invalid CMH_DKIM_ALGORITHM: %w", err)
+}
+return nil
+}
+
+// One-shot subcommands (e.g. run as a Kubernetes Job) work on the
+// default server
+if len(os.Args) > 1 {
+mailService := services.NewMailService(services.NewSSHClient(defaults.SSHConfig()))
+if err := setupMail(mailService); err != nil {
+log.Fatal(err)
+}
+os.Exit(runCommand(mailService, os.Args[1:]))
+}
+
+// Application database (API tokens, roles)
+store, err := services.OpenStore(cfg.DatabasePath)
+if err != nil {
+log.Fatalf("Failed to open database: %v", err)
+}
+defer store.Close()
+tokenService, err := services.NewTokenService(store)
+if err != nil {
+log.Fatalf("Failed to initialize API tokens: %v", err)
+}
+superadmins := cfg.Superadmins
+if cfg.DevMode && cfg.DevAuthEmail != "" {
+superadmins = append(superadmins, cfg.DevAuthEmail)
+}
+roleService, err := services.NewRoleService(store, superadmins)
+if err != nil {
+log.Fatalf("Failed to initialize roles: %v", err)
+}
+if len(superadmins) == 0 {
+log.Printf("WARNING: CMH_SUPERADMINS is empty; nobody can assign roles")
+}
+
+// Mail server inventory: the default server, the servers file and the
+// servers added from the UI
+servers, err := services.NewServerInventory(store, defaults, setupMail)
+if err != nil {
+log.Fatalf("Failed to initialize servers: %v", err)
+}
+if _, err := servers.Register(defaults, services.ServerSourceEnv); err != nil {
+log.Fatalf("Invalid default server: %v", err)
+}
+if cfg.ServersFile != "" {
+specs, err := services.LoadServerFile(cfg.ServersFile)
+if err != nil {
+log.Fatalf("Invalid CMH_SERVERS_FILE: %v", err)
+}
+for _, spec := range specs {
+if _, err := servers.Register(spec, services.ServerSourceFile); err != nil {
+log.Fatalf("Invalid server in %s: %v", cfg.ServersFile, err)
+}
+}
+log.Printf("Loaded %d servers from %s", len(specs), cfg.ServersFile)
+}
 
 // Test connection
-if err := mailService.TestConnection(); err != nil {
+if err := servers.Default().Mail().TestConnection(); err != nil {
 log.Printf("WARNING: SSH connection test failed: %v", err)
 log.Printf("Mail management features may not work until SSH is configured")
 } else {
 log.Printf("SSH connection to mail server established")
 }
 
+// Authentication: trusted ingress proxies and optional AuthCrunch JWTs
+proxies, err := middleware.ParseTrustedProxies(cfg.TrustedProxies)
+if err != nil {
+log.Fatalf("Invalid CMH_TRUSTED_PROXIES: %v", err)
+}
+if len(proxies) == 0 && !cfg.DevMode {
+log.Printf("WARNING: CMH_TRUSTED_PROXIES is empty; X-Auth-User headers will be rejected")
+}
+authOpts := middleware.AuthOptions{Tokens: tokenService, Proxies: proxies}
+if cfg.JWT.JWKSPath != "" {
+authOpts.JWT, err = middleware.NewJWTVerifier(middleware.JWTConfig{
+JWKSPath: cfg.JWT.JWKSPath,
+Issuer:   cfg.JWT.Issuer,
+Audience: cfg.JWT.Audience,
+Header:   cfg.JWT.Header,
+Cookie:   cfg.JWT.Cookie,
+})
+if err != nil {
+log.Fatalf("Invalid CMH_JWT_JWKS_FILE: %v", err)
+}
+log.Printf("Verifying AuthCrunch JWTs against %s", cfg.JWT.JWKSPath)
+}
+
+// Audit log: checkpoint signing key and retention
+auditService, err := services.GetAuditService()
+if err != nil {
+log.Fatalf("Failed to open audit log: %v", err)
+}
+auditKey, err := services.LoadAuditSigningKey(cfg.AuditSigningKey)
+if err != nil {
+log.Fatalf("Invalid CMH_AUDIT_SIGNING_KEY: %v", err)
+}
+auditService.SetSigningKey(auditKey)
+if cfg.AuditRetentionDays > 0 {
+go auditService.RunRetention(services.RetentionPolicy{
+MaxAge:   time.Duration(cfg.AuditRetentionDays) * 24 * time.Hour,
+Archive:  cfg.AuditArchive,
+Interval: cfg.AuditPruneInterval,
+}, nil)
+log.Printf("Pruning audit entries older than %d days (archive: %v)", cfg.AuditRetentionDays, cfg.AuditArchive)
+}
+
+// Notifications of administrative events (webhooks, optional SMTP mail)
+notifyService, err := services.NewNotificationService(store)
+if err != nil {
+log.Fatalf("Failed to initialize notifications: %v", err)
+}
+if cfg.SMTP.Addr != "" {
+notifyService.SetMailer(cfg.NotifyFrom, services.SMTPSender(cfg.SMTP.Addr, cfg.SMTP.User, cfg.SMTP.Password))
+log.Printf("Sending notification mail via %s", cfg.SMTP.Addr)
+}
+go notifyService.Run(time.Minute, nil)
+
 // Initialize handlers with dependencies
-handlers.Init(mailService)
+handlers.Init(servers, tokenService, roleService, notifyService, services.NewDNSChecker(services.NewDNSResolver(cfg.DNSServer)))
 
 // Setup router
 r := chi.NewRouter()
 
 // Global middleware
+r.Use(chimiddleware.RequestID)
 r.Use(chimiddleware.Logger)
 r.Use(chimiddleware.Recoverer)
-r.Use(chimiddleware.RealIP)
+r.Use(middleware.RealIP(proxies))
 
 // Health check (no auth required)
 r.Get("/health", handlers.HealthCheck)
 
-// Protected routes
+// Protected routes. Every route states the permission it needs; routes
+// under a {domain} are checked against that domain.
 r.Group(func(r chi.Router) {
-r.Use(middleware.Auth(cfg))
+r.Use(middleware.Auth(cfg, authOpts))
+r.Use(middleware.Roles(roleService))
+view := middleware.Require(services.PermView)
+resetPassword := middleware.Require(services.PermResetPassword)
+manageMailboxes := middleware.Require(services.PermManageMailboxes)
+trainBayes := middleware.Require(services.PermTrainBayes)
+manageDomains := middleware.Require(services.PermManageDomains)
+viewAudit := middleware.Require(services.PermViewAudit)
+viewServer := middleware.Require(services.PermViewServer)
+manageServer := middleware.Require(services.PermManageServer)
+manageRoles := middleware.Require(services.PermManageRoles)
+
+// Pages that work on one mail server: the selected server under
+// /servers/{server}, and the remembered or default server without it
+serverRoutes := func(r chi.Router) {
+r.Use(handlers.SelectServer)
+r.Use(handlers.RecordChanges)
 
 // Dashboard
-r.Get("/", handlers.Dashboard)
+r.With(view).Get("/", handlers.Dashboard)
 
 // Domain management
 r.Route("/domains", func(r chi.Router) {
-r.Get("/", handlers.ListDomains)
-r.Get("/list", handlers.ListDomainsPartial)
-r.Get("/new", handlers.NewDomainForm)
-r.Post("/", handlers.CreateDomain)
-r.Delete("/{domain}", handlers.DeleteDomain)
+r.With(view).Get("/", handlers.ListDomains)
+r.With(view).Get("/list", handlers.ListDomainsPartial)
+r.With(manageDomains).Get("/new", handlers.NewDomainForm)
+r.With(manageDomains).Post("/", handlers.CreateDomain)
+r.With(manageDomains).Get("/{domain}/delete", handlers.DeleteDomainForm)
+r.With(manageDomains).Get("/{domain}/delete/preview", handlers.DeleteDomainPreview)
+r.With(manageDomains).Delete("/{domain}", handlers.DeleteDomain)
+r.With(manageDomains).Get("/{domain}/quota", handlers.DomainQuotaForm)
+r.With(manageDomains).Put("/{domain}/quota", handlers.UpdateDomainQuota)
+
+// DNS readiness per domain
+r.With(view).Get("/{domain}/dns", handlers.DNSPage)
+r.With(view).Get("/{domain}/dns/check", handlers.DNSPartial)
+
+// DKIM keys per domain
+r.Route("/{domain}/dkim", func(r chi.Router) {
+r.With(view).Get("/", handlers.DKIMPage)
+r.With(view).Get("/list", handlers.DKIMPartial)
+r.With(manageDomains).Post("/", handlers.CreateDKIMKey)
+r.With(manageDomains).Put("/{selector}/activate", handlers.ActivateDKIMKey)
+r.With(manageDomains).Delete("/{selector}", handlers.DeleteDKIMKey)
+})
 
 // Users per domain
 r.Route("/{domain}/users", func(r chi.Router) {
-r.Get("/", handlers.ListUsers)
-r.Get("/list", handlers.ListUsersPartial)
-r.Get("/new", handlers.NewUserForm)
-r.Post("/", handlers.CreateUser)
-r.Get("/{user}/edit", handlers.EditUserForm)
-r.Put("/{user}/password", handlers.ChangePassword)
-r.Delete("/{user}", handlers.DeleteUser)
+r.With(view).Get("/", handlers.ListUsers)
+r.With(view).Get("/list", handlers.ListUsersPartial)
+r.With(manageMailboxes).Get("/new", handlers.NewUserForm)
+r.With(manageMailboxes).Post("/", handlers.CreateUser)
+r.With(resetPassword).Get("/{user}/edit", handlers.EditUserForm)
+r.With(resetPassword).Put("/{user}/password", handlers.ChangePassword)
+r.With(manageMailboxes).Get("/{user}/quota", handlers.EditQuotaForm)
+r.With(manageMailboxes).Put("/{user}/quota", handlers.UpdateQuota)
+r.With(manageMailboxes).Delete("/{user}", handlers.DeleteUser)
+r.With(trainBayes).Get("/{user}/training", handlers.TrainingPage)
+r.With(trainBayes).Get("/{user}/training/messages", handlers.TrainingMessagesPartial)
+r.With(trainBayes).Post("/{user}/training/learn", handlers.LearnMailboxMessage)
+})
+
+// Aliases and forwards per domain
+r.Route("/{domain}/aliases", func(r chi.Router) {
+r.With(view).Get("/", handlers.ListAliases)
+r.With(view).Get("/list", handlers.ListAliasesPartial)
+r.With(manageMailboxes).Get("/new", handlers.NewAliasForm)
+r.With(manageMailboxes).Post("/", handlers.CreateAlias)
+r.With(manageMailboxes).Get("/{alias}/edit", handlers.EditAliasForm)
+r.With(manageMailboxes).Put("/{alias}", handlers.UpdateAlias)
+r.With(manageMailboxes).Delete("/{alias}", handlers.DeleteAlias)
 })
 })
 
-// Audit log
-r.Get("/audit", handlers.AuditLog)
-r.Get("/audit/entries", handlers.AuditEntriesPartial)
+// SSH host key verification
+r.With(viewServer).Get("/settings/hostkeys", handlers.HostKeysPage)
+r.With(viewServer).Get("/settings/hostkeys/list", handlers.HostKeysPartial)
+r.With(manageServer).Post("/settings/hostkeys/trust", handlers.TrustHostKey)
 
 // Rspamd antispam management
 r.Route("/rspamd", func(r chi.Router) {
-r.Get("/", handlers.HandleRspamdDashboard)
-r.Get("/status", handlers.HandleRspamdStatus)
-r.Get("/metrics", handlers.HandleRspamdMetrics)
-r.Get("/config", handlers.HandleRspamdConfig)
-r.Put("/config", handlers.HandleRspamdConfigUpdate)
-r.Post("/config", handlers.HandleRspamdConfigUpdate)
-r.Get("/whitelist", handlers.HandleRspamdWhitelist)
-r.Post("/whitelist", handlers.HandleRspamdWhitelistAdd)
-r.Delete("/whitelist", handlers.HandleRspamdWhitelistRemove)
-r.Get("/logs", handlers.HandleRspamdLogs)
-r.Post("/service/start", handlers.HandleRspamdServiceStart)
-r.Post("/service/stop", handlers.HandleRspamdServiceStop)
-r.Post("/service/restart", handlers.HandleRspamdServiceRestart)
-r.Get("/export", handlers.HandleRspamdExport)
+r.With(viewServer).Get("/", handlers.HandleRspamdDashboard)
+r.With(viewServer).Get("/status", handlers.HandleRspamdStatus)
+r.With(viewServer).Get("/metrics", handlers.HandleRspamdMetrics)
+r.With(viewServer).Get("/config", handlers.HandleRspamdConfig)
+r.With(manageServer).Put("/config", handlers.HandleRspamdConfigUpdate)
+r.With(manageServer).Post("/config", handlers.HandleRspamdConfigUpdate)
+r.With(viewServer).Get("/whitelist", handlers.HandleRspamdWhitelist)
+r.With(manageServer).Post("/whitelist", handlers.HandleRspamdWhitelistAdd)
+r.With(manageServer).Delete("/whitelist", handlers.HandleRspamdWhitelistRemove)
+r.With(viewServer).Get("/logs", handlers.HandleRspamdLogs)
+r.With(viewServer).Get("/history", handlers.HandleRspamdHistory)
+r.With(manageServer).Post("/learn", handlers.HandleRspamdLearn)
+r.With(manageServer).Post("/service/start", handlers.HandleRspamdServiceStart)
+r.With(manageServer).Post("/service/stop", handlers.HandleRspamdServiceStop)
+r.With(manageServer).Post("/service/restart", handlers.HandleRspamdServiceRestart)
+r.With(viewServer).Get("/export", handlers.HandleRspamdExport)
 })
+}
+r.Group(serverRoutes)
+r.Route("/servers/{server}", serverRoutes)
+
+// Audit log
+r.With(viewAudit).Get("/audit", handlers.AuditLog)
+r.With(viewAudit).Get("/audit/entries", handlers.AuditEntriesPartial)
+r.With(viewAudit).Get("/audit/export", handlers.ExportAuditLog)
+r.With(viewAudit).Get("/audit/integrity", handlers.AuditIntegrityPartial)
+
+// JSON API for automation (permissions are declared per route in the API table)
+r.Mount("/api/v1", handlers.APIRouter())
+
+// Personal API tokens
+r.With(view).Get("/settings/tokens", handlers.TokensPage)
+r.With(view).Get("/settings/tokens/list", handlers.TokensPartial)
+r.With(view).Post("/settings/tokens", handlers.CreateToken)
+r.With(view).Delete("/settings/tokens/{id}", handlers.RevokeToken)
+
+// Notification subscriptions
+r.With(manageServer).Get("/settings/notifications", handlers.NotificationsPage)
+r.With(manageServer).Get("/settings/notifications/list", handlers.NotificationsPartial)
+r.With(manageServer).Post("/settings/notifications", handlers.CreateNotification)
+r.With(manageServer).Delete("/settings/notifications/{id}", handlers.DeleteNotification)
+r.With(manageServer).Post("/settings/notifications/{id}/test", handlers.TestNotification)
+
+// Mail server inventory
+r.With(viewServer).Get("/settings/servers", handlers.ServersPage)
+r.With(viewServer).Get("/settings/servers/list", handlers.ServersPartial)
+r.With(manageServer).Post("/settings/servers", handlers.AddServer)
+r.With(manageServer).Delete("/settings/servers/{name}", handlers.RemoveServer)
+
+// Role management
+r.With(manageRoles).Get("/settings/roles", handlers.RolesPage)
+r.With(manageRoles).Get("/settings/roles/list", handlers.RolesPartial)
+r.With(manageRoles).Post("/settings/roles", handlers.AssignRole)
+r.With(manageRoles).Delete("/settings/roles/{email}", handlers.RemoveRole)
+
 })// Static files
 fileServer := http.FileServer(http.Dir("web/static"))
 r.Handle("/static/*", http.StripPrefix("/static/", fileServer))
@@ -106,7 +326,7 @@ r.Handle("/static/*", http.StripPrefix("/static/", fileServer))
 // Start server
 addr := ":" + cfg.Port
 log.Printf("Starting MailHub Admin on %s", addr)
-log.Printf("SSH Host: %s, User: %s", cfg.SSH.Host, cfg.SSH.User)
+log.Printf("Default server %s: %s@%s", cfg.ServerName, cfg.SSH.User, cfg.SSH.Host)
 log.Printf("Dev mode: %v", cfg.DevMode)
 
 if err := http.ListenAndServe(addr, r); err != nil {
@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds application configuration
@@ -13,12 +15,74 @@ type Config struct {
 	// Database (SQLite)
 	DatabasePath string
 
-	// SSH Configuration
+	// SSH Configuration of the default mail server, and the connection
+	// defaults of every other server
 	SSH SSHConfig
 
+	// Name of the default mail server and an optional JSON file with more
+	// servers; servers can also be added from the UI
+	ServerName  string
+	ServersFile string
+
+	// Dovecot password scheme for new passwords (SHA512-CRYPT, BLF-CRYPT, ARGON2ID)
+	PasswordScheme string
+
+	// Directory on the mail host where deleted domains are archived
+	ArchiveDir string
+
+	// DKIM key algorithm for new domains (rsa, ed25519, or none)
+	DKIMAlgorithm string
+
+	// DNS server (host:port) for the domain DNS checks; empty uses the
+	// system resolver
+	DNSServer string
+
+	// Rspamd controller address on the mail host and its password
+	RspamdController string
+	RspamdPassword   string
+
 	// Auth
 	DevMode      bool
 	DevAuthEmail string
+
+	// SSO emails that always have the superadmin role
+	Superadmins []string
+
+	// Proxies (CIDRs or IPs) allowed to send X-Auth-User and X-Forwarded-For
+	TrustedProxies []string
+
+	// Optional AuthCrunch JWT verification; enabled when JWKSPath is set
+	JWT JWTConfig
+
+	// Audit log retention; entries older than AuditRetentionDays are pruned
+	// every AuditPruneInterval (0 days keeps everything)
+	AuditRetentionDays int
+	AuditArchive       bool
+	AuditPruneInterval time.Duration
+
+	// Ed25519 key (PEM) that signs audit checkpoints; created if missing
+	AuditSigningKey string
+
+	// Notification mail, sent through the SMTP server at SMTP.Addr
+	// (host:port, usually the managed Postfix); empty disables email
+	SMTP       SMTPConfig
+	NotifyFrom string
+}
+
+// SMTPConfig holds the SMTP relay used for notification mail
+type SMTPConfig struct {
+	Addr     string
+	User     string
+	Password string
+}
+
+// JWTConfig holds JWT verification settings
+type JWTConfig struct {
+	JWKSPath string
+	Issuer   string
+	Audience string
+	Header   string
+	Cookie   string
 }
 
 // SSHConfig holds SSH connection settings
@@ -30,11 +94,24 @@ type SSHConfig struct {
 	JumpHost    string
 	JumpUser    string
 	JumpKeyPath string
+
+	// Host key verification: a pinned SHA256 fingerprint takes precedence
+	// over the known_hosts file
+	KnownHostsPath      string
+	HostFingerprint     string
+	JumpKnownHostsPath  string
+	JumpHostFingerprint string
 }
 
 // Load reads configuration from environment variables
 func Load() *Config {
 	sshPort, _ := strconv.Atoi(getEnv("CMH_SSH_PORT", "22"))
+	knownHosts := getEnv("CMH_SSH_KNOWN_HOSTS", "/data/known_hosts")
+	retentionDays, _ := strconv.Atoi(getEnv("CMH_AUDIT_RETENTION_DAYS", "0"))
+	pruneInterval, err := time.ParseDuration(getEnv("CMH_AUDIT_PRUNE_INTERVAL", "24h"))
+	if err != nil || pruneInterval <= 0 {
+		pruneInterval = 24 * time.Hour
+	}
 
 	return &Config{
 		Port:         getEnv("PORT", "8080"),
@@ -49,13 +126,59 @@ func Load() *Config {
 			JumpHost:    getEnv("CMH_SSH_JUMP_HOST", "jump.ingasti.com"),
 			JumpUser:    getEnv("CMH_SSH_JUMP_USER", "ubuntu"),
 			JumpKeyPath: getEnv("CMH_SSH_JUMP_KEY_PATH", "/secrets/jump_key"),
+
+			KnownHostsPath:      knownHosts,
+			HostFingerprint:     getEnv("CMH_SSH_HOST_FINGERPRINT", ""),
+			JumpKnownHostsPath:  getEnv("CMH_SSH_JUMP_KNOWN_HOSTS", knownHosts),
+			JumpHostFingerprint: getEnv("CMH_SSH_JUMP_HOST_FINGERPRINT", ""),
 		},
 
+		ServerName:  getEnv("CMH_SERVER_NAME", "cmh"),
+		ServersFile: getEnv("CMH_SERVERS_FILE", ""),
+
+		PasswordScheme: getEnv("PASSWORD_SCHEME", "SHA512-CRYPT"),
+		ArchiveDir:     getEnv("CMH_ARCHIVE_DIR", "/var/mail/archive"),
+		DKIMAlgorithm:  getEnv("CMH_DKIM_ALGORITHM", "rsa"),
+		DNSServer:      getEnv("CMH_DNS_SERVER", ""),
+
+		RspamdController: getEnv("CMH_RSPAMD_CONTROLLER", "127.0.0.1:11334"),
+		RspamdPassword:   getEnv("CMH_RSPAMD_PASSWORD", ""),
+
 		DevMode:      getEnv("DEV_MODE", "false") == "true",
 		DevAuthEmail: getEnv("DEV_AUTH_EMAIL", "dev@example.com"),
+
+		Superadmins:    getEnvList("CMH_SUPERADMINS"),
+		TrustedProxies: getEnvList("CMH_TRUSTED_PROXIES"),
+
+		JWT: JWTConfig{
+			JWKSPath: getEnv("CMH_JWT_JWKS_FILE", ""),
+			Issuer:   getEnv("CMH_JWT_ISSUER", ""),
+			Audience: getEnv("CMH_JWT_AUDIENCE", ""),
+			Header:   getEnv("CMH_JWT_HEADER", "X-Auth-Token"),
+			Cookie:   getEnv("CMH_JWT_COOKIE", "access_token"),
+		},
+
+		AuditRetentionDays: retentionDays,
+		AuditArchive:       getEnv("CMH_AUDIT_ARCHIVE", "true") == "true",
+		AuditPruneInterval: pruneInterval,
+		AuditSigningKey:    getEnv("CMH_AUDIT_SIGNING_KEY", "/data/audit-signing.pem"),
+
+		SMTP: SMTPConfig{
+			Addr:     getEnv("CMH_SMTP_ADDR", ""),
+			User:     getEnv("CMH_SMTP_USER", ""),
+			Password: getEnv("CMH_SMTP_PASSWORD", ""),
+		},
+		NotifyFrom: getEnv("CMH_NOTIFY_FROM", "mailhub-admin@localhost"),
 	}
 }
 
+// getEnvList splits a comma or space separated variable
+func getEnvList(key string) []string {
+	return strings.FieldsFunc(os.Getenv(key), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Ingasti/mailhub-admin/internal/middleware"
+	"github.com/Ingasti/mailhub-admin/internal/services"
+)
+
+// can reports whether the current user's role grants perm, for domain if
+// non-empty. Handlers use it to hide controls the user cannot use; the
+// routes themselves are guarded by middleware.Require.
+func can(r *http.Request, perm services.Permission, domain string) bool {
+	return middleware.GetAuthUser(r).Role.Can(perm, domain)
+}
+
+// visibleDomains filters domains to those the current user may see
+func visibleDomains(r *http.Request, domains []services.Domain) []services.Domain {
+	role := middleware.GetAuthUser(r).Role
+	visible := []services.Domain{}
+	for _, d := range domains {
+		if role.HasDomain(d.Name) {
+			visible = append(visible, d)
+		}
+	}
+	return visible
+}
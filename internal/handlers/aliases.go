@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/Ingasti/mailhub-admin/internal/templates"
+	"github.com/go-chi/chi/v5"
+)
+
+// ListAliases renders the aliases page for a domain
+func ListAliases(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	w.Header().Set("Content-Type", "text/html")
+
+	addButton := ""
+	if can(r, services.PermManageMailboxes, domain) {
+		addButton = fmt.Sprintf(`
+    <button class="btn btn-primary" hx-get="%s/aliases/new" hx-target="#modal" hx-swap="innerHTML">
+        <i class="la la-share" style="margin-right: 8px;"></i> Add Alias
+    </button>`, domainPath(r, domain))
+	}
+
+	content := fmt.Sprintf(`
+<div class="card">
+    <a href="%s/users" class="nav-link"><i class="la la-arrow-left"></i> Back to Users</a>
+    <div class="header">
+        <h1>Aliases: %s</h1>
+        <p class="subtitle">Manage forwards and the catch-all address for this domain</p>
+    </div>
+%s
+
+    <div id="alias-list" hx-get="%s/aliases/list" hx-trigger="load" hx-swap="innerHTML">
+        <div class="empty-state">
+            <i class="la la-spinner la-spin"></i>
+            <p>Loading aliases...</p>
+        </div>
+    </div>
+    <div id="modal"></div>
+</div>`,
+		domainPath(r, domain),
+		html.EscapeString(domain),
+		addButton,
+		domainPath(r, domain))
+
+	templates.RenderPage(w, "Aliases - "+domain, content)
+}
+
+// ListAliasesPartial returns alias list as HTML partial (for HTMX)
+func ListAliasesPartial(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	w.Header().Set("Content-Type", "text/html")
+
+	if mailFor(r) == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Mail service not initialized</div>`))
+		return
+	}
+
+	aliases, err := mailFor(r).ListAliases(domain)
+	if err != nil {
+		log.Printf("Error listing aliases for %s: %v", domain, err)
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+
+	if len(aliases) == 0 {
+		w.Write([]byte(`
+<div class="empty-state">
+    <i class="la la-share"></i>
+    <p>No aliases configured yet</p>
+    <p style="font-size: 0.9rem; margin-top: 10px;">Click "Add Alias" to create a forward or catch-all</p>
+</div>`))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`
+<table>
+    <thead>
+        <tr>
+            <th>Alias</th>
+            <th>Forwards To</th>
+            <th>Actions</th>
+        </tr>
+    </thead>
+    <tbody>`)
+
+	for _, a := range aliases {
+		label := html.EscapeString(a.Source)
+		if a.CatchAll {
+			label += ` <span class="badge badge-info">catch-all</span>`
+		}
+
+		var targets []string
+		for _, t := range a.Targets {
+			targets = append(targets, html.EscapeString(t))
+		}
+
+		actions := ""
+		if can(r, services.PermManageMailboxes, domain) {
+			source := html.EscapeString(url.PathEscape(a.Source))
+			actions = fmt.Sprintf(`
+                <button class="btn btn-secondary btn-sm"
+                        hx-get="%s/aliases/%s/edit"
+                        hx-target="#modal"
+                        hx-swap="innerHTML">
+                    <i class="la la-edit"></i>
+                </button>
+                <button class="btn btn-danger btn-sm"
+                        hx-delete="%s/aliases/%s"
+                        hx-target="#alias-list"
+                        hx-swap="innerHTML"
+                        hx-confirm="Delete alias %s?">
+                    <i class="la la-trash"></i>
+                </button>`,
+				domainPath(r, domain),
+				source,
+				domainPath(r, domain),
+				source,
+				html.EscapeString(a.Source))
+		}
+
+		sb.WriteString(fmt.Sprintf(`
+        <tr>
+            <td>
+                <i class="la la-share" style="color: #1a73e8; margin-right: 8px;"></i>
+                <strong>%s</strong>
+            </td>
+            <td>%s</td>
+            <td class="actions">%s
+            </td>
+        </tr>`,
+			label,
+			strings.Join(targets, "<br>"),
+			actions))
+	}
+
+	sb.WriteString(`
+    </tbody>
+</table>`)
+
+	w.Write([]byte(sb.String()))
+}
+
+// NewAliasForm returns the add alias form
+func NewAliasForm(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(fmt.Sprintf(`
+<div class="modal-overlay" onclick="if(event.target===this) this.remove()">
+    <div class="modal">
+        <h3><i class="la la-share" style="color: #1a73e8; margin-right: 8px;"></i>Add Alias to %s</h3>
+        <form hx-post="%s/aliases" hx-target="#alias-list" hx-swap="innerHTML">
+            <div class="form-group">
+                <label for="local">Alias (before @, leave empty for catch-all)</label>
+                <input type="text" id="local" name="local" placeholder="info"
+                       pattern="[a-zA-Z0-9._-]+">
+            </div>
+            <div class="form-group">
+                <label for="targets">Forward To (one address per line)</label>
+                <textarea id="targets" name="targets" rows="4" placeholder="user@example.com" required></textarea>
+            </div>
+            <div class="modal-footer">
+                <button type="button" class="btn btn-secondary" onclick="this.closest('.modal-overlay').remove()">Cancel</button>
+                <button type="submit" class="btn btn-primary">Add Alias</button>
+            </div>
+        </form>
+    </div>
+</div>`,
+		html.EscapeString(domain),
+		domainPath(r, domain))))
+}
+
+// CreateAlias adds a new alias or catch-all
+func CreateAlias(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	local := strings.ToLower(strings.TrimSpace(r.FormValue("local")))
+	targets := splitAliasTargets(r.FormValue("targets"))
+
+	if domain == "" || len(targets) == 0 {
+		http.Error(w, "Domain and at least one target required", http.StatusBadRequest)
+		return
+	}
+
+	if mailFor(r) == nil {
+		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	source := services.AliasSource(domain, local)
+	if err := mailFor(r).AddAlias(domain, local, targets); err != nil {
+		log.Printf("Error adding alias %s: %v", source, err)
+		LogAuditError(r, "add_alias", source, err)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+
+	log.Printf("Alias added: %s", source)
+	LogAudit(r, "add_alias", source, "success", strings.Join(targets, ","))
+
+	// Return updated list
+	ListAliasesPartial(w, r)
+}
+
+// EditAliasForm returns the edit alias form
+func EditAliasForm(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	source := chi.URLParam(r, "alias")
+	w.Header().Set("Content-Type", "text/html")
+
+	if mailFor(r) == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Mail service not initialized</div>`))
+		return
+	}
+
+	aliases, err := mailFor(r).ListAliases(domain)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+
+	var targets []string
+	for _, a := range aliases {
+		if a.Source == source {
+			targets = a.Targets
+			break
+		}
+	}
+
+	w.Write([]byte(fmt.Sprintf(`
+<div class="modal-overlay" onclick="if(event.target===this) this.remove()">
+    <div class="modal">
+        <h3><i class="la la-edit" style="color: #1a73e8; margin-right: 8px;"></i>Edit Alias</h3>
+        <p style="color: #666; margin-bottom: 20px;">%s</p>
+        <form hx-put="%s/aliases/%s" hx-target="#alias-list" hx-swap="innerHTML">
+            <div class="form-group">
+                <label for="targets">Forward To (one address per line)</label>
+                <textarea id="targets" name="targets" rows="4" required>%s</textarea>
+            </div>
+            <div class="modal-footer">
+                <button type="button" class="btn btn-secondary" onclick="this.closest('.modal-overlay').remove()">Cancel</button>
+                <button type="submit" class="btn btn-primary">Save Alias</button>
+            </div>
+        </form>
+    </div>
+</div>`,
+		html.EscapeString(source),
+		domainPath(r, domain),
+		html.EscapeString(url.PathEscape(source)),
+		html.EscapeString(strings.Join(targets, "\n")))))
+}
+
+// UpdateAlias replaces the targets of an alias
+func UpdateAlias(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	source := chi.URLParam(r, "alias")
+	targets := splitAliasTargets(r.FormValue("targets"))
+
+	if domain == "" || source == "" || len(targets) == 0 {
+		http.Error(w, "All fields required", http.StatusBadRequest)
+		return
+	}
+
+	if mailFor(r) == nil {
+		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	if err := mailFor(r).UpdateAlias(domain, source, targets); err != nil {
+		log.Printf("Error updating alias %s: %v", source, err)
+		LogAuditError(r, "update_alias", source, err)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+
+	log.Printf("Alias updated: %s", source)
+	LogAudit(r, "update_alias", source, "success", strings.Join(targets, ","))
+
+	// Return updated list
+	ListAliasesPartial(w, r)
+}
+
+// DeleteAlias removes an alias
+func DeleteAlias(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	source := chi.URLParam(r, "alias")
+
+	if domain == "" || source == "" {
+		http.Error(w, "Domain and alias required", http.StatusBadRequest)
+		return
+	}
+
+	if mailFor(r) == nil {
+		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	if err := mailFor(r).DeleteAlias(domain, source); err != nil {
+		log.Printf("Error deleting alias %s: %v", source, err)
+		LogAuditError(r, "delete_alias", source, err)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+
+	log.Printf("Alias deleted: %s", source)
+	LogAudit(r, "delete_alias", source, "success", "")
+
+	// Return updated list
+	ListAliasesPartial(w, r)
+}
+
+// splitAliasTargets splits a textarea value on newlines, commas and spaces
+func splitAliasTargets(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == '\n' || r == '\r' || r == ',' || r == ' ' || r == '\t'
+	})
+}
@@ -0,0 +1,605 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/middleware"
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/go-chi/chi/v5"
+)
+
+// APIError is the body of every failed /api/v1 request
+type APIError struct {
+	Error APIErrorBody `json:"error"`
+}
+
+// APIErrorBody describes an API error. Code is a stable machine-readable
+// value: invalid_request, not_found, conflict, unauthorized, forbidden,
+// rollback or internal.
+type APIErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// CreateDomainRequest is the body of POST /domains
+type CreateDomainRequest struct {
+	Domain string `json:"domain"`
+}
+
+// DeleteDomainRequest is the body of DELETE /domains/{domain}. Confirm must
+// repeat the domain name.
+type DeleteDomainRequest struct {
+	Mode    string `json:"mode"`
+	Confirm string `json:"confirm"`
+}
+
+// CreateMailboxRequest is the body of POST /domains/{domain}/mailboxes
+type CreateMailboxRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// ChangePasswordRequest is the body of PUT .../mailboxes/{user}/password
+type ChangePasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// CreateAliasRequest is the body of POST /domains/{domain}/aliases. An
+// empty local part creates the catch-all.
+type CreateAliasRequest struct {
+	Local   string   `json:"local,omitempty"`
+	Targets []string `json:"targets"`
+}
+
+// UpdateAliasRequest is the body of PUT /domains/{domain}/aliases/{alias}
+type UpdateAliasRequest struct {
+	Targets []string `json:"targets"`
+}
+
+// apiParam documents a query parameter
+type apiParam struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+// apiRoute is one /api/v1 endpoint. The table drives both routing and the
+// OpenAPI document, so the two cannot drift apart.
+type apiRoute struct {
+	Method   string
+	Pattern  string
+	Tag      string
+	Summary  string
+	Query    []apiParam
+	Request  interface{} // request body type, nil if none
+	Response interface{} // response body type, nil if none
+	Status   int
+	Perm     services.Permission // checked for the {domain} of the path, if any
+	Server   bool                // works on a mail server; also served under /servers/{server}
+	Handler  http.HandlerFunc
+}
+
+// auditFilterParams are the filters of the audit endpoints (see auditFilter)
+var auditFilterParams = []apiParam{
+	{Name: "user", Description: "actor email", Type: "string"},
+	{Name: "action", Description: "action, e.g. create_mailbox", Type: "string"},
+	{Name: "target", Description: "target of the action", Type: "string"},
+	{Name: "status", Description: "success or failed", Type: "string"},
+	{Name: "server", Description: "mail server name", Type: "string"},
+	{Name: "q", Description: "case-insensitive text in the details", Type: "string"},
+	{Name: "from", Description: "first day (YYYY-MM-DD, UTC) or RFC 3339 time", Type: "string"},
+	{Name: "to", Description: "last day (YYYY-MM-DD, UTC, inclusive) or RFC 3339 time (exclusive)", Type: "string"},
+}
+
+// apiRoutes lists every /api/v1 endpoint
+var apiRoutes = []apiRoute{
+	{Method: "GET", Pattern: "/servers", Tag: "servers", Summary: "List the managed mail servers, the default first",
+		Response: []services.Server{}, Status: http.StatusOK, Perm: services.PermViewServer, Handler: apiListServers},
+
+	{Method: "GET", Pattern: "/domains", Tag: "domains", Summary: "List domains",
+		Response: []services.Domain{}, Status: http.StatusOK, Perm: services.PermView, Server: true, Handler: apiListDomains},
+	{Method: "POST", Pattern: "/domains", Tag: "domains", Summary: "Add a domain",
+		Request: CreateDomainRequest{}, Response: services.Domain{}, Status: http.StatusCreated, Perm: services.PermManageDomains, Server: true, Handler: apiCreateDomain},
+	{Method: "GET", Pattern: "/domains/{domain}/deletion-plan", Tag: "domains", Summary: "Dry-run a domain deletion",
+		Query:    []apiParam{{Name: "mode", Description: "cascade or archive", Type: "string"}},
+		Response: services.DomainDeletionPlan{}, Status: http.StatusOK, Perm: services.PermManageDomains, Server: true, Handler: apiPlanDomainDeletion},
+	{Method: "GET", Pattern: "/domains/{domain}/dns", Tag: "domains", Summary: "Check the MX, SPF, DKIM, DMARC, MTA-STS and reverse DNS records of a domain",
+		Response: services.DNSReport{}, Status: http.StatusOK, Perm: services.PermView, Server: true, Handler: apiCheckDomainDNS},
+	{Method: "DELETE", Pattern: "/domains/{domain}", Tag: "domains", Summary: "Delete a domain with its mailboxes and aliases",
+		Request: DeleteDomainRequest{}, Response: services.DomainDeletionPlan{}, Status: http.StatusOK, Perm: services.PermManageDomains, Server: true, Handler: apiDeleteDomain},
+
+	{Method: "GET", Pattern: "/domains/{domain}/mailboxes", Tag: "mailboxes", Summary: "List mailboxes with quota usage",
+		Response: []services.Mailbox{}, Status: http.StatusOK, Perm: services.PermView, Server: true, Handler: apiListMailboxes},
+	{Method: "POST", Pattern: "/domains/{domain}/mailboxes", Tag: "mailboxes", Summary: "Create a mailbox",
+		Request: CreateMailboxRequest{}, Response: services.Mailbox{}, Status: http.StatusCreated, Perm: services.PermManageMailboxes, Server: true, Handler: apiCreateMailbox},
+	{Method: "PUT", Pattern: "/domains/{domain}/mailboxes/{user}/password", Tag: "mailboxes", Summary: "Change a mailbox password",
+		Request: ChangePasswordRequest{}, Status: http.StatusNoContent, Perm: services.PermResetPassword, Server: true, Handler: apiChangePassword},
+	{Method: "DELETE", Pattern: "/domains/{domain}/mailboxes/{user}", Tag: "mailboxes", Summary: "Delete a mailbox (the maildir is kept)",
+		Status: http.StatusNoContent, Perm: services.PermManageMailboxes, Server: true, Handler: apiDeleteMailbox},
+
+	{Method: "GET", Pattern: "/domains/{domain}/aliases", Tag: "aliases", Summary: "List aliases and the catch-all",
+		Response: []services.Alias{}, Status: http.StatusOK, Perm: services.PermView, Server: true, Handler: apiListAliases},
+	{Method: "POST", Pattern: "/domains/{domain}/aliases", Tag: "aliases", Summary: "Create an alias or catch-all",
+		Request: CreateAliasRequest{}, Response: services.Alias{}, Status: http.StatusCreated, Perm: services.PermManageMailboxes, Server: true, Handler: apiCreateAlias},
+	{Method: "PUT", Pattern: "/domains/{domain}/aliases/{alias}", Tag: "aliases", Summary: "Replace the targets of an alias",
+		Request: UpdateAliasRequest{}, Response: services.Alias{}, Status: http.StatusOK, Perm: services.PermManageMailboxes, Server: true, Handler: apiUpdateAlias},
+	{Method: "DELETE", Pattern: "/domains/{domain}/aliases/{alias}", Tag: "aliases", Summary: "Delete an alias",
+		Status: http.StatusNoContent, Perm: services.PermManageMailboxes, Server: true, Handler: apiDeleteAlias},
+
+	{Method: "GET", Pattern: "/audit", Tag: "audit", Summary: "List audit entries, most recent first",
+		Query: append(auditFilterParams,
+			apiParam{Name: "cursor", Description: "X-Next-Cursor header of the previous page", Type: "integer"},
+			apiParam{Name: "limit", Description: "maximum number of entries (default 50, at most 1000)", Type: "integer"}),
+		Response: []services.AuditEntry{}, Status: http.StatusOK, Perm: services.PermViewAudit, Handler: apiListAudit},
+	{Method: "GET", Pattern: "/audit/export", Tag: "audit", Summary: "Download matching audit entries as CSV or JSON Lines",
+		Query:  append([]apiParam{{Name: "format", Description: "csv or jsonl", Type: "string"}}, auditFilterParams...),
+		Status: http.StatusOK, Perm: services.PermViewAudit, Handler: apiExportAudit},
+	{Method: "GET", Pattern: "/audit/verify", Tag: "audit", Summary: "Walk the audit hash chain and report the first broken link",
+		Response: services.AuditChainReport{}, Status: http.StatusOK, Perm: services.PermViewAudit, Handler: apiVerifyAudit},
+	{Method: "GET", Pattern: "/audit/checkpoint", Tag: "audit", Summary: "Sign a checkpoint of the audit chain head",
+		Response: services.AuditCheckpoint{}, Status: http.StatusOK, Perm: services.PermViewAudit, Handler: apiAuditCheckpoint},
+}
+
+// APIRouter returns the /api/v1 router
+func APIRouter() http.Handler {
+	r := chi.NewRouter()
+	for _, route := range apiRoutes {
+		if !route.Server {
+			r.With(middleware.Require(route.Perm)).Method(route.Method, route.Pattern, route.Handler)
+			continue
+		}
+		// Without a prefix the default server (or the remembered one) is used
+		for _, v := range routeVariants(route) {
+			r.With(middleware.Require(route.Perm), apiSelectServer, RecordChanges).Method(v.Method, v.Pattern, v.Handler)
+		}
+	}
+	r.Get("/openapi.json", OpenAPISpec)
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no such endpoint")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+	})
+	return r
+}
+
+// writeJSON writes v as JSON with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// writeAPIError writes an APIError
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, APIError{Error: APIErrorBody{Code: code, Message: message}})
+}
+
+// writeServiceError maps a service error to a status code and APIError
+func writeServiceError(w http.ResponseWriter, err error) {
+	var rb *services.RollbackError
+	switch {
+	case errors.Is(err, services.ErrInvalid):
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+	case errors.Is(err, services.ErrNotFound):
+		writeAPIError(w, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, services.ErrExists):
+		writeAPIError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.As(err, &rb):
+		writeAPIError(w, http.StatusInternalServerError, "rollback", err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+	}
+}
+
+// decodeJSON reads a JSON request body into v, rejecting unknown fields
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// apiSelectServer is SelectServer with an APIError for unknown servers
+func apiSelectServer(next http.Handler) http.Handler {
+	return selectServer(next, func(w http.ResponseWriter, err error) {
+		writeServiceError(w, err)
+	})
+}
+
+// apiMail returns the mail service, writing an error if it is missing
+func apiMail(w http.ResponseWriter, r *http.Request) *services.MailService {
+	mail := mailFor(r)
+	if mail == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "internal", "mail service not initialized")
+	}
+	return mail
+}
+
+func apiListServers(w http.ResponseWriter, r *http.Request) {
+	if h == nil || h.Servers == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "internal", "server inventory not initialized")
+		return
+	}
+	servers, err := h.Servers.Servers()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, servers)
+}
+
+func apiListDomains(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	domains, err := mail.ListDomains()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, visibleDomains(r, domains))
+}
+
+func apiCreateDomain(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	var req CreateDomainRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	domain := strings.ToLower(strings.TrimSpace(req.Domain))
+
+	if err := mail.AddDomain(domain); err != nil {
+		log.Printf("API: error adding domain %s: %v", domain, err)
+		LogAuditError(r, "add_domain", domain, err)
+		writeServiceError(w, err)
+		return
+	}
+	LogAudit(r, "add_domain", domain, "success", "")
+	writeJSON(w, http.StatusCreated, services.Domain{Name: domain})
+}
+
+func apiPlanDomainDeletion(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = services.DeleteModeArchive
+	}
+	plan, err := mail.PlanDomainDeletion(chi.URLParam(r, "domain"), mode)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func apiDeleteDomain(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	domain := chi.URLParam(r, "domain")
+	var req DeleteDomainRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	plan, err := mail.DeleteDomain(domain, services.DeleteDomainOptions{Mode: req.Mode, Confirm: req.Confirm})
+	if err != nil {
+		log.Printf("API: error deleting domain %s: %v", domain, err)
+		LogAuditError(r, "delete_domain", domain, err)
+		writeServiceError(w, err)
+		return
+	}
+	details := fmt.Sprintf("mode=%s mailboxes=%d aliases=%d", plan.Mode, len(plan.Mailboxes), len(plan.Aliases))
+	if plan.Archive != "" {
+		details += " archive=" + plan.Archive
+	}
+	LogAudit(r, "delete_domain", domain, "success", details)
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func apiCheckDomainDNS(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	if h.DNS == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "internal", "DNS checker not initialized")
+		return
+	}
+	report, err := h.DNS.CheckDomain(r.Context(), mail, chi.URLParam(r, "domain"))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func apiListMailboxes(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	domain := chi.URLParam(r, "domain")
+	mailboxes, err := mail.ListMailboxesWithUsage(domain)
+	if err != nil && mailboxes == nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err != nil {
+		log.Printf("API: error getting quota usage for %s: %v", domain, err)
+	}
+	if mailboxes == nil {
+		mailboxes = []services.Mailbox{}
+	}
+	writeJSON(w, http.StatusOK, mailboxes)
+}
+
+func apiCreateMailbox(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	domain := chi.URLParam(r, "domain")
+	var req CreateMailboxRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	username := strings.ToLower(strings.TrimSpace(req.Username))
+	email := username + "@" + domain
+
+	if err := mail.AddMailbox(domain, username, req.Password); err != nil {
+		log.Printf("API: error adding user %s: %v", email, err)
+		LogAuditError(r, "add_user", email, err)
+		writeServiceError(w, err)
+		return
+	}
+	LogAudit(r, "add_user", email, "success", "")
+
+	mailboxes, err := mail.ListMailboxes(domain)
+	if err == nil {
+		for _, mb := range mailboxes {
+			if mb.Email == email {
+				writeJSON(w, http.StatusCreated, mb)
+				return
+			}
+		}
+	}
+	writeJSON(w, http.StatusCreated, services.Mailbox{Email: email, Username: username, Domain: domain})
+}
+
+func apiChangePassword(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	domain := chi.URLParam(r, "domain")
+	username := chi.URLParam(r, "user")
+	var req ChangePasswordRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	email := username + "@" + domain
+
+	if err := mail.ChangePassword(domain, username, req.Password); err != nil {
+		log.Printf("API: error changing password for %s: %v", email, err)
+		LogAuditError(r, "change_password", email, err)
+		writeServiceError(w, err)
+		return
+	}
+	LogAudit(r, "change_password", email, "success", "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiDeleteMailbox(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	domain := chi.URLParam(r, "domain")
+	username := chi.URLParam(r, "user")
+	email := username + "@" + domain
+
+	mailboxes, err := mail.ListMailboxes(domain)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	found := false
+	for _, mb := range mailboxes {
+		found = found || mb.Email == email
+	}
+	if !found {
+		writeAPIError(w, http.StatusNotFound, "not_found", "user not found: "+email)
+		return
+	}
+
+	if err := mail.DeleteMailbox(domain, username); err != nil {
+		log.Printf("API: error deleting user %s: %v", email, err)
+		LogAuditError(r, "delete_user", email, err)
+		writeServiceError(w, err)
+		return
+	}
+	LogAudit(r, "delete_user", email, "success", "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiListAliases(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	aliases, err := mail.ListAliases(chi.URLParam(r, "domain"))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if aliases == nil {
+		aliases = []services.Alias{}
+	}
+	writeJSON(w, http.StatusOK, aliases)
+}
+
+// apiAlias returns the alias with the given source, if it exists
+func apiAlias(mail *services.MailService, domain, source string) (services.Alias, bool) {
+	aliases, err := mail.ListAliases(domain)
+	if err != nil {
+		return services.Alias{}, false
+	}
+	for _, a := range aliases {
+		if a.Source == source {
+			return a, true
+		}
+	}
+	return services.Alias{}, false
+}
+
+func apiCreateAlias(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	domain := chi.URLParam(r, "domain")
+	var req CreateAliasRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	local := strings.ToLower(strings.TrimSpace(req.Local))
+	source := services.AliasSource(domain, local)
+
+	if err := mail.AddAlias(domain, local, req.Targets); err != nil {
+		log.Printf("API: error adding alias %s: %v", source, err)
+		LogAuditError(r, "add_alias", source, err)
+		writeServiceError(w, err)
+		return
+	}
+	alias, _ := apiAlias(mail, domain, source)
+	LogAudit(r, "add_alias", source, "success", strings.Join(alias.Targets, ", "))
+	writeJSON(w, http.StatusCreated, alias)
+}
+
+func apiUpdateAlias(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	domain := chi.URLParam(r, "domain")
+	source := chi.URLParam(r, "alias")
+	var req UpdateAliasRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := mail.UpdateAlias(domain, source, req.Targets); err != nil {
+		log.Printf("API: error updating alias %s: %v", source, err)
+		LogAuditError(r, "update_alias", source, err)
+		writeServiceError(w, err)
+		return
+	}
+	alias, _ := apiAlias(mail, domain, source)
+	LogAudit(r, "update_alias", source, "success", strings.Join(alias.Targets, ", "))
+	writeJSON(w, http.StatusOK, alias)
+}
+
+func apiDeleteAlias(w http.ResponseWriter, r *http.Request) {
+	mail := apiMail(w, r)
+	if mail == nil {
+		return
+	}
+	domain := chi.URLParam(r, "domain")
+	source := chi.URLParam(r, "alias")
+
+	if err := mail.DeleteAlias(domain, source); err != nil {
+		log.Printf("API: error deleting alias %s: %v", source, err)
+		LogAuditError(r, "delete_alias", source, err)
+		writeServiceError(w, err)
+		return
+	}
+	LogAudit(r, "delete_alias", source, "success", "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiListAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "audit service unavailable")
+		return
+	}
+	page, err := auditSvc.Query(filter)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if page.NextCursor > 0 {
+		w.Header().Set("X-Next-Cursor", strconv.FormatInt(page.NextCursor, 10))
+	}
+	entries := page.Entries
+	if entries == nil {
+		entries = []services.AuditEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func apiExportAudit(w http.ResponseWriter, r *http.Request) {
+	if status, err := exportAudit(w, r); err != nil {
+		code := "invalid_request"
+		if status == http.StatusInternalServerError {
+			code = "internal"
+		}
+		writeAPIError(w, status, code, err.Error())
+	}
+}
+
+func apiVerifyAudit(w http.ResponseWriter, r *http.Request) {
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "audit service unavailable")
+		return
+	}
+	report, err := auditSvc.VerifyChain(nil)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func apiAuditCheckpoint(w http.ResponseWriter, r *http.Request) {
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", "audit service unavailable")
+		return
+	}
+	cp, err := auditSvc.Checkpoint()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cp)
+}
@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Ingasti/mailhub-admin/internal/config"
+	"github.com/Ingasti/mailhub-admin/internal/middleware"
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/go-chi/chi/v5"
+)
+
+// TestMain points the audit singleton at a directory that outlives the
+// individual tests
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "mailhub-handlers")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("DATA_DIR", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestAPI returns /api/v1 behind the auth and role middleware, with
+// ci@example.com as superadmin
+func newTestAPI(t *testing.T) (http.Handler, *services.FakeExecutor) {
+	t.Helper()
+
+	fake := services.NewFakeExecutor()
+	fake.SetFile("/etc/postfix/virtual_domains", "")
+	fake.SetFile("/etc/postfix/virtual_mailbox", "")
+	fake.SetFile("/etc/postfix/virtual_alias", "")
+	fake.SetFile("/etc/dovecot/users", "")
+	store, err := services.OpenStore(t.TempDir() + "/mailhub.db")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	tokens, err := services.NewTokenService(store)
+	if err != nil {
+		t.Fatalf("token service: %v", err)
+	}
+	roles, err := services.NewRoleService(store, []string{"ci@example.com"})
+	if err != nil {
+		t.Fatalf("role service: %v", err)
+	}
+	notify, err := services.NewNotificationService(store)
+	if err != nil {
+		t.Fatalf("notification service: %v", err)
+	}
+	servers, err := services.NewServerInventory(store, services.ServerSpec{}, nil)
+	if err != nil {
+		t.Fatalf("server inventory: %v", err)
+	}
+	if _, err := servers.RegisterExecutor("cmh", fake); err != nil {
+		t.Fatalf("register server: %v", err)
+	}
+	Init(servers, tokens, roles, notify, services.NewDNSChecker(nil))
+
+	r := chi.NewRouter()
+	proxies, _ := middleware.ParseTrustedProxies([]string{"192.0.2.0/24"}) // httptest's RemoteAddr
+	r.Use(middleware.Auth(&config.Config{}, middleware.AuthOptions{Tokens: tokens, Proxies: proxies}))
+	r.Use(middleware.Roles(roles))
+	r.Mount("/api/v1", APIRouter())
+	return r, fake
+}
+
+func apiCall(t *testing.T, api http.Handler, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	return apiCallAs(t, api, "ci@example.com", method, path, body)
+}
+
+// apiCallAs calls /api/v1 + path as an SSO user
+func apiCallAs(t *testing.T, api http.Handler, user, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, "/api/v1"+path, &buf)
+	req.Header.Set("X-Auth-User", user)
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIMailboxLifecycle(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	steps := []struct {
+		method, path string
+		body         interface{}
+		status       int
+	}{
+		{"POST", "/domains", CreateDomainRequest{Domain: "Example.com"}, http.StatusCreated},
+		{"POST", "/domains", CreateDomainRequest{Domain: "example.com"}, http.StatusConflict},
+		{"POST", "/domains", CreateDomainRequest{Domain: "nope"}, http.StatusBadRequest},
+		{"POST", "/domains/example.com/mailboxes", CreateMailboxRequest{Username: "alice", Password: "correct-horse"}, http.StatusCreated},
+		{"POST", "/domains/example.com/mailboxes", CreateMailboxRequest{Username: "bob", Password: "short"}, http.StatusBadRequest},
+		{"PUT", "/domains/example.com/mailboxes/alice/password", ChangePasswordRequest{Password: "battery-staple"}, http.StatusNoContent},
+		{"PUT", "/domains/example.com/mailboxes/nobody/password", ChangePasswordRequest{Password: "battery-staple"}, http.StatusNotFound},
+		{"POST", "/domains/example.com/aliases", CreateAliasRequest{Local: "info", Targets: []string{"alice@example.com"}}, http.StatusCreated},
+		{"PUT", "/domains/example.com/aliases/info@example.com", UpdateAliasRequest{Targets: []string{"x@example.org"}}, http.StatusOK},
+		{"DELETE", "/domains/example.com/aliases/missing@example.com", nil, http.StatusNotFound},
+		{"DELETE", "/domains/example.com/mailboxes/nobody", nil, http.StatusNotFound},
+		{"DELETE", "/domains/example.com", DeleteDomainRequest{Mode: "cascade", Confirm: "wrong"}, http.StatusBadRequest},
+		{"GET", "/nope", nil, http.StatusNotFound},
+	}
+	for _, s := range steps {
+		rec := apiCall(t, api, s.method, s.path, s.body)
+		if rec.Code != s.status {
+			t.Fatalf("%s %s: status %d, want %d: %s", s.method, s.path, rec.Code, s.status, rec.Body.String())
+		}
+		if rec.Code >= 400 {
+			var apiErr APIError
+			if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil || apiErr.Error.Code == "" {
+				t.Fatalf("%s %s: malformed error body %q", s.method, s.path, rec.Body.String())
+			}
+		}
+	}
+
+	rec := apiCall(t, api, "GET", "/domains/example.com/mailboxes", nil)
+	var mailboxes []services.Mailbox
+	if err := json.Unmarshal(rec.Body.Bytes(), &mailboxes); err != nil || len(mailboxes) != 1 || mailboxes[0].Email != "alice@example.com" {
+		t.Fatalf("unexpected mailboxes: %s", rec.Body.String())
+	}
+
+	rec = apiCall(t, api, "DELETE", "/domains/example.com", DeleteDomainRequest{Mode: "cascade", Confirm: "example.com"})
+	var plan services.DomainDeletionPlan
+	if err := json.Unmarshal(rec.Body.Bytes(), &plan); err != nil || len(plan.Mailboxes) != 1 || len(plan.Aliases) != 1 {
+		t.Fatalf("unexpected deletion result %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = apiCall(t, api, "GET", "/audit?limit=100", nil)
+	var entries []services.AuditEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil || len(entries) == 0 {
+		t.Fatalf("unexpected audit entries: %s", rec.Body.String())
+	}
+	if entries[0].User != "ci@example.com" {
+		t.Errorf("audit entry attributed to %q", entries[0].User)
+	}
+}
+
+func TestAPITokenAuth(t *testing.T) {
+	r, _ := newTestAPI(t)
+	for email, role := range map[string]string{"reader@example.com": services.RoleReadOnly, "writer@example.com": services.RoleSuperadmin} {
+		if _, err := h.Roles.Assign(email, role, nil, "ci@example.com"); err != nil {
+			t.Fatalf("assign role: %v", err)
+		}
+	}
+
+	readToken, _, err := h.Tokens.Create("reader@example.com", "ci read", []string{services.ScopeRead}, services.MinTokenLifetime)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	writeToken, _, err := h.Tokens.Create("writer@example.com", "ci write", []string{services.ScopeWrite}, services.MinTokenLifetime)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+
+	call := func(method, path, token string, body interface{}) int {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Auth-User", "spoofed@example.com")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := call("GET", "/api/v1/domains", readToken, nil); code != http.StatusOK {
+		t.Errorf("read token GET: status %d", code)
+	}
+	if code := call("POST", "/api/v1/domains", readToken, CreateDomainRequest{Domain: "example.com"}); code != http.StatusForbidden {
+		t.Errorf("read token POST: status %d, want 403", code)
+	}
+	if code := call("POST", "/api/v1/domains", writeToken, CreateDomainRequest{Domain: "example.com"}); code != http.StatusCreated {
+		t.Errorf("write token POST: status %d", code)
+	}
+	if code := call("GET", "/api/v1/domains", "mha_00000000_bogus", nil); code != http.StatusUnauthorized {
+		t.Errorf("unknown token: status %d, want 401", code)
+	}
+	if code := call("GET", "/settings/tokens", writeToken, nil); code != http.StatusUnauthorized {
+		t.Errorf("token outside /api: status %d, want 401", code)
+	}
+
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	entries, err := auditSvc.GetEntries(100)
+	if err != nil {
+		t.Fatalf("audit entries: %v", err)
+	}
+	attributed := false
+	for _, e := range entries {
+		if e.User == "spoofed@example.com" {
+			t.Errorf("audit entry %s attributed to client-supplied X-Auth-User", e.Action)
+		}
+		if e.User == "writer@example.com" && e.Action == "add_domain" {
+			attributed = true
+		}
+	}
+	if !attributed {
+		t.Error("add_domain not attributed to the token owner")
+	}
+}
+
+func TestAPIRoles(t *testing.T) {
+	api, _ := newTestAPI(t)
+	for _, domain := range []string{"example.com", "example.org"} {
+		if rec := apiCall(t, api, "POST", "/domains", CreateDomainRequest{Domain: domain}); rec.Code != http.StatusCreated {
+			t.Fatalf("create %s: %d %s", domain, rec.Code, rec.Body.String())
+		}
+		if rec := apiCall(t, api, "POST", "/domains/"+domain+"/mailboxes", CreateMailboxRequest{Username: "alice", Password: "correct-horse"}); rec.Code != http.StatusCreated {
+			t.Fatalf("create mailbox: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	if _, err := h.Roles.Assign("admin@example.com", services.RoleDomainAdmin, []string{"example.com"}, "ci@example.com"); err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+	if _, err := h.Roles.Assign("help@example.com", services.RoleHelpdesk, nil, "ci@example.com"); err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+
+	steps := []struct {
+		user, method, path string
+		body               interface{}
+		status             int
+	}{
+		{"nobody@example.com", "GET", "/domains", nil, http.StatusForbidden},
+		{"admin@example.com", "POST", "/domains", CreateDomainRequest{Domain: "example.net"}, http.StatusForbidden},
+		{"admin@example.com", "POST", "/domains/example.com/mailboxes", CreateMailboxRequest{Username: "bob", Password: "correct-horse"}, http.StatusCreated},
+		{"admin@example.com", "POST", "/domains/example.org/mailboxes", CreateMailboxRequest{Username: "bob", Password: "correct-horse"}, http.StatusForbidden},
+		{"admin@example.com", "GET", "/domains/example.org/mailboxes", nil, http.StatusForbidden},
+		{"admin@example.com", "DELETE", "/domains/example.com", DeleteDomainRequest{Mode: "cascade", Confirm: "example.com"}, http.StatusForbidden},
+		{"admin@example.com", "GET", "/audit", nil, http.StatusForbidden},
+		{"help@example.com", "PUT", "/domains/example.org/mailboxes/alice/password", ChangePasswordRequest{Password: "battery-staple"}, http.StatusNoContent},
+		{"help@example.com", "DELETE", "/domains/example.org/mailboxes/alice", nil, http.StatusForbidden},
+	}
+	for _, s := range steps {
+		rec := apiCallAs(t, api, s.user, s.method, s.path, s.body)
+		if rec.Code != s.status {
+			t.Errorf("%s %s %s: status %d, want %d: %s", s.user, s.method, s.path, rec.Code, s.status, rec.Body.String())
+		}
+	}
+
+	rec := apiCallAs(t, api, "admin@example.com", "GET", "/domains", nil)
+	var domains []services.Domain
+	if err := json.Unmarshal(rec.Body.Bytes(), &domains); err != nil || len(domains) != 1 || domains[0].Name != "example.com" {
+		t.Errorf("domain admin sees %s", rec.Body.String())
+	}
+}
+
+func TestAPIServerRoutes(t *testing.T) {
+	api, cmh := newTestAPI(t)
+	edge := services.NewFakeExecutor()
+	edge.SetFile("/etc/postfix/virtual_domains", "")
+	if _, err := h.Servers.RegisterExecutor("edge", edge); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	if rec := apiCall(t, api, "POST", "/servers/edge/domains", CreateDomainRequest{Domain: "edge.example"}); rec.Code != http.StatusCreated {
+		t.Fatalf("create on edge: %d %s", rec.Code, rec.Body.String())
+	}
+	onEdge, _ := edge.File("/etc/postfix/virtual_domains")
+	onCMH, _ := cmh.File("/etc/postfix/virtual_domains")
+	if !strings.Contains(onEdge, "edge.example") || strings.Contains(onCMH, "edge.example") {
+		t.Errorf("domain written to the wrong server: edge %q, cmh %q", onEdge, onCMH)
+	}
+
+	// Unprefixed routes use the default server
+	var domains []services.Domain
+	rec := apiCall(t, api, "GET", "/domains", nil)
+	json.NewDecoder(rec.Body).Decode(&domains)
+	if rec.Code != http.StatusOK || len(domains) != 0 {
+		t.Errorf("default server domains: %d %+v", rec.Code, domains)
+	}
+
+	if rec := apiCall(t, api, "GET", "/servers/nope/domains", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown server: %d", rec.Code)
+	}
+
+	var servers []services.Server
+	rec = apiCall(t, api, "GET", "/servers", nil)
+	json.NewDecoder(rec.Body).Decode(&servers)
+	if len(servers) != 2 || servers[0].Name != "cmh" || servers[1].Name != "edge" {
+		t.Errorf("servers: %+v", servers)
+	}
+
+	auditSvc, _ := services.GetAuditService()
+	page, err := auditSvc.Query(services.AuditFilter{Action: "add_domain", Target: "edge.example"})
+	if err != nil || len(page.Entries) == 0 || page.Entries[0].Server != "edge" {
+		t.Errorf("audit entry not attributed to edge: %+v %v", page, err)
+	}
+}
+
+func TestOpenAPIDocumentUpToDate(t *testing.T) {
+	doc, err := json.MarshalIndent(OpenAPIDocument(), "", "  ")
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	shipped, err := os.ReadFile("../../docs/openapi.json")
+	if err != nil {
+		t.Fatalf("read shipped document: %v", err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(shipped), doc) {
+		t.Fatal("docs/openapi.json is out of date; regenerate with: go run ./cmd/mailhub-admin openapi > docs/openapi.json")
+	}
+
+	paths := OpenAPIDocument()["paths"].(map[string]map[string]interface{})
+	for _, route := range apiRoutes {
+		if _, ok := paths[route.Pattern][strings.ToLower(route.Method)]; !ok {
+			t.Errorf("%s %s missing from OpenAPI document", route.Method, route.Pattern)
+		}
+	}
+}
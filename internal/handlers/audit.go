@@ -1,17 +1,37 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Ingasti/mailhub-admin/internal/middleware"
 	"github.com/Ingasti/mailhub-admin/internal/services"
 	"github.com/Ingasti/mailhub-admin/internal/templates"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
 )
 
 // AuditLog renders the audit log page
 func AuditLog(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 
+	actions := `<option value="">All actions</option>`
+	if auditSvc, err := services.GetAuditService(); err == nil {
+		if list, err := auditSvc.Actions(); err == nil {
+			for _, a := range list {
+				actions += fmt.Sprintf(`<option value="%s">%s</option>`, html.EscapeString(a), html.EscapeString(a))
+			}
+		}
+	}
+
 	content := `
 <div class="card">
     <a href="/" class="nav-link"><i class="la la-arrow-left"></i> Back to Dashboard</a>
@@ -20,42 +40,134 @@ func AuditLog(w http.ResponseWriter, r *http.Request) {
         <h1>Audit Log</h1>
         <p class="subtitle">Activity History</p>
     </div>
-    
+
+    <form id="audit-filter" hx-get="/audit/entries" hx-target="#audit-list" hx-swap="innerHTML"
+          hx-trigger="submit, change, keyup delay:400ms"
+          style="display: flex; flex-wrap: wrap; gap: 10px; margin-bottom: 20px; align-items: flex-end;">
+        <div class="form-group" style="margin: 0;">
+            <label for="audit-q">Search details</label>
+            <input type="search" id="audit-q" name="q" placeholder="text">
+        </div>
+        <div class="form-group" style="margin: 0;">
+            <label for="audit-user">User</label>
+            <input type="search" id="audit-user" name="user" placeholder="admin@example.com">
+        </div>
+        <div class="form-group" style="margin: 0;">
+            <label for="audit-action">Action</label>
+            <select id="audit-action" name="action">` + actions + `</select>
+        </div>
+        <div class="form-group" style="margin: 0;">
+            <label for="audit-target">Target</label>
+            <input type="search" id="audit-target" name="target" placeholder="user@example.com">
+        </div>
+        <div class="form-group" style="margin: 0;">
+            <label for="audit-server">Server</label>
+            <input type="search" id="audit-server" name="server" placeholder="cmh">
+        </div>
+        <div class="form-group" style="margin: 0;">
+            <label for="audit-status">Status</label>
+            <select id="audit-status" name="status">
+                <option value="">Any</option>
+                <option value="success">success</option>
+                <option value="failed">failed</option>
+            </select>
+        </div>
+        <div class="form-group" style="margin: 0;">
+            <label for="audit-from">From (UTC)</label>
+            <input type="date" id="audit-from" name="from">
+        </div>
+        <div class="form-group" style="margin: 0;">
+            <label for="audit-to">To (UTC)</label>
+            <input type="date" id="audit-to" name="to">
+        </div>
+        <button type="reset" class="btn btn-secondary"
+                onclick="setTimeout(() => htmx.trigger('#audit-filter', 'submit'))">
+            <i class="la la-times"></i> Clear
+        </button>
+        <a href="/audit/export?format=csv" class="btn btn-secondary" onclick="return exportAudit(this)">
+            <i class="la la-file-csv"></i> CSV
+        </a>
+        <a href="/audit/export?format=jsonl" class="btn btn-secondary" onclick="return exportAudit(this)">
+            <i class="la la-file-code"></i> JSONL
+        </a>
+    </form>
+
     <div id="audit-list" hx-get="/audit/entries" hx-trigger="load" hx-swap="innerHTML">
         <p style="text-align: center; color: #666;">Loading audit entries...</p>
     </div>
-</div>`
+</div>
+
+<div class="card">
+    <h2>Integrity</h2>
+    <p style="color: #666; font-size: 0.9rem;">
+        Every entry is hash-chained to the one before it. Verifying walks the
+        chain; the signed checkpoint of its head, kept outside the server,
+        later proves that no earlier entry was changed or removed.
+    </p>
+    <div id="audit-integrity">
+        <button class="btn btn-secondary" hx-get="/audit/integrity" hx-target="#audit-integrity" hx-swap="innerHTML">
+            <i class="la la-shield-alt"></i> Verify chain
+        </button>
+    </div>
+</div>
+<script>
+// exportAudit downloads with the current filter
+function exportAudit(link) {
+    const params = new URLSearchParams(new FormData(document.getElementById('audit-filter')));
+    params.set('format', new URL(link.href).searchParams.get('format'));
+    window.location = '/audit/export?' + params;
+    return false;
+}
+</script>`
 
 	templates.RenderPage(w, "Audit Log", content)
 }
 
-// AuditEntriesPartial returns audit entries as HTML partial (for HTMX)
+// AuditEntriesPartial returns audit entries matching the filter form as HTML
+// partial (for HTMX). With a cursor it returns only the next rows, which
+// replace the previous page's "Load more" row.
 func AuditEntriesPartial(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 
+	filter, err := auditFilter(r.URL.Query())
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+
 	auditSvc, err := services.GetAuditService()
 	if err != nil {
 		w.Write([]byte(`<div class="alert alert-danger">Failed to load audit service</div>`))
 		return
 	}
 
-	entries, err := auditSvc.GetEntries(50)
+	page, err := auditSvc.Query(filter)
 	if err != nil {
-		w.Write([]byte(`<div class="alert alert-danger">Failed to load audit entries</div>`))
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> %s</div>`, html.EscapeString(err.Error()))))
 		return
 	}
 
-	if len(entries) == 0 {
+	if filter.Before > 0 {
+		w.Write([]byte(auditRows(r, page)))
+		return
+	}
+
+	if len(page.Entries) == 0 {
+		hint := "Activity will be logged when you manage domains and mailboxes."
+		if r.URL.RawQuery != "" {
+			hint = "No entries match the filter."
+		}
 		w.Write([]byte(`
 <div style="text-align: center; padding: 40px; color: #666;">
     <i class="la la-clipboard-list" style="font-size: 3rem; margin-bottom: 15px; display: block; opacity: 0.5;"></i>
-    <p><em>No audit entries yet</em></p>
-    <p style="font-size: 0.9rem;">Activity will be logged when you manage domains and mailboxes.</p>
+    <p><em>No audit entries found</em></p>
+    <p style="font-size: 0.9rem;">` + hint + `</p>
 </div>`))
 		return
 	}
 
-	html := `<table>
+	var sb strings.Builder
+	sb.WriteString(`<table>
     <thead>
         <tr>
             <th>Timestamp</th>
@@ -63,44 +175,333 @@ func AuditEntriesPartial(w http.ResponseWriter, r *http.Request) {
             <th>Action</th>
             <th>Target</th>
             <th>Status</th>
+            <th>Client</th>
         </tr>
     </thead>
-    <tbody>`
+    <tbody>`)
+	sb.WriteString(auditRows(r, page))
+	sb.WriteString(`
+    </tbody>
+</table>`)
+
+	w.Write([]byte(sb.String()))
+}
+
+// ExportAuditLog downloads the entries matching the filter form as CSV or
+// JSON Lines (format=csv|jsonl)
+func ExportAuditLog(w http.ResponseWriter, r *http.Request) {
+	if status, err := exportAudit(w, r); err != nil {
+		http.Error(w, err.Error(), status)
+	}
+}
+
+// exportAudit streams an export. Errors, with their status, are returned
+// only while nothing has been written yet.
+func exportAudit(w http.ResponseWriter, r *http.Request) (int, error) {
+	filter, err := auditFilter(r.URL.Query())
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	format := r.URL.Query().Get("format")
+	contentType := map[string]string{
+		services.ExportCSV:   "text/csv; charset=utf-8",
+		services.ExportJSONL: "application/x-ndjson",
+	}[format]
+	if contentType == "" {
+		return http.StatusBadRequest, fmt.Errorf("format must be %s or %s", services.ExportCSV, services.ExportJSONL)
+	}
+
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.%s"`, time.Now().UTC().Format("20060102-150405"), format))
+	count, err := auditSvc.Export(w, filter, format)
+	if err != nil {
+		// The status is already sent; the truncated file is all we can do
+		log.Printf("Audit export failed after %d entries: %v", count, err)
+		LogAuditError(r, "export_audit_log", format, err)
+		return http.StatusOK, nil
+	}
+	LogAudit(r, "export_audit_log", format, "success", fmt.Sprintf("%d entries; filter %s", count, r.URL.Query().Encode()))
+	return http.StatusOK, nil
+}
+
+// AuditIntegrityPartial verifies the hash chain and shows a signed
+// checkpoint of its head (for HTMX)
+func AuditIntegrityPartial(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		w.Write([]byte(`<div class="alert alert-danger">Failed to load audit service</div>`))
+		return
+	}
+	report, err := auditSvc.VerifyChain(nil)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+
+	if !report.OK {
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-triangle"></i> Chain broken at entry %d: %s</div>`,
+			report.BrokenID, html.EscapeString(report.Reason))))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf(`<div class="success-msg"><i class="la la-check-circle"></i> Chain intact: %d entries, head %d.</div>`,
+		report.Entries, report.HeadID))
+
+	cp, err := auditSvc.Checkpoint()
+	if err != nil {
+		sb.WriteString(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> No checkpoint: %s</div>`, html.EscapeString(err.Error())))
+	} else {
+		data, _ := json.MarshalIndent(cp, "", "  ")
+		sb.WriteString(fmt.Sprintf(`
+<p style="margin-top: 15px;">Signed checkpoint (save it, then check later with <code>mailhub-admin audit-verify -checkpoint FILE</code>):</p>
+<pre style="background: #f5f5f5; padding: 12px; border-radius: 6px; overflow-x: auto; font-size: 0.8rem;">%s</pre>`,
+			html.EscapeString(string(data))))
+	}
+
+	w.Write([]byte(sb.String()))
+}
 
-	for _, e := range entries {
+// auditRows renders the rows of a page, followed by a "Load more" row that
+// fetches the next page with the same filter
+func auditRows(r *http.Request, page *services.AuditPage) string {
+	var sb strings.Builder
+	for _, e := range page.Entries {
 		statusClass := "badge-success"
 		if e.Status == "failed" {
 			statusClass = "badge-danger"
 		}
-		html += fmt.Sprintf(`
+		action := html.EscapeString(e.Action)
+		if e.Diff != "" {
+			action += fmt.Sprintf(`
+                <button class="btn btn-secondary btn-sm" title="Show changes"
+                        onclick="const d = document.getElementById('audit-diff-%d'); d.hidden = !d.hidden;">
+                    <i class="la la-code"></i> diff
+                </button>`, e.ID)
+		}
+		target := html.EscapeString(e.Target)
+		if e.Server != "" {
+			target += ` <span class="badge badge-info" title="Mail server">` + html.EscapeString(e.Server) + `</span>`
+		}
+		sb.WriteString(fmt.Sprintf(`
         <tr>
             <td>%s</td>
             <td>%s</td>
             <td>%s</td>
             <td>%s</td>
             <td><span class="badge %s">%s</span></td>
+            <td title="%s" style="font-size: 0.85rem;">%s<br><code style="color: #666;">%s</code></td>
         </tr>`,
 			e.Timestamp.Format("2006-01-02 15:04:05"),
-			e.User,
-			e.Action,
-			e.Target,
+			html.EscapeString(e.User),
+			action,
+			target,
 			statusClass,
-			e.Status,
-		)
+			html.EscapeString(e.Status),
+			html.EscapeString(e.UserAgent),
+			html.EscapeString(e.ClientIP),
+			html.EscapeString(e.RequestID),
+		))
+		if e.Diff != "" {
+			sb.WriteString(fmt.Sprintf(`
+        <tr id="audit-diff-%d" hidden>
+            <td colspan="6"><pre style="margin: 0; padding: 12px; background: #f8f9fa; border-radius: 6px; overflow-x: auto; font-size: 0.8rem;">%s</pre></td>
+        </tr>`, e.ID, renderDiff(e.Diff)))
+		}
 	}
 
-	html += `
-    </tbody>
-</table>`
+	if page.NextCursor > 0 {
+		q := r.URL.Query()
+		q.Set("cursor", strconv.FormatInt(page.NextCursor, 10))
+		sb.WriteString(fmt.Sprintf(`
+        <tr id="audit-more">
+            <td colspan="6" style="text-align: center;">
+                <button class="btn btn-secondary btn-sm" hx-get="/audit/entries?%s" hx-target="#audit-more" hx-swap="outerHTML">
+                    <i class="la la-angle-down"></i> Load more
+                </button>
+            </td>
+        </tr>`, html.EscapeString(q.Encode())))
+	}
+	return sb.String()
+}
+
+// renderDiff escapes a unified diff and colors its lines
+func renderDiff(diff string) string {
+	var sb strings.Builder
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		color := ""
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			color = "#333; font-weight: 600"
+		case strings.HasPrefix(line, "@@"):
+			color = "#1a73e8"
+		case strings.HasPrefix(line, "+"):
+			color = "#1e7e34"
+		case strings.HasPrefix(line, "-"):
+			color = "#c82333"
+		}
+		if color == "" {
+			sb.WriteString(html.EscapeString(line))
+		} else {
+			sb.WriteString(fmt.Sprintf(`<span style="color: %s;">%s</span>`, color, html.EscapeString(line)))
+		}
+	}
+	return sb.String()
+}
+
+// auditFilter reads an audit filter from query parameters shared by the
+// audit page and the API: user, action, target, status, server, q (details search),
+// from and to (dates, inclusive, or RFC 3339 times), cursor and limit
+func auditFilter(q url.Values) (services.AuditFilter, error) {
+	f := services.AuditFilter{
+		User:   strings.TrimSpace(q.Get("user")),
+		Action: strings.TrimSpace(q.Get("action")),
+		Target: strings.TrimSpace(q.Get("target")),
+		Status: q.Get("status"),
+		Server: strings.TrimSpace(q.Get("server")),
+		Search: strings.TrimSpace(q.Get("q")),
+	}
 
-	w.Write([]byte(html))
+	var err error
+	if v := q.Get("from"); v != "" {
+		if f.Since, err = parseAuditTime(v, false); err != nil {
+			return f, err
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if f.Until, err = parseAuditTime(v, true); err != nil {
+			return f, err
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		if f.Before, err = strconv.ParseInt(v, 10, 64); err != nil || f.Before <= 0 {
+			return f, fmt.Errorf("invalid cursor %q", v)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 || f.Limit > services.MaxAuditPage {
+			return f, fmt.Errorf("limit must be between 1 and %d", services.MaxAuditPage)
+		}
+	}
+	return f, nil
+}
+
+// parseAuditTime parses a date (UTC) or RFC 3339 time. An end date covers
+// the whole day.
+func parseAuditTime(v string, end bool) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q", v)
+	}
+	return t, nil
 }
 
-// LogAudit is a helper to log audit entries from handlers
-func LogAudit(user, action, target, status, details string) {
+// LogAudit records an action of the request's authenticated user, with the
+// request ID, client IP and user agent
+func LogAudit(r *http.Request, action, target, status, details string) {
 	auditSvc, err := services.GetAuditService()
 	if err != nil {
 		return // Silently fail - audit logging shouldn't break the app
 	}
-	auditSvc.Log(user, action, target, status, details)
+	entry := auditEntry(r, action, target, status, details)
+	if err := auditSvc.Log(entry); err != nil {
+		log.Printf("Error writing audit entry %s %s: %v", action, target, err)
+	}
+	notify(entry)
+}
+
+// notify queues notifications for a successful audited action
+func notify(entry services.AuditEntry) {
+	if h == nil || h.Notify == nil || entry.Status != "success" {
+		return
+	}
+	err := h.Notify.Publish(services.NotificationEvent{
+		Event:     entry.Action,
+		Target:    entry.Target,
+		User:      entry.User,
+		Details:   entry.Details,
+		RequestID: entry.RequestID,
+		Server:    entry.Server,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("Error queueing notifications for %s %s: %v", entry.Action, entry.Target, err)
+	}
+}
+
+// LogAuditError records a failed action. When the failure triggered a
+// change set rollback, the rollback is recorded as its own entry.
+func LogAuditError(r *http.Request, action, target string, err error) {
+	LogAudit(r, action, target, "failed", err.Error())
+
+	var rb *services.RollbackError
+	if errors.As(err, &rb) {
+		status := "success"
+		details := fmt.Sprintf("step %q failed; restored %s", rb.Step, strings.Join(rb.Restored, ", "))
+		if rb.RollbackErr != nil {
+			status = "failed"
+			details += "; " + rb.RollbackErr.Error()
+		}
+		LogAudit(r, "rollback_"+action, target, status, details)
+	}
+}
+
+// maxUserAgent bounds the user agent stored per audit entry
+const maxUserAgent = 256
+
+// auditEntry builds an audit entry attributed to the context user, with
+// the diff of the files the request changed
+func auditEntry(r *http.Request, action, target, status, details string) services.AuditEntry {
+	user := middleware.GetAuthUser(r).Email
+	if user == "" {
+		user = "system"
+	}
+
+	clientIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgent {
+		userAgent = userAgent[:maxUserAgent]
+	}
+
+	var diff string
+	if rec := recorder(r); rec != nil {
+		diff = rec.Diff()
+	}
+
+	// Only requests bound to a mail server record one; token, role and
+	// other console actions leave it empty
+	var server string
+	if srv := serverFrom(r); srv != nil {
+		server = srv.Name
+	}
+
+	return services.AuditEntry{
+		User:      user,
+		Action:    action,
+		Target:    target,
+		Status:    status,
+		Details:   details,
+		RequestID: chimiddleware.GetReqID(r.Context()),
+		ClientIP:  clientIP,
+		UserAgent: userAgent,
+		Server:    server,
+		Diff:      diff,
+	}
 }
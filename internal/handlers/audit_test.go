@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Ingasti/mailhub-admin/internal/config"
+	"github.com/Ingasti/mailhub-admin/internal/middleware"
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+)
+
+func TestAuditRecordsContextUserAndRequest(t *testing.T) {
+	newTestAPI(t)
+
+	cfg := &config.Config{DevMode: true, DevAuthEmail: "dev@example.com"}
+	roles, err := services.NewRoleService(mustStore(t), []string{"dev@example.com"})
+	if err != nil {
+		t.Fatalf("role service: %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(chimiddleware.RequestID)
+	r.Use(middleware.Auth(cfg, middleware.AuthOptions{}))
+	r.Use(middleware.Roles(roles))
+	r.Use(SelectServer)
+	r.Post("/rspamd/service/restart", HandleRspamdServiceRestart)
+
+	req := httptest.NewRequest("POST", "/rspamd/service/restart", nil)
+	req.Header.Set("User-Agent", "audit-test/1.0")
+	req.Header.Set("X-Auth-User", "spoofed@example.com")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restart: %d %s", rec.Code, rec.Body.String())
+	}
+
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	entries, err := auditSvc.GetEntries(1)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("entries: %v %v", entries, err)
+	}
+	e := entries[0]
+	if e.Action != "rspamd_restart" || e.User != "dev@example.com" {
+		t.Errorf("entry %s attributed to %q, want dev@example.com", e.Action, e.User)
+	}
+	if e.RequestID == "" || e.ClientIP != "192.0.2.1" || e.UserAgent != "audit-test/1.0" || e.Server != "cmh" {
+		t.Errorf("request metadata not recorded: %+v", e)
+	}
+}
+
+func mustStore(t *testing.T) *services.Store {
+	t.Helper()
+	store, err := services.OpenStore(t.TempDir() + "/mailhub.db")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestAuditFilterAndCursor(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		auditSvc.Log(services.AuditEntry{User: "pager@example.com", Action: "create_alias", Target: "a@example.com", Status: "success"})
+	}
+	auditSvc.Log(services.AuditEntry{User: "pager@example.com", Action: "delete_alias", Target: "a@example.com", Status: "failed", Details: "alias is busy"})
+
+	rec := apiCall(t, api, "GET", "/audit?user=pager@example.com&action=create_alias&limit=2", nil)
+	var first []services.AuditEntry
+	json.NewDecoder(rec.Body).Decode(&first)
+	cursor := rec.Header().Get("X-Next-Cursor")
+	if rec.Code != http.StatusOK || len(first) != 2 || cursor == "" {
+		t.Fatalf("first page: %d %d entries, cursor %q", rec.Code, len(first), cursor)
+	}
+
+	rec = apiCall(t, api, "GET", "/audit?user=pager@example.com&action=create_alias&limit=2&cursor="+cursor, nil)
+	var second []services.AuditEntry
+	json.NewDecoder(rec.Body).Decode(&second)
+	if len(second) != 1 || second[0].ID >= first[1].ID || rec.Header().Get("X-Next-Cursor") != "" {
+		t.Errorf("second page: %+v, cursor %q", second, rec.Header().Get("X-Next-Cursor"))
+	}
+
+	rec = apiCall(t, api, "GET", "/audit?user=pager@example.com&q=BUSY", nil)
+	var found []services.AuditEntry
+	json.NewDecoder(rec.Body).Decode(&found)
+	if len(found) != 1 || found[0].Action != "delete_alias" {
+		t.Errorf("search: %+v", found)
+	}
+
+	for _, q := range []string{"status=maybe", "from=yesterday", "cursor=-1", "limit=0", "from=2026-02-01&to=2026-01-01"} {
+		if rec := apiCall(t, api, "GET", "/audit?"+q, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", q, rec.Code)
+		}
+	}
+
+	// the HTMX partial pages through "Load more" rows
+	req := httptest.NewRequest("GET", "/audit/entries?user=pager%40example.com&limit=3", nil)
+	rec = httptest.NewRecorder()
+	AuditEntriesPartial(rec, req)
+	body := rec.Body.String()
+	if !strings.Contains(body, "<table>") || strings.Count(body, "pager@example.com") != 3 || !strings.Contains(body, `id="audit-more"`) {
+		t.Fatalf("first partial:\n%s", body)
+	}
+
+	more := regexp.MustCompile(`hx-get="(/audit/entries\?[^"]+)"`).FindStringSubmatch(body)
+	if more == nil {
+		t.Fatal("no load more link")
+	}
+	req = httptest.NewRequest("GET", html.UnescapeString(more[1]), nil)
+	rec = httptest.NewRecorder()
+	AuditEntriesPartial(rec, req)
+	body = rec.Body.String()
+	if strings.Contains(body, "<table>") || strings.Count(body, "pager@example.com") != 1 || strings.Contains(body, `id="audit-more"`) {
+		t.Errorf("next partial:\n%s", body)
+	}
+}
+
+func TestAuditExportEndpoint(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	auditSvc.Log(services.AuditEntry{User: "exporter@example.com", Action: "create_alias", Target: "a@example.com", Status: "success"})
+
+	rec := apiCall(t, api, "GET", "/audit/export?format=csv&user=exporter@example.com", nil)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") ||
+		!strings.Contains(rec.Header().Get("Content-Disposition"), ".csv") {
+		t.Fatalf("csv export: %d %v", rec.Code, rec.Header())
+	}
+	if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); len(lines) != 2 || !strings.Contains(lines[1], "exporter@example.com") {
+		t.Errorf("csv body:\n%s", rec.Body.String())
+	}
+
+	if rec := apiCall(t, api, "GET", "/audit/export?format=xml", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("xml export: %d", rec.Code)
+	}
+
+	// the export itself is audited
+	entries, _ := auditSvc.GetEntries(5)
+	found := false
+	for _, e := range entries {
+		found = found || (e.Action == "export_audit_log" && e.Target == "csv" && strings.HasPrefix(e.Details, "1 entries"))
+	}
+	if !found {
+		t.Errorf("export not audited: %+v", entries)
+	}
+}
+
+func TestAuditIntegrityEndpoints(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	auditSvc.Log(services.AuditEntry{User: "chain@example.com", Action: "create_alias", Target: "a@example.com", Status: "success"})
+
+	rec := apiCall(t, api, "GET", "/audit/verify", nil)
+	var report services.AuditChainReport
+	json.NewDecoder(rec.Body).Decode(&report)
+	if rec.Code != http.StatusOK || !report.OK || report.Entries == 0 {
+		t.Fatalf("verify: %d %+v", rec.Code, report)
+	}
+
+	key, err := services.LoadAuditSigningKey(t.TempDir() + "/audit.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditSvc.SetSigningKey(key)
+	defer auditSvc.SetSigningKey(nil)
+
+	rec = apiCall(t, api, "GET", "/audit/checkpoint", nil)
+	var cp services.AuditCheckpoint
+	json.NewDecoder(rec.Body).Decode(&cp)
+	if rec.Code != http.StatusOK || cp.Verify() != nil || cp.HeadID < report.HeadID {
+		t.Fatalf("checkpoint: %d %+v", rec.Code, cp)
+	}
+
+	rec = httptest.NewRecorder()
+	AuditIntegrityPartial(rec, httptest.NewRequest("GET", "/audit/integrity", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "Chain intact") || !strings.Contains(body, "&#34;signature&#34;") {
+		t.Errorf("integrity partial:\n%s", body)
+	}
+}
+
+func TestAuditRecordsConfigDiff(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	steps := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"POST", "/domains", CreateDomainRequest{Domain: "diff.example"}},
+		{"POST", "/domains/diff.example/mailboxes", CreateMailboxRequest{Username: "alice", Password: "correct-horse"}},
+		{"PUT", "/domains/diff.example/mailboxes/alice/password", ChangePasswordRequest{Password: "battery-staple"}},
+		{"POST", "/domains/diff.example/aliases", CreateAliasRequest{Local: "info", Targets: []string{"alice@diff.example"}}},
+	}
+	for _, s := range steps {
+		if rec := apiCall(t, api, s.method, s.path, s.body); rec.Code >= 300 {
+			t.Fatalf("%s %s: %d %s", s.method, s.path, rec.Code, rec.Body.String())
+		}
+	}
+
+	auditSvc, _ := services.GetAuditService()
+	entries, err := auditSvc.GetEntries(4)
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("entries: %v", err)
+	}
+	diffs := map[string]string{}
+	for _, e := range entries {
+		diffs[e.Action] = e.Diff
+	}
+
+	if d := diffs["add_alias"]; !strings.Contains(d, "+++ b/etc/postfix/virtual_alias\n") || !strings.Contains(d, "+info@diff.example    alice@diff.example\n") {
+		t.Errorf("alias diff:\n%s", d)
+	}
+	if d := diffs["change_password"]; !strings.Contains(d, "/etc/dovecot/users") || !strings.Contains(d, "[REDACTED]") || strings.Contains(d, "$6$") {
+		t.Errorf("password diff is not redacted:\n%s", d)
+	}
+	if report, _ := auditSvc.VerifyChain(nil); !report.OK {
+		t.Errorf("chain with diffs: %+v", report)
+	}
+
+	rec := httptest.NewRecorder()
+	AuditEntriesPartial(rec, httptest.NewRequest("GET", "/audit/entries?action=add_alias&target=info@diff.example", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `id="audit-diff-`) || !strings.Contains(body, "+info@diff.example") {
+		t.Errorf("partial has no diff row:\n%s", body)
+	}
+}
+
+func TestAuditQueuesNotifications(t *testing.T) {
+	api, _ := newTestAPI(t)
+	if _, err := h.Notify.Subscribe(services.ChannelWebhook, "https://hooks.example.com/mailhub", []string{"add_domain"}, "ci@example.com"); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	apiCall(t, api, "POST", "/domains", CreateDomainRequest{Domain: "notify.example"})
+	apiCall(t, api, "POST", "/domains", CreateDomainRequest{Domain: "notify.example"}) // conflict, not notified
+	apiCall(t, api, "POST", "/domains/notify.example/mailboxes", CreateMailboxRequest{Username: "a", Password: "correct-horse-1"})
+
+	deliveries, err := h.Notify.Deliveries(10)
+	if err != nil {
+		t.Fatalf("deliveries: %v", err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1: %+v", len(deliveries), deliveries)
+	}
+	e := deliveries[0].Event
+	if e.Event != "add_domain" || e.Target != "notify.example" || e.User != "ci@example.com" {
+		t.Errorf("event %+v", e)
+	}
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Ingasti/mailhub-admin/internal/services"
+)
+
+type changesKey struct{}
+
+// RecordChanges gives each request its own FileRecorder around the
+// executor of the selected server. Handlers reach the host through mailFor
+// and executorFor, and LogAudit stores the diff of the files the request
+// changed. It runs after SelectServer.
+func RecordChanges(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv := serverFrom(r)
+		if srv == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := services.NewFileRecorder(srv.Mail().GetExecutor())
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), changesKey{}, rec)))
+	})
+}
+
+// recorder returns the request's FileRecorder, or nil
+func recorder(r *http.Request) *services.FileRecorder {
+	rec, _ := r.Context().Value(changesKey{}).(*services.FileRecorder)
+	return rec
+}
+
+// mailFor returns the mail service of the request's server, or nil if no
+// server is selected
+func mailFor(r *http.Request) *services.MailService {
+	srv := serverFrom(r)
+	if srv == nil {
+		return nil
+	}
+	if rec := recorder(r); rec != nil {
+		return srv.Mail().WithExecutor(rec)
+	}
+	return srv.Mail()
+}
+
+// executorFor returns the mail host executor of the request's server, or
+// nil if no server is selected
+func executorFor(r *http.Request) services.Executor {
+	if rec := recorder(r); rec != nil {
+		return rec
+	}
+	if srv := serverFrom(r); srv != nil {
+		return srv.Mail().GetExecutor()
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/Ingasti/mailhub-admin/internal/templates"
+	"github.com/go-chi/chi/v5"
+)
+
+// DKIMPage renders the DKIM keys of a domain with the DNS records to publish
+func DKIMPage(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	w.Header().Set("Content-Type", "text/html")
+
+	createForm := ""
+	if can(r, services.PermManageDomains, domain) {
+		createForm = fmt.Sprintf(`
+    <form hx-post="%s/dkim" hx-target="#dkim-list" hx-swap="innerHTML">
+        <div class="form-group">
+            <label for="selector">Selector (empty for mhYYYYMM)</label>
+            <input type="text" id="selector" name="selector" pattern="[a-z0-9][a-z0-9-]{0,62}">
+        </div>
+        <div class="form-group">
+            <label for="algorithm">Algorithm</label>
+            <select id="algorithm" name="algorithm">
+                <option value="rsa">RSA 2048</option>
+                <option value="ed25519">Ed25519</option>
+            </select>
+        </div>
+        <button type="submit" class="btn btn-primary"><i class="la la-key"></i> New Key</button>
+    </form>
+    <p style="color: #666; margin-top: 10px;">
+        To rotate, create a new key, publish its record and wait for DNS to pick it up, then activate it.
+        The old key is retired: keep its record for a few days so mail already sent still verifies, then remove it.
+    </p>`, domainPath(r, domain))
+	}
+
+	content := fmt.Sprintf(`
+<div class="card">
+    <a href="%s/users" class="nav-link"><i class="la la-arrow-left"></i> Back to Users</a>
+    <div class="header">
+        <h1>DKIM: %s</h1>
+        <p class="subtitle">Signing keys and the DNS records to publish for them</p>
+    </div>
+%s
+
+    <div id="dkim-list" hx-get="%s/dkim/list" hx-trigger="load" hx-swap="innerHTML" style="margin-top: 20px;">
+        <div class="empty-state">
+            <i class="la la-spinner la-spin"></i>
+            <p>Loading keys...</p>
+        </div>
+    </div>
+</div>`,
+		domainPath(r, domain),
+		html.EscapeString(domain),
+		createForm,
+		domainPath(r, domain))
+
+	templates.RenderPage(w, "DKIM - "+domain, content)
+}
+
+// DKIMPartial returns the key list as HTML partial (for HTMX)
+func DKIMPartial(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	if mailFor(r) == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Mail service not initialized</div>`))
+		return
+	}
+
+	renderDKIMKeys(w, r, "")
+}
+
+// CreateDKIMKey generates a key for the domain
+func CreateDKIMKey(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	if mailFor(r) == nil {
+		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	key, err := mailFor(r).CreateDKIMKey(domain, r.FormValue("selector"), r.FormValue("algorithm"))
+	if err != nil {
+		log.Printf("Error creating DKIM key for %s: %v", domain, err)
+		LogAuditError(r, "create_dkim_key", domain, err)
+		renderDKIMKeys(w, r, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	log.Printf("DKIM key created: %s (%s)", key.RecordName(), key.Status)
+	LogAudit(r, "create_dkim_key", domain, "success", fmt.Sprintf("selector=%s algorithm=%s status=%s", key.Selector, key.Algorithm, key.Status))
+
+	message := fmt.Sprintf(`<div class="success-msg"><i class="la la-check-circle"></i> Key <strong>%s</strong> created. Publish its DNS record, then activate it.</div>`,
+		html.EscapeString(key.Selector))
+	if key.Status == services.DKIMStatusActive {
+		message = fmt.Sprintf(`<div class="success-msg"><i class="la la-check-circle"></i> Key <strong>%s</strong> created and signing. Publish its DNS record so receivers can verify it.</div>`,
+			html.EscapeString(key.Selector))
+	}
+	renderDKIMKeys(w, r, message)
+}
+
+// ActivateDKIMKey switches signing to a pending key, retiring the active one
+func ActivateDKIMKey(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	selector := chi.URLParam(r, "selector")
+	if mailFor(r) == nil {
+		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := mailFor(r).ActivateDKIMKey(domain, selector); err != nil {
+		log.Printf("Error activating DKIM key %s for %s: %v", selector, domain, err)
+		LogAuditError(r, "activate_dkim_key", domain, err)
+		renderDKIMKeys(w, r, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	log.Printf("DKIM key activated: %s._domainkey.%s", selector, domain)
+	LogAudit(r, "activate_dkim_key", domain, "success", "selector="+selector)
+
+	renderDKIMKeys(w, r, fmt.Sprintf(`<div class="success-msg"><i class="la la-check-circle"></i> Mail of %s is now signed with <strong>%s</strong>.</div>`,
+		html.EscapeString(domain), html.EscapeString(selector)))
+}
+
+// DeleteDKIMKey removes a pending or retired key
+func DeleteDKIMKey(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	selector := chi.URLParam(r, "selector")
+	if mailFor(r) == nil {
+		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := mailFor(r).RemoveDKIMKey(domain, selector); err != nil {
+		log.Printf("Error removing DKIM key %s for %s: %v", selector, domain, err)
+		LogAuditError(r, "remove_dkim_key", domain, err)
+		renderDKIMKeys(w, r, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	log.Printf("DKIM key removed: %s._domainkey.%s", selector, domain)
+	LogAudit(r, "remove_dkim_key", domain, "success", "selector="+selector)
+
+	renderDKIMKeys(w, r, `<div class="success-msg"><i class="la la-check-circle"></i> Key removed. Its DNS record can be deleted.</div>`)
+}
+
+// dkimStatusBadge renders the state of a key
+func dkimStatusBadge(status string) string {
+	class := map[string]string{
+		services.DKIMStatusActive:  "badge-success",
+		services.DKIMStatusPending: "badge-warning",
+		services.DKIMStatusRetired: "badge-info",
+	}[status]
+	return fmt.Sprintf(`<span class="badge %s">%s</span>`, class, html.EscapeString(status))
+}
+
+// renderDKIMKeys writes the keys of the domain with their DNS records,
+// preceded by an optional message
+func renderDKIMKeys(w http.ResponseWriter, r *http.Request, message string) {
+	domain := chi.URLParam(r, "domain")
+	keys, err := mailFor(r).DKIMKeys(domain)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf(`%s<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, message, html.EscapeString(err.Error()))))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(message)
+	if len(keys) == 0 {
+		sb.WriteString(`
+<div class="empty-state">
+    <i class="la la-key"></i>
+    <p>No DKIM key: mail of this domain is sent unsigned</p>
+</div>`)
+		w.Write([]byte(sb.String()))
+		return
+	}
+
+	manage := can(r, services.PermManageDomains, domain)
+	sb.WriteString(`
+<table>
+    <thead>
+        <tr>
+            <th>Selector</th>
+            <th>Status</th>
+            <th>DNS TXT record</th>
+            <th>Actions</th>
+        </tr>
+    </thead>
+    <tbody>`)
+	for _, k := range keys {
+		actions := ""
+		if manage {
+			selector := html.EscapeString(k.Selector)
+			if k.Status == services.DKIMStatusPending {
+				actions = fmt.Sprintf(`
+                <button class="btn btn-primary btn-sm"
+                        hx-put="%s/dkim/%s/activate"
+                        hx-target="#dkim-list"
+                        hx-swap="innerHTML"
+                        hx-confirm="Sign mail with %s? Make sure its DNS record is published first.">
+                    <i class="la la-check"></i>
+                </button>`, domainPath(r, domain), selector, selector)
+			}
+			if k.Status != services.DKIMStatusActive {
+				actions += fmt.Sprintf(`
+                <button class="btn btn-danger btn-sm"
+                        hx-delete="%s/dkim/%s"
+                        hx-target="#dkim-list"
+                        hx-swap="innerHTML"
+                        hx-confirm="Remove key %s?">
+                    <i class="la la-trash"></i>
+                </button>`, domainPath(r, domain), selector, selector)
+			}
+		}
+
+		sb.WriteString(fmt.Sprintf(`
+        <tr>
+            <td><i class="la la-key" style="color: #1a73e8; margin-right: 6px;"></i><strong>%s</strong><br><small>%s, created %s</small></td>
+            <td>%s</td>
+            <td>
+                <p>Name: <code>%s</code></p>
+                <p>Value:</p>
+                <textarea readonly rows="3" style="width: 100%%; font-family: monospace;" onclick="this.select()">%s</textarea>
+                <details><summary>Zone file</summary><pre style="white-space: pre-wrap;">%s</pre></details>
+            </td>
+            <td class="actions">%s
+            </td>
+        </tr>`,
+			html.EscapeString(k.Selector),
+			html.EscapeString(k.Algorithm),
+			k.CreatedAt.Format("2006-01-02"),
+			dkimStatusBadge(k.Status),
+			html.EscapeString(k.RecordName()),
+			html.EscapeString(k.RecordValue()),
+			html.EscapeString(k.ZoneRecord()),
+			actions))
+	}
+	sb.WriteString(`
+    </tbody>
+</table>`)
+
+	w.Write([]byte(sb.String()))
+}
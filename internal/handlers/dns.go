@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/Ingasti/mailhub-admin/internal/templates"
+	"github.com/go-chi/chi/v5"
+)
+
+// DNSPage renders the DNS readiness page of a domain. The checks run in
+// DNSPartial, as the lookups can take a few seconds.
+func DNSPage(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	w.Header().Set("Content-Type", "text/html")
+
+	content := fmt.Sprintf(`
+<div class="card">
+    <a href="%s/users" class="nav-link"><i class="la la-arrow-left"></i> Back to Users</a>
+    <div class="header">
+        <h1>DNS: %s</h1>
+        <p class="subtitle">Mail records of the domain compared with what this hub expects</p>
+    </div>
+    <button class="btn btn-secondary" hx-get="%s/dns/check" hx-target="#dns-report" hx-swap="innerHTML">
+        <i class="la la-sync" style="margin-right: 8px;"></i> Check Again
+    </button>
+
+    <div id="dns-report" hx-get="%s/dns/check" hx-trigger="load" hx-swap="innerHTML" style="margin-top: 20px;">
+        <div class="empty-state">
+            <i class="la la-spinner la-spin"></i>
+            <p>Resolving records...</p>
+        </div>
+    </div>
+</div>`,
+		domainPath(r, domain),
+		html.EscapeString(domain),
+		domainPath(r, domain),
+		domainPath(r, domain))
+
+	templates.RenderPage(w, "DNS - "+domain, content)
+}
+
+// DNSPartial runs the DNS checks of a domain and returns the report as HTML
+// partial (for HTMX)
+func DNSPartial(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	w.Header().Set("Content-Type", "text/html")
+
+	if mailFor(r) == nil || h.DNS == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> DNS checker not initialized</div>`))
+		return
+	}
+
+	report, err := h.DNS.CheckDomain(r.Context(), mailFor(r), domain)
+	if err != nil {
+		log.Printf("Error checking DNS of %s: %v", domain, err)
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf(`
+<p>Hub <code>%s</code> (%s), checked %s UTC: %s</p>
+<table>
+    <thead>
+        <tr>
+            <th>Check</th>
+            <th>Status</th>
+            <th>Found</th>
+            <th>Fix</th>
+        </tr>
+    </thead>
+    <tbody>`,
+		html.EscapeString(report.Hub),
+		html.EscapeString(strings.Join(report.HubAddrs, ", ")),
+		report.CheckedAt.Format("2006-01-02 15:04:05"),
+		dnsStatusBadge(report.Status)))
+
+	for _, c := range report.Checks {
+		found := "&mdash;"
+		if len(c.Found) > 0 {
+			var lines []string
+			for _, f := range c.Found {
+				lines = append(lines, html.EscapeString(f))
+			}
+			found = "<code>" + strings.Join(lines, "</code><br><code>") + "</code>"
+		}
+		fix := ""
+		if c.Fix != "" {
+			fix = fmt.Sprintf(`<pre style="white-space: pre-wrap; margin: 0;">%s</pre>`, html.EscapeString(c.Fix))
+		}
+
+		sb.WriteString(fmt.Sprintf(`
+        <tr>
+            <td><strong>%s</strong><br><small><code>%s</code></small></td>
+            <td>%s<br><small>%s</small></td>
+            <td style="word-break: break-all;">%s</td>
+            <td>%s</td>
+        </tr>`,
+			html.EscapeString(c.Check),
+			html.EscapeString(c.Name),
+			dnsStatusBadge(c.Status),
+			html.EscapeString(c.Detail),
+			found,
+			fix))
+	}
+	sb.WriteString(`
+    </tbody>
+</table>`)
+
+	w.Write([]byte(sb.String()))
+}
+
+// dnsStatusBadge renders a check result
+func dnsStatusBadge(status string) string {
+	class := map[string]string{
+		services.DNSPass: "badge-success",
+		services.DNSWarn: "badge-warning",
+		services.DNSFail: "badge-danger",
+	}[status]
+	return fmt.Sprintf(`<span class="badge %s">%s</span>`, class, html.EscapeString(status))
+}
@@ -5,8 +5,10 @@ import (
 	"html"
 	"log"
 	"net/http"
+	"regexp"
 	"strings"
 
+	"github.com/Ingasti/mailhub-admin/internal/services"
 	"github.com/Ingasti/mailhub-admin/internal/templates"
 	"github.com/go-chi/chi/v5"
 )
@@ -15,6 +17,14 @@ import (
 func ListDomains(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 
+	addButton := ""
+	if can(r, services.PermManageDomains, "") {
+		addButton = `
+    <button class="btn btn-primary" hx-get="` + serverBase(r) + `/domains/new" hx-target="#modal" hx-swap="innerHTML">
+        <i class="la la-plus" style="margin-right: 8px;"></i> Add Domain
+    </button>`
+	}
+
 	content := `
 <div class="card">
     <a href="/" class="nav-link"><i class="la la-arrow-left"></i> Back to Dashboard</a>
@@ -22,12 +32,9 @@ func ListDomains(w http.ResponseWriter, r *http.Request) {
         <h1>Mail Domains</h1>
         <p class="subtitle">Manage your mail domains</p>
     </div>
+    ` + addButton + `
     
-    <button class="btn btn-primary" hx-get="/domains/new" hx-target="#modal" hx-swap="innerHTML">
-        <i class="la la-plus" style="margin-right: 8px;"></i> Add Domain
-    </button>
-    
-    <div id="domain-list" hx-get="/domains/list" hx-trigger="load" hx-swap="innerHTML">
+    <div id="domain-list" hx-get="` + serverBase(r) + `/domains/list" hx-trigger="load" hx-swap="innerHTML">
         <div class="empty-state">
             <i class="la la-spinner la-spin"></i>
             <p>Loading domains...</p>
@@ -77,17 +84,18 @@ func ListDomains(w http.ResponseWriter, r *http.Request) {
 func ListDomainsPartial(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 
-	if h == nil || h.Mail == nil {
+	if mailFor(r) == nil {
 		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Mail service not initialized</div>`))
 		return
 	}
 
-	domains, err := h.Mail.ListDomains()
+	domains, err := mailFor(r).ListDomains()
 	if err != nil {
 		log.Printf("Error listing domains: %v", err)
 		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
 		return
 	}
+	domains = visibleDomains(r, domains)
 
 	if len(domains) == 0 {
 		w.Write([]byte(`
@@ -112,29 +120,35 @@ func ListDomainsPartial(w http.ResponseWriter, r *http.Request) {
     <tbody>`)
 
 	for _, d := range domains {
+		actions := fmt.Sprintf(`
+                <a href="%s/dns" class="btn btn-secondary btn-sm" title="DNS check">
+                    <i class="la la-stethoscope"></i>
+                </a>`, domainPath(r, d.Name))
+		if can(r, services.PermManageDomains, d.Name) {
+			actions += fmt.Sprintf(`
+                <button class="btn btn-danger btn-sm" 
+                        hx-get="%s/delete" 
+                        hx-target="#modal" 
+                        hx-swap="innerHTML">
+                    <i class="la la-trash"></i>
+                </button>`, domainPath(r, d.Name))
+		}
+
 		sb.WriteString(fmt.Sprintf(`
         <tr>
             <td>
-                <a href="/domains/%s/users" style="color: #1a73e8; text-decoration: none; font-weight: 500;">
+                <a href="%s/users" style="color: #1a73e8; text-decoration: none; font-weight: 500;">
                     <i class="la la-globe" style="margin-right: 6px;"></i>%s
                 </a>
             </td>
             <td><span class="badge badge-info">%d users</span></td>
-            <td class="actions">
-                <button class="btn btn-danger btn-sm" 
-                        hx-delete="/domains/%s" 
-                        hx-target="#domain-list" 
-                        hx-swap="innerHTML"
-                        hx-confirm="Delete domain %s and all its users?">
-                    <i class="la la-trash"></i>
-                </button>
+            <td class="actions">%s
             </td>
         </tr>`,
-			html.EscapeString(d.Name),
+			domainPath(r, d.Name),
 			html.EscapeString(d.Name),
 			d.UserCount,
-			html.EscapeString(d.Name),
-			html.EscapeString(d.Name)))
+			actions))
 	}
 
 	sb.WriteString(`
@@ -151,7 +165,7 @@ func NewDomainForm(w http.ResponseWriter, r *http.Request) {
 <div class="modal-overlay" onclick="if(event.target===this) this.remove()">
     <div class="modal">
         <h3><i class="la la-plus-circle" style="color: #1a73e8; margin-right: 8px;"></i>Add Domain</h3>
-        <form hx-post="/domains" hx-target="#domain-list" hx-swap="innerHTML">
+        <form hx-post="` + serverBase(r) + `/domains" hx-target="#domain-list" hx-swap="innerHTML">
             <div class="form-group">
                 <label for="domain">Domain Name</label>
                 <input type="text" id="domain" name="domain" placeholder="example.com" required 
@@ -176,59 +190,192 @@ func CreateDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if h == nil || h.Mail == nil {
+	if mailFor(r) == nil {
 		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
 		return
 	}
 
-	user := r.Header.Get("X-Auth-User")
-	if user == "" {
-		user = "system"
-	}
-
-	if err := h.Mail.AddDomain(domain); err != nil {
+	if err := mailFor(r).AddDomain(domain); err != nil {
 		log.Printf("Error adding domain %s: %v", domain, err)
-		LogAudit(user, "add_domain", domain, "failed", err.Error())
+		LogAuditError(r, "add_domain", domain, err)
 		w.Header().Set("Content-Type", "text/html")
 		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
 		return
 	}
 
 	log.Printf("Domain added: %s", domain)
-	LogAudit(user, "add_domain", domain, "success", "")
+	LogAudit(r, "add_domain", domain, "success", "")
 
 	// Return updated list
 	ListDomainsPartial(w, r)
 }
 
-// DeleteDomain removes a mail domain
+// DeleteDomainForm returns the domain deletion dialog with a dry-run
+// preview and a typed-name confirmation
+func DeleteDomainForm(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(fmt.Sprintf(`
+<div class="modal-overlay" onclick="if(event.target===this) this.remove()">
+    <div class="modal">
+        <h3><i class="la la-trash" style="color: #dc2626; margin-right: 8px;"></i>Delete Domain %s</h3>
+        <form hx-delete="%s" hx-target="#domain-list" hx-swap="innerHTML">
+            <div class="form-group">
+                <label>Mailboxes</label>
+                <label style="font-weight: normal;">
+                    <input type="radio" name="mode" value="archive" checked style="width: auto; margin-right: 6px;"
+                           hx-get="%s/delete/preview" hx-target="#delete-preview" hx-include="this">
+                    Archive maildirs, then delete everything
+                </label>
+                <label style="font-weight: normal;">
+                    <input type="radio" name="mode" value="cascade" style="width: auto; margin-right: 6px;"
+                           hx-get="%s/delete/preview" hx-target="#delete-preview" hx-include="this">
+                    Delete everything including mail (cannot be undone)
+                </label>
+            </div>
+            <div id="delete-preview" hx-get="%s/delete/preview?mode=archive" hx-trigger="load" hx-swap="innerHTML">
+                <div class="empty-state">
+                    <i class="la la-spinner la-spin"></i>
+                    <p>Checking what will be deleted...</p>
+                </div>
+            </div>
+            <div class="form-group">
+                <label for="confirm">Type <strong>%s</strong> to confirm</label>
+                <input type="text" id="confirm" name="confirm" required autocomplete="off" pattern="%s">
+            </div>
+            <div class="modal-footer">
+                <button type="button" class="btn btn-secondary" onclick="this.closest('.modal-overlay').remove()">Cancel</button>
+                <button type="submit" class="btn btn-danger">Delete Domain</button>
+            </div>
+        </form>
+    </div>
+</div>`,
+		html.EscapeString(domain),
+		domainPath(r, domain),
+		domainPath(r, domain),
+		domainPath(r, domain),
+		domainPath(r, domain),
+		html.EscapeString(domain),
+		html.EscapeString(regexp.QuoteMeta(domain)))))
+}
+
+// DeleteDomainPreview returns the dry-run of a domain deletion
+func DeleteDomainPreview(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	mode := r.FormValue("mode")
+	w.Header().Set("Content-Type", "text/html")
+
+	if mailFor(r) == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Mail service not initialized</div>`))
+		return
+	}
+
+	plan, err := mailFor(r).PlanDomainDeletion(domain, mode)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+
+	w.Write([]byte(renderDeletionPlan(plan)))
+}
+
+// renderDeletionPlan lists the files, lines and directories of a plan
+func renderDeletionPlan(plan *services.DomainDeletionPlan) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf(`
+<p style="margin-bottom: 10px;">
+    <span class="badge badge-danger">%d mailboxes</span>
+    <span class="badge badge-danger">%d aliases</span>
+    <span class="badge badge-info">%d config lines</span>
+</p>`, len(plan.Mailboxes), len(plan.Aliases), len(plan.Changes)))
+
+	sb.WriteString(`<div style="max-height: 240px; overflow-y: auto; font-size: 0.85rem; margin-bottom: 15px;">`)
+	file := ""
+	for _, c := range plan.Changes {
+		if c.File != file {
+			if file != "" {
+				sb.WriteString(`</ul>`)
+			}
+			file = c.File
+			sb.WriteString(fmt.Sprintf(`<p style="margin-top: 8px;"><code>%s</code></p><ul style="margin-left: 20px;">`, html.EscapeString(file)))
+		}
+		if c.Replacement == "" {
+			sb.WriteString(fmt.Sprintf(`<li>remove <code>%s</code></li>`, html.EscapeString(c.Line)))
+		} else {
+			sb.WriteString(fmt.Sprintf(`<li>rewrite <code>%s</code> &rarr; <code>%s</code></li>`,
+				html.EscapeString(c.Line), html.EscapeString(c.Replacement)))
+		}
+	}
+	if file != "" {
+		sb.WriteString(`</ul>`)
+	}
+
+	if plan.Maildir != "" {
+		sb.WriteString(fmt.Sprintf(`<p style="margin-top: 8px;"><code>%s</code> (removed)</p><ul style="margin-left: 20px;">`,
+			html.EscapeString(plan.Maildir)))
+		for _, dir := range plan.Maildirs {
+			sb.WriteString(fmt.Sprintf(`<li><code>%s</code></li>`, html.EscapeString(dir)))
+		}
+		sb.WriteString(`</ul>`)
+	}
+	if len(plan.DKIMKeys) > 0 {
+		sb.WriteString(`<p style="margin-top: 8px;">DKIM keys (removed)</p><ul style="margin-left: 20px;">`)
+		for _, key := range plan.DKIMKeys {
+			sb.WriteString(fmt.Sprintf(`<li><code>%s</code></li>`, html.EscapeString(key)))
+		}
+		sb.WriteString(`</ul>`)
+	}
+	sb.WriteString(`</div>`)
+
+	switch {
+	case plan.Archive != "":
+		sb.WriteString(fmt.Sprintf(`<div class="success-msg"><i class="la la-archive"></i> Maildirs will be archived to <code>%s</code></div>`,
+			html.EscapeString(plan.Archive)))
+	case plan.Maildir != "":
+		sb.WriteString(`<div class="error-msg"><i class="la la-exclamation-triangle"></i> All mail of this domain will be permanently deleted</div>`)
+	}
+
+	return sb.String()
+}
+
+// DeleteDomain removes a mail domain after the operator typed its name
 func DeleteDomain(w http.ResponseWriter, r *http.Request) {
 	domain := chi.URLParam(r, "domain")
-	if domain == "" {
-		http.Error(w, "Domain required", http.StatusBadRequest)
+	mode := r.FormValue("mode")
+	confirm := strings.TrimSpace(r.FormValue("confirm"))
+
+	if domain == "" || mode == "" {
+		http.Error(w, "Domain and mode required", http.StatusBadRequest)
 		return
 	}
 
-	if h == nil || h.Mail == nil {
+	if mailFor(r) == nil {
 		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
 		return
 	}
 
-	user := r.Header.Get("X-Auth-User")
-	if user == "" {
-		user = "system"
+	w.Header().Set("Content-Type", "text/html")
+	if confirm != domain {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: confirmation does not match the domain name</div>`))
+		ListDomainsPartial(w, r)
+		return
 	}
 
-	if err := h.Mail.DeleteDomain(domain); err != nil {
+	plan, err := mailFor(r).DeleteDomain(domain, services.DeleteDomainOptions{Mode: mode, Confirm: confirm})
+	if err != nil {
 		log.Printf("Error deleting domain %s: %v", domain, err)
-		LogAudit(user, "delete_domain", domain, "failed", err.Error())
-		w.Header().Set("Content-Type", "text/html")
+		LogAuditError(r, "delete_domain", domain, err)
 		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
 		return
 	}
 
-	log.Printf("Domain deleted: %s", domain)
-	LogAudit(user, "delete_domain", domain, "success", "")
+	details := fmt.Sprintf("mode=%s mailboxes=%d aliases=%d", plan.Mode, len(plan.Mailboxes), len(plan.Aliases))
+	if plan.Archive != "" {
+		details += " archive=" + plan.Archive
+	}
+	log.Printf("Domain deleted: %s (%s)", domain, details)
+	LogAudit(r, "delete_domain", domain, "success", details)
 
 	// Return updated list
 	ListDomainsPartial(w, r)
@@ -4,18 +4,27 @@ import (
 	"github.com/Ingasti/mailhub-admin/internal/services"
 )
 
-// Handler holds dependencies for HTTP handlers
+// Handler holds dependencies for HTTP handlers. Mail hosts are reached
+// through the server the request selected (see SelectServer).
 type Handler struct {
-	Mail *services.MailService
+	Servers *services.ServerInventory
+	Tokens  *services.TokenService
+	Roles   *services.RoleService
+	Notify  *services.NotificationService
+	DNS     *services.DNSChecker
 }
 
 // Global handler instance (initialized in main)
 var h *Handler
 
 // Init initializes the handler with dependencies
-func Init(mail *services.MailService) {
+func Init(servers *services.ServerInventory, tokens *services.TokenService, roles *services.RoleService, notify *services.NotificationService, dns *services.DNSChecker) {
 	h = &Handler{
-		Mail: mail,
+		Servers: servers,
+		Tokens:  tokens,
+		Roles:   roles,
+		Notify:  notify,
+		DNS:     dns,
 	}
 }
 
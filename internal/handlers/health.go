@@ -2,8 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 
+	"github.com/Ingasti/mailhub-admin/internal/services"
 	"github.com/Ingasti/mailhub-admin/internal/templates"
 )
 
@@ -16,6 +19,46 @@ func HealthCheck(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// menuItems are the dashboard tiles, each shown only with its permission.
+// Server tiles open the page for the selected server.
+var menuItems = []struct {
+	Href, Icon, Label string
+	Perm              services.Permission
+	Server            bool
+}{
+	{"/domains", "la-globe", "Domains", services.PermView, true},
+	{"/rspamd", "la-shield", "Rspamd Protection", services.PermViewServer, true},
+	{"/audit", "la-history", "Audit Log", services.PermViewAudit, false},
+	{"/settings/hostkeys", "la-key", "Host Keys", services.PermViewServer, true},
+	{"/settings/servers", "la-server", "Servers", services.PermViewServer, false},
+	{"/settings/tokens", "la-user-lock", "API Tokens", services.PermView, false},
+	{"/settings/roles", "la-users-cog", "Roles", services.PermManageRoles, false},
+	{"/settings/notifications", "la-bell", "Notifications", services.PermManageServer, false},
+}
+
+// dashboardMenu renders the tiles the current user may open
+func dashboardMenu(r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(`<div class="menu-grid">`)
+	for _, item := range menuItems {
+		if !can(r, item.Perm, "") {
+			continue
+		}
+		href := item.Href
+		if item.Server {
+			href = serverBase(r) + href
+		}
+		sb.WriteString(fmt.Sprintf(`
+        <a href="%s" class="menu-item">
+            <i class="la %s"></i>
+            <span>%s</span>
+        </a>`, href, item.Icon, item.Label))
+	}
+	sb.WriteString(`
+    </div>`)
+	return sb.String()
+}
+
 // Dashboard renders the main dashboard
 func Dashboard(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
@@ -28,20 +71,7 @@ func Dashboard(w http.ResponseWriter, r *http.Request) {
         <p class="subtitle">Mail Server Administration</p>
     </div>
     
-    <div class="menu-grid">
-        <a href="/domains" class="menu-item">
-            <i class="la la-globe"></i>
-            <span>Domains</span>
-        </a>
-        <a href="/rspamd" class="menu-item">
-            <i class="la la-shield"></i>
-            <span>Rspamd Protection</span>
-        </a>
-        <a href="/audit" class="menu-item">
-            <i class="la la-history"></i>
-            <span>Audit Log</span>
-        </a>
-    </div>
+    ` + serverSwitcher(r) + dashboardMenu(r) + `
 </div>
 
 <div class="card">
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/Ingasti/mailhub-admin/internal/templates"
+)
+
+// HostKeysPage renders the SSH host key verification page
+func HostKeysPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	content := `
+<div class="card">
+    <a href="/" class="nav-link"><i class="la la-arrow-left"></i> Back to Dashboard</a>
+    <div class="header">
+        <h1>SSH Host Keys</h1>
+        <p class="subtitle">Verify the identity of the jump host and mail server</p>
+    </div>
+
+    <div id="hostkey-list" hx-get="` + serverBase(r) + `/settings/hostkeys/list" hx-trigger="load" hx-swap="innerHTML">
+        <div class="empty-state">
+            <i class="la la-spinner la-spin"></i>
+            <p>Loading host keys...</p>
+        </div>
+    </div>
+</div>`
+
+	templates.RenderPage(w, "SSH Host Keys", content)
+}
+
+// HostKeysPartial returns the host key status as HTML partial (for HTMX)
+func HostKeysPartial(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	if sshFor(r) == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> SSH client not initialized</div>`))
+		return
+	}
+
+	renderHostKeys(w, r, "")
+}
+
+// TrustHostKey trusts the key currently presented by a hop
+func TrustHostKey(w http.ResponseWriter, r *http.Request) {
+	hop := r.FormValue("hop")
+	fingerprint := r.FormValue("fingerprint")
+
+	if hop == "" || fingerprint == "" {
+		http.Error(w, "Hop and fingerprint required", http.StatusBadRequest)
+		return
+	}
+
+	ssh := sshFor(r)
+	if ssh == nil {
+		http.Error(w, "SSH client not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	target := hop + " " + fingerprint
+	if err := ssh.TrustHostKey(hop, fingerprint); err != nil {
+		log.Printf("Error trusting %s host key %s: %v", hop, fingerprint, err)
+		LogAuditError(r, "trust_host_key", target, err)
+		renderHostKeys(w, r, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	log.Printf("Trusted %s host key %s", hop, fingerprint)
+	LogAudit(r, "trust_host_key", target, "success", "")
+
+	// Reconnect so the next hop (if any) presents its key
+	msg := `<div class="success-msg"><i class="la la-check-circle"></i> Host key trusted. Connection established.</div>`
+	if mail := mailFor(r); mail != nil {
+		if err := mail.TestConnection(); err != nil {
+			msg = fmt.Sprintf(`<div class="success-msg"><i class="la la-check-circle"></i> Host key trusted.</div>
+<div class="error-msg"><i class="la la-exclamation-circle"></i> Connection: %s</div>`, html.EscapeString(err.Error()))
+		}
+	}
+	renderHostKeys(w, r, msg)
+}
+
+// sshFor returns the SSH client of the request's server, or nil
+func sshFor(r *http.Request) *services.SSHClient {
+	if srv := serverFrom(r); srv != nil {
+		return srv.SSH()
+	}
+	return nil
+}
+
+// renderHostKeys writes the host key table, preceded by an optional message.
+// The trust button is only offered to users who may manage the server.
+func renderHostKeys(w http.ResponseWriter, r *http.Request, message string) {
+	var sb strings.Builder
+	sb.WriteString(message)
+	sb.WriteString(`
+<table>
+    <thead>
+        <tr>
+            <th>Hop</th>
+            <th>Address</th>
+            <th>Verification</th>
+            <th>Status</th>
+        </tr>
+    </thead>
+    <tbody>`)
+
+	for _, s := range sshFor(r).HostKeyStatus() {
+		verification := html.EscapeString(s.Mode)
+		switch {
+		case s.Fingerprint != "":
+			verification += `<br><code>` + html.EscapeString(s.Fingerprint) + `</code>`
+		case s.KnownHostsPath != "":
+			verification += `<br><code>` + html.EscapeString(s.KnownHostsPath) + `</code>`
+		}
+
+		status := `<span class="badge badge-success">verified on connect</span>`
+		if s.Pending != nil {
+			status = fmt.Sprintf(`
+                <span class="badge badge-danger">untrusted key presented</span>
+                <p style="margin: 10px 0; font-size: 0.85rem; color: #666;">
+                    %s from %s at %s<br><code>%s</code>
+                </p>`,
+				html.EscapeString(s.Pending.Type),
+				html.EscapeString(s.Pending.Address),
+				s.Pending.SeenAt.Format("2006-01-02 15:04:05"),
+				html.EscapeString(s.Pending.Fingerprint))
+			if s.Fingerprint == "" && s.KnownHostsPath != "" && can(r, services.PermManageServer, "") {
+				status += fmt.Sprintf(`
+                <form hx-post="%s/settings/hostkeys/trust" hx-target="#hostkey-list" hx-swap="innerHTML"
+                      hx-confirm="Only trust this key if the fingerprint matches the one shown by ssh-keygen -lf on the host. Trust it?">
+                    <input type="hidden" name="hop" value="%s">
+                    <input type="hidden" name="fingerprint" value="%s">
+                    <button type="submit" class="btn btn-primary btn-sm"><i class="la la-check"></i> Trust</button>
+                </form>`,
+					serverBase(r),
+					html.EscapeString(s.Hop),
+					html.EscapeString(s.Pending.Fingerprint))
+			}
+		}
+
+		sb.WriteString(fmt.Sprintf(`
+        <tr>
+            <td><strong>%s</strong></td>
+            <td>%s</td>
+            <td>%s</td>
+            <td>%s</td>
+        </tr>`,
+			html.EscapeString(s.Hop),
+			html.EscapeString(s.Address),
+			verification,
+			status))
+	}
+
+	sb.WriteString(`
+    </tbody>
+</table>`)
+
+	w.Write([]byte(sb.String()))
+}
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/middleware"
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/Ingasti/mailhub-admin/internal/templates"
+	"github.com/go-chi/chi/v5"
+)
+
+// NotificationsPage renders the notification settings page
+func NotificationsPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	var events strings.Builder
+	for _, e := range services.NotifyEvents {
+		events.WriteString(fmt.Sprintf(`
+            <label style="font-weight: normal;"><input type="checkbox" name="event" value="%s"> %s <code>%s</code></label>`,
+			e.Action, html.EscapeString(e.Label), e.Action))
+	}
+
+	emailOption := `<option value="email" disabled>Email (set CMH_SMTP_ADDR to enable)</option>`
+	if h != nil && h.Notify != nil && h.Notify.EmailEnabled() {
+		emailOption = `<option value="email">Email summary</option>`
+	}
+
+	content := `
+<div class="card">
+    <a href="/" class="nav-link"><i class="la la-arrow-left"></i> Back to Dashboard</a>
+    <div class="header">
+        <h1>Notifications</h1>
+        <p class="subtitle">Webhooks and email for administrative events</p>
+    </div>
+
+    <form hx-post="/settings/notifications" hx-target="#notification-list" hx-swap="innerHTML">
+        <div class="form-group">
+            <label for="channel">Channel</label>
+            <select id="channel" name="channel">
+                <option value="webhook">Webhook (signed JSON POST)</option>
+                ` + emailOption + `
+            </select>
+        </div>
+        <div class="form-group">
+            <label for="target">Webhook URL or email address</label>
+            <input type="text" id="target" name="target" placeholder="https://hooks.example.com/mailhub" required>
+        </div>
+        <div class="form-group">
+            <label>Events</label>` + events.String() + `
+        </div>
+        <button type="submit" class="btn btn-primary"><i class="la la-plus"></i> Add Subscription</button>
+    </form>
+
+    <div id="notification-list" hx-get="/settings/notifications/list" hx-trigger="load" hx-swap="innerHTML" style="margin-top: 20px;">
+        <div class="empty-state">
+            <i class="la la-spinner la-spin"></i>
+            <p>Loading subscriptions...</p>
+        </div>
+    </div>
+</div>`
+
+	templates.RenderPage(w, "Notifications", content)
+}
+
+// NotificationsPartial returns subscriptions and recent deliveries as HTML
+// partial (for HTMX)
+func NotificationsPartial(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	if h == nil || h.Notify == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Notification service not initialized</div>`))
+		return
+	}
+
+	renderNotifications(w, "")
+}
+
+// CreateNotification adds a subscription. A webhook's signing secret is
+// shown once.
+func CreateNotification(w http.ResponseWriter, r *http.Request) {
+	if h == nil || h.Notify == nil {
+		http.Error(w, "Notification service not initialized", http.StatusInternalServerError)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	channel := r.FormValue("channel")
+	target := strings.TrimSpace(r.FormValue("target"))
+
+	w.Header().Set("Content-Type", "text/html")
+	sub, err := h.Notify.Subscribe(channel, target, r.Form["event"], middleware.GetAuthUser(r).Email)
+	if err != nil {
+		log.Printf("Error adding %s notification %s: %v", channel, target, err)
+		LogAuditError(r, "create_notification", target, err)
+		renderNotifications(w, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	log.Printf("Notification %d added: %s %s", sub.ID, sub.Channel, sub.Target)
+	LogAudit(r, "create_notification", sub.Target, "success",
+		fmt.Sprintf("channel=%s events=%s", sub.Channel, strings.Join(sub.Events, ",")))
+
+	message := fmt.Sprintf(`<div class="success-msg"><i class="la la-check-circle"></i> Subscription for <strong>%s</strong> added.</div>`,
+		html.EscapeString(sub.Target))
+	if sub.Channel == services.ChannelWebhook {
+		message = fmt.Sprintf(`
+<div class="success-msg">
+    <i class="la la-check-circle"></i> Webhook <strong>%s</strong> added. Copy its signing secret now &mdash; it will not be shown again.
+    <p style="margin-top: 10px;"><code style="user-select: all; word-break: break-all;">%s</code></p>
+</div>`, html.EscapeString(sub.Target), html.EscapeString(sub.Secret))
+	}
+	renderNotifications(w, message)
+}
+
+// DeleteNotification removes a subscription and its queued deliveries
+func DeleteNotification(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid subscription id", http.StatusBadRequest)
+		return
+	}
+	if h == nil || h.Notify == nil {
+		http.Error(w, "Notification service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	sub, err := h.Notify.Unsubscribe(id)
+	if err != nil {
+		log.Printf("Error deleting notification %d: %v", id, err)
+		LogAuditError(r, "delete_notification", strconv.FormatInt(id, 10), err)
+		renderNotifications(w, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	log.Printf("Notification %d deleted: %s %s", sub.ID, sub.Channel, sub.Target)
+	LogAudit(r, "delete_notification", sub.Target, "success", "channel="+sub.Channel)
+
+	renderNotifications(w, `<div class="success-msg"><i class="la la-check-circle"></i> Subscription deleted.</div>`)
+}
+
+// TestNotification queues a test event for a subscription
+func TestNotification(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid subscription id", http.StatusBadRequest)
+		return
+	}
+	if h == nil || h.Notify == nil {
+		http.Error(w, "Notification service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.Notify.SendTest(id, middleware.GetAuthUser(r).Email); err != nil {
+		renderNotifications(w, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+	renderNotifications(w, `<div class="success-msg"><i class="la la-check-circle"></i> Test notification queued; see the deliveries below.</div>`)
+}
+
+// recentDeliveries is the number of deliveries listed on the page
+const recentDeliveries = 20
+
+// renderNotifications writes the subscription and delivery tables, preceded
+// by an optional message
+func renderNotifications(w http.ResponseWriter, message string) {
+	subs, err := h.Notify.Subscriptions()
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf(`%s<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, message, html.EscapeString(err.Error()))))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(message)
+
+	if len(subs) == 0 {
+		sb.WriteString(`
+<div class="empty-state">
+    <i class="la la-bell-slash"></i>
+    <p>No subscriptions yet</p>
+</div>`)
+		w.Write([]byte(sb.String()))
+		return
+	}
+
+	sb.WriteString(`
+<table>
+    <thead>
+        <tr>
+            <th>Channel</th>
+            <th>Target</th>
+            <th>Events</th>
+            <th>Created</th>
+            <th>Actions</th>
+        </tr>
+    </thead>
+    <tbody>`)
+	for _, s := range subs {
+		sb.WriteString(fmt.Sprintf(`
+        <tr>
+            <td>%s</td>
+            <td><strong>%s</strong></td>
+            <td><code>%s</code></td>
+            <td>%s<br><small>%s</small></td>
+            <td class="actions">
+                <button class="btn btn-secondary btn-sm" title="Send test"
+                        hx-post="/settings/notifications/%d/test"
+                        hx-target="#notification-list"
+                        hx-swap="innerHTML">
+                    <i class="la la-paper-plane"></i>
+                </button>
+                <button class="btn btn-danger btn-sm"
+                        hx-delete="/settings/notifications/%d"
+                        hx-target="#notification-list"
+                        hx-swap="innerHTML"
+                        hx-confirm="Delete subscription for %s?">
+                    <i class="la la-trash"></i>
+                </button>
+            </td>
+        </tr>`,
+			s.Channel,
+			html.EscapeString(s.Target),
+			html.EscapeString(strings.Join(s.Events, ", ")),
+			s.CreatedAt.Local().Format("2006-01-02 15:04"),
+			html.EscapeString(s.CreatedBy),
+			s.ID, s.ID,
+			html.EscapeString(s.Target)))
+	}
+	sb.WriteString(`
+    </tbody>
+</table>`)
+
+	deliveries, err := h.Notify.Deliveries(recentDeliveries)
+	if err != nil {
+		sb.WriteString(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		w.Write([]byte(sb.String()))
+		return
+	}
+	if len(deliveries) > 0 {
+		sb.WriteString(`
+<h3 style="margin: 20px 0 10px;">Recent deliveries</h3>
+<table>
+    <thead>
+        <tr>
+            <th>Event</th>
+            <th>Target</th>
+            <th>Status</th>
+            <th>Attempts</th>
+            <th>Last error</th>
+        </tr>
+    </thead>
+    <tbody>`)
+		for _, d := range deliveries {
+			status := `<span class="badge badge-success">delivered</span>`
+			switch d.Status() {
+			case "failed":
+				status = `<span class="badge badge-danger">failed</span>`
+			case "pending":
+				status = fmt.Sprintf(`<span class="badge badge-warning">pending</span><br><small>next %s</small>`,
+					d.NextAttemptAt.Local().Format("15:04:05"))
+			}
+			sb.WriteString(fmt.Sprintf(`
+        <tr>
+            <td><code>%s</code> %s</td>
+            <td>%s</td>
+            <td>%s</td>
+            <td>%d</td>
+            <td><small>%s</small></td>
+        </tr>`,
+				html.EscapeString(d.Event.Event),
+				html.EscapeString(d.Event.Target),
+				html.EscapeString(d.Target),
+				status,
+				d.Attempts,
+				html.EscapeString(d.LastError)))
+		}
+		sb.WriteString(`
+    </tbody>
+</table>`)
+	}
+
+	w.Write([]byte(sb.String()))
+}
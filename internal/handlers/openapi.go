@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIVersion is the version reported in the OpenAPI document
+const APIVersion = "1.0.0"
+
+var pathParamRe = regexp.MustCompile(`\{([^}]+)\}`)
+
+// OpenAPISpec serves the OpenAPI document of /api/v1
+func OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, OpenAPIDocument())
+}
+
+// OpenAPIDocument builds the OpenAPI 3.0 document for /api/v1 from the route
+// table and the request and response Go types
+func OpenAPIDocument() map[string]interface{} {
+	gen := &schemaGen{schemas: make(map[string]interface{})}
+	errorRef := gen.schema(reflect.TypeOf(APIError{}))
+
+	paths := make(map[string]map[string]interface{})
+	for _, r := range apiRoutes {
+		for _, route := range routeVariants(r) {
+			op := map[string]interface{}{
+				"summary":     route.Summary,
+				"tags":        []string{route.Tag},
+				"operationId": operationID(route),
+			}
+			if route.Perm != "" {
+				op["x-required-permission"] = string(route.Perm)
+			}
+
+			var params []interface{}
+			for _, m := range pathParamRe.FindAllStringSubmatch(route.Pattern, -1) {
+				params = append(params, map[string]interface{}{
+					"name": m[1], "in": "path", "required": true,
+					"schema": map[string]interface{}{"type": "string"},
+				})
+			}
+			for _, q := range route.Query {
+				params = append(params, map[string]interface{}{
+					"name": q.Name, "in": "query", "description": q.Description,
+					"schema": map[string]interface{}{"type": q.Type},
+				})
+			}
+			if len(params) > 0 {
+				op["parameters"] = params
+			}
+
+			if route.Request != nil {
+				op["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": gen.schema(reflect.TypeOf(route.Request))},
+					},
+				}
+			}
+
+			success := map[string]interface{}{"description": http.StatusText(route.Status)}
+			if route.Response != nil {
+				success["content"] = map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": gen.schema(reflect.TypeOf(route.Response))},
+				}
+			}
+			op["responses"] = map[string]interface{}{
+				strconv.Itoa(route.Status): success,
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": errorRef},
+					},
+				},
+			}
+
+			if paths[route.Pattern] == nil {
+				paths[route.Pattern] = make(map[string]interface{})
+			}
+			paths[route.Pattern][strings.ToLower(route.Method)] = op
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "MailHub Admin API",
+			"version":     APIVersion,
+			"description": "Manage domains, mailboxes, aliases and the audit log of the Central Mail Hub.",
+		},
+		"servers":  []interface{}{map[string]interface{}{"url": "/api/v1"}},
+		"paths":    paths,
+		"security": []interface{}{map[string]interface{}{"bearerAuth": []string{}}},
+		"components": map[string]interface{}{
+			"schemas": gen.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Personal API token from Settings > API Tokens. GET requests need the read scope, all others write.",
+				},
+			},
+		},
+	}
+}
+
+// routeVariants returns the route and, for server routes, its copy under
+// /servers/{server}
+func routeVariants(route apiRoute) []apiRoute {
+	if !route.Server {
+		return []apiRoute{route}
+	}
+	prefixed := route
+	prefixed.Pattern = "/servers/{server}" + route.Pattern
+	return []apiRoute{route, prefixed}
+}
+
+// operationID derives a stable operation id such as get_domains_domain_aliases
+func operationID(route apiRoute) string {
+	return strings.ToLower(route.Method) + strings.NewReplacer("/", "_", "{", "", "}", "", "-", "_").Replace(route.Pattern)
+}
+
+// schemaGen converts Go types to OpenAPI schemas, collecting named structs
+// under components/schemas
+type schemaGen struct {
+	schemas map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct:
+		name := t.Name()
+		if _, done := g.schemas[name]; !done {
+			g.schemas[name] = nil // guards against recursive types
+			g.schemas[name] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	}
+	return map[string]interface{}{}
+}
+
+func (g *schemaGen) structSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+
+	s := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/go-chi/chi/v5"
+)
+
+// quotaCell renders the usage bar and quota of a mailbox for the user list
+func quotaCell(mb services.Mailbox) string {
+	limit := "unlimited"
+	if mb.Quota > 0 {
+		limit = services.FormatBytes(mb.Quota)
+	}
+	source := ""
+	if mb.QuotaInherited && mb.Quota > 0 {
+		source = " (domain default)"
+	}
+
+	if !mb.UsageKnown {
+		return fmt.Sprintf(`<span class="quota-text">%s%s</span>`, limit, source)
+	}
+
+	used := services.FormatBytes(mb.UsedBytes)
+	if mb.Quota <= 0 {
+		return fmt.Sprintf(`<span class="quota-text">%s used / %s</span>`, used, limit)
+	}
+
+	percent := mb.UsagePercent()
+	width := percent
+	if width > 100 {
+		width = 100
+	}
+	fill, badge := "quota-bar-fill", ""
+	if mb.QuotaWarning() {
+		fill += " warn"
+		badge = fmt.Sprintf(` <span class="badge badge-warning"><i class="la la-exclamation-triangle"></i> %.0f%%</span>`, percent)
+	}
+
+	return fmt.Sprintf(`
+                <div class="quota-bar"><div class="%s" style="width: %.1f%%;"></div></div>
+                <span class="quota-text">%s / %s%s</span>%s`,
+		fill, width, used, limit, source, badge)
+}
+
+// EditQuotaForm returns the mailbox quota form
+func EditQuotaForm(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	user := chi.URLParam(r, "user")
+
+	if mailFor(r) == nil {
+		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	email := user + "@" + domain
+	users, err := mailFor(r).ListMailboxes(domain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var mailbox *services.Mailbox
+	for i := range users {
+		if users[i].Email == email {
+			mailbox = &users[i]
+		}
+	}
+	if mailbox == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	defaultQuota, err := mailFor(r).DomainQuota(domain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	current, checked := "", ""
+	if mailbox.QuotaInherited {
+		checked = "checked"
+	} else {
+		current = services.FormatQuota(mailbox.Quota)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(fmt.Sprintf(`
+<div class="modal-overlay" onclick="if(event.target===this) this.remove()">
+    <div class="modal">
+        <h3><i class="la la-hdd" style="color: #1a73e8; margin-right: 8px;"></i>Mailbox Quota</h3>
+        <p style="color: #666; margin-bottom: 20px;">%s</p>
+        <form hx-put="%s/users/%s/quota" hx-target="#user-list" hx-swap="innerHTML">
+            <div class="form-group">
+                <label>
+                    <input type="checkbox" name="inherit" value="1" %s style="width: auto; margin-right: 6px;">
+                    Use domain default (%s)
+                </label>
+            </div>
+            <div class="form-group">
+                <label for="quota">Quota</label>
+                <input type="text" id="quota" name="quota" value="%s" placeholder="e.g. 500M, 2G or 0 for unlimited">
+            </div>
+            <div class="modal-footer">
+                <button type="button" class="btn btn-secondary" onclick="this.closest('.modal-overlay').remove()">Cancel</button>
+                <button type="submit" class="btn btn-primary">Save Quota</button>
+            </div>
+        </form>
+    </div>
+</div>`,
+		html.EscapeString(email),
+		domainPath(r, domain),
+		html.EscapeString(user),
+		checked,
+		services.FormatQuota(defaultQuota),
+		html.EscapeString(current))))
+}
+
+// UpdateQuota sets a mailbox quota
+func UpdateQuota(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	user := chi.URLParam(r, "user")
+	inherit := r.FormValue("inherit") != ""
+	quota := strings.TrimSpace(r.FormValue("quota"))
+
+	if domain == "" || user == "" || (!inherit && quota == "") {
+		http.Error(w, "Quota required", http.StatusBadRequest)
+		return
+	}
+
+	if mailFor(r) == nil {
+		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	email := user + "@" + domain
+
+	var bytes int64
+	details := "domain default"
+	if !inherit {
+		var err error
+		bytes, err = services.ParseQuota(quota)
+		if err != nil {
+			w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+			return
+		}
+		details = services.FormatQuota(bytes)
+	}
+
+	if err := mailFor(r).SetMailboxQuota(domain, user, bytes, inherit); err != nil {
+		log.Printf("Error setting quota for %s: %v", email, err)
+		LogAuditError(r, "set_quota", email, err)
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+
+	log.Printf("Quota for %s set to %s", email, details)
+	LogAudit(r, "set_quota", email, "success", details)
+
+	// Return updated list
+	ListUsersPartial(w, r)
+}
+
+// DomainQuotaForm returns the domain default quota form
+func DomainQuotaForm(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+
+	if mailFor(r) == nil {
+		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	current, err := mailFor(r).DomainQuota(domain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	value := ""
+	if current > 0 {
+		value = services.FormatQuota(current)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(fmt.Sprintf(`
+<div class="modal-overlay" onclick="if(event.target===this) this.remove()">
+    <div class="modal">
+        <h3><i class="la la-hdd" style="color: #1a73e8; margin-right: 8px;"></i>Domain Default Quota</h3>
+        <p style="color: #666; margin-bottom: 20px;">%s &mdash; applies to new mailboxes and to mailboxes using the current default</p>
+        <form hx-put="%s/quota" hx-target="#user-list" hx-swap="innerHTML">
+            <div class="form-group">
+                <label for="quota">Default Quota</label>
+                <input type="text" id="quota" name="quota" value="%s" placeholder="e.g. 2G, empty for no default">
+            </div>
+            <div class="modal-footer">
+                <button type="button" class="btn btn-secondary" onclick="this.closest('.modal-overlay').remove()">Cancel</button>
+                <button type="submit" class="btn btn-primary">Save Default</button>
+            </div>
+        </form>
+    </div>
+</div>`,
+		html.EscapeString(domain),
+		domainPath(r, domain),
+		html.EscapeString(value))))
+}
+
+// UpdateDomainQuota sets the default quota of a domain
+func UpdateDomainQuota(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	quota := strings.TrimSpace(r.FormValue("quota"))
+
+	if domain == "" {
+		http.Error(w, "Domain required", http.StatusBadRequest)
+		return
+	}
+
+	if mailFor(r) == nil {
+		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+
+	var bytes int64
+	if quota != "" {
+		var err error
+		bytes, err = services.ParseQuota(quota)
+		if err != nil {
+			w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+			return
+		}
+	}
+
+	if err := mailFor(r).SetDomainQuota(domain, bytes); err != nil {
+		log.Printf("Error setting default quota for %s: %v", domain, err)
+		LogAuditError(r, "set_domain_quota", domain, err)
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+
+	log.Printf("Default quota for %s set to %s", domain, services.FormatQuota(bytes))
+	LogAudit(r, "set_domain_quota", domain, "success", services.FormatQuota(bytes))
+
+	// Return updated list
+	ListUsersPartial(w, r)
+}
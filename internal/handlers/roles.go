@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/middleware"
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/Ingasti/mailhub-admin/internal/templates"
+	"github.com/go-chi/chi/v5"
+)
+
+// roleDescriptions explain each role on the management page
+var roleDescriptions = map[string]string{
+	services.RoleSuperadmin:  "everything, including domains, Rspamd, host keys and roles",
+	services.RoleDomainAdmin: "mailboxes, aliases, quotas and passwords of the listed domains",
+	services.RoleHelpdesk:    "view mailboxes and reset passwords in every domain",
+	services.RoleReadOnly:    "view domains, mailboxes, Rspamd and the audit log",
+}
+
+// RolesPage renders the role management page
+func RolesPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	var options, legend strings.Builder
+	for _, role := range services.Roles {
+		options.WriteString(fmt.Sprintf(`<option value="%s">%s</option>`, role, role))
+		legend.WriteString(fmt.Sprintf(`<li><strong>%s</strong> &mdash; %s</li>`, role, roleDescriptions[role]))
+	}
+
+	content := `
+<div class="card">
+    <a href="/" class="nav-link"><i class="la la-arrow-left"></i> Back to Dashboard</a>
+    <div class="header">
+        <h1>Roles</h1>
+        <p class="subtitle">Assign roles to SSO users</p>
+    </div>
+
+    <ul style="color: #666; font-size: 0.9rem; margin: 0 0 20px 20px;">` + legend.String() + `</ul>
+
+    <form hx-post="/settings/roles" hx-target="#role-list" hx-swap="innerHTML">
+        <div class="form-group">
+            <label for="email">SSO email</label>
+            <input type="email" id="email" name="email" placeholder="user@example.com" required>
+        </div>
+        <div class="form-group">
+            <label for="role">Role</label>
+            <select id="role" name="role">` + options.String() + `</select>
+        </div>
+        <div class="form-group">
+            <label for="domains">Domains (domain_admin only, comma separated)</label>
+            <input type="text" id="domains" name="domains" placeholder="example.com, example.org">
+        </div>
+        <button type="submit" class="btn btn-primary"><i class="la la-user-check"></i> Assign Role</button>
+    </form>
+
+    <div id="role-list" hx-get="/settings/roles/list" hx-trigger="load" hx-swap="innerHTML" style="margin-top: 20px;">
+        <div class="empty-state">
+            <i class="la la-spinner la-spin"></i>
+            <p>Loading roles...</p>
+        </div>
+    </div>
+</div>`
+
+	templates.RenderPage(w, "Roles", content)
+}
+
+// RolesPartial returns the role assignments as HTML partial (for HTMX)
+func RolesPartial(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	if h == nil || h.Roles == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Role service not initialized</div>`))
+		return
+	}
+
+	renderRoles(w, r, "")
+}
+
+// AssignRole sets the role of an SSO user
+func AssignRole(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimSpace(r.FormValue("email"))
+	role := r.FormValue("role")
+	domains := strings.Split(r.FormValue("domains"), ",")
+
+	if email == "" || role == "" {
+		http.Error(w, "Email and role required", http.StatusBadRequest)
+		return
+	}
+
+	if h == nil || h.Roles == nil {
+		http.Error(w, "Role service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	authUser := middleware.GetAuthUser(r).Email
+	w.Header().Set("Content-Type", "text/html")
+	assignment, err := h.Roles.Assign(email, role, domains, authUser)
+	if err != nil {
+		log.Printf("Error assigning role %s to %s: %v", role, email, err)
+		LogAuditError(r, "assign_role", email, err)
+		renderRoles(w, r, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	details := "role=" + assignment.Role
+	if len(assignment.Domains) > 0 {
+		details += " domains=" + strings.Join(assignment.Domains, ",")
+	}
+	log.Printf("Role of %s set to %s by %s", assignment.Email, assignment.Role, authUser)
+	LogAudit(r, "assign_role", assignment.Email, "success", details)
+
+	renderRoles(w, r, `<div class="success-msg"><i class="la la-check-circle"></i> Role assigned.</div>`)
+}
+
+// RemoveRole revokes the role of an SSO user
+func RemoveRole(w http.ResponseWriter, r *http.Request) {
+	email, err := url.PathUnescape(chi.URLParam(r, "email"))
+	if err != nil || email == "" {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+
+	if h == nil || h.Roles == nil {
+		http.Error(w, "Role service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	authUser := middleware.GetAuthUser(r).Email
+	w.Header().Set("Content-Type", "text/html")
+	if err := h.Roles.Remove(email, authUser); err != nil {
+		log.Printf("Error removing role of %s: %v", email, err)
+		LogAuditError(r, "remove_role", email, err)
+		renderRoles(w, r, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	log.Printf("Role of %s removed by %s", email, authUser)
+	LogAudit(r, "remove_role", email, "success", "")
+
+	renderRoles(w, r, `<div class="success-msg"><i class="la la-check-circle"></i> Role removed.</div>`)
+}
+
+// renderRoles writes the role table, preceded by an optional message
+func renderRoles(w http.ResponseWriter, r *http.Request, message string) {
+	assignments, err := h.Roles.List()
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf(`%s<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, message, html.EscapeString(err.Error()))))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(message)
+	sb.WriteString(`
+<table>
+    <thead>
+        <tr>
+            <th>User</th>
+            <th>Role</th>
+            <th>Domains</th>
+            <th>Changed</th>
+            <th>Actions</th>
+        </tr>
+    </thead>
+    <tbody>`)
+
+	self := middleware.GetAuthUser(r).Email
+	for _, a := range assignments {
+		changed := `<span class="badge badge-info">CMH_SUPERADMINS</span>`
+		action := ""
+		if !a.Bootstrap {
+			changed = fmt.Sprintf(`%s<br><span style="font-size: 0.85rem; color: #666;">by %s</span>`,
+				a.UpdatedAt.Local().Format("2006-01-02 15:04"), html.EscapeString(a.UpdatedBy))
+			if !strings.EqualFold(a.Email, self) {
+				action = fmt.Sprintf(`
+                <button class="btn btn-danger btn-sm"
+                        hx-delete="/settings/roles/%s"
+                        hx-target="#role-list"
+                        hx-swap="innerHTML"
+                        hx-confirm="Remove the role of %s?">
+                    <i class="la la-user-times"></i>
+                </button>`, html.EscapeString(url.PathEscape(a.Email)), html.EscapeString(a.Email))
+			}
+		}
+
+		domains := "all"
+		if a.Role == services.RoleDomainAdmin {
+			domains = html.EscapeString(strings.Join(a.Domains, ", "))
+		}
+
+		sb.WriteString(fmt.Sprintf(`
+        <tr>
+            <td><strong>%s</strong></td>
+            <td><span class="badge badge-info">%s</span></td>
+            <td>%s</td>
+            <td>%s</td>
+            <td class="actions">%s</td>
+        </tr>`,
+			html.EscapeString(a.Email),
+			html.EscapeString(a.Role),
+			domains,
+			changed,
+			action))
+	}
+
+	sb.WriteString(`
+    </tbody>
+</table>`)
+
+	w.Write([]byte(sb.String()))
+}
@@ -2,18 +2,40 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/Ingasti/mailhub-admin/internal/services"
 	"github.com/Ingasti/mailhub-admin/internal/templates"
 )
 
+// rspamdFor returns the Rspamd service of the request's server, with its
+// controller client when the server is reached through SSH
+func rspamdFor(r *http.Request) *services.RspamdService {
+	rspamd := services.NewRspamdService(executorFor(r))
+	if srv := serverFrom(r); srv != nil {
+		rspamd.WithController(srv.RspamdController())
+	}
+	return rspamd
+}
+
 // HandleRspamdDashboard renders the Rspamd dashboard page
 func HandleRspamdDashboard(w http.ResponseWriter, r *http.Request) {
+	page := templates.RspamdDashboardHTML
+	if !can(r, services.PermManageServer, "") {
+		// Read-only users see status, metrics and logs but no controls
+		page = strings.Replace(page, "</head>", "<style>.requires-manage { display: none !important; }</style>\n</head>", 1)
+	}
+	// Call back into the server this page was opened for
+	page = strings.Replace(page, "const API_BASE = '/rspamd';", "const API_BASE = '"+serverBase(r)+"/rspamd';", 1)
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(templates.RspamdDashboardHTML))
+	w.Write([]byte(page))
 }
 
 // RspamdResponse wraps API responses
@@ -26,8 +48,7 @@ type RspamdResponse struct {
 
 // HandleRspamdStatus returns the current Rspamd status
 func HandleRspamdStatus(w http.ResponseWriter, r *http.Request) {
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
 	status, err := rspamd.GetStatus()
 	if err != nil {
@@ -50,8 +71,7 @@ func HandleRspamdStatus(w http.ResponseWriter, r *http.Request) {
 
 // HandleRspamdMetrics returns Rspamd performance metrics
 func HandleRspamdMetrics(w http.ResponseWriter, r *http.Request) {
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
 	metrics, err := rspamd.GetMetrics()
 	if err != nil {
@@ -74,8 +94,7 @@ func HandleRspamdMetrics(w http.ResponseWriter, r *http.Request) {
 
 // HandleRspamdConfig returns the current Rspamd configuration
 func HandleRspamdConfig(w http.ResponseWriter, r *http.Request) {
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
 	config, err := rspamd.GetConfig()
 	if err != nil {
@@ -119,10 +138,13 @@ func HandleRspamdConfigUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
+	details := fmt.Sprintf("worker_max_tasks=%d worker_count=%d worker_timeout=%d redis_memory=%s spf=%t dkim=%t surbl=%t fuzzy=%t",
+		config.WorkerMaxTasks, config.WorkerCount, config.WorkerTimeout, config.RedisMemory,
+		config.SPFEnabled, config.DKIMEnabled, config.SURBLEnabled, config.FuzzyEnabled)
 	if err := rspamd.UpdateConfig(&config); err != nil {
+		LogAuditError(r, "update_rspamd_config", "rspamd", err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(RspamdResponse{
@@ -132,6 +154,8 @@ func HandleRspamdConfigUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	LogAudit(r, "update_rspamd_config", "rspamd", "success", details)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(RspamdResponse{
@@ -142,8 +166,7 @@ func HandleRspamdConfigUpdate(w http.ResponseWriter, r *http.Request) {
 
 // HandleRspamdWhitelist returns the SPF whitelist
 func HandleRspamdWhitelist(w http.ResponseWriter, r *http.Request) {
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
 	whitelist, err := rspamd.GetWhitelist()
 	if err != nil {
@@ -189,10 +212,10 @@ func HandleRspamdWhitelistAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
 	if err := rspamd.AddToWhitelist(req.Entry); err != nil {
+		LogAuditError(r, "rspamd_whitelist_add", req.Entry, err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(RspamdResponse{
@@ -202,6 +225,8 @@ func HandleRspamdWhitelistAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	LogAudit(r, "rspamd_whitelist_add", req.Entry, "success", "")
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(RspamdResponse{
@@ -235,10 +260,10 @@ func HandleRspamdWhitelistRemove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
 	if err := rspamd.RemoveFromWhitelist(req.Entry); err != nil {
+		LogAuditError(r, "rspamd_whitelist_remove", req.Entry, err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(RspamdResponse{
@@ -248,6 +273,8 @@ func HandleRspamdWhitelistRemove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	LogAudit(r, "rspamd_whitelist_remove", req.Entry, "success", "")
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(RspamdResponse{
@@ -267,8 +294,7 @@ func HandleRspamdLogs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
 	logs, err := rspamd.GetLogs(lines)
 	if err != nil {
@@ -289,6 +315,105 @@ func HandleRspamdLogs(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// HandleRspamdHistory returns the recent scans from the controller,
+// filtered by action and score range (?action=reject&min_score=5&max_score=15)
+func HandleRspamdHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := services.RspamdHistoryFilter{Action: strings.TrimSpace(q.Get("action"))}
+	for param, bound := range map[string]**float64{"min_score": &filter.MinScore, "max_score": &filter.MaxScore} {
+		v := strings.TrimSpace(q.Get(param))
+		if v == "" {
+			continue
+		}
+		score, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(RspamdResponse{
+				Success: false,
+				Error:   "invalid " + param + ": " + v,
+			})
+			return
+		}
+		*bound = &score
+	}
+
+	rspamd := rspamdFor(r)
+
+	history, err := rspamd.GetHistory(filter)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrInvalid) {
+			status = http.StatusBadRequest
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(RspamdResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(RspamdResponse{
+		Success: true,
+		Data:    history,
+	})
+}
+
+// HandleRspamdLearn trains the Bayes classifier with an uploaded .eml file
+// (multipart fields "message" and "class", spam or ham)
+func HandleRspamdLearn(w http.ResponseWriter, r *http.Request) {
+	class := r.FormValue("class")
+	action := learnAuditAction(class)
+
+	file, header, err := r.FormFile("message")
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(RspamdResponse{
+			Success: false,
+			Error:   "no message uploaded",
+		})
+		return
+	}
+	defer file.Close()
+	target := "upload:" + header.Filename
+
+	message, err := io.ReadAll(io.LimitReader(file, services.MaxLearnSize+1))
+	if err == nil {
+		err = rspamdFor(r).Learn(class, message)
+	}
+	if err != nil {
+		LogAuditError(r, action, target, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrInvalid) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, services.ErrExists) {
+			status = http.StatusConflict
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(RspamdResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	messageID, _ := services.ParseLearnMessage(message)
+	LogAudit(r, action, target, "success", fmt.Sprintf("size=%d message_id=%s", len(message), messageID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(RspamdResponse{
+		Success: true,
+		Message: "Message learned as " + class,
+	})
+}
+
 // HandleRspamdServiceStart starts the Rspamd service
 func HandleRspamdServiceStart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -301,10 +426,10 @@ func HandleRspamdServiceStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
 	if err := rspamd.StartService(); err != nil {
+		LogAuditError(r, "rspamd_start", "rspamd", err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(RspamdResponse{
@@ -314,6 +439,8 @@ func HandleRspamdServiceStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	LogAudit(r, "rspamd_start", "rspamd", "success", "")
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(RspamdResponse{
@@ -334,10 +461,10 @@ func HandleRspamdServiceStop(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
 	if err := rspamd.StopService(); err != nil {
+		LogAuditError(r, "rspamd_stop", "rspamd", err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(RspamdResponse{
@@ -347,6 +474,8 @@ func HandleRspamdServiceStop(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	LogAudit(r, "rspamd_stop", "rspamd", "success", "")
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(RspamdResponse{
@@ -367,10 +496,10 @@ func HandleRspamdServiceRestart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
 	if err := rspamd.RestartService(); err != nil {
+		LogAuditError(r, "rspamd_restart", "rspamd", err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(RspamdResponse{
@@ -380,6 +509,8 @@ func HandleRspamdServiceRestart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	LogAudit(r, "rspamd_restart", "rspamd", "success", "")
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(RspamdResponse{
@@ -390,8 +521,7 @@ func HandleRspamdServiceRestart(w http.ResponseWriter, r *http.Request) {
 
 // HandleRspamdExport exports all metrics as JSON
 func HandleRspamdExport(w http.ResponseWriter, r *http.Request) {
-	h := GetHandler()
-	rspamd := services.NewRspamdService(h.Mail.GetSSHClient())
+	rspamd := rspamdFor(r)
 
 	data, err := rspamd.ExportMetricsJSON()
 	if err != nil {
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/middleware"
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/Ingasti/mailhub-admin/internal/templates"
+	"github.com/go-chi/chi/v5"
+)
+
+type serverKey struct{}
+
+// serverCookie remembers the last server opened through a /servers/{server}
+// URL, for the unprefixed routes
+const serverCookie = "mailhub_server"
+
+// SelectServer picks the mail server a request works on: the {server} URL
+// parameter, else the server remembered in the cookie, else the default
+// server. An unknown {server} is a 404; an explicit one is remembered.
+func SelectServer(next http.Handler) http.Handler {
+	return selectServer(next, func(w http.ResponseWriter, err error) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	})
+}
+
+func selectServer(next http.Handler, unknown func(w http.ResponseWriter, err error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h == nil || h.Servers == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var srv *services.Server
+		if name := chi.URLParam(r, "server"); name != "" {
+			s, err := h.Servers.Get(name)
+			if err != nil {
+				unknown(w, err)
+				return
+			}
+			srv = s
+			http.SetCookie(w, &http.Cookie{
+				Name:     serverCookie,
+				Value:    srv.Name,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		} else if c, err := r.Cookie(serverCookie); err == nil {
+			srv, _ = h.Servers.Get(c.Value)
+		}
+		if srv == nil {
+			srv = h.Servers.Default()
+		}
+		if srv == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), serverKey{}, srv)))
+	})
+}
+
+// serverFrom returns the server selected for the request, or nil
+func serverFrom(r *http.Request) *services.Server {
+	srv, _ := r.Context().Value(serverKey{}).(*services.Server)
+	return srv
+}
+
+// serverBase returns the path prefix of the request's server, e.g.
+// "/servers/cmh", so that links keep working on the same server
+func serverBase(r *http.Request) string {
+	if srv := serverFrom(r); srv != nil {
+		return "/servers/" + srv.Name
+	}
+	return ""
+}
+
+// domainPath returns the escaped URL of a domain on the request's server
+func domainPath(r *http.Request, domain string) string {
+	return html.EscapeString(serverBase(r) + "/domains/" + domain)
+}
+
+// serverSwitcher renders a drop-down that opens the dashboard of another
+// server, or nothing if there is only one
+func serverSwitcher(r *http.Request) string {
+	if h == nil || h.Servers == nil {
+		return ""
+	}
+	servers, err := h.Servers.Servers()
+	if err != nil || len(servers) < 2 {
+		return ""
+	}
+
+	current := serverFrom(r)
+	var sb strings.Builder
+	sb.WriteString(`
+    <div class="form-group" style="max-width: 320px; margin: 0 auto 20px;">
+        <label for="server-switch"><i class="la la-server"></i> Mail server</label>
+        <select id="server-switch" onchange="window.location.href = '/servers/' + this.value + '/'">`)
+	for _, s := range servers {
+		selected := ""
+		if current != nil && current.Name == s.Name {
+			selected = " selected"
+		}
+		sb.WriteString(fmt.Sprintf(`
+            <option value="%s"%s>%s (%s)</option>`,
+			html.EscapeString(s.Name), selected, html.EscapeString(s.Name), html.EscapeString(s.Host)))
+	}
+	sb.WriteString(`
+        </select>
+    </div>`)
+	return sb.String()
+}
+
+// ServersPage renders the server inventory page
+func ServersPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	addForm := ""
+	if can(r, services.PermManageServer, "") {
+		addForm = `
+    <form hx-post="/settings/servers" hx-target="#server-list" hx-swap="innerHTML">
+        <div class="form-group">
+            <label for="name">Name</label>
+            <input type="text" id="name" name="name" placeholder="cmh2" required pattern="[a-z0-9][a-z0-9-]{0,31}">
+        </div>
+        <div class="form-group">
+            <label for="host">SSH host</label>
+            <input type="text" id="host" name="host" placeholder="10.0.0.2" required>
+        </div>
+        <div class="form-group">
+            <label for="port">SSH port</label>
+            <input type="number" id="port" name="port" placeholder="22" min="1" max="65535">
+        </div>
+        <div class="form-group">
+            <label for="user">SSH user (empty for the default)</label>
+            <input type="text" id="user" name="user">
+        </div>
+        <div class="form-group">
+            <label for="key_path">SSH key path (empty for the default)</label>
+            <input type="text" id="key_path" name="key_path">
+        </div>
+        <div class="form-group">
+            <label for="jump_host">Jump host (empty for the default)</label>
+            <input type="text" id="jump_host" name="jump_host">
+        </div>
+        <div class="form-group">
+            <label for="host_fingerprint">Host key fingerprint (SHA256:..., optional)</label>
+            <input type="text" id="host_fingerprint" name="host_fingerprint">
+        </div>
+        <div class="form-group">
+            <label for="rspamd_password">Rspamd controller password (empty for the default)</label>
+            <input type="password" id="rspamd_password" name="rspamd_password" autocomplete="off">
+        </div>
+        <button type="submit" class="btn btn-primary"><i class="la la-plus"></i> Add Server</button>
+    </form>`
+	}
+
+	content := `
+<div class="card">
+    <a href="/" class="nav-link"><i class="la la-arrow-left"></i> Back to Dashboard</a>
+    <div class="header">
+        <h1>Mail Servers</h1>
+        <p class="subtitle">Mail hubs managed from this console</p>
+    </div>
+` + addForm + `
+
+    <div id="server-list" hx-get="/settings/servers/list" hx-trigger="load" hx-swap="innerHTML" style="margin-top: 20px;">
+        <div class="empty-state">
+            <i class="la la-spinner la-spin"></i>
+            <p>Loading servers...</p>
+        </div>
+    </div>
+</div>`
+
+	templates.RenderPage(w, "Mail Servers", content)
+}
+
+// ServersPartial returns the server list as HTML partial (for HTMX)
+func ServersPartial(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	if h == nil || h.Servers == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Server inventory not initialized</div>`))
+		return
+	}
+
+	renderServers(w, r, "")
+}
+
+// AddServer stores a new server in the database
+func AddServer(w http.ResponseWriter, r *http.Request) {
+	if h == nil || h.Servers == nil {
+		http.Error(w, "Server inventory not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	spec := services.ServerSpec{
+		Name:            r.FormValue("name"),
+		Host:            r.FormValue("host"),
+		User:            strings.TrimSpace(r.FormValue("user")),
+		KeyPath:         strings.TrimSpace(r.FormValue("key_path")),
+		JumpHost:        strings.TrimSpace(r.FormValue("jump_host")),
+		HostFingerprint: strings.TrimSpace(r.FormValue("host_fingerprint")),
+		RspamdPassword:  r.FormValue("rspamd_password"),
+	}
+	if v := strings.TrimSpace(r.FormValue("port")); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid port", http.StatusBadRequest)
+			return
+		}
+		spec.Port = port
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	srv, err := h.Servers.Add(spec, middleware.GetAuthUser(r).Email)
+	if err != nil {
+		log.Printf("Error adding server %s: %v", spec.Name, err)
+		LogAuditError(r, "add_server", spec.Name, err)
+		renderServers(w, r, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	log.Printf("Server added: %s (%s)", srv.Name, srv.Host)
+	LogAudit(r, "add_server", srv.Name, "success", "host="+srv.Host)
+
+	renderServers(w, r, fmt.Sprintf(`<div class="success-msg"><i class="la la-check-circle"></i> Server <strong>%s</strong> added. Trust its host key under Host Keys before managing it.</div>`,
+		html.EscapeString(srv.Name)))
+}
+
+// RemoveServer deletes a server added from the UI
+func RemoveServer(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if h == nil || h.Servers == nil {
+		http.Error(w, "Server inventory not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	srv, err := h.Servers.Remove(name)
+	if err != nil {
+		log.Printf("Error removing server %s: %v", name, err)
+		LogAuditError(r, "remove_server", name, err)
+		renderServers(w, r, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	log.Printf("Server removed: %s", srv.Name)
+	LogAudit(r, "remove_server", srv.Name, "success", "host="+srv.Host)
+
+	renderServers(w, r, `<div class="success-msg"><i class="la la-check-circle"></i> Server removed.</div>`)
+}
+
+// renderServers writes the server table, preceded by an optional message
+func renderServers(w http.ResponseWriter, r *http.Request, message string) {
+	servers, err := h.Servers.Servers()
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf(`%s<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, message, html.EscapeString(err.Error()))))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(message)
+	if len(servers) == 0 {
+		sb.WriteString(`
+<div class="empty-state">
+    <i class="la la-server"></i>
+    <p>No servers configured</p>
+</div>`)
+		w.Write([]byte(sb.String()))
+		return
+	}
+
+	sb.WriteString(`
+<table>
+    <thead>
+        <tr>
+            <th>Server</th>
+            <th>SSH</th>
+            <th>Jump host</th>
+            <th>Defined in</th>
+            <th>Actions</th>
+        </tr>
+    </thead>
+    <tbody>`)
+	manage := can(r, services.PermManageServer, "")
+	for _, s := range servers {
+		spec := s.Spec()
+		actions := fmt.Sprintf(`
+                <a href="/servers/%s/" class="btn btn-secondary btn-sm" title="Open">
+                    <i class="la la-external-link-alt"></i>
+                </a>`, html.EscapeString(s.Name))
+		if manage && s.Source == services.ServerSourceDatabase {
+			actions += fmt.Sprintf(`
+                <button class="btn btn-danger btn-sm"
+                        hx-delete="/settings/servers/%s"
+                        hx-target="#server-list"
+                        hx-swap="innerHTML"
+                        hx-confirm="Remove server %s?">
+                    <i class="la la-trash"></i>
+                </button>`, html.EscapeString(s.Name), html.EscapeString(s.Name))
+		}
+		jump := spec.JumpHost
+		if jump == "" {
+			jump = "&mdash;"
+		} else {
+			jump = html.EscapeString(spec.JumpUser + "@" + jump)
+		}
+		sb.WriteString(fmt.Sprintf(`
+        <tr>
+            <td><i class="la la-server" style="color: #1a73e8; margin-right: 6px;"></i><strong>%s</strong></td>
+            <td><code>%s</code></td>
+            <td><code>%s</code></td>
+            <td><span class="badge badge-info">%s</span></td>
+            <td class="actions">%s
+            </td>
+        </tr>`,
+			html.EscapeString(s.Name),
+			html.EscapeString(fmt.Sprintf("%s@%s:%d", spec.User, spec.Host, spec.Port)),
+			jump,
+			s.Source,
+			actions))
+	}
+	sb.WriteString(`
+    </tbody>
+</table>`)
+
+	w.Write([]byte(sb.String()))
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ingasti/mailhub-admin/internal/middleware"
+	"github.com/Ingasti/mailhub-admin/internal/templates"
+	"github.com/go-chi/chi/v5"
+)
+
+// tokenLifetimes are the expiry choices offered when creating a token
+var tokenLifetimes = []struct {
+	Days  int
+	Label string
+}{
+	{7, "7 days"},
+	{30, "30 days"},
+	{90, "90 days"},
+	{365, "1 year"},
+}
+
+// TokensPage renders the API token settings page
+func TokensPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	var lifetimes strings.Builder
+	for _, l := range tokenLifetimes {
+		selected := ""
+		if l.Days == 90 {
+			selected = " selected"
+		}
+		lifetimes.WriteString(fmt.Sprintf(`<option value="%d"%s>%s</option>`, l.Days, selected, l.Label))
+	}
+
+	content := `
+<div class="card">
+    <a href="/" class="nav-link"><i class="la la-arrow-left"></i> Back to Dashboard</a>
+    <div class="header">
+        <h1>API Tokens</h1>
+        <p class="subtitle">Personal tokens for the JSON API at /api/v1</p>
+    </div>
+
+    <form hx-post="/settings/tokens" hx-target="#token-list" hx-swap="innerHTML">
+        <div class="form-group">
+            <label for="name">Token name</label>
+            <input type="text" id="name" name="name" placeholder="e.g. provisioning script" required maxlength="64">
+        </div>
+        <div class="form-group">
+            <label>Scopes</label>
+            <label style="font-weight: normal;"><input type="checkbox" name="scope" value="read" checked> read &mdash; list domains, mailboxes, aliases and the audit log</label>
+            <label style="font-weight: normal;"><input type="checkbox" name="scope" value="write"> write &mdash; create, change and delete (includes read)</label>
+        </div>
+        <div class="form-group">
+            <label for="expires">Expires after</label>
+            <select id="expires" name="expires">` + lifetimes.String() + `</select>
+        </div>
+        <button type="submit" class="btn btn-primary"><i class="la la-plus"></i> Create Token</button>
+    </form>
+
+    <div id="token-list" hx-get="/settings/tokens/list" hx-trigger="load" hx-swap="innerHTML" style="margin-top: 20px;">
+        <div class="empty-state">
+            <i class="la la-spinner la-spin"></i>
+            <p>Loading tokens...</p>
+        </div>
+    </div>
+</div>`
+
+	templates.RenderPage(w, "API Tokens", content)
+}
+
+// TokensPartial returns the current user's tokens as HTML partial (for HTMX)
+func TokensPartial(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+
+	if h == nil || h.Tokens == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Token service not initialized</div>`))
+		return
+	}
+
+	renderTokens(w, middleware.GetAuthUser(r).Email, "")
+}
+
+// CreateToken issues a token for the current user and shows it once
+func CreateToken(w http.ResponseWriter, r *http.Request) {
+	if h == nil || h.Tokens == nil {
+		http.Error(w, "Token service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	owner := middleware.GetAuthUser(r).Email
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	days, _ := strconv.Atoi(r.FormValue("expires"))
+
+	w.Header().Set("Content-Type", "text/html")
+	plaintext, token, err := h.Tokens.Create(owner, name, r.Form["scope"], time.Duration(days)*24*time.Hour)
+	if err != nil {
+		log.Printf("Error creating API token %q for %s: %v", name, owner, err)
+		LogAuditError(r, "create_api_token", name, err)
+		renderTokens(w, owner, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	log.Printf("API token %s created for %s", token.Prefix, owner)
+	LogAudit(r, "create_api_token", token.Name, "success",
+		fmt.Sprintf("prefix=%s scopes=%s expires=%s", token.Prefix, strings.Join(token.Scopes, ","), token.ExpiresAt.Format("2006-01-02")))
+
+	renderTokens(w, owner, fmt.Sprintf(`
+<div class="success-msg">
+    <i class="la la-check-circle"></i> Token <strong>%s</strong> created. Copy it now &mdash; it will not be shown again.
+    <p style="margin-top: 10px;"><code style="user-select: all; word-break: break-all;">%s</code></p>
+</div>`, html.EscapeString(token.Name), html.EscapeString(plaintext)))
+}
+
+// RevokeToken revokes one of the current user's tokens
+func RevokeToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid token id", http.StatusBadRequest)
+		return
+	}
+
+	if h == nil || h.Tokens == nil {
+		http.Error(w, "Token service not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	owner := middleware.GetAuthUser(r).Email
+	w.Header().Set("Content-Type", "text/html")
+	token, err := h.Tokens.Revoke(owner, id)
+	if err != nil {
+		log.Printf("Error revoking API token %d for %s: %v", id, owner, err)
+		LogAuditError(r, "revoke_api_token", strconv.FormatInt(id, 10), err)
+		renderTokens(w, owner, fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error())))
+		return
+	}
+
+	log.Printf("API token %s revoked by %s", token.Prefix, owner)
+	LogAudit(r, "revoke_api_token", token.Name, "success", "prefix="+token.Prefix)
+
+	renderTokens(w, owner, `<div class="success-msg"><i class="la la-check-circle"></i> Token revoked.</div>`)
+}
+
+// renderTokens writes the token table of owner, preceded by an optional message
+func renderTokens(w http.ResponseWriter, owner, message string) {
+	tokens, err := h.Tokens.List(owner)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf(`%s<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, message, html.EscapeString(err.Error()))))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(message)
+
+	if len(tokens) == 0 {
+		sb.WriteString(`
+<div class="empty-state">
+    <i class="la la-key"></i>
+    <p>No API tokens yet</p>
+</div>`)
+		w.Write([]byte(sb.String()))
+		return
+	}
+
+	sb.WriteString(`
+<table>
+    <thead>
+        <tr>
+            <th>Name</th>
+            <th>Token</th>
+            <th>Scopes</th>
+            <th>Expires</th>
+            <th>Last used</th>
+            <th>Actions</th>
+        </tr>
+    </thead>
+    <tbody>`)
+
+	now := time.Now()
+	for _, t := range tokens {
+		lastUsed := "never"
+		if !t.LastUsedAt.IsZero() {
+			lastUsed = t.LastUsedAt.Local().Format("2006-01-02 15:04")
+		}
+
+		expires := t.ExpiresAt.Local().Format("2006-01-02")
+		action := fmt.Sprintf(`
+                <button class="btn btn-danger btn-sm"
+                        hx-delete="/settings/tokens/%d"
+                        hx-target="#token-list"
+                        hx-swap="innerHTML"
+                        hx-confirm="Revoke token %s?">
+                    <i class="la la-ban"></i>
+                </button>`, t.ID, html.EscapeString(t.Name))
+		switch {
+		case !t.RevokedAt.IsZero():
+			expires = `<span class="badge badge-danger">revoked</span>`
+			action = ""
+		case !t.Active(now):
+			expires += ` <span class="badge badge-warning">expired</span>`
+			action = ""
+		}
+
+		sb.WriteString(fmt.Sprintf(`
+        <tr>
+            <td><strong>%s</strong></td>
+            <td><code>%s_…</code></td>
+            <td>%s</td>
+            <td>%s</td>
+            <td>%s</td>
+            <td class="actions">%s</td>
+        </tr>`,
+			html.EscapeString(t.Name),
+			html.EscapeString(t.Prefix),
+			html.EscapeString(strings.Join(t.Scopes, ", ")),
+			expires,
+			lastUsed,
+			action))
+	}
+
+	sb.WriteString(`
+    </tbody>
+</table>`)
+
+	w.Write([]byte(sb.String()))
+}
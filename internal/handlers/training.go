@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/Ingasti/mailhub-admin/internal/templates"
+	"github.com/go-chi/chi/v5"
+)
+
+// trainingListLimit is the number of messages listed per folder
+const trainingListLimit = 100
+
+// TrainingPage renders the Bayes training page of a mailbox: messages of
+// its Junk and Inbox folders that can be learned as ham or spam
+func TrainingPage(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	user := chi.URLParam(r, "user")
+	email := user + "@" + domain
+	base := fmt.Sprintf("%s/users/%s/training", domainPath(r, domain), html.EscapeString(user))
+	w.Header().Set("Content-Type", "text/html")
+
+	var folders strings.Builder
+	for _, folder := range services.TrainingFolders {
+		folders.WriteString(fmt.Sprintf(`
+        <button class="btn btn-secondary" hx-get="%s/messages?folder=%s" hx-target="#training-list" hx-swap="innerHTML">
+            <i class="la la-folder-open" style="margin-right: 8px;"></i> %s
+        </button>`, base, folder, folder))
+	}
+
+	content := fmt.Sprintf(`
+<div class="card">
+    <a href="%s/users" class="nav-link"><i class="la la-arrow-left"></i> Back to Users</a>
+    <div class="header">
+        <h1>Spam Training: %s</h1>
+        <p class="subtitle">Teach Rspamd's Bayes filter with messages it got wrong: ham that landed in Junk, spam that reached the Inbox</p>
+    </div>
+    <div style="display: flex; gap: 10px;">%s
+    </div>
+
+    <div id="training-list" hx-get="%s/messages?folder=Junk" hx-trigger="load" hx-swap="innerHTML" style="margin-top: 20px;">
+        <div class="empty-state">
+            <i class="la la-spinner la-spin"></i>
+            <p>Loading messages...</p>
+        </div>
+    </div>
+</div>`,
+		domainPath(r, domain),
+		html.EscapeString(email),
+		folders.String(),
+		base)
+
+	templates.RenderPage(w, "Spam Training - "+email, content)
+}
+
+// TrainingMessagesPartial lists the newest messages of a folder as HTML
+// partial (for HTMX)
+func TrainingMessagesPartial(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	user := chi.URLParam(r, "user")
+	email := user + "@" + domain
+	folder := r.URL.Query().Get("folder")
+	w.Header().Set("Content-Type", "text/html")
+
+	if mailFor(r) == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Mail service not initialized</div>`))
+		return
+	}
+
+	messages, err := mailFor(r).FolderMessages(email, folder, trainingListLimit)
+	if err != nil {
+		log.Printf("Error listing %s of %s: %v", folder, email, err)
+		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
+		return
+	}
+	if len(messages) == 0 {
+		w.Write([]byte(fmt.Sprintf(`
+<div class="empty-state">
+    <i class="la la-inbox"></i>
+    <p>%s is empty</p>
+</div>`, html.EscapeString(folder))))
+		return
+	}
+
+	// Junk holds the filter's false positives, the Inbox its misses
+	suggested := services.BayesHam
+	if folder != "Junk" {
+		suggested = services.BayesSpam
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf(`
+<p>Newest %d messages in <strong>%s</strong></p>
+<table>
+    <thead>
+        <tr>
+            <th>Received</th>
+            <th>From</th>
+            <th>Subject</th>
+            <th>Size</th>
+            <th>Learn as</th>
+        </tr>
+    </thead>
+    <tbody>`, len(messages), html.EscapeString(folder)))
+
+	for _, m := range messages {
+		var buttons strings.Builder
+		for _, class := range []string{services.BayesHam, services.BayesSpam} {
+			style := "btn-secondary"
+			if class == suggested {
+				style = "btn-primary"
+			}
+			buttons.WriteString(fmt.Sprintf(`
+                <button class="btn %s btn-sm"
+                        hx-post="%s/users/%s/training/learn"
+                        hx-vals='{"folder": "%s", "uid": "%d", "class": "%s"}'
+                        hx-target="closest td"
+                        hx-swap="innerHTML">%s</button>`,
+				style, domainPath(r, domain), html.EscapeString(user), html.EscapeString(folder), m.UID, class, class))
+		}
+		sb.WriteString(fmt.Sprintf(`
+        <tr>
+            <td style="white-space: nowrap;">%s</td>
+            <td>%s</td>
+            <td>%s</td>
+            <td>%s</td>
+            <td class="actions">%s
+            </td>
+        </tr>`,
+			html.EscapeString(m.Received),
+			html.EscapeString(m.From),
+			html.EscapeString(m.Subject),
+			services.FormatBytes(m.Size),
+			buttons.String()))
+	}
+	sb.WriteString(`
+    </tbody>
+</table>`)
+
+	w.Write([]byte(sb.String()))
+}
+
+// LearnMailboxMessage fetches a message from the mailbox and submits it to
+// the Bayes classifier as spam or ham
+func LearnMailboxMessage(w http.ResponseWriter, r *http.Request) {
+	domain := chi.URLParam(r, "domain")
+	user := chi.URLParam(r, "user")
+	email := user + "@" + domain
+	folder := r.FormValue("folder")
+	class := r.FormValue("class")
+	action := learnAuditAction(class)
+	w.Header().Set("Content-Type", "text/html")
+
+	if mailFor(r) == nil {
+		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Mail service not initialized</div>`))
+		return
+	}
+
+	fail := func(err error) {
+		log.Printf("Error learning message from %s of %s as %s: %v", folder, email, class, err)
+		LogAuditError(r, action, email, err)
+		w.Write([]byte(fmt.Sprintf(`<span class="badge badge-danger">failed</span> <small>%s</small>`, html.EscapeString(err.Error()))))
+	}
+
+	uid, err := strconv.Atoi(r.FormValue("uid"))
+	if err != nil {
+		fail(fmt.Errorf("invalid message UID: %q", r.FormValue("uid")))
+		return
+	}
+	message, err := mailFor(r).FetchMessage(email, folder, uid)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := rspamdFor(r).Learn(class, message); err != nil {
+		fail(err)
+		return
+	}
+
+	messageID, _ := services.ParseLearnMessage(message)
+	log.Printf("Learned message %d from %s of %s as %s", uid, folder, email, class)
+	LogAudit(r, action, email, "success", fmt.Sprintf("folder=%s uid=%d message_id=%s", folder, uid, messageID))
+
+	w.Write([]byte(fmt.Sprintf(`<span class="badge badge-success">learned as %s</span>`, html.EscapeString(class))))
+}
+
+// learnAuditAction returns the audit action of learning a message as class
+func learnAuditAction(class string) string {
+	if class == services.BayesSpam || class == services.BayesHam {
+		return "rspamd_learn_" + class
+	}
+	return "rspamd_learn"
+}
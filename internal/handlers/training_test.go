@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Ingasti/mailhub-admin/internal/config"
+	"github.com/Ingasti/mailhub-admin/internal/middleware"
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestTrainingAuditsLearning(t *testing.T) {
+	_, fake := newTestAPI(t)
+	fake.SetFile("/etc/postfix/virtual_mailbox", "bob@example.com example.com/bob/\n")
+	uid := fake.AddMessage("bob@example.com", "Junk", "From: alice@example.org\r\nSubject: Lunch?\r\nMessage-ID: <lunch@example.org>\r\n\r\nNoon?\r\n")
+
+	cfg := &config.Config{DevMode: true, DevAuthEmail: "dev@example.com"}
+	roles, err := services.NewRoleService(mustStore(t), []string{"dev@example.com"})
+	if err != nil {
+		t.Fatalf("role service: %v", err)
+	}
+	r := chi.NewRouter()
+	r.Use(middleware.Auth(cfg, middleware.AuthOptions{}))
+	r.Use(middleware.Roles(roles))
+	r.Use(SelectServer)
+	r.Get("/domains/{domain}/users/{user}/training/messages", TrainingMessagesPartial)
+	r.Post("/domains/{domain}/users/{user}/training/learn", LearnMailboxMessage)
+	r.Post("/rspamd/learn", HandleRspamdLearn)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/domains/example.com/users/bob/training/messages?folder=Junk", nil))
+	if !strings.Contains(rec.Body.String(), "Lunch?") || !strings.Contains(rec.Body.String(), "/domains/example.com/users/bob/training/learn") {
+		t.Fatalf("messages: %s", rec.Body.String())
+	}
+
+	// The fake server has no controller, so the fetched message cannot be
+	// learned, but the attempt is audited
+	form := url.Values{"folder": {"Junk"}, "uid": {"1"}, "class": {"ham"}}
+	req := httptest.NewRequest("POST", "/domains/example.com/users/bob/training/learn", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if uid != 1 || !strings.Contains(rec.Body.String(), "controller not configured") {
+		t.Errorf("learn: %s", rec.Body.String())
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("class", "spam")
+	part, _ := mw.CreateFormFile("message", "notes.txt")
+	part.Write([]byte("not a message"))
+	mw.Close()
+	req = httptest.NewRequest("POST", "/rspamd/learn", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+
+	auditSvc, err := services.GetAuditService()
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	entries, err := auditSvc.GetEntries(2)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("entries: %v %v", entries, err)
+	}
+	if e := entries[0]; e.Action != "rspamd_learn_spam" || e.Target != "upload:notes.txt" || e.Status != "failed" {
+		t.Errorf("upload entry %+v", e)
+	}
+	if e := entries[1]; e.Action != "rspamd_learn_ham" || e.Target != "bob@example.com" || e.Status != "failed" || e.User != "dev@example.com" {
+		t.Errorf("mailbox entry %+v", e)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/Ingasti/mailhub-admin/internal/services"
 	"github.com/Ingasti/mailhub-admin/internal/templates"
 	"github.com/go-chi/chi/v5"
 )
@@ -16,19 +17,40 @@ func ListUsers(w http.ResponseWriter, r *http.Request) {
 	domain := chi.URLParam(r, "domain")
 	w.Header().Set("Content-Type", "text/html")
 
+	addButton := ""
+	if can(r, services.PermManageMailboxes, domain) {
+		addButton = fmt.Sprintf(`
+    <button class="btn btn-primary" hx-get="%s/users/new" hx-target="#modal" hx-swap="innerHTML">
+        <i class="la la-user-plus" style="margin-right: 8px;"></i> Add User
+    </button>`, domainPath(r, domain))
+	}
+	quotaButton := ""
+	if can(r, services.PermManageDomains, domain) {
+		quotaButton = fmt.Sprintf(`
+    <button class="btn btn-secondary" hx-get="%s/quota" hx-target="#modal" hx-swap="innerHTML">
+        <i class="la la-hdd" style="margin-right: 8px;"></i> Domain Quota
+    </button>`, domainPath(r, domain))
+	}
+
 	content := fmt.Sprintf(`
 <div class="card">
-    <a href="/domains" class="nav-link"><i class="la la-arrow-left"></i> Back to Domains</a>
+    <a href="%s/domains" class="nav-link"><i class="la la-arrow-left"></i> Back to Domains</a>
     <div class="header">
         <h1>Users: %s</h1>
         <p class="subtitle">Manage mailboxes for this domain</p>
     </div>
+    %s
+    <a href="%s/aliases" class="btn btn-secondary">
+        <i class="la la-share" style="margin-right: 8px;"></i> Aliases
+    </a>
+    <a href="%s/dkim" class="btn btn-secondary">
+        <i class="la la-key" style="margin-right: 8px;"></i> DKIM
+    </a>
+    <a href="%s/dns" class="btn btn-secondary">
+        <i class="la la-stethoscope" style="margin-right: 8px;"></i> DNS
+    </a>%s
     
-    <button class="btn btn-primary" hx-get="/domains/%s/users/new" hx-target="#modal" hx-swap="innerHTML">
-        <i class="la la-user-plus" style="margin-right: 8px;"></i> Add User
-    </button>
-    
-    <div id="user-list" hx-get="/domains/%s/users/list" hx-trigger="load" hx-swap="innerHTML">
+    <div id="user-list" hx-get="%s/users/list" hx-trigger="load" hx-swap="innerHTML">
         <div class="empty-state">
             <i class="la la-spinner la-spin"></i>
             <p>Loading users...</p>
@@ -36,9 +58,14 @@ func ListUsers(w http.ResponseWriter, r *http.Request) {
     </div>
     <div id="modal"></div>
 </div>`,
+		serverBase(r),
 		html.EscapeString(domain),
-		html.EscapeString(domain),
-		html.EscapeString(domain))
+		addButton,
+		domainPath(r, domain),
+		domainPath(r, domain),
+		domainPath(r, domain),
+		quotaButton,
+		domainPath(r, domain))
 
 	templates.RenderPage(w, "Users - "+domain, content)
 }
@@ -48,13 +75,16 @@ func ListUsersPartial(w http.ResponseWriter, r *http.Request) {
 	domain := chi.URLParam(r, "domain")
 	w.Header().Set("Content-Type", "text/html")
 
-	if h == nil || h.Mail == nil {
+	if mailFor(r) == nil {
 		w.Write([]byte(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Mail service not initialized</div>`))
 		return
 	}
 
-	users, err := h.Mail.ListMailboxes(domain)
-	if err != nil {
+	users, err := mailFor(r).ListMailboxesWithUsage(domain)
+	if err != nil && users != nil {
+		// Usage is optional; still show the mailboxes and their quotas
+		log.Printf("Error getting quota usage for %s: %v", domain, err)
+	} else if err != nil {
 		log.Printf("Error listing users for %s: %v", domain, err)
 		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
 		return
@@ -76,6 +106,7 @@ func ListUsersPartial(w http.ResponseWriter, r *http.Request) {
     <thead>
         <tr>
             <th>Email</th>
+            <th>Quota</th>
             <th>Actions</th>
         </tr>
     </thead>
@@ -88,35 +119,60 @@ func ListUsersPartial(w http.ResponseWriter, r *http.Request) {
                 <i class="la la-envelope" style="color: #1a73e8; margin-right: 8px;"></i>
                 <strong>%s</strong>
             </td>
-            <td class="actions">
+            <td>%s</td>
+            <td class="actions">%s
+            </td>
+        </tr>`,
+			html.EscapeString(u.Email),
+			quotaCell(u),
+			userActions(r, domain, u)))
+	}
+
+	sb.WriteString(`
+    </tbody>
+</table>`)
+
+	w.Write([]byte(sb.String()))
+}
+
+// userActions returns the row buttons the current user may use
+func userActions(r *http.Request, domain string, u services.Mailbox) string {
+	var sb strings.Builder
+	if can(r, services.PermResetPassword, domain) {
+		sb.WriteString(fmt.Sprintf(`
                 <button class="btn btn-secondary btn-sm" 
-                        hx-get="/domains/%s/users/%s/edit" 
+                        hx-get="%s/users/%s/edit" 
                         hx-target="#modal" 
                         hx-swap="innerHTML">
                     <i class="la la-key"></i>
+                </button>`, domainPath(r, domain), html.EscapeString(u.Username)))
+	}
+	if can(r, services.PermTrainBayes, domain) {
+		sb.WriteString(fmt.Sprintf(`
+                <a class="btn btn-secondary btn-sm" href="%s/users/%s/training">
+                    <i class="la la-graduation-cap"></i>
+                </a>`, domainPath(r, domain), html.EscapeString(u.Username)))
+	}
+	if can(r, services.PermManageMailboxes, domain) {
+		sb.WriteString(fmt.Sprintf(`
+                <button class="btn btn-secondary btn-sm" 
+                        hx-get="%s/users/%s/quota" 
+                        hx-target="#modal" 
+                        hx-swap="innerHTML">
+                    <i class="la la-hdd"></i>
                 </button>
                 <button class="btn btn-danger btn-sm" 
-                        hx-delete="/domains/%s/users/%s" 
+                        hx-delete="%s/users/%s" 
                         hx-target="#user-list" 
                         hx-swap="innerHTML"
                         hx-confirm="Delete user %s?">
                     <i class="la la-trash"></i>
-                </button>
-            </td>
-        </tr>`,
-			html.EscapeString(u.Email),
-			html.EscapeString(domain),
-			html.EscapeString(u.Username),
-			html.EscapeString(domain),
-			html.EscapeString(u.Username),
+                </button>`,
+			domainPath(r, domain), html.EscapeString(u.Username),
+			domainPath(r, domain), html.EscapeString(u.Username),
 			html.EscapeString(u.Email)))
 	}
-
-	sb.WriteString(`
-    </tbody>
-</table>`)
-
-	w.Write([]byte(sb.String()))
+	return sb.String()
 }
 
 // NewUserForm returns the add user form
@@ -128,7 +184,7 @@ func NewUserForm(w http.ResponseWriter, r *http.Request) {
 <div class="modal-overlay" onclick="if(event.target===this) this.remove()">
     <div class="modal">
         <h3><i class="la la-user-plus" style="color: #1a73e8; margin-right: 8px;"></i>Add User to %s</h3>
-        <form hx-post="/domains/%s/users" hx-target="#user-list" hx-swap="innerHTML">
+        <form hx-post="%s/users" hx-target="#user-list" hx-swap="innerHTML">
             <div class="form-group">
                 <label for="username">Username (before @)</label>
                 <input type="text" id="username" name="username" placeholder="user" required 
@@ -146,7 +202,7 @@ func NewUserForm(w http.ResponseWriter, r *http.Request) {
     </div>
 </div>`,
 		html.EscapeString(domain),
-		html.EscapeString(domain))))
+		domainPath(r, domain))))
 }
 
 // CreateUser adds a new email user
@@ -161,27 +217,22 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if h == nil || h.Mail == nil {
+	if mailFor(r) == nil {
 		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
 		return
 	}
 
-	authUser := r.Header.Get("X-Auth-User")
-	if authUser == "" {
-		authUser = "system"
-	}
-
 	email := username + "@" + domain
-	if err := h.Mail.AddMailbox(domain, username, password); err != nil {
+	if err := mailFor(r).AddMailbox(domain, username, password); err != nil {
 		log.Printf("Error adding user %s@%s: %v", username, domain, err)
-		LogAudit(authUser, "add_user", email, "failed", err.Error())
+		LogAuditError(r, "add_user", email, err)
 		w.Header().Set("Content-Type", "text/html")
 		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
 		return
 	}
 
 	log.Printf("User added: %s@%s", username, domain)
-	LogAudit(authUser, "add_user", email, "success", "")
+	LogAudit(r, "add_user", email, "success", "")
 
 	// Return updated list
 	ListUsersPartial(w, r)
@@ -198,7 +249,7 @@ func EditUserForm(w http.ResponseWriter, r *http.Request) {
     <div class="modal">
         <h3><i class="la la-key" style="color: #1a73e8; margin-right: 8px;"></i>Change Password</h3>
         <p style="color: #666; margin-bottom: 20px;">%s@%s</p>
-        <form hx-put="/domains/%s/users/%s/password" hx-target="#user-list" hx-swap="innerHTML">
+        <form hx-put="%s/users/%s/password" hx-target="#user-list" hx-swap="innerHTML">
             <div class="form-group">
                 <label for="password">New Password</label>
                 <input type="password" id="password" name="password" required minlength="8">
@@ -212,7 +263,7 @@ func EditUserForm(w http.ResponseWriter, r *http.Request) {
 </div>`,
 		html.EscapeString(user),
 		html.EscapeString(domain),
-		html.EscapeString(domain),
+		domainPath(r, domain),
 		html.EscapeString(user))))
 }
 
@@ -227,27 +278,22 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if h == nil || h.Mail == nil {
+	if mailFor(r) == nil {
 		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
 		return
 	}
 
-	authUser := r.Header.Get("X-Auth-User")
-	if authUser == "" {
-		authUser = "system"
-	}
-
 	email := user + "@" + domain
-	if err := h.Mail.ChangePassword(domain, user, password); err != nil {
+	if err := mailFor(r).ChangePassword(domain, user, password); err != nil {
 		log.Printf("Error changing password for %s@%s: %v", user, domain, err)
-		LogAudit(authUser, "change_password", email, "failed", err.Error())
+		LogAuditError(r, "change_password", email, err)
 		w.Header().Set("Content-Type", "text/html")
 		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
 		return
 	}
 
 	log.Printf("Password changed for: %s@%s", user, domain)
-	LogAudit(authUser, "change_password", email, "success", "")
+	LogAudit(r, "change_password", email, "success", "")
 
 	// Return updated list
 	ListUsersPartial(w, r)
@@ -263,27 +309,22 @@ func DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if h == nil || h.Mail == nil {
+	if mailFor(r) == nil {
 		http.Error(w, "Mail service not initialized", http.StatusInternalServerError)
 		return
 	}
 
-	authUser := r.Header.Get("X-Auth-User")
-	if authUser == "" {
-		authUser = "system"
-	}
-
 	email := user + "@" + domain
-	if err := h.Mail.DeleteMailbox(domain, user); err != nil {
+	if err := mailFor(r).DeleteMailbox(domain, user); err != nil {
 		log.Printf("Error deleting user %s@%s: %v", user, domain, err)
-		LogAudit(authUser, "delete_user", email, "failed", err.Error())
+		LogAuditError(r, "delete_user", email, err)
 		w.Header().Set("Content-Type", "text/html")
 		w.Write([]byte(fmt.Sprintf(`<div class="error-msg"><i class="la la-exclamation-circle"></i> Error: %s</div>`, html.EscapeString(err.Error()))))
 		return
 	}
 
 	log.Printf("User deleted: %s@%s", user, domain)
-	LogAudit(authUser, "delete_user", email, "success", "")
+	LogAudit(r, "delete_user", email, "success", "")
 
 	// Return updated list
 	ListUsersPartial(w, r)
@@ -2,15 +2,25 @@ package middleware
 
 import (
 	"context"
+	"encoding/json"
+	"log"
 	"net/http"
+	"strings"
 
 	"github.com/Ingasti/mailhub-admin/internal/config"
+	"github.com/Ingasti/mailhub-admin/internal/services"
 )
 
 // AuthUser represents the authenticated user
 type AuthUser struct {
 	Email string
 	Name  string
+
+	// Token is set when the request authenticated with an API token
+	Token *services.APIToken
+
+	// Role is set by the Roles middleware; nil if the user has none
+	Role *services.RoleAssignment
 }
 
 // contextKey for storing auth user in context
@@ -18,25 +28,75 @@ type contextKey string
 
 const AuthUserKey contextKey = "authUser"
 
-// Auth middleware extracts authentication headers from Caddy
-func Auth(cfg *config.Config) func(http.Handler) http.Handler {
+// AuthOptions are the credentials Auth accepts besides the dev-mode user
+type AuthOptions struct {
+	// Tokens authenticates personal API tokens; optional
+	Tokens *services.TokenService
+
+	// Proxies may send X-Auth-User/X-Auth-Name; the headers are rejected
+	// from any other peer
+	Proxies TrustedProxies
+
+	// JWT, if set, replaces the headers: the identity is taken only from a
+	// token signed by AuthCrunch
+	JWT *JWTVerifier
+}
+
+// Auth middleware extracts authentication headers from Caddy. API requests
+// may instead present a personal token as "Authorization: Bearer <token>".
+func Auth(cfg *config.Config, opts AuthOptions) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var user AuthUser
 
-			if cfg.DevMode && cfg.DevAuthEmail != "" {
+			if bearer, ok := bearerToken(r); ok && opts.Tokens != nil {
+				token, err := opts.Tokens.Authenticate(bearer)
+				if err != nil || !strings.HasPrefix(r.URL.Path, "/api/") {
+					unauthorized(w, r)
+					return
+				}
+				if !token.HasScope(requiredScope(r.Method)) {
+					forbidden(w, r, "token lacks the "+requiredScope(r.Method)+" scope")
+					return
+				}
+
+				user = AuthUser{
+					Email: token.Owner,
+					Name:  token.Owner,
+					Token: token,
+				}
+			} else if cfg.DevMode && cfg.DevAuthEmail != "" {
 				// Dev mode - use simulated user
 				user = AuthUser{
 					Email: cfg.DevAuthEmail,
 					Name:  "Dev User",
 				}
+			} else if opts.JWT != nil {
+				// Signed identity from AuthCrunch
+				claims, err := opts.JWT.Verify(opts.JWT.FromRequest(r))
+				if err != nil {
+					log.Printf("Rejected JWT from %s: %v", PeerAddr(r), err)
+					unauthorized(w, r)
+					return
+				}
+
+				user = AuthUser{
+					Email: claims.Email,
+					Name:  claims.Name,
+				}
 			} else {
-				// Production - extract from Caddy headers
+				// Production - extract from Caddy headers, which only the
+				// trusted proxies may set
 				email := r.Header.Get("X-Auth-User")
 				name := r.Header.Get("X-Auth-Name")
 
+				if email != "" && !opts.Proxies.Contains(PeerAddr(r)) {
+					log.Printf("Rejected X-Auth-User from untrusted peer %s", PeerAddr(r))
+					unauthorized(w, r)
+					return
+				}
 				if email == "" {
-					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					unauthorized(w, r)
 					return
 				}
 
@@ -53,6 +113,58 @@ func Auth(cfg *config.Config) func(http.Handler) http.Handler {
 	}
 }
 
+// unauthorized rejects a request, as JSON for API clients
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// forbidden rejects an authenticated request, as JSON for API clients
+func forbidden(w http.ResponseWriter, r *http.Request, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, http.StatusForbidden, "forbidden", message)
+		return
+	}
+	http.Error(w, "Forbidden: "+message, http.StatusForbidden)
+}
+
+// writeAPIError writes an error in the API's JSON error format
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	type errorBody struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	body, _ := json.Marshal(struct {
+		Error errorBody `json:"error"`
+	}{errorBody{Code: code, Message: message}})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// requiredScope maps a request method to the token scope it needs
+func requiredScope(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return services.ScopeRead
+	}
+	return services.ScopeWrite
+}
+
 // GetAuthUser extracts authenticated user from context
 func GetAuthUser(r *http.Request) AuthUser {
 	user, ok := r.Context().Value(AuthUserKey).(AuthUser)
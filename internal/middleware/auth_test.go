@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Ingasti/mailhub-admin/internal/config"
+)
+
+// whoami echoes the authenticated user and the client address
+var whoami = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(GetAuthUser(r).Email + " " + r.RemoteAddr))
+})
+
+func serve(h http.Handler, remote string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remote
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.42.0.0/16", "192.0.2.7", "::1"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+
+	h := RealIP(proxies)(Auth(&config.Config{}, AuthOptions{Proxies: proxies})(whoami))
+
+	tests := []struct {
+		remote  string
+		headers map[string]string
+		status  int
+		body    string
+	}{
+		{"10.42.3.4:5000", map[string]string{"X-Auth-User": "admin@example.com", "X-Forwarded-For": "203.0.113.9"},
+			http.StatusOK, "admin@example.com 203.0.113.9"},
+		{"[::1]:5000", map[string]string{"X-Auth-User": "admin@example.com"},
+			http.StatusOK, "admin@example.com [::1]:5000"},
+		// a client prepending its own X-Forwarded-For cannot pick its address
+		{"10.42.3.4:5000", map[string]string{"X-Auth-User": "a@example.com", "X-Forwarded-For": "1.2.3.4, 203.0.113.9, 10.42.0.1"},
+			http.StatusOK, "a@example.com 203.0.113.9"},
+		{"203.0.113.9:5000", map[string]string{"X-Auth-User": "admin@example.com"}, http.StatusUnauthorized, ""},
+		{"203.0.113.9:5000", map[string]string{"X-Auth-User": "admin@example.com", "X-Forwarded-For": "10.42.3.4"}, http.StatusUnauthorized, ""},
+		{"10.42.3.4:5000", nil, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		rec := serve(h, tt.remote, tt.headers)
+		if rec.Code != tt.status || (tt.body != "" && rec.Body.String() != tt.body) {
+			t.Errorf("%s %v: %d %q, want %d %q", tt.remote, tt.headers, rec.Code, rec.Body.String(), tt.status, tt.body)
+		}
+	}
+}
+
+// signJWT signs claims with key (RSA, ECDSA P-256 or Ed25519)
+func signJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	alg := "RS256"
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		alg = "ES256"
+	case ed25519.PrivateKey:
+		alg = "EdDSA"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, sum[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	default:
+		sum := sha256.Sum256([]byte(signed))
+		sig, err = key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerification(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewJWTVerifier(JWTConfig{JWKSPath: path, Issuer: "https://auth.example.com", Audience: "mailhub", Header: "X-Auth-Token", Cookie: "access_token"})
+	if err != nil {
+		t.Fatalf("verifier: %v", err)
+	}
+	now := time.Unix(1_800_000_000, 0)
+	v.now = func() time.Time { return now }
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"email": "admin@example.com", "name": "Admin", "iss": "https://auth.example.com",
+			"aud": []string{"mailhub"}, "exp": now.Add(time.Hour).Unix(),
+		}
+		for k, val := range overrides {
+			if val == nil {
+				delete(c, k)
+			} else {
+				c[k] = val
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"rsa", signJWT(t, rsaKey, "rsa", claims(nil)), true},
+		{"ecdsa", signJWT(t, ecKey, "ec", claims(nil)), true},
+		{"ed25519", signJWT(t, edKey, "ed", claims(map[string]interface{}{"aud": "mailhub"})), true},
+		{"wrong key", signJWT(t, otherKey, "rsa", claims(nil)), false},
+		{"unknown kid", signJWT(t, rsaKey, "nope", claims(nil)), false},
+		{"key type mismatch", signJWT(t, edKey, "rsa", claims(nil)), false},
+		{"expired", signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), false},
+		{"no expiry", signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"exp": nil})), false},
+		{"not yet valid", signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), false},
+		{"wrong issuer", signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{"wrong audience", signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"aud": "other"})), false},
+		{"no email", signJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"email": nil})), false},
+		{"alg none", b64([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + b64([]byte(`{"email":"admin@example.com"}`)) + ".", false},
+		{"garbage", "not.a.jwt", false},
+	}
+	for _, tt := range tests {
+		c, err := v.Verify(tt.token)
+		if tt.ok && (err != nil || c.Email != "admin@example.com") {
+			t.Errorf("%s: rejected: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+
+	// JWT mode ignores X-Auth-User and needs no trusted proxy
+	h := Auth(&config.Config{}, AuthOptions{JWT: v})(whoami)
+	rec := serve(h, "203.0.113.9:5000", map[string]string{"X-Auth-User": "spoofed@example.com", "X-Auth-Token": "Bearer " + signJWT(t, rsaKey, "rsa", claims(nil))})
+	if rec.Code != http.StatusOK || rec.Body.String() != "admin@example.com 203.0.113.9:5000" {
+		t.Errorf("JWT header: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := serve(h, "10.0.0.1:5000", map[string]string{"X-Auth-User": "admin@example.com"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("header without JWT: %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: signJWT(t, ecKey, "ec", claims(nil))})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("JWT cookie: %d", rec.Code)
+	}
+}
+
+func TestForbiddenJSON(t *testing.T) {
+	message := `no role assigned to "eve"@example.com\`
+	rec := httptest.NewRecorder()
+	forbidden(rec, httptest.NewRequest("GET", "/api/v1/domains", nil), message)
+
+	var body struct {
+		Error struct{ Code, Message string }
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	if rec.Code != http.StatusForbidden || body.Error.Code != "forbidden" || body.Error.Message != message {
+		t.Errorf("got %d %+v", rec.Code, body)
+	}
+}
@@ -0,0 +1,361 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtLeeway tolerates clock skew between AuthCrunch and this pod
+const jwtLeeway = time.Minute
+
+// JWTClaims are the identity claims taken from a verified token
+type JWTClaims struct {
+	Email string
+	Name  string
+}
+
+// JWTVerifier verifies tokens issued by AuthCrunch against a JWKS file. The
+// file is re-read when it changes, so keys can be rotated by updating the
+// mounted ConfigMap or Secret.
+type JWTVerifier struct {
+	path     string
+	issuer   string
+	audience string
+	header   string
+	cookie   string
+	now      func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]jwk
+	modTime time.Time
+}
+
+// JWTConfig configures a JWTVerifier
+type JWTConfig struct {
+	JWKSPath string
+	Issuer   string // checked against "iss" if set
+	Audience string // must be in "aud" if set
+	Header   string // request header carrying the token, e.g. X-Auth-Token
+	Cookie   string // cookie carrying the token, e.g. access_token
+}
+
+// jwk is one parsed key of the key set
+type jwk struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// NewJWTVerifier loads the key set at cfg.JWKSPath
+func NewJWTVerifier(cfg JWTConfig) (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		path:     cfg.JWKSPath,
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		header:   cfg.Header,
+		cookie:   cfg.Cookie,
+		now:      time.Now,
+	}
+	if _, err := v.keySet(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// FromRequest returns the raw token of a request, if any
+func (v *JWTVerifier) FromRequest(r *http.Request) string {
+	if v.header != "" {
+		if token := strings.TrimSpace(r.Header.Get(v.header)); token != "" {
+			if scheme, rest, ok := strings.Cut(token, " "); ok && strings.EqualFold(scheme, "Bearer") {
+				token = strings.TrimSpace(rest)
+			}
+			return token
+		}
+	}
+	if v.cookie != "" {
+		if c, err := r.Cookie(v.cookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// Verify checks the signature and registered claims of token and returns
+// its identity claims
+func (v *JWTVerifier) Verify(token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	keys, err := v.keySet()
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[header.Kid]
+	if !ok && header.Kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", header.Kid)
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return nil, fmt.Errorf("algorithm %s not allowed for key %q", header.Alg, header.Kid)
+	}
+	if err := verifySignature(header.Alg, key.key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Email string          `json:"email"`
+		Name  string          `json:"name"`
+		Iss   string          `json:"iss"`
+		Aud   json.RawMessage `json:"aud"`
+		Exp   *json.Number    `json:"exp"`
+		Nbf   *json.Number    `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+
+	now := v.now()
+	if claims.Exp == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	if exp, err := claims.Exp.Float64(); err != nil || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.Nbf != nil {
+		if nbf, err := claims.Nbf.Float64(); err != nil || now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+			return nil, errors.New("token not yet valid")
+		}
+	}
+	if v.issuer != "" && claims.Iss != v.issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Iss)
+	}
+	if v.audience != "" && !audienceContains(claims.Aud, v.audience) {
+		return nil, errors.New("token not issued for this audience")
+	}
+	if claims.Email == "" {
+		return nil, errors.New("token has no email claim")
+	}
+
+	return &JWTClaims{Email: claims.Email, Name: claims.Name}, nil
+}
+
+// keySet returns the keys, reloading the file if it changed
+func (v *JWTVerifier) keySet() (map[string]jwk, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	info, err := os.Stat(v.path)
+	if err != nil {
+		if v.keys != nil {
+			return v.keys, nil // keep the last good keys during a remount
+		}
+		return nil, fmt.Errorf("failed to read JWKS: %w", err)
+	}
+	if v.keys != nil && info.ModTime().Equal(v.modTime) {
+		return v.keys, nil
+	}
+
+	data, err := os.ReadFile(v.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		if v.keys != nil {
+			return v.keys, nil
+		}
+		return nil, err
+	}
+	v.keys, v.modTime = keys, info.ModTime()
+	return keys, nil
+}
+
+// parseJWKS parses the RSA, EC and Ed25519 signing keys of a key set
+func parseJWKS(data []byte) (map[string]jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make(map[string]jwk)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, errN := decodeBigInt(k.N)
+			e, errE := decodeBigInt(k.E)
+			if errN != nil || errE != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+			key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("unsupported curve %q for key %q", k.Crv, k.Kid)
+			}
+			x, errX := decodeBigInt(k.X)
+			y, errY := decodeBigInt(k.Y)
+			if errX != nil || errY != nil || !curve.IsOnCurve(x, y) {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("invalid OKP key %q", k.Kid)
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		keys[k.Kid] = jwk{alg: k.Alg, key: key}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+// verifySignature checks a JWS signature. The algorithm must match the
+// key type, so an RSA key can never verify an HMAC or "none" token.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	hashes := map[string]crypto.Hash{
+		"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+		"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		hash, ok := hashes[alg]
+		if !ok || alg[0] == 'E' {
+			break
+		}
+		h := hash.New()
+		h.Write(signed)
+		var err error
+		if alg[0] == 'P' {
+			err = rsa.VerifyPSS(k, hash, h.Sum(nil), sig, nil)
+		} else {
+			err = rsa.VerifyPKCS1v15(k, hash, h.Sum(nil), sig)
+		}
+		if err != nil {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		hash, ok := hashes[alg]
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !ok || alg[0] != 'E' || len(sig) != 2*size {
+			break
+		}
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, h.Sum(nil), r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(k, signed, sig) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported token algorithm %q for key", alg)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// audienceContains reports whether the "aud" claim (string or array)
+// includes audience
+func audienceContains(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, a := range list {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
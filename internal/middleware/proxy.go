@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the networks allowed to set forwarded-for and auth
+// headers (normally the Caddy/AuthCrunch ingress)
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses CIDRs; bare IPs are taken as single hosts
+func ParseTrustedProxies(list []string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Contains reports whether addr (an IP, optionally with port) is trusted
+func (t TrustedProxies) Contains(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+const peerAddrKey contextKey = "peerAddr"
+
+// RealIP replaces chi's RealIP middleware. X-Forwarded-For and X-Real-IP
+// are only honored from trusted proxies, and the client address is the
+// right-most untrusted hop, so clients cannot spoof it by sending the
+// header themselves. The direct peer is kept for Auth.
+func RealIP(proxies TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer := r.RemoteAddr
+			if proxies.Contains(peer) {
+				if ip := forwardedFor(r, proxies); ip != "" {
+					r.RemoteAddr = ip
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), peerAddrKey, peer)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// forwardedFor returns the client address named by trusted proxies
+func forwardedFor(r *http.Request, proxies TrustedProxies) string {
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			return ""
+		}
+		if !proxies.Contains(hops[i]) || i == 0 {
+			return hops[i]
+		}
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return ""
+}
+
+// PeerAddr returns the address of the direct peer, before RealIP applied
+// any forwarded header
+func PeerAddr(r *http.Request) string {
+	if peer, ok := r.Context().Value(peerAddrKey).(string); ok {
+		return peer
+	}
+	return r.RemoteAddr
+}
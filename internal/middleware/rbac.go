@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/Ingasti/mailhub-admin/internal/services"
+	"github.com/go-chi/chi/v5"
+)
+
+// Roles middleware resolves the role of the authenticated user and rejects
+// users without one. It must run after Auth.
+func Roles(roles *services.RoleService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := GetAuthUser(r)
+			role, err := roles.Resolve(user.Email)
+			if err != nil {
+				log.Printf("Error resolving role of %s: %v", user.Email, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if role == nil {
+				forbidden(w, r, "no role assigned to "+user.Email)
+				return
+			}
+
+			user.Role = role
+			ctx := context.WithValue(r.Context(), AuthUserKey, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Require middleware rejects requests whose role lacks perm. On routes with
+// a {domain} parameter the permission is checked for that domain.
+func Require(perm services.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !GetAuthUser(r).Role.Can(perm, chi.URLParam(r, "domain")) {
+				forbidden(w, r, "permission denied: "+string(perm))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
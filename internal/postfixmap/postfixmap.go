@@ -0,0 +1,322 @@
+// Package postfixmap reads and writes Postfix lookup tables in the source
+// format read by postmap(1): hash/lmdb/cdb tables ("key value") and
+// regexp/pcre tables ("/pattern/flags value").
+//
+// A parsed Map keeps the original text of every line. Entries that are not
+// changed, comments, blank lines and layout are written back byte for byte,
+// so String returns the input unchanged when nothing was edited.
+package postfixmap
+
+import (
+	"strings"
+)
+
+// Type selects how the key of an entry is parsed
+type Type int
+
+const (
+	// Hash tables (hash, lmdb, cdb, btree, texthash): the key ends at the
+	// first whitespace
+	Hash Type = iota
+	// Regexp tables (regexp, pcre): the key is a delimited pattern with
+	// optional flags, which may contain whitespace. "if /pattern/" and
+	// "endif" lines are entries with the key "if" or "endif".
+	Regexp
+)
+
+// Separator is written between the key and value of new or changed entries
+const Separator = "    "
+
+// Entry is one logical line of a table. A logical line may span several
+// physical lines: lines starting with whitespace continue the entry above.
+//
+// Postfix does not know inline comments; a value followed by whitespace and
+// "#" is split into Value and Comment so that "alice@example.com  # old"
+// reads as alice@example.com.
+//
+// The fields may be changed in place. Changed entries are written on one
+// line as Key, Separator, Value and " # Comment".
+type Entry struct {
+	Key     string
+	Value   string
+	Comment string
+
+	// Line is the 1-based line the entry starts on, or 0 for new entries
+	Line int
+
+	raw                string // original text, with line terminators
+	inner              string // comment and blank lines inside a continued entry
+	origKey, origValue string
+	origComment        string
+	eol                string // terminator of the last physical line
+}
+
+// Text returns the original text of the entry without its final line
+// terminator, or the formatted entry if it is new
+func (e *Entry) Text() string {
+	if e.raw == "" {
+		return e.Format()
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(e.raw, "\n"), "\r")
+}
+
+// Format returns the entry as written after a change
+func (e *Entry) Format() string {
+	line := e.Key
+	if e.Value != "" {
+		line += Separator + e.Value
+	}
+	if e.Comment != "" {
+		line += " # " + e.Comment
+	}
+	return line
+}
+
+// changed reports whether the entry must be rewritten
+func (e *Entry) changed() bool {
+	return e.raw == "" || e.Key != e.origKey || e.Value != e.origValue || e.Comment != e.origComment
+}
+
+// block is a run of physical lines: an entry, or text that is not part of
+// one (comments, blank lines, stray continuation lines)
+type block struct {
+	text  string
+	entry *Entry
+}
+
+// Map is a parsed lookup table
+type Map struct {
+	typ    Type
+	blocks []block
+}
+
+// Parse parses a hash-style table
+func Parse(content string) *Map {
+	return ParseType(content, Hash)
+}
+
+// ParseType parses a table of the given type. Parsing never fails: lines
+// that are not entries are kept as text.
+func ParseType(content string, typ Type) *Map {
+	m := &Map{typ: typ}
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for i := 0; i < len(lines); {
+		if !startsEntry(lines[i]) {
+			m.blocks = append(m.blocks, block{text: lines[i]})
+			i++
+			continue
+		}
+
+		// Collect continuation lines; comments and blank lines between
+		// them belong to the entry only if a continuation follows
+		logical := strings.TrimSpace(lines[i])
+		end := i + 1
+		var inner strings.Builder
+		var pending []string
+		for j := i + 1; j < len(lines); j++ {
+			if isBlankOrComment(lines[j]) {
+				pending = append(pending, lines[j])
+				continue
+			}
+			if !continues(lines[j]) {
+				break
+			}
+			for _, p := range pending {
+				if strings.TrimSpace(p) != "" {
+					inner.WriteString(p)
+				}
+			}
+			pending = nil
+			logical += " " + strings.TrimSpace(lines[j])
+			end = j + 1
+		}
+
+		raw := strings.Join(lines[i:end], "")
+		e := parseLogical(logical, typ)
+		e.Line = i + 1
+		e.raw = raw
+		e.inner = inner.String()
+		e.origKey, e.origValue, e.origComment = e.Key, e.Value, e.Comment
+		switch {
+		case strings.HasSuffix(raw, "\r\n"):
+			e.eol = "\r\n"
+		case strings.HasSuffix(raw, "\n"):
+			e.eol = "\n"
+		}
+		m.blocks = append(m.blocks, block{entry: e})
+		i = end
+	}
+	return m
+}
+
+func startsEntry(line string) bool {
+	return line != "" && !isBlankOrComment(line) && line[0] != ' ' && line[0] != '\t'
+}
+
+func continues(line string) bool {
+	return line != "" && (line[0] == ' ' || line[0] == '\t')
+}
+
+func isBlankOrComment(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
+
+// parseLogical splits a logical line into key, value and inline comment
+func parseLogical(logical string, typ Type) *Entry {
+	e := &Entry{}
+	rest := logical
+	if typ == Regexp {
+		e.Key, rest = splitPattern(logical)
+	} else if i := strings.IndexAny(logical, " \t"); i >= 0 {
+		e.Key, rest = logical[:i], logical[i:]
+	} else {
+		e.Key, rest = logical, ""
+	}
+
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(rest, "#") {
+		e.Comment = strings.TrimSpace(rest[1:])
+		return e
+	}
+	for i := 1; i < len(rest); i++ {
+		if rest[i] == '#' && (rest[i-1] == ' ' || rest[i-1] == '\t') {
+			e.Value = strings.TrimSpace(rest[:i])
+			e.Comment = strings.TrimSpace(rest[i+1:])
+			return e
+		}
+	}
+	e.Value = rest
+	return e
+}
+
+// splitPattern splits a regexp table line after its pattern and flags.
+// "if" and "endif" are returned as the key with the pattern as the rest.
+func splitPattern(logical string) (string, string) {
+	for _, kw := range []string{"if", "endif"} {
+		if logical == kw || strings.HasPrefix(logical, kw+" ") || strings.HasPrefix(logical, kw+"\t") {
+			return kw, logical[len(kw):]
+		}
+	}
+
+	delim := logical[0]
+	i := 1
+	for ; i < len(logical); i++ {
+		if logical[i] == '\\' {
+			i++
+			continue
+		}
+		if logical[i] == delim {
+			break
+		}
+	}
+	if i >= len(logical) {
+		// Unterminated pattern: postmap rejects it, keep it whole
+		return logical, ""
+	}
+	i++
+	for i < len(logical) && isFlag(logical[i]) {
+		i++
+	}
+	return logical[:i], logical[i:]
+}
+
+func isFlag(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Entries returns the entries in file order
+func (m *Map) Entries() []*Entry {
+	var entries []*Entry
+	for _, b := range m.blocks {
+		if b.entry != nil {
+			entries = append(entries, b.entry)
+		}
+	}
+	return entries
+}
+
+// Keys returns the keys in file order
+func (m *Map) Keys() []string {
+	var keys []string
+	for _, e := range m.Entries() {
+		keys = append(keys, e.Key)
+	}
+	return keys
+}
+
+// Lookup returns the first entry with key, or nil. Hash keys are compared
+// case-insensitively, as postmap folds them to lowercase.
+func (m *Map) Lookup(key string) *Entry {
+	for _, e := range m.Entries() {
+		if e.Key == key || (m.typ == Hash && strings.EqualFold(e.Key, key)) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Add appends an entry at the end of the table
+func (m *Map) Add(key, value string) *Entry {
+	e := &Entry{Key: key, Value: value, eol: "\n"}
+	m.blocks = append(m.blocks, block{entry: e})
+	return e
+}
+
+// Remove deletes an entry, including its continuation lines
+func (m *Map) Remove(e *Entry) bool {
+	for i, b := range m.blocks {
+		if b.entry == e {
+			m.blocks = append(m.blocks[:i], m.blocks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveFunc deletes every entry for which fn returns true and returns the
+// number removed
+func (m *Map) RemoveFunc(fn func(e *Entry) bool) int {
+	kept := m.blocks[:0]
+	removed := 0
+	for _, b := range m.blocks {
+		if b.entry != nil && fn(b.entry) {
+			removed++
+			continue
+		}
+		kept = append(kept, b)
+	}
+	m.blocks = kept
+	return removed
+}
+
+// String serializes the table. Unchanged entries keep their original text;
+// changed entries are written on one line, preceded by any comment lines
+// they contained.
+func (m *Map) String() string {
+	var sb strings.Builder
+	for _, b := range m.blocks {
+		// Only the last line of the input can lack a terminator; terminate
+		// it when something is written after it
+		if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "\n") {
+			sb.WriteString("\n")
+		}
+		if b.entry == nil {
+			sb.WriteString(b.text)
+			continue
+		}
+		e := b.entry
+		if !e.changed() {
+			sb.WriteString(e.raw)
+			continue
+		}
+		sb.WriteString(e.inner)
+		sb.WriteString(e.Format())
+		sb.WriteString(e.eol)
+	}
+	return sb.String()
+}
@@ -0,0 +1,109 @@
+package postfixmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoundTripUnchanged(t *testing.T) {
+	inputs := []string{
+		"",
+		"\n",
+		"example.com",
+		"# hosted domains\nexample.com\n\nexample.org\n",
+		"alice@example.com    example.com/alice/\r\nbob@example.com\texample.com/bob/\r\n",
+		"team@example.com  alice@example.com,\n    bob@example.com\n# trailing\n",
+		"team@example.com  alice@example.com,\n# inside\n\n\tbob@example.com\nx y",
+		"   stray continuation\nkey value # note\n",
+		"/^(.*)@old\\.example$/   ${1}@example.com\nif /^a/\n/^ab/ OK\nendif\n",
+	}
+	for _, typ := range []Type{Hash, Regexp} {
+		for _, in := range inputs {
+			if got := ParseType(in, typ).String(); got != in {
+				t.Errorf("round trip (type %d) of %q = %q", typ, in, got)
+			}
+		}
+	}
+}
+
+func TestParseEntries(t *testing.T) {
+	m := Parse(`# aliases
+team@example.com    alice@example.com,
+        bob@example.com   # on leave
+postmaster@example.com root@example.com
+@example.com
+`)
+	entries := m.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries: %+v", len(entries), entries)
+	}
+	team := entries[0]
+	if team.Key != "team@example.com" || team.Value != "alice@example.com, bob@example.com" || team.Comment != "on leave" || team.Line != 2 {
+		t.Errorf("continued entry: %+v", team)
+	}
+	if e := entries[2]; e.Key != "@example.com" || e.Value != "" {
+		t.Errorf("key-only entry: %+v", e)
+	}
+	if e := m.Lookup("POSTMASTER@example.com"); e != entries[1] {
+		t.Errorf("case-insensitive lookup: %+v", e)
+	}
+	if got, want := m.Keys(), []string{"team@example.com", "postmaster@example.com", "@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys %v, want %v", got, want)
+	}
+}
+
+func TestParseRegexp(t *testing.T) {
+	m := ParseType("/^user name@(.*)$/i   REJECT no spaces # old rule\n!/x!  OK\nif /^a/\nendif\n", Regexp)
+	got := [][3]string{}
+	for _, e := range m.Entries() {
+		got = append(got, [3]string{e.Key, e.Value, e.Comment})
+	}
+	want := [][3]string{
+		{"/^user name@(.*)$/i", "REJECT no spaces", "old rule"},
+		{"!/x!", "OK", ""},
+		{"if", "/^a/", ""},
+		{"endif", "", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries %q, want %q", got, want)
+	}
+}
+
+func TestEditKeepsUntouchedLines(t *testing.T) {
+	in := "# header\r\n" +
+		"a@example.com   a/\r\n" +
+		"team@example.com  a@example.com,\n" +
+		"# inside\n" +
+		"\tb@example.com\n" +
+		"c@example.com\tc/ # keep me\n" +
+		"d@example.com d/"
+	m := Parse(in)
+
+	m.Lookup("team@example.com").Value = "b@example.com"
+	m.Lookup("c@example.com").Value = "cc/"
+	m.RemoveFunc(func(e *Entry) bool { return e.Key == "a@example.com" })
+	m.Add("e@example.com", "e/")
+
+	want := "# header\r\n" +
+		"# inside\n" +
+		"team@example.com    b@example.com\n" +
+		"c@example.com    cc/ # keep me\n" +
+		"d@example.com d/\n" +
+		"e@example.com    e/\n"
+	if got := m.String(); got != want {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestRemoveLastEntry(t *testing.T) {
+	m := Parse("example.com 2G\n")
+	if !m.Remove(m.Lookup("example.com")) {
+		t.Fatal("entry not removed")
+	}
+	if got := m.String(); got != "" {
+		t.Errorf("got %q", got)
+	}
+	if m.Remove(&Entry{}) {
+		t.Error("removed an unknown entry")
+	}
+}
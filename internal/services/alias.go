@@ -0,0 +1,227 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/postfixmap"
+)
+
+// Alias represents a virtual alias (forwarding) entry
+type Alias struct {
+	Source   string   `json:"source"`
+	Targets  []string `json:"targets"`
+	Domain   string   `json:"domain"`
+	CatchAll bool     `json:"catch_all"`
+}
+
+// ListAliases returns all aliases for a domain, including its catch-all
+func (m *MailService) ListAliases(domain string) ([]Alias, error) {
+	aliasMap, err := readMap(m.exec, virtualAliasFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read aliases: %w", err)
+	}
+
+	var aliases []Alias
+	for _, e := range aliasMap.Entries() {
+		alias, ok := aliasFromEntry(e)
+		if !ok || alias.Domain != domain {
+			continue
+		}
+		aliases = append(aliases, alias)
+	}
+
+	sort.Slice(aliases, func(i, j int) bool {
+		// Catch-all always comes last
+		if aliases[i].CatchAll != aliases[j].CatchAll {
+			return aliases[j].CatchAll
+		}
+		return aliases[i].Source < aliases[j].Source
+	})
+
+	return aliases, nil
+}
+
+// AddAlias creates a new alias. An empty local part creates the catch-all
+// (@domain) entry.
+func (m *MailService) AddAlias(domain, local string, targets []string) error {
+	source := AliasSource(domain, local)
+
+	if local != "" && !isValidUsername(local) {
+		return invalidf("invalid alias name: %s", local)
+	}
+	targets, err := normalizeAliasTargets(targets)
+	if err != nil {
+		return err
+	}
+
+	aliases, err := m.ListAliases(domain)
+	if err != nil {
+		return err
+	}
+	for _, a := range aliases {
+		if a.Source == source {
+			return existsf("alias already exists: %s", source)
+		}
+	}
+
+	return m.changeSet("add_alias", source, virtualAliasFile).
+		Step("add alias", func() error {
+			err := editMap(m.exec, virtualAliasFile, func(pm *postfixmap.Map) error {
+				pm.Add(source, strings.Join(targets, ","))
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add alias: %w", err)
+			}
+			return nil
+		}).
+		Step("postmap", m.postmap(virtualAliasFile)).
+		Step("reload postfix", m.reloadPostfix).
+		Run()
+}
+
+// UpdateAlias replaces the targets of an existing alias
+func (m *MailService) UpdateAlias(domain, source string, targets []string) error {
+	targets, err := normalizeAliasTargets(targets)
+	if err != nil {
+		return err
+	}
+	if err := m.requireAlias(domain, source); err != nil {
+		return err
+	}
+
+	return m.changeSet("update_alias", source, virtualAliasFile).
+		Step("update alias", func() error {
+			return m.rewriteAliases(func(a Alias) ([]string, bool) {
+				return targets, a.Source == source && a.Domain == domain
+			})
+		}).
+		Step("postmap", m.postmap(virtualAliasFile)).
+		Step("reload postfix", m.reloadPostfix).
+		Run()
+}
+
+// DeleteAlias removes an alias
+func (m *MailService) DeleteAlias(domain, source string) error {
+	if err := m.requireAlias(domain, source); err != nil {
+		return err
+	}
+
+	return m.changeSet("delete_alias", source, virtualAliasFile).
+		Step("delete alias", func() error {
+			return m.rewriteAliases(func(a Alias) ([]string, bool) {
+				return nil, a.Source == source && a.Domain == domain
+			})
+		}).
+		Step("postmap", m.postmap(virtualAliasFile)).
+		Step("reload postfix", m.reloadPostfix).
+		Run()
+}
+
+// requireAlias returns an error unless the alias exists
+func (m *MailService) requireAlias(domain, source string) error {
+	aliases, err := m.ListAliases(domain)
+	if err != nil {
+		return err
+	}
+	for _, a := range aliases {
+		if a.Source == source {
+			return nil
+		}
+	}
+	return notFoundf("alias not found: %s", source)
+}
+
+// rewriteAliases rewrites virtual_alias, letting fn replace the targets of
+// any entry it matches; matched entries left without targets are removed.
+// Comments, inline comments and unrelated entries are kept as-is.
+func (m *MailService) rewriteAliases(fn func(a Alias) ([]string, bool)) error {
+	err := editMap(m.exec, virtualAliasFile, func(pm *postfixmap.Map) error {
+		pm.RemoveFunc(func(e *postfixmap.Entry) bool {
+			alias, ok := aliasFromEntry(e)
+			if !ok {
+				return false
+			}
+			targets, matched := fn(alias)
+			if !matched {
+				return false
+			}
+			if len(targets) == 0 {
+				return true
+			}
+			e.Value = strings.Join(targets, ",")
+			return false
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update aliases: %w", err)
+	}
+	return nil
+}
+
+// AliasSource builds the lookup key for an alias; an empty local part yields
+// the catch-all key.
+func AliasSource(domain, local string) string {
+	if local == "" || local == "@" {
+		return "@" + domain
+	}
+	return local + "@" + domain
+}
+
+// aliasFromEntry reads an alias from a virtual_alias entry
+// ("source target[,target...]"); targets may be separated by commas or
+// whitespace
+func aliasFromEntry(e *postfixmap.Entry) (Alias, bool) {
+	at := strings.LastIndex(e.Key, "@")
+	if at < 0 {
+		return Alias{}, false
+	}
+
+	targets := strings.FieldsFunc(e.Value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(targets) == 0 {
+		return Alias{}, false
+	}
+
+	return Alias{
+		Source:   e.Key,
+		Targets:  targets,
+		Domain:   e.Key[at+1:],
+		CatchAll: at == 0,
+	}, true
+}
+
+// normalizeAliasTargets trims, validates and de-duplicates alias targets
+func normalizeAliasTargets(targets []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var result []string
+	for _, t := range targets {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		if !isValidEmail(t) {
+			return nil, invalidf("invalid alias target: %s", t)
+		}
+		seen[t] = true
+		result = append(result, t)
+	}
+	if len(result) == 0 {
+		return nil, invalidf("at least one alias target is required")
+	}
+	return result, nil
+}
+
+func isValidEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return false
+	}
+	// Allow sub-addressing (user+tag) in forward targets
+	local := strings.ReplaceAll(email[:at], "+", "")
+	return isValidUsername(local) && isValidDomain(email[at+1:])
+}
@@ -1,10 +1,13 @@
 package services
 
 import (
+	"crypto/ed25519"
 	"database/sql"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,19 +16,28 @@ import (
 
 // AuditEntry represents an audit log entry
 type AuditEntry struct {
-	ID        int64
-	Timestamp time.Time
-	User      string
-	Action    string
-	Target    string
-	Status    string
-	Details   string
+	ID        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	User      string    `json:"user"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Status    string    `json:"status"`
+	Details   string    `json:"details"`
+	RequestID string    `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	Server    string    `json:"server,omitempty"` // mail server the action ran against
+	Diff      string    `json:"diff,omitempty"`   // unified diff of changed config files
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
 }
 
 // AuditService handles audit logging
 type AuditService struct {
-	db *sql.DB
-	mu sync.Mutex
+	db      *sql.DB
+	dataDir string
+	signer  ed25519.PrivateKey // signs checkpoints, see SetSigningKey
+	mu      sync.Mutex
 }
 
 var auditInstance *AuditService
@@ -79,51 +91,224 @@ func newAuditService() (*AuditService, error) {
 		return nil, fmt.Errorf("failed to create audit table: %w", err)
 	}
 
-	return &AuditService{db: db}, nil
+	// Request metadata columns, added to databases created before them
+	if err := addMissingColumns(db, "audit_log", map[string]string{
+		"request_id": "TEXT NOT NULL DEFAULT ''",
+		"client_ip":  "TEXT NOT NULL DEFAULT ''",
+		"user_agent": "TEXT NOT NULL DEFAULT ''",
+		"diff":       "TEXT NOT NULL DEFAULT ''",
+		"server":     "TEXT NOT NULL DEFAULT ''",
+		"prev_hash":  "TEXT NOT NULL DEFAULT ''",
+		"hash":       "TEXT NOT NULL DEFAULT ''",
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate audit table: %w", err)
+	}
+
+	// Every filter is an equality on one column ordered by id, so each gets
+	// a (column, id) index; the date range uses the timestamp index
+	for _, stmt := range []string{
+		`CREATE INDEX IF NOT EXISTS idx_audit_user ON audit_log (user, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_action ON audit_log (action, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_target ON audit_log (target, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_timestamp ON audit_log (timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_server ON audit_log (server, id)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to index audit table: %w", err)
+		}
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS audit_meta (key TEXT PRIMARY KEY, value TEXT NOT NULL)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create audit meta table: %w", err)
+	}
+
+	s := &AuditService{db: db, dataDir: dataDir}
+	if err := s.chainUnhashed(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to hash audit entries: %w", err)
+	}
+	return s, nil
 }
 
-// Log records an audit entry
-func (s *AuditService) Log(user, action, target, status, details string) error {
+// Log records an audit entry and links it into the hash chain. ID,
+// Timestamp and the hashes are assigned here.
+func (s *AuditService) Log(e AuditEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	_, err := s.db.Exec(
-		"INSERT INTO audit_log (user, action, target, status, details) VALUES (?, ?, ?, ?, ?)",
-		user, action, target, status, details,
+	prev, err := s.headHash()
+	if err != nil {
+		return err
+	}
+	ts := time.Now().UTC().Format(auditTimeFormat)
+	_, err = s.db.Exec(
+		`INSERT INTO audit_log (timestamp, user, action, target, status, details, request_id, client_ip, user_agent, server, diff, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ts, e.User, e.Action, e.Target, e.Status, e.Details, e.RequestID, e.ClientIP, e.UserAgent, e.Server, e.Diff,
+		prev, entryHash(prev, ts, e),
 	)
 	return err
 }
 
-// GetEntries retrieves audit entries, most recent first
+// AuditFilter selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	User   string    // exact actor email
+	Action string    // exact action, e.g. create_mailbox
+	Target string    // exact target
+	Status string    // success or failed
+	Server string    // exact mail server name
+	Search string    // substring of the details, case-insensitive
+	Since  time.Time // inclusive
+	Until  time.Time // exclusive
+	Before int64     // cursor: only entries with a smaller ID
+	Limit  int       // default 50, at most MaxAuditPage
+}
+
+// MaxAuditPage bounds the entries returned by one query
+const MaxAuditPage = 1000
+
+// AuditPage is one page of a query. NextCursor is passed as Before to fetch
+// the following page, and is 0 on the last page.
+type AuditPage struct {
+	Entries    []AuditEntry
+	NextCursor int64
+}
+
+// auditTimeFormat is how SQLite's CURRENT_TIMESTAMP stores times (UTC)
+const auditTimeFormat = "2006-01-02 15:04:05"
+
+// Query returns the entries matching f, most recent first. Pages are keyed
+// on the entry ID, which grows with the timestamp, so entries logged while
+// paging neither shift nor repeat rows.
+func (s *AuditService) Query(f AuditFilter) (*AuditPage, error) {
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	if f.Limit > MaxAuditPage {
+		return nil, invalidf("limit must be at most %d", MaxAuditPage)
+	}
+	if f.Status != "" && f.Status != "success" && f.Status != "failed" {
+		return nil, invalidf("invalid status %q", f.Status)
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && !f.Since.Before(f.Until) {
+		return nil, invalidf("date range is empty")
+	}
+
+	var where []string
+	var args []interface{}
+	for _, c := range []struct{ column, value string }{
+		{"user", f.User}, {"action", f.Action}, {"target", f.Target}, {"status", f.Status}, {"server", f.Server},
+	} {
+		if c.value != "" {
+			where = append(where, c.column+" = ?")
+			args = append(args, c.value)
+		}
+	}
+	if f.Search != "" {
+		where = append(where, `details LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(f.Search)+"%")
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "timestamp >= ?")
+		args = append(args, f.Since.UTC().Format(auditTimeFormat))
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "timestamp < ?")
+		args = append(args, f.Until.UTC().Format(auditTimeFormat))
+	}
+	if f.Before > 0 {
+		where = append(where, "id < ?")
+		args = append(args, f.Before)
+	}
+
+	query := `SELECT ` + auditColumns + ` FROM audit_log`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, f.Limit+1)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &AuditPage{}
+	for rows.Next() {
+		e, _, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Entries = append(page.Entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Entries) > f.Limit {
+		page.Entries = page.Entries[:f.Limit]
+		page.NextCursor = page.Entries[f.Limit-1].ID
+	}
+	return page, nil
+}
+
+// auditColumns are the columns read by scanAuditEntry
+const auditColumns = `id, timestamp, user, action, target, status, COALESCE(details, ''), request_id, client_ip, user_agent, server, diff, prev_hash, hash`
+
+// scanAuditEntry reads the auditColumns of a row. The timestamp is also
+// returned in auditTimeFormat, as that is what the entry hash covers.
+func scanAuditEntry(row rowScanner) (AuditEntry, string, error) {
+	var e AuditEntry
+	var ts string
+	if err := row.Scan(&e.ID, &ts, &e.User, &e.Action, &e.Target, &e.Status, &e.Details, &e.RequestID, &e.ClientIP, &e.UserAgent, &e.Server, &e.Diff, &e.PrevHash, &e.Hash); err != nil {
+		return e, "", err
+	}
+	// the driver returns DATETIME columns as RFC 3339
+	for _, layout := range []string{time.RFC3339, auditTimeFormat} {
+		if t, err := time.Parse(layout, ts); err == nil {
+			e.Timestamp = t
+			ts = t.UTC().Format(auditTimeFormat)
+			break
+		}
+	}
+	return e, ts, nil
+}
+
+// GetEntries retrieves the latest audit entries, most recent first
 func (s *AuditService) GetEntries(limit int) ([]AuditEntry, error) {
-	if limit <= 0 {
-		limit = 50
+	page, err := s.Query(AuditFilter{Limit: limit})
+	if err != nil {
+		return nil, err
 	}
+	return page.Entries, nil
+}
 
-	rows, err := s.db.Query(`
-		SELECT id, timestamp, user, action, target, status, COALESCE(details, '') 
-		FROM audit_log 
-		ORDER BY timestamp DESC 
-		LIMIT ?
-	`, limit)
+// Actions returns the distinct actions in the log, for filter choices
+func (s *AuditService) Actions() ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT action FROM audit_log ORDER BY action`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var entries []AuditEntry
+	var actions []string
 	for rows.Next() {
-		var e AuditEntry
-		var ts string
-		if err := rows.Scan(&e.ID, &ts, &e.User, &e.Action, &e.Target, &e.Status, &e.Details); err != nil {
+		var action string
+		if err := rows.Scan(&action); err != nil {
 			return nil, err
 		}
-		e.Timestamp, _ = time.Parse("2006-01-02 15:04:05", ts)
-		entries = append(entries, e)
+		actions = append(actions, action)
 	}
-	return entries, rows.Err()
+	return actions, rows.Err()
 }
 
+// likeEscaper escapes the LIKE wildcards of a search term
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 // Close closes the database connection
 func (s *AuditService) Close() error {
 	if s.db != nil {
@@ -131,3 +316,39 @@ func (s *AuditService) Close() error {
 	}
 	return nil
 }
+
+// addMissingColumns adds columns that an older table lacks
+func addMissingColumns(db *sql.DB, table string, columns map[string]string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if existing[name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, name, columns[name])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
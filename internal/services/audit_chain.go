@@ -0,0 +1,315 @@
+package services
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The audit log is a hash chain: each entry stores the hash of its content
+// and of the previous entry's hash. Editing an entry breaks its own hash;
+// deleting or reordering entries breaks the next entry's link. Cutting off
+// the newest entries is only visible against a checkpoint, a signed copy
+// of the head kept outside the database.
+
+// entryHash is the hex SHA-256 of the previous hash and the entry content,
+// encoded as a JSON array so that field boundaries are unambiguous. The
+// diff is only appended when set, so entries from before diffs were
+// recorded keep their hash.
+func entryHash(prev, timestamp string, e AuditEntry) string {
+	fields := []string{
+		prev, timestamp, e.User, e.Action, e.Target, e.Status, e.Details, e.RequestID, e.ClientIP, e.UserAgent,
+	}
+	// Diff and Server were added later; they are only hashed when set so
+	// older entries keep their hash. The server implies the diff slot.
+	if e.Diff != "" || e.Server != "" {
+		fields = append(fields, e.Diff)
+	}
+	if e.Server != "" {
+		fields = append(fields, e.Server)
+	}
+	content, _ := json.Marshal(fields)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// headHash returns the hash of the newest entry, or the anchor left by
+// pruning when the log is empty. Callers hold s.mu.
+func (s *AuditService) headHash() (string, error) {
+	var hash string
+	err := s.db.QueryRow(`SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1`).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return chainAnchor(s.db)
+	}
+	return hash, err
+}
+
+// queryRower is a *sql.DB or *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// chainAnchor is the hash the oldest kept entry links to: empty for a log
+// that was never pruned, else the hash of the last pruned entry
+func chainAnchor(db queryRower) (string, error) {
+	var anchor string
+	err := db.QueryRow(`SELECT value FROM audit_meta WHERE key = 'anchor'`).Scan(&anchor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return anchor, err
+}
+
+// chainUnhashed links entries written before the chain existed. They were
+// never protected, so this only makes every later entry verifiable.
+func (s *AuditService) chainUnhashed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query(`SELECT ` + auditColumns + ` FROM audit_log WHERE hash = '' ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	type link struct {
+		id         int64
+		prev, hash string
+	}
+	var links []link
+	var prev string
+	for rows.Next() {
+		e, ts, err := scanAuditEntry(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if links == nil {
+			var before string
+			err := s.db.QueryRow(`SELECT hash FROM audit_log WHERE id < ? ORDER BY id DESC LIMIT 1`, e.ID).Scan(&before)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				rows.Close()
+				return err
+			}
+			prev = before
+		}
+		hash := entryHash(prev, ts, e)
+		links = append(links, link{e.ID, prev, hash})
+		prev = hash
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(links) == 0 {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, l := range links {
+		if _, err := tx.Exec(`UPDATE audit_log SET prev_hash = ?, hash = ? WHERE id = ?`, l.prev, l.hash, l.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AuditChainReport is the result of walking the hash chain. BrokenID is
+// the first entry that fails, 0 if the chain is intact.
+type AuditChainReport struct {
+	OK       bool   `json:"ok"`
+	Entries  int    `json:"entries"`
+	HeadID   int64  `json:"head_id"`
+	HeadHash string `json:"head_hash"`
+	BrokenID int64  `json:"broken_id,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// VerifyChain recomputes every entry hash from the oldest kept entry and
+// checks each link. With a checkpoint, it also checks that the checkpoint
+// is validly signed and that its head is still in the chain unchanged.
+func (s *AuditService) VerifyChain(cp *AuditCheckpoint) (*AuditChainReport, error) {
+	// one read transaction sees a consistent snapshot, even if entries
+	// are logged or pruned meanwhile
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	prev, err := chainAnchor(tx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(`SELECT ` + auditColumns + ` FROM audit_log ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &AuditChainReport{OK: true, HeadHash: prev}
+	if cp != nil {
+		if err := cp.Verify(); err != nil {
+			return report.broken(0, err.Error()), nil
+		}
+	}
+	cpSeen := false
+	for rows.Next() {
+		e, ts, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		report.Entries++
+		switch {
+		case e.PrevHash != prev:
+			return report.broken(e.ID, "link to the previous entry does not match: an entry before it was deleted or changed"), nil
+		case e.Hash != entryHash(e.PrevHash, ts, e):
+			return report.broken(e.ID, "content does not match its hash: the entry was modified"), nil
+		}
+		if cp != nil && e.ID == cp.HeadID {
+			if e.Hash != cp.HeadHash {
+				return report.broken(e.ID, "entry differs from the checkpoint"), nil
+			}
+			cpSeen = true
+		}
+		prev = e.Hash
+		report.HeadID, report.HeadHash = e.ID, e.Hash
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if cp != nil {
+		if !cpSeen && cp.HeadID > 0 {
+			var oldest sql.NullInt64
+			if err := tx.QueryRow(`SELECT MIN(id) FROM audit_log`).Scan(&oldest); err != nil {
+				return nil, err
+			}
+			switch {
+			case cp.HeadID > report.HeadID:
+				return report.broken(cp.HeadID, "checkpoint head is missing: newer entries were removed"), nil
+			case cp.HeadID >= oldest.Int64:
+				return report.broken(cp.HeadID, "checkpoint head is missing from the chain"), nil
+			}
+			// otherwise the head was pruned by the retention policy
+		}
+	}
+	return report, nil
+}
+
+func (r *AuditChainReport) broken(id int64, reason string) *AuditChainReport {
+	r.OK, r.BrokenID, r.Reason = false, id, reason
+	return r
+}
+
+// AuditCheckpoint is a signed statement of the chain head. Kept outside
+// the server (printed, mailed, committed), it proves which entries existed.
+type AuditCheckpoint struct {
+	HeadID    int64     `json:"head_id"`
+	HeadHash  string    `json:"head_hash"`
+	Entries   int       `json:"entries"`
+	SignedAt  time.Time `json:"signed_at"`
+	PublicKey string    `json:"public_key"` // base64 Ed25519 key
+	Signature string    `json:"signature"`  // base64 Ed25519 signature of payload()
+}
+
+// payload is the signed text of the checkpoint
+func (c *AuditCheckpoint) payload() []byte {
+	return []byte(fmt.Sprintf("mailhub-audit-checkpoint\nhead_id=%d\nhead_hash=%s\nentries=%d\nsigned_at=%s\n",
+		c.HeadID, c.HeadHash, c.Entries, c.SignedAt.UTC().Format(time.RFC3339)))
+}
+
+// Verify checks the signature with the embedded public key. Whether that
+// key is the server's must be checked against a trusted copy of it.
+func (c *AuditCheckpoint) Verify() error {
+	pub, err := base64.StdEncoding.DecodeString(c.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("checkpoint has an invalid public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), c.payload(), sig) {
+		return errors.New("checkpoint signature is invalid")
+	}
+	return nil
+}
+
+// Checkpoint signs the current head of the chain
+func (s *AuditService) Checkpoint() (*AuditCheckpoint, error) {
+	if s.signer == nil {
+		return nil, errors.New("no audit signing key configured")
+	}
+
+	s.mu.Lock()
+	cp := &AuditCheckpoint{SignedAt: time.Now().UTC().Truncate(time.Second)}
+	var headID sql.NullInt64
+	err := s.db.QueryRow(`SELECT COUNT(*), MAX(id) FROM audit_log`).Scan(&cp.Entries, &headID)
+	if err == nil {
+		cp.HeadID = headID.Int64
+		cp.HeadHash, err = s.headHash()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	cp.PublicKey = base64.StdEncoding.EncodeToString(s.signer.Public().(ed25519.PublicKey))
+	cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.signer, cp.payload()))
+	return cp, nil
+}
+
+// SetSigningKey sets the key that signs checkpoints
+func (s *AuditService) SetSigningKey(key ed25519.PrivateKey) {
+	s.signer = key
+}
+
+// LoadAuditSigningKey reads a PEM (PKCS #8) Ed25519 key, creating one if
+// path does not exist
+func LoadAuditSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, block, 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit signing key: %w", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("audit signing key must be Ed25519")
+	}
+	return key, nil
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditChain(t *testing.T) {
+	s := newTestAudit(t)
+	key, err := LoadAuditSigningKey(filepath.Join(t.TempDir(), "keys", "audit.pem"))
+	if err != nil {
+		t.Fatalf("signing key: %v", err)
+	}
+	s.SetSigningKey(key)
+
+	for _, action := range []string{"create_domain", "create_mailbox", "create_alias"} {
+		if err := s.Log(AuditEntry{User: "a@example.com", Action: action, Target: "example.com", Status: "success"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	verify := func(cp *AuditCheckpoint) *AuditChainReport {
+		t.Helper()
+		report, err := s.VerifyChain(cp)
+		if err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+		return report
+	}
+	if r := verify(nil); !r.OK || r.Entries != 3 || r.HeadID != 3 {
+		t.Fatalf("intact chain: %+v", r)
+	}
+
+	cp, err := s.Checkpoint()
+	if err != nil || cp.Verify() != nil || cp.HeadID != 3 || cp.Entries != 3 {
+		t.Fatalf("checkpoint: %+v %v", cp, err)
+	}
+	if r := verify(cp); !r.OK {
+		t.Fatalf("chain against checkpoint: %+v", r)
+	}
+	forged := *cp
+	forged.HeadID = 2
+	if r := verify(&forged); r.OK || !strings.Contains(r.Reason, "signature") {
+		t.Errorf("forged checkpoint: %+v", r)
+	}
+
+	// edits and deletions are found without a checkpoint
+	s.db.Exec(`UPDATE audit_log SET details = 'nothing happened' WHERE id = 2`)
+	if r := verify(nil); r.OK || r.BrokenID != 2 || !strings.Contains(r.Reason, "modified") {
+		t.Errorf("edited entry: %+v", r)
+	}
+	s.db.Exec(`UPDATE audit_log SET details = '' WHERE id = 2`)
+	if r := verify(nil); !r.OK {
+		t.Fatalf("restored entry: %+v", r)
+	}
+
+	row := s.db.QueryRow(`SELECT ` + auditColumns + ` FROM audit_log WHERE id = 2`)
+	deleted, deletedTS, err := scanAuditEntry(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db.Exec(`DELETE FROM audit_log WHERE id = 2`)
+	if r := verify(nil); r.OK || r.BrokenID != 3 || !strings.Contains(r.Reason, "deleted") {
+		t.Errorf("deleted entry: %+v", r)
+	}
+	s.db.Exec(`INSERT INTO audit_log (id, timestamp, user, action, target, status, details, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		deleted.ID, deletedTS, deleted.User, deleted.Action, deleted.Target, deleted.Status, deleted.Details, deleted.PrevHash, deleted.Hash)
+
+	// cutting off the newest entry is only visible against a checkpoint
+	s.db.Exec(`DELETE FROM audit_log WHERE id = 3`)
+	if r := verify(nil); !r.OK {
+		t.Errorf("truncated chain without checkpoint: %+v", r)
+	}
+	if r := verify(cp); r.OK || r.BrokenID != 3 {
+		t.Errorf("truncated chain with checkpoint: %+v", r)
+	}
+}
+
+func TestAuditChainAcrossPruneAndUpgrade(t *testing.T) {
+	s := newTestAudit(t)
+	for i := 0; i < 3; i++ {
+		s.Log(AuditEntry{User: "a@example.com", Action: "create_mailbox", Target: "x@example.com", Status: "success"})
+	}
+
+	// entries from before the chain are linked on startup
+	s.db.Exec(`UPDATE audit_log SET prev_hash = '', hash = ''`)
+	if err := s.chainUnhashed(); err != nil {
+		t.Fatalf("chain unhashed: %v", err)
+	}
+	if r, _ := s.VerifyChain(nil); !r.OK || r.Entries != 3 {
+		t.Fatalf("upgraded chain: %+v", r)
+	}
+
+	s.db.Exec(`UPDATE audit_log SET timestamp = '2020-01-01 00:00:00' WHERE id <= 2`)
+	s.chainUnhashed() // no-op: everything is hashed
+	s.db.Exec(`UPDATE audit_log SET prev_hash = '', hash = ''`)
+	s.chainUnhashed()
+
+	if _, err := s.Prune(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), false); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if r, _ := s.VerifyChain(nil); !r.OK || r.Entries != 1 {
+		t.Errorf("chain after prune: %+v", r)
+	}
+
+	// pruning everything keeps the anchor for the next entry
+	if _, err := s.Prune(time.Now().Add(time.Hour), false); err != nil {
+		t.Fatalf("prune all: %v", err)
+	}
+	s.Log(AuditEntry{User: "a@example.com", Action: "create_alias", Target: "x@example.com", Status: "success"})
+	if r, _ := s.VerifyChain(nil); !r.OK || r.Entries != 1 || r.HeadID != 4 {
+		t.Errorf("chain after pruning everything: %+v", r)
+	}
+}
+
+func TestLoadAuditSigningKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.pem")
+	created, err := LoadAuditSigningKey(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	loaded, err := LoadAuditSigningKey(path)
+	if err != nil || !loaded.Equal(created) {
+		t.Errorf("reload: %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package services
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audit export formats
+const (
+	ExportCSV   = "csv"
+	ExportJSONL = "jsonl"
+)
+
+// auditCSVHeader names the CSV columns, in AuditEntry order
+var auditCSVHeader = []string{"id", "timestamp", "user", "action", "target", "status", "details", "request_id", "client_ip", "user_agent", "server"}
+
+// Export writes every entry matching f (ignoring f.Limit) to w, most recent
+// first, and returns the number of entries written
+func (s *AuditService) Export(w io.Writer, f AuditFilter, format string) (int, error) {
+	if format != ExportCSV && format != ExportJSONL {
+		return 0, invalidf("unsupported export format %q (csv or jsonl)", format)
+	}
+
+	enc := newAuditEncoder(w, format)
+	if err := enc.begin(); err != nil {
+		return 0, err
+	}
+
+	f.Limit = MaxAuditPage
+	count := 0
+	for {
+		page, err := s.Query(f)
+		if err != nil {
+			return count, err
+		}
+		for _, e := range page.Entries {
+			if err := enc.write(e); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if page.NextCursor == 0 {
+			break
+		}
+		f.Before = page.NextCursor
+	}
+	return count, enc.end()
+}
+
+// auditEncoder writes entries as CSV or JSON Lines
+type auditEncoder struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+func newAuditEncoder(w io.Writer, format string) *auditEncoder {
+	if format == ExportCSV {
+		return &auditEncoder{csv: csv.NewWriter(w)}
+	}
+	return &auditEncoder{json: json.NewEncoder(w)}
+}
+
+func (e *auditEncoder) begin() error {
+	if e.csv != nil {
+		return e.csv.Write(auditCSVHeader)
+	}
+	return nil
+}
+
+func (e *auditEncoder) write(entry AuditEntry) error {
+	if e.json != nil {
+		return e.json.Encode(entry)
+	}
+	return e.csv.Write([]string{
+		strconv.FormatInt(entry.ID, 10),
+		entry.Timestamp.UTC().Format(time.RFC3339),
+		csvCell(entry.User),
+		csvCell(entry.Action),
+		csvCell(entry.Target),
+		csvCell(entry.Status),
+		csvCell(entry.Details),
+		csvCell(entry.RequestID),
+		csvCell(entry.ClientIP),
+		csvCell(entry.UserAgent),
+		csvCell(entry.Server),
+	})
+}
+
+func (e *auditEncoder) end() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		return e.csv.Error()
+	}
+	return nil
+}
+
+// csvCell neutralizes values a spreadsheet would run as a formula. Targets
+// and details come from user input, so an entry must not become code when
+// the export is opened.
+func csvCell(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// RetentionPolicy controls how long audit entries are kept
+type RetentionPolicy struct {
+	MaxAge   time.Duration // entries older than this are pruned; 0 keeps everything
+	Archive  bool          // write pruned entries to DATA_DIR/audit-archive first
+	Interval time.Duration // time between prune runs
+}
+
+// PruneResult reports one prune run
+type PruneResult struct {
+	Cutoff  time.Time
+	Deleted int
+	Archive string // archive file, empty if archiving is off or nothing was pruned
+}
+
+// Prune deletes the entries logged before cutoff. With archive set, they are
+// first written as gzipped JSON Lines to a new file under
+// DATA_DIR/audit-archive, and nothing is deleted unless that file was
+// written completely.
+func (s *AuditService) Prune(cutoff time.Time, archive bool) (*PruneResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := &PruneResult{Cutoff: cutoff}
+	ts := cutoff.UTC().Format(auditTimeFormat)
+
+	// Prune up to the newest old entry, by ID, so the chain is only ever
+	// cut at one point
+	var lastID sql.NullInt64
+	if err := s.db.QueryRow(`SELECT MAX(id) FROM audit_log WHERE timestamp < ?`, ts).Scan(&lastID); err != nil {
+		return nil, err
+	}
+	if !lastID.Valid {
+		return result, nil
+	}
+	var anchor string
+	if err := s.db.QueryRow(`SELECT hash FROM audit_log WHERE id = ?`, lastID.Int64).Scan(&anchor); err != nil {
+		return nil, err
+	}
+
+	if archive {
+		path, err := s.archive(cutoff, lastID.Int64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to archive audit entries: %w", err)
+		}
+		result.Archive = path
+	}
+
+	// The newest pruned hash becomes the anchor the oldest kept entry links to
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM audit_log WHERE id <= ?`, lastID.Int64)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`INSERT INTO audit_meta (key, value) VALUES ('anchor', ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, anchor)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	deleted, _ := res.RowsAffected()
+	result.Deleted = int(deleted)
+	return result, nil
+}
+
+// archive writes the entries up to lastID to a gzip file named after the
+// cutoff and returns its path
+func (s *AuditService) archive(cutoff time.Time, lastID int64) (string, error) {
+	dir := filepath.Join(s.dataDir, "audit-archive")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("audit-%s.jsonl.gz", cutoff.UTC().Format("20060102T150405Z")))
+
+	tmp, err := os.CreateTemp(dir, ".audit-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(zw)
+	filter := AuditFilter{Before: lastID + 1, Limit: MaxAuditPage}
+	for {
+		page, err := s.Query(filter)
+		if err != nil {
+			return "", err
+		}
+		for _, e := range page.Entries {
+			if err := enc.Encode(e); err != nil {
+				return "", err
+			}
+		}
+		if page.NextCursor == 0 {
+			break
+		}
+		filter.Before = page.NextCursor
+	}
+
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("archive %s already exists", path)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// RunRetention prunes entries older than policy.MaxAge now and then every
+// policy.Interval until stop is closed. Each run is itself audited.
+func (s *AuditService) RunRetention(policy RetentionPolicy, stop <-chan struct{}) {
+	if policy.MaxAge <= 0 {
+		return
+	}
+	if policy.Interval <= 0 {
+		policy.Interval = 24 * time.Hour
+	}
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+	for {
+		s.pruneOnce(policy)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *AuditService) pruneOnce(policy RetentionPolicy) {
+	cutoff := time.Now().Add(-policy.MaxAge)
+	entry := AuditEntry{User: "system", Action: "prune_audit_log", Target: "audit_log", Status: "success"}
+
+	result, err := s.Prune(cutoff, policy.Archive)
+	switch {
+	case err != nil:
+		log.Printf("Audit retention: %v", err)
+		entry.Status, entry.Details = "failed", err.Error()
+	case result.Deleted == 0:
+		return
+	default:
+		entry.Details = fmt.Sprintf("deleted %d entries before %s", result.Deleted, cutoff.UTC().Format(time.RFC3339))
+		if result.Archive != "" {
+			entry.Details += "; archived to " + result.Archive
+		}
+		log.Printf("Audit retention: %s", entry.Details)
+	}
+
+	if err := s.Log(entry); err != nil {
+		log.Printf("Audit retention: failed to log prune: %v", err)
+	}
+}
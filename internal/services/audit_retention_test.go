@@ -0,0 +1,111 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditExport(t *testing.T) {
+	s := newTestAudit(t)
+	s.Log(AuditEntry{User: "a@example.com", Action: "create_alias", Target: "=HYPERLINK(\"x\")", Status: "success", Details: "targets=b@example.com, c@example.com"})
+	s.Log(AuditEntry{User: "b@example.com", Action: "delete_alias", Target: "info@example.com", Status: "failed", Details: "line one\nline two"})
+
+	var buf bytes.Buffer
+	n, err := s.Export(&buf, AuditFilter{}, ExportCSV)
+	if err != nil || n != 2 {
+		t.Fatalf("csv export: %d %v", n, err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("csv parse: %v", err)
+	}
+	if len(records) != 3 || records[0][0] != "id" || records[1][6] != "line one\nline two" {
+		t.Errorf("csv records: %q", records)
+	}
+	if records[2][4] != `'=HYPERLINK("x")` {
+		t.Errorf("formula not neutralized: %q", records[2][4])
+	}
+
+	buf.Reset()
+	if n, err := s.Export(&buf, AuditFilter{Status: "failed", Limit: 1}, ExportJSONL); err != nil || n != 1 {
+		t.Fatalf("jsonl export: %d %v", n, err)
+	}
+	var e AuditEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil || e.Action != "delete_alias" {
+		t.Errorf("jsonl entry: %+v %v", e, err)
+	}
+
+	if _, err := s.Export(&buf, AuditFilter{}, "xml"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("xml export: %v", err)
+	}
+}
+
+func TestAuditPrune(t *testing.T) {
+	s := newTestAudit(t)
+	for i := 0; i < 4; i++ {
+		s.Log(AuditEntry{User: "a@example.com", Action: "create_mailbox", Target: "x@example.com", Status: "success"})
+		day := time.Date(2026, 1, 1+i, 0, 0, 0, 0, time.UTC).Format(auditTimeFormat)
+		s.db.Exec(`UPDATE audit_log SET timestamp = ? WHERE id = ?`, day, i+1)
+	}
+	cutoff := time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	result, err := s.Prune(cutoff, true)
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if result.Deleted != 2 || !strings.HasPrefix(result.Archive, s.dataDir) {
+		t.Fatalf("prune result: %+v", result)
+	}
+
+	f, err := os.Open(result.Archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("archive is not gzip: %v", err)
+	}
+	var archived []int64
+	for sc := bufio.NewScanner(zr); sc.Scan(); {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		archived = append(archived, e.ID)
+	}
+	if len(archived) != 2 || archived[0] != 2 || archived[1] != 1 {
+		t.Errorf("archived IDs: %v", archived)
+	}
+
+	left, _ := s.GetEntries(10)
+	if len(left) != 2 || left[1].ID != 3 {
+		t.Errorf("remaining entries: %+v", left)
+	}
+
+	// nothing older left: no archive and no deletions
+	result, err = s.Prune(cutoff, true)
+	if err != nil || result.Deleted != 0 || result.Archive != "" {
+		t.Errorf("second prune: %+v %v", result, err)
+	}
+
+	// a failed archive keeps the entries
+	if err := os.WriteFile(s.dataDir+"/audit-archive/blocker", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.dataDir = s.dataDir + "/audit-archive/blocker"
+	if _, err := s.Prune(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), true); err == nil {
+		t.Error("prune succeeded without an archive")
+	}
+	if left, _ := s.GetEntries(10); len(left) != 2 {
+		t.Errorf("entries deleted after failed archive: %d left", len(left))
+	}
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAudit(t *testing.T) *AuditService {
+	t.Helper()
+	t.Setenv("DATA_DIR", t.TempDir())
+	s, err := newAuditService()
+	if err != nil {
+		t.Fatalf("audit service: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestAuditQuery(t *testing.T) {
+	s := newTestAudit(t)
+
+	entries := []AuditEntry{
+		{User: "a@example.com", Action: "create_mailbox", Target: "x@example.com", Status: "success"},
+		{User: "b@example.com", Action: "delete_mailbox", Target: "x@example.com", Status: "failed", Details: "mailbox not found"},
+		{User: "a@example.com", Action: "create_alias", Target: "info@example.com", Status: "success", Details: "targets=x@example.com"},
+		{User: "a@example.com", Action: "create_mailbox", Target: "y@example.com", Status: "success", Details: "100% quota_ok"},
+		{User: "b@example.com", Action: "create_mailbox", Target: "z@example.com", Status: "success"},
+	}
+	for i, e := range entries {
+		if err := s.Log(e); err != nil {
+			t.Fatal(err)
+		}
+		// one entry per day, starting 2026-01-01
+		day := time.Date(2026, 1, 1+i, 12, 0, 0, 0, time.UTC).Format(auditTimeFormat)
+		if _, err := s.db.Exec(`UPDATE audit_log SET timestamp = ? WHERE id = ?`, day, i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(f AuditFilter) []int64 {
+		t.Helper()
+		page, err := s.Query(f)
+		if err != nil {
+			t.Fatalf("query %+v: %v", f, err)
+		}
+		var got []int64
+		for _, e := range page.Entries {
+			got = append(got, e.ID)
+		}
+		return got
+	}
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		want   []int64
+	}{
+		{"all", AuditFilter{}, []int64{5, 4, 3, 2, 1}},
+		{"user", AuditFilter{User: "a@example.com"}, []int64{4, 3, 1}},
+		{"action", AuditFilter{Action: "create_mailbox"}, []int64{5, 4, 1}},
+		{"target", AuditFilter{Target: "x@example.com"}, []int64{2, 1}},
+		{"status", AuditFilter{Status: "failed"}, []int64{2}},
+		{"search", AuditFilter{Search: "NOT FOUND"}, []int64{2}},
+		{"search wildcards are literal", AuditFilter{Search: "0% q"}, []int64{4}},
+		{"search underscore is literal", AuditFilter{Search: "a_q"}, nil},
+		{"date range", AuditFilter{Since: day(2), Until: day(4)}, []int64{3, 2}},
+		{"combined", AuditFilter{User: "a@example.com", Action: "create_mailbox", Since: day(2)}, []int64{4}},
+	}
+	for _, tt := range tests {
+		got := ids(tt.filter)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+
+	// pages of two follow the cursor without gaps or repeats
+	var seen []int64
+	f := AuditFilter{Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("cursor does not terminate")
+		}
+		page, err := s.Query(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range page.Entries {
+			seen = append(seen, e.ID)
+		}
+		if page.NextCursor == 0 {
+			break
+		}
+		f.Before = page.NextCursor
+	}
+	if len(seen) != 5 || seen[0] != 5 || seen[4] != 1 {
+		t.Errorf("paged IDs: %v", seen)
+	}
+
+	for _, f := range []AuditFilter{
+		{Status: "maybe"},
+		{Limit: MaxAuditPage + 1},
+		{Since: day(3), Until: day(3)},
+	} {
+		if _, err := s.Query(f); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%+v: got %v, want ErrInvalid", f, err)
+		}
+	}
+
+	actions, err := s.Actions()
+	if err != nil || len(actions) != 3 || actions[0] != "create_alias" {
+		t.Errorf("actions: %v %v", actions, err)
+	}
+}
+
+func TestAuditQueryUsesIndexes(t *testing.T) {
+	s := newTestAudit(t)
+	for _, column := range []string{"user", "action", "target"} {
+		var id, parent, notused int
+		var detail string
+		err := s.db.QueryRow(`EXPLAIN QUERY PLAN SELECT id FROM audit_log WHERE `+column+` = ? ORDER BY id DESC LIMIT 50`, "x").
+			Scan(&id, &parent, &notused, &detail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "idx_audit_" + column; !strings.Contains(detail, want) {
+			t.Errorf("filter on %s: plan %q does not use %s", column, detail, want)
+		}
+	}
+}
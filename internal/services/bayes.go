@@ -0,0 +1,195 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bayes classes a message can be learned as
+const (
+	BayesSpam = "spam"
+	BayesHam  = "ham"
+)
+
+// MaxLearnSize is the largest message accepted for learning
+const MaxLearnSize = 25 << 20
+
+// TrainingFolders are the mailbox folders messages can be learned from:
+// ham wrongly filed as Junk, spam that made it to the Inbox
+var TrainingFolders = []string{"INBOX", "Junk"}
+
+// StoredMessage is a message in a mailbox folder, as listed by doveadm
+type StoredMessage struct {
+	UID       int    `json:"uid"`
+	Received  string `json:"received"`
+	Size      int64  `json:"size"`
+	MessageID string `json:"message_id"`
+	From      string `json:"from"`
+	Subject   string `json:"subject"`
+}
+
+// storedMessageFields are the doveadm fetch fields of a StoredMessage
+const storedMessageFields = "uid date.received size.physical hdr.message-id hdr.from hdr.subject"
+
+// isTrainingFolder reports whether folder is one of TrainingFolders
+func isTrainingFolder(folder string) bool {
+	for _, f := range TrainingFolders {
+		if f == folder {
+			return true
+		}
+	}
+	return false
+}
+
+// requireMailbox fails with ErrNotFound unless email is a mailbox
+func (m *MailService) requireMailbox(email string) error {
+	mailboxMap, err := readMap(m.exec, virtualMailboxFile)
+	if err != nil {
+		return fmt.Errorf("failed to read mailboxes: %w", err)
+	}
+	if mailboxMap.Lookup(email) == nil {
+		return notFoundf("user not found: %s", email)
+	}
+	return nil
+}
+
+// FolderMessages returns the newest messages of a mailbox folder, at most
+// limit of them (0 for all)
+func (m *MailService) FolderMessages(email, folder string, limit int) ([]StoredMessage, error) {
+	if !isTrainingFolder(folder) {
+		return nil, invalidf("messages can only be learned from %s", strings.Join(TrainingFolders, " or "))
+	}
+	if err := m.requireMailbox(email); err != nil {
+		return nil, err
+	}
+
+	output, err := m.exec.Execute(fmt.Sprintf("doas doveadm -f tab fetch -u %s %s mailbox %s",
+		shellQuote(email), shellQuote(storedMessageFields), shellQuote(folder)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s of %s: %w", folder, email, err)
+	}
+	messages := parseFetchTab(output)
+	sort.Slice(messages, func(i, j int) bool { return messages[i].UID > messages[j].UID })
+	if limit > 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+// parseFetchTab parses doveadm -f tab fetch output of storedMessageFields.
+// Lines that do not start with a UID, e.g. the rest of a folded header, are
+// skipped.
+func parseFetchTab(output string) []StoredMessage {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		return nil
+	}
+	col := make(map[string]int)
+	for i, name := range strings.Split(lines[0], "\t") {
+		col[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	field := func(fields []string, name string) string {
+		if i, ok := col[name]; ok && i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+
+	var messages []StoredMessage
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		uid, err := strconv.Atoi(field(fields, "uid"))
+		if err != nil {
+			continue
+		}
+		size, _ := strconv.ParseInt(field(fields, "size.physical"), 10, 64)
+		messages = append(messages, StoredMessage{
+			UID:       uid,
+			Received:  field(fields, "date.received"),
+			Size:      size,
+			MessageID: field(fields, "hdr.message-id"),
+			From:      decodeHeader(field(fields, "hdr.from")),
+			Subject:   decodeHeader(field(fields, "hdr.subject")),
+		})
+	}
+	return messages
+}
+
+// decodeHeader decodes RFC 2047 encoded words, keeping the raw value if
+// they are malformed
+func decodeHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// FetchMessage returns the raw message with uid from a mailbox folder
+func (m *MailService) FetchMessage(email, folder string, uid int) ([]byte, error) {
+	if !isTrainingFolder(folder) {
+		return nil, invalidf("messages can only be learned from %s", strings.Join(TrainingFolders, " or "))
+	}
+	if uid <= 0 {
+		return nil, invalidf("invalid message UID: %d", uid)
+	}
+	if err := m.requireMailbox(email); err != nil {
+		return nil, err
+	}
+
+	output, err := m.exec.Execute(fmt.Sprintf("doas doveadm -f pager fetch -u %s text mailbox %s uid %d",
+		shellQuote(email), shellQuote(folder), uid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch message %d from %s of %s: %w", uid, folder, email, err)
+	}
+	// The pager format prints "text:" and the message on the next line
+	text, ok := strings.CutPrefix(output, "text:")
+	if !ok || strings.TrimSpace(text) == "" {
+		return nil, notFoundf("message not found: %d in %s of %s", uid, folder, email)
+	}
+	return []byte(strings.TrimPrefix(strings.TrimPrefix(text, "\r"), "\n") + "\n"), nil
+}
+
+// ParseLearnMessage checks that message looks like an RFC 5322 message
+// that can be learned and returns its Message-ID, if any
+func ParseLearnMessage(message []byte) (string, error) {
+	if len(bytes.TrimSpace(message)) == 0 {
+		return "", invalidf("message is empty")
+	}
+	if len(message) > MaxLearnSize {
+		return "", invalidf("message is larger than %d MiB", MaxLearnSize>>20)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil || len(msg.Header) == 0 {
+		return "", invalidf("not an email message (expected headers, a blank line and the body)")
+	}
+	return strings.TrimSpace(msg.Header.Get("Message-Id")), nil
+}
+
+// Learn trains the Bayes classifier with message as class (spam or ham)
+// through the controller
+func (r *RspamdService) Learn(class string, message []byte) error {
+	if class != BayesSpam && class != BayesHam {
+		return invalidf("invalid class %q (expected %s or %s)", class, BayesSpam, BayesHam)
+	}
+	if _, err := ParseLearnMessage(message); err != nil {
+		return err
+	}
+	if r.controller == nil {
+		return fmt.Errorf("rspamd controller not configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if class == BayesSpam {
+		return r.controller.LearnSpam(ctx, message)
+	}
+	return r.controller.LearnHam(ctx, message)
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const (
+	junkHam   = "From: Alice <alice@example.org>\r\nSubject: =?UTF-8?Q?Caf=C3=A9_tonight?=\r\nMessage-ID: <ham-1@example.org>\r\n\r\nSee you at 8.\r\n"
+	inboxSpam = "From: winner@lottery.example\r\nSubject: You won\r\nMessage-ID: <spam-1@lottery.example>\r\n\r\nClaim your prize.\r\n"
+)
+
+func TestFolderMessages(t *testing.T) {
+	mail, fake := newTestMailService(t)
+	mail.SetDKIMAlgorithm(DKIMAlgorithmNone)
+	if err := mail.AddDomain("example.com"); err != nil {
+		t.Fatalf("AddDomain: %v", err)
+	}
+	if err := mail.AddMailbox("example.com", "bob", "Secret123!"); err != nil {
+		t.Fatalf("AddMailbox: %v", err)
+	}
+	fake.AddMessage("bob@example.com", "Junk", inboxSpam)
+	uid := fake.AddMessage("bob@example.com", "Junk", junkHam)
+
+	messages, err := mail.FolderMessages("bob@example.com", "Junk", 0)
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("FolderMessages: %+v %v", messages, err)
+	}
+	if m := messages[0]; m.UID != uid || m.Subject != "Café tonight" || m.From != "Alice <alice@example.org>" ||
+		m.MessageID != "<ham-1@example.org>" || m.Size != int64(len(junkHam)) {
+		t.Errorf("newest message %+v", m)
+	}
+	if messages, _ := mail.FolderMessages("bob@example.com", "Junk", 1); len(messages) != 1 || messages[0].UID != uid {
+		t.Errorf("limit: %+v", messages)
+	}
+	if messages, err := mail.FolderMessages("bob@example.com", "INBOX", 0); err != nil || len(messages) != 0 {
+		t.Errorf("empty inbox: %+v %v", messages, err)
+	}
+
+	raw, err := mail.FetchMessage("bob@example.com", "Junk", uid)
+	// Trailing whitespace is lost to the executor's trimming
+	if err != nil || strings.TrimSpace(string(raw)) != strings.TrimSpace(junkHam) {
+		t.Errorf("FetchMessage = %q, %v", raw, err)
+	}
+	if _, err := mail.FetchMessage("bob@example.com", "Junk", 9); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing UID: %v", err)
+	}
+	if _, err := mail.FetchMessage("bob@example.com", "Sent", uid); !errors.Is(err, ErrInvalid) {
+		t.Errorf("other folder: %v", err)
+	}
+	if _, err := mail.FolderMessages("eve@example.com", "Junk", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown mailbox: %v", err)
+	}
+}
+
+func TestLearn(t *testing.T) {
+	c, learned := fakeController(t, "")
+	rspamd := NewRspamdService(NewFakeExecutor()).WithController(c)
+
+	if err := rspamd.Learn(BayesHam, []byte(junkHam)); err != nil {
+		t.Fatalf("Learn ham: %v", err)
+	}
+	if err := rspamd.Learn(BayesHam, []byte(junkHam)); !errors.Is(err, ErrExists) {
+		t.Errorf("relearn: %v", err)
+	}
+	if err := rspamd.Learn(BayesSpam, []byte(inboxSpam)); err != nil {
+		t.Fatalf("Learn spam: %v", err)
+	}
+	if len(*learned) != 2 || !strings.HasPrefix((*learned)[0], "/learnham From: Alice") || !strings.HasPrefix((*learned)[1], "/learnspam ") {
+		t.Errorf("learned %q", *learned)
+	}
+
+	for name, err := range map[string]error{
+		"class":   rspamd.Learn("phishing", []byte(inboxSpam)),
+		"empty":   rspamd.Learn(BayesSpam, []byte("\r\n")),
+		"no mail": rspamd.Learn(BayesSpam, []byte("just some text")),
+		"too big": rspamd.Learn(BayesSpam, []byte(inboxSpam+strings.Repeat("x", MaxLearnSize))),
+	} {
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if id, err := ParseLearnMessage([]byte(inboxSpam)); err != nil || id != "<spam-1@lottery.example>" {
+		t.Errorf("ParseLearnMessage = %q, %v", id, err)
+	}
+	if err := NewRspamdService(NewFakeExecutor()).Learn(BayesSpam, []byte(inboxSpam)); err == nil {
+		t.Error("learn without a controller")
+	}
+}
@@ -0,0 +1,238 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ChangeSet applies a multi-step change to the mail server. It snapshots
+// every file it touches before the first step runs; if a step fails, the
+// completed steps are undone, the snapshots restored and services reloaded.
+//
+// Snapshots are read and restored under the executor's edit lock. A file
+// someone else modified while the change set ran is not restored, as that
+// would drop their edit; it is reported as a conflict instead.
+type ChangeSet struct {
+	exec   Executor
+	op     string
+	target string
+
+	paths    []string
+	steps    []changeStep
+	onRevert []string
+}
+
+type changeStep struct {
+	name string
+	do   func() error
+	undo func() error
+}
+
+type fileSnapshot struct {
+	path    string
+	content string
+	exists  bool
+
+	// expected is the content the change set left in the file, and
+	// conflict is set once a foreign edit was seen
+	expected string
+	conflict bool
+}
+
+// writeObserver is implemented by executors that report the writes
+// committed through them (FileRecorder)
+type writeObserver interface {
+	Observe(fn func(path, before, after string)) (stop func())
+}
+
+// errReadOnly aborts an edit that only reads the file under the lock
+var errReadOnly = errors.New("read only")
+
+// RollbackError is returned when a change set step failed and the change
+// set was rolled back
+type RollbackError struct {
+	Op          string
+	Target      string
+	Step        string
+	Err         error
+	Restored    []string
+	Conflicts   []string
+	RollbackErr error
+}
+
+func (e *RollbackError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("%s (rollback failed: %v)", e.Err, e.RollbackErr)
+	}
+	return fmt.Sprintf("%s (changes rolled back)", e.Err)
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// NewChangeSet creates an empty change set for the named operation
+func NewChangeSet(exec Executor, op, target string) *ChangeSet {
+	return &ChangeSet{exec: exec, op: op, target: target}
+}
+
+// Snapshot registers files to capture before the first step runs
+func (cs *ChangeSet) Snapshot(paths ...string) *ChangeSet {
+	cs.paths = append(cs.paths, paths...)
+	return cs
+}
+
+// Step adds a step whose effects are covered by the file snapshots
+func (cs *ChangeSet) Step(name string, do func() error) *ChangeSet {
+	return cs.StepWithUndo(name, do, nil)
+}
+
+// StepWithUndo adds a step with an explicit undo action, for effects that
+// file snapshots cannot restore (e.g. created directories)
+func (cs *ChangeSet) StepWithUndo(name string, do, undo func() error) *ChangeSet {
+	cs.steps = append(cs.steps, changeStep{name: name, do: do, undo: undo})
+	return cs
+}
+
+// OnRollback registers commands to run after the snapshots are restored,
+// such as postmap and service reloads
+func (cs *ChangeSet) OnRollback(cmds ...string) *ChangeSet {
+	cs.onRevert = append(cs.onRevert, cmds...)
+	return cs
+}
+
+// Run executes all steps, rolling back on the first failure
+func (cs *ChangeSet) Run() error {
+	snapshots := make([]*fileSnapshot, 0, len(cs.paths))
+	byPath := make(map[string]*fileSnapshot)
+	for _, path := range cs.paths {
+		snap, err := cs.snapshot(path)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %w", path, err)
+		}
+		snapshots = append(snapshots, snap)
+		byPath[path] = snap
+	}
+
+	// Track what the steps write, so a foreign edit merged into one of our
+	// writes, or landing after it, is not clobbered by the rollback
+	stop := func() {}
+	observer, tracked := cs.exec.(writeObserver)
+	if tracked {
+		stop = observer.Observe(func(path, before, after string) {
+			if snap, ok := byPath[path]; ok {
+				snap.conflict = snap.conflict || before != snap.expected
+				snap.expected = after
+			}
+		})
+	}
+
+	for i, step := range cs.steps {
+		if err := step.do(); err != nil {
+			stop()
+			if !tracked {
+				// Without a write journal the best reference is the
+				// state the steps left behind
+				for _, snap := range snapshots {
+					var readErr error
+					if snap.expected, _, readErr = readLocked(cs.exec, snap.path); readErr != nil {
+						snap.conflict = true
+					}
+				}
+			}
+			return cs.rollback(step.name, err, cs.steps[:i], snapshots)
+		}
+	}
+	stop()
+	return nil
+}
+
+// snapshot reads path under the edit lock
+func (cs *ChangeSet) snapshot(path string) (*fileSnapshot, error) {
+	content, exists, err := readLocked(cs.exec, path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSnapshot{path: path, content: content, exists: exists, expected: content}, nil
+}
+
+// readLocked reads path under the edit lock, and whether it exists
+func readLocked(exec Executor, path string) (string, bool, error) {
+	exists, err := fileExists(exec, path)
+	if err != nil {
+		return "", false, err
+	}
+	var content string
+	err = editFile(exec, path, func(current string) (string, error) {
+		content = current
+		return "", errReadOnly
+	})
+	if err != nil && !errors.Is(err, errReadOnly) {
+		return "", false, err
+	}
+	// Created since the existence check
+	exists = exists || content != ""
+	return content, exists, nil
+}
+
+// rollback undoes completed steps in reverse order, restores the snapshots
+// and runs the rollback commands
+func (cs *ChangeSet) rollback(failed string, cause error, done []changeStep, snapshots []*fileSnapshot) error {
+	rbErr := &RollbackError{
+		Op:     cs.op,
+		Target: cs.target,
+		Step:   failed,
+		Err:    cause,
+	}
+
+	var failures []string
+	for i := len(done) - 1; i >= 0; i-- {
+		if done[i].undo == nil {
+			continue
+		}
+		if err := done[i].undo(); err != nil {
+			failures = append(failures, fmt.Sprintf("undo %s: %v", done[i].name, err))
+		}
+	}
+
+	for _, snap := range snapshots {
+		if err := cs.restore(snap); err != nil {
+			if errors.Is(err, ErrFileChanged) {
+				rbErr.Conflicts = append(rbErr.Conflicts, snap.path)
+			}
+			failures = append(failures, fmt.Sprintf("restore %s: %v", snap.path, err))
+			continue
+		}
+		rbErr.Restored = append(rbErr.Restored, snap.path)
+	}
+
+	for _, cmd := range cs.onRevert {
+		if _, err := cs.exec.Execute(cmd); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", cmd, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		rbErr.RollbackErr = fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return rbErr
+}
+
+// restore puts the snapshot back under the edit lock, unless the file no
+// longer holds what the change set left in it
+func (cs *ChangeSet) restore(snap *fileSnapshot) error {
+	err := editFile(cs.exec, snap.path, func(current string) (string, error) {
+		if snap.conflict || current != snap.expected {
+			return "", fmt.Errorf("kept as is, %w", ErrFileChanged)
+		}
+		if !snap.exists {
+			return "", errReadOnly
+		}
+		return snap.content, nil
+	})
+	if errors.Is(err, errReadOnly) {
+		_, err = cs.exec.Execute("doas rm -f " + shellQuote(snap.path))
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRollbackKeepsConcurrentEdits(t *testing.T) {
+	const path = "/etc/postfix/virtual_alias"
+	ours := func(exec Executor) func() error {
+		return func() error {
+			return editFile(exec, path, func(content string) (string, error) {
+				return content + "ours@example.com bob@example.com\n", nil
+			})
+		}
+	}
+	foreign := func(fake *FakeExecutor) func() error {
+		return func() error {
+			content, _ := fake.File(path)
+			fake.SetFile(path, content+"theirs@example.com eve@example.com\n")
+			return nil
+		}
+	}
+	fail := func() error { return errors.New("boom") }
+
+	for _, tc := range []struct {
+		name     string
+		recorded bool
+		steps    func(exec Executor, fake *FakeExecutor) []func() error
+		conflict bool
+	}{
+		{"untouched", true, func(exec Executor, fake *FakeExecutor) []func() error {
+			return []func() error{ours(exec), fail}
+		}, false},
+		{"edited before our write", true, func(exec Executor, fake *FakeExecutor) []func() error {
+			return []func() error{foreign(fake), ours(exec), fail}
+		}, true},
+		{"edited after our write", true, func(exec Executor, fake *FakeExecutor) []func() error {
+			return []func() error{ours(exec), foreign(fake), fail}
+		}, true},
+		{"unrecorded, untouched", false, func(exec Executor, fake *FakeExecutor) []func() error {
+			return []func() error{ours(exec), fail}
+		}, false},
+	} {
+		fake := NewFakeExecutor()
+		fake.SetFile(path, "a@example.com bob@example.com\n")
+		var exec Executor = fake
+		if tc.recorded {
+			exec = NewFileRecorder(fake)
+		}
+
+		cs := NewChangeSet(exec, "test", "example.com").Snapshot(path)
+		for _, step := range tc.steps(exec, fake) {
+			cs.Step("step", step)
+		}
+		before, _ := fake.File(path)
+		err := cs.Run()
+		after, _ := fake.File(path)
+
+		var rb *RollbackError
+		if !errors.As(err, &rb) {
+			t.Fatalf("%s: expected RollbackError, got %v", tc.name, err)
+		}
+		if tc.conflict {
+			if len(rb.Conflicts) != 1 || rb.RollbackErr == nil || after == before {
+				t.Errorf("%s: conflict not reported or file clobbered: %+v %q", tc.name, rb, after)
+			}
+			continue
+		}
+		if len(rb.Conflicts) != 0 || rb.RollbackErr != nil || after != before {
+			t.Errorf("%s: not restored: %+v %q", tc.name, rb, after)
+		}
+	}
+}
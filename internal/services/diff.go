@@ -0,0 +1,230 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// maxDiffEdits bounds the work of the line diff; beyond it the whole file
+// is shown as replaced
+const maxDiffEdits = 2000
+
+// diffOp is one line of an edit script: ' ' kept, '-' removed, '+' added
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// UnifiedDiff returns the unified diff of a file, in the format of
+// diff -u, or "" if before and after are equal. A file that did not exist
+// is diffed against /dev/null.
+func UnifiedDiff(path string, before, after string, existed, exists bool) string {
+	if before == after && existed == exists {
+		return ""
+	}
+
+	from, to := "a"+path, "b"+path
+	if !existed {
+		from = "/dev/null"
+	}
+	if !exists {
+		to = "/dev/null"
+	}
+
+	ops := diffLines(splitLines(before), splitLines(after))
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", from, to)
+	writeHunks(&sb, ops)
+	return sb.String()
+}
+
+// splitLines splits content into lines that keep their newline, so a
+// missing final newline shows up as a change
+func splitLines(content string) []string {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a shortest edit script with Myers' algorithm
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+	off := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		if d > maxDiffEdits {
+			return replaceAll(a, b)
+		}
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	// walk the trace back from the end, collecting operations in reverse
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+				y--
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+				x--
+			}
+		}
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+func replaceAll(a, b []string) []diffOp {
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a {
+		ops = append(ops, diffOp{'-', line})
+	}
+	for _, line := range b {
+		ops = append(ops, diffOp{'+', line})
+	}
+	return ops
+}
+
+// writeHunks writes the changes of ops as hunks with diffContext lines of
+// context, merging hunks whose context would overlap
+func writeHunks(sb *strings.Builder, ops []diffOp) {
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// extend the hunk while the next change is within 2*diffContext
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		stop := end + diffContext
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		// line numbers of the hunk start in the old and new file
+		aLine, bLine := 1, 1
+		for _, op := range ops[:start] {
+			if op.kind != '+' {
+				aLine++
+			}
+			if op.kind != '-' {
+				bLine++
+			}
+		}
+		aLen, bLen := 0, 0
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		if aLen == 0 {
+			aLine--
+		}
+		if bLen == 0 {
+			bLine--
+		}
+
+		fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(aLine, aLen), hunkRange(bLine, bLen))
+		for _, op := range ops[start:stop] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = stop
+	}
+}
+
+func hunkRange(line, n int) string {
+	if n == 1 {
+		return fmt.Sprint(line)
+	}
+	return fmt.Sprintf("%d,%d", line, n)
+}
+
+// secretPatterns match secrets in config files and maps. The first group
+// is kept, the rest of the match is replaced.
+var secretPatterns = []*regexp.Regexp{
+	// dovecot passwd-file hashes: user:{SCHEME}hash:uid:...
+	regexp.MustCompile(`(\{[A-Z0-9.-]+\})[^:\s]+`),
+	// key = value, key: value and key value settings named like secrets
+	regexp.MustCompile(`(?i)(\b[\w.-]*(?:password|passwd|secret|token|api_?key|private_?key|requirepass|masterauth)[\w.-]*"?[ \t]*(?:[=:][ \t]*|[ \t]+))("[^"]*"|'[^']*'|[^\s;,]+)`),
+}
+
+// pemBlock matches private keys pasted into a file
+var pemBlock = regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`)
+
+// RedactSecrets replaces password hashes, secret settings and private keys
+// in text with [REDACTED]
+func RedactSecrets(text string) string {
+	text = pemBlock.ReplaceAllString(text, "[REDACTED PRIVATE KEY]")
+	for _, re := range secretPatterns {
+		text = re.ReplaceAllString(text, "${1}[REDACTED]")
+	}
+	return text
+}
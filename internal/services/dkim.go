@@ -0,0 +1,470 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DKIM keys live on the mail host: the private keys in dkimKeyDir, readable
+// by rspamd only, and the key list in dkimStateFile. dkimSigningConf is
+// generated from the key list and owned by mailhub-admin.
+const (
+	dkimKeyDir      = "/var/lib/rspamd/dkim"
+	dkimStateFile   = dkimKeyDir + "/keys.json"
+	dkimSigningConf = "/etc/rspamd/local.d/dkim_signing.conf"
+)
+
+// DKIM key algorithms. DKIMAlgorithmNone turns off key creation for new
+// domains.
+const (
+	DKIMAlgorithmRSA     = "rsa"
+	DKIMAlgorithmEd25519 = "ed25519"
+	DKIMAlgorithmNone    = "none"
+
+	dkimRSABits = 2048
+)
+
+// DKIM key states. A domain signs with its active key. A pending key is
+// published in DNS ahead of a rotation; a retired key stays in DNS until
+// mail signed with it has been delivered, then it is removed.
+const (
+	DKIMStatusPending = "pending"
+	DKIMStatusActive  = "active"
+	DKIMStatusRetired = "retired"
+)
+
+// DefaultDKIMAlgorithm is the algorithm of keys created with new domains
+const DefaultDKIMAlgorithm = DKIMAlgorithmRSA
+
+// DKIMKey is a signing key of a domain
+type DKIMKey struct {
+	Domain    string `json:"domain"`
+	Selector  string `json:"selector"`
+	Algorithm string `json:"algorithm"`
+	Status    string `json:"status"`
+
+	// PublicKey is the base64 "p=" value of the DNS record
+	PublicKey string `json:"public_key"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	ActivatedAt *time.Time `json:"activated_at,omitempty"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
+}
+
+// KeyPath returns the path of the private key on the mail host
+func (k DKIMKey) KeyPath() string {
+	return fmt.Sprintf("%s/%s.%s.key", dkimKeyDir, k.Domain, k.Selector)
+}
+
+// RecordName returns the DNS name of the key's TXT record
+func (k DKIMKey) RecordName() string {
+	return k.Selector + "._domainkey." + k.Domain
+}
+
+// RecordValue returns the content of the key's TXT record
+func (k DKIMKey) RecordValue() string {
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", k.Algorithm, k.PublicKey)
+}
+
+// ZoneRecord returns the TXT record in zone file syntax. The value is split
+// into strings of at most 255 characters, as 2048-bit RSA keys do not fit
+// in one.
+func (k DKIMKey) ZoneRecord() string {
+	value := k.RecordValue()
+	var parts []string
+	for len(value) > 255 {
+		parts = append(parts, `"`+value[:255]+`"`)
+		value = value[255:]
+	}
+	parts = append(parts, `"`+value+`"`)
+	return fmt.Sprintf("%s. IN TXT ( %s )", k.RecordName(), strings.Join(parts, " "))
+}
+
+// ValidDKIMAlgorithm reports whether alg is a supported key algorithm
+func ValidDKIMAlgorithm(alg string) bool {
+	return alg == DKIMAlgorithmRSA || alg == DKIMAlgorithmEd25519
+}
+
+// SetDKIMAlgorithm selects the algorithm of the key created with each new
+// domain, or "none" to add domains without a key
+func (m *MailService) SetDKIMAlgorithm(alg string) error {
+	alg = strings.ToLower(alg)
+	if !ValidDKIMAlgorithm(alg) && alg != DKIMAlgorithmNone {
+		return fmt.Errorf("unsupported DKIM algorithm: %s", alg)
+	}
+	m.dkimAlgorithm = alg
+	return nil
+}
+
+var dkimSelectorRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// dkimState is the content of dkimStateFile
+type dkimState struct {
+	Keys []DKIMKey `json:"keys"`
+}
+
+func parseDKIMState(content string) (*dkimState, error) {
+	st := &dkimState{}
+	if strings.TrimSpace(content) == "" {
+		return st, nil
+	}
+	if err := json.Unmarshal([]byte(content), st); err != nil {
+		return nil, fmt.Errorf("corrupt %s: %w", dkimStateFile, err)
+	}
+	return st, nil
+}
+
+// find returns the key of domain with the given selector, or nil
+func (st *dkimState) find(domain, selector string) *DKIMKey {
+	for i := range st.Keys {
+		if st.Keys[i].Domain == domain && st.Keys[i].Selector == selector {
+			return &st.Keys[i]
+		}
+	}
+	return nil
+}
+
+// active returns the active key of domain, or nil
+func (st *dkimState) active(domain string) *DKIMKey {
+	for i := range st.Keys {
+		if st.Keys[i].Domain == domain && st.Keys[i].Status == DKIMStatusActive {
+			return &st.Keys[i]
+		}
+	}
+	return nil
+}
+
+// readDKIMState reads the key list; a missing file is an empty list
+func (m *MailService) readDKIMState() (*dkimState, error) {
+	exists, err := fileExists(m.exec, dkimStateFile)
+	if err != nil || !exists {
+		return &dkimState{}, err
+	}
+	content, err := m.exec.ReadFile(dkimStateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DKIM keys: %w", err)
+	}
+	return parseDKIMState(content)
+}
+
+// DKIMKeys returns the keys of domain, or of all domains if domain is
+// empty, sorted by domain and creation time
+func (m *MailService) DKIMKeys(domain string) ([]DKIMKey, error) {
+	st, err := m.readDKIMState()
+	if err != nil {
+		return nil, err
+	}
+	var keys []DKIMKey
+	for _, k := range st.Keys {
+		if domain == "" || k.Domain == domain {
+			keys = append(keys, k)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].Domain != keys[j].Domain {
+			return keys[i].Domain < keys[j].Domain
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// generateDKIMKey creates a key pair and returns the PEM private key and
+// the base64 public key for DNS: the SubjectPublicKeyInfo for RSA, the raw
+// key for Ed25519 (RFC 8463)
+func generateDKIMKey(alg string) (string, string, error) {
+	switch alg {
+	case DKIMAlgorithmRSA:
+		key, err := rsa.GenerateKey(rand.Reader, dkimRSABits)
+		if err != nil {
+			return "", "", err
+		}
+		pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			return "", "", err
+		}
+		priv := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		return string(priv), base64.StdEncoding.EncodeToString(pub), nil
+	case DKIMAlgorithmEd25519:
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return "", "", err
+		}
+		priv := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		return string(priv), base64.StdEncoding.EncodeToString(pub), nil
+	}
+	return "", "", invalidf("unsupported DKIM algorithm: %s", alg)
+}
+
+// renderDKIMSigning renders dkim_signing.conf with the active key of each
+// domain
+func renderDKIMSigning(st *dkimState) string {
+	var sb strings.Builder
+	sb.WriteString("# Managed by mailhub-admin; manual changes are overwritten.\n")
+	sb.WriteString("# Keys are listed in " + dkimStateFile + ".\n")
+	sb.WriteString("domain {\n")
+	var active []DKIMKey
+	for _, k := range st.Keys {
+		if k.Status == DKIMStatusActive {
+			active = append(active, k)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Domain < active[j].Domain })
+	for _, k := range active {
+		fmt.Fprintf(&sb, "  %q {\n    selectors [\n      { path = %q; selector = %q; }\n    ];\n  }\n",
+			k.Domain, k.KeyPath(), k.Selector)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// updateDKIM returns a step that applies fn to the key list and regenerates
+// dkim_signing.conf from the result
+func (m *MailService) updateDKIM(fn func(st *dkimState) error) func() error {
+	return func() error {
+		var updated *dkimState
+		err := editFile(m.exec, dkimStateFile, func(content string) (string, error) {
+			st, err := parseDKIMState(content)
+			if err != nil {
+				return "", err
+			}
+			if err := fn(st); err != nil {
+				return "", err
+			}
+			data, err := json.MarshalIndent(st, "", "  ")
+			if err != nil {
+				return "", err
+			}
+			updated = st
+			return string(data) + "\n", nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update DKIM keys: %w", err)
+		}
+		if err := m.exec.WriteFile(dkimSigningConf, renderDKIMSigning(updated)); err != nil {
+			return fmt.Errorf("failed to write %s: %w", dkimSigningConf, err)
+		}
+		return nil
+	}
+}
+
+// reloadRspamd reloads rspamd so it picks up dkim_signing.conf
+func (m *MailService) reloadRspamd() error {
+	if _, err := m.exec.Execute("doas rc-service rspamd reload"); err != nil {
+		return fmt.Errorf("failed to reload rspamd: %w", err)
+	}
+	return nil
+}
+
+// dkimChangeSet is a change set over the DKIM key list and signing config
+func (m *MailService) dkimChangeSet(op, domain string) *ChangeSet {
+	return NewChangeSet(m.exec, op, domain).
+		Snapshot(dkimStateFile, dkimSigningConf).
+		OnRollback("doas rc-service rspamd reload")
+}
+
+// writeDKIMKey returns do/undo actions that install a private key readable
+// by rspamd only. The key directory is not world-accessible, so the key is
+// never exposed while its mode is being set.
+func (m *MailService) writeDKIMKey(path, key string) (func() error, func() error) {
+	do := func() error {
+		dir := fmt.Sprintf("doas mkdir -p %s && doas chown root:rspamd %s && doas chmod 750 %s", dkimKeyDir, dkimKeyDir, dkimKeyDir)
+		if _, err := m.exec.Execute(dir); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dkimKeyDir, err)
+		}
+		if err := m.exec.WriteFile(path, key); err != nil {
+			return fmt.Errorf("failed to write DKIM key: %w", err)
+		}
+		if _, err := m.exec.Execute(fmt.Sprintf("doas chown root:rspamd %s && doas chmod 640 %s", shellQuote(path), shellQuote(path))); err != nil {
+			return fmt.Errorf("failed to protect DKIM key: %w", err)
+		}
+		return nil
+	}
+	undo := func() error {
+		_, err := m.exec.Execute("doas rm -f " + shellQuote(path))
+		return err
+	}
+	return do, undo
+}
+
+// dkimKeySteps generates a key for domain and adds the steps that install
+// it to cs. The first key of a domain is active at once; later keys are
+// pending until ActivateDKIMKey. key is filled in when the change set runs.
+func (m *MailService) dkimKeySteps(cs *ChangeSet, domain, selector, alg string, key *DKIMKey) (*ChangeSet, error) {
+	priv, pub, err := generateDKIMKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	*key = DKIMKey{Domain: domain, Selector: selector, Algorithm: alg, PublicKey: pub, CreatedAt: now}
+	writeKey, removeKey := m.writeDKIMKey(key.KeyPath(), priv)
+
+	return cs.
+		StepWithUndo("write DKIM key", writeKey, removeKey).
+		Step("update DKIM keys", m.updateDKIM(func(st *dkimState) error {
+			if st.find(domain, selector) != nil {
+				return existsf("DKIM selector %s already exists for %s", selector, domain)
+			}
+			key.Status = DKIMStatusPending
+			if st.active(domain) == nil {
+				key.Status = DKIMStatusActive
+				key.ActivatedAt = &now
+			}
+			st.Keys = append(st.Keys, *key)
+			return nil
+		})).
+		Step("reload rspamd", m.reloadRspamd), nil
+}
+
+// nextDKIMSelector returns a selector named after the current month, e.g.
+// "mh202610", with a suffix if the domain already has one of that name
+func (m *MailService) nextDKIMSelector(domain string) (string, error) {
+	keys, err := m.DKIMKeys(domain)
+	if err != nil {
+		return "", err
+	}
+	base := "mh" + time.Now().UTC().Format("200601")
+	selector := base
+	for n := 2; ; n++ {
+		taken := false
+		for _, k := range keys {
+			if k.Selector == selector {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return selector, nil
+		}
+		selector = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// CreateDKIMKey generates a key for an existing domain. An empty selector
+// is named after the current month and an empty algorithm is the configured
+// one (RSA if new domains get no key). The key signs at once if the domain
+// has no active key; otherwise it is pending, to be published in DNS before
+// ActivateDKIMKey switches signing to it.
+func (m *MailService) CreateDKIMKey(domain, selector, alg string) (*DKIMKey, error) {
+	if err := m.requireDomain(domain); err != nil {
+		return nil, err
+	}
+	if alg == "" {
+		alg = m.dkimAlgorithm
+		if alg == DKIMAlgorithmNone {
+			alg = DKIMAlgorithmRSA
+		}
+	}
+	if !ValidDKIMAlgorithm(alg) {
+		return nil, invalidf("unsupported DKIM algorithm: %s", alg)
+	}
+	selector = strings.ToLower(strings.TrimSpace(selector))
+	if selector == "" {
+		var err error
+		if selector, err = m.nextDKIMSelector(domain); err != nil {
+			return nil, err
+		}
+	}
+	if !dkimSelectorRe.MatchString(selector) {
+		return nil, invalidf("invalid DKIM selector: %q", selector)
+	}
+
+	key := &DKIMKey{}
+	cs, err := m.dkimKeySteps(m.dkimChangeSet("create_dkim_key", domain), domain, selector, alg, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.Run(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ActivateDKIMKey switches the signing of domain to a pending key. The key
+// that was active is retired; keep its DNS record until mail signed with it
+// has been delivered, then remove it with RemoveDKIMKey.
+func (m *MailService) ActivateDKIMKey(domain, selector string) error {
+	return m.dkimChangeSet("activate_dkim_key", domain).
+		Step("update DKIM keys", m.updateDKIM(func(st *dkimState) error {
+			key := st.find(domain, selector)
+			if key == nil {
+				return notFoundf("DKIM key not found: %s for %s", selector, domain)
+			}
+			if key.Status != DKIMStatusPending {
+				return invalidf("DKIM key %s is %s, only pending keys can be activated", selector, key.Status)
+			}
+			now := time.Now().UTC()
+			if old := st.active(domain); old != nil {
+				old.Status = DKIMStatusRetired
+				old.RetiredAt = &now
+			}
+			key.Status = DKIMStatusActive
+			key.ActivatedAt = &now
+			return nil
+		})).
+		Step("reload rspamd", m.reloadRspamd).
+		Run()
+}
+
+// RemoveDKIMKey deletes a pending or retired key of domain and its private
+// key file. The active key cannot be removed.
+func (m *MailService) RemoveDKIMKey(domain, selector string) error {
+	var path string
+	return m.dkimChangeSet("remove_dkim_key", domain).
+		Step("update DKIM keys", m.updateDKIM(func(st *dkimState) error {
+			key := st.find(domain, selector)
+			if key == nil {
+				return notFoundf("DKIM key not found: %s for %s", selector, domain)
+			}
+			if key.Status == DKIMStatusActive {
+				return invalidf("DKIM key %s is active; activate another key first", selector)
+			}
+			path = key.KeyPath()
+			kept := st.Keys[:0]
+			for _, k := range st.Keys {
+				if k.Domain != domain || k.Selector != selector {
+					kept = append(kept, k)
+				}
+			}
+			st.Keys = kept
+			return nil
+		})).
+		Step("remove DKIM key", func() error {
+			if _, err := m.exec.Execute("doas rm -f " + shellQuote(path)); err != nil {
+				return fmt.Errorf("failed to remove DKIM key: %w", err)
+			}
+			return nil
+		}).
+		Run()
+}
+
+// requireDomain returns a not-found error unless domain is configured
+func (m *MailService) requireDomain(domain string) error {
+	if !isValidDomain(domain) {
+		return invalidf("invalid domain format: %s", domain)
+	}
+	domains, err := m.ListDomains()
+	if err != nil {
+		return err
+	}
+	for _, d := range domains {
+		if d.Name == domain {
+			return nil
+		}
+	}
+	return notFoundf("domain not found: %s", domain)
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAddDomainCreatesDKIMKey(t *testing.T) {
+	mail, fake := newTestMailService(t)
+	if err := mail.SetDKIMAlgorithm("ed25519"); err != nil {
+		t.Fatalf("SetDKIMAlgorithm: %v", err)
+	}
+	if err := mail.AddDomain("example.com"); err != nil {
+		t.Fatalf("AddDomain: %v", err)
+	}
+
+	keys, err := mail.DKIMKeys("example.com")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("DKIMKeys: %+v %v", keys, err)
+	}
+	key := keys[0]
+	if key.Status != DKIMStatusActive || key.Algorithm != DKIMAlgorithmEd25519 {
+		t.Errorf("new domain key %+v", key)
+	}
+	if pub, err := base64.StdEncoding.DecodeString(key.PublicKey); err != nil || len(pub) != 32 {
+		t.Errorf("ed25519 public key is not the raw key: %q", key.PublicKey)
+	}
+	if !strings.HasPrefix(key.RecordValue(), "v=DKIM1; k=ed25519; p=") || key.RecordName() != key.Selector+"._domainkey.example.com" {
+		t.Errorf("record %s %s", key.RecordName(), key.RecordValue())
+	}
+
+	priv, ok := fake.File(key.KeyPath())
+	if !ok || !strings.Contains(priv, "BEGIN PRIVATE KEY") {
+		t.Fatalf("private key not installed: %q", priv)
+	}
+	conf, _ := fake.File(dkimSigningConf)
+	if !strings.Contains(conf, `"example.com" {`) || !strings.Contains(conf, `selector = "`+key.Selector+`"`) {
+		t.Errorf("signing config:\n%s", conf)
+	}
+	if fake.Reloads("rspamd") == 0 {
+		t.Error("rspamd was not reloaded")
+	}
+
+	if err := mail.SetDKIMAlgorithm("none"); err != nil {
+		t.Fatalf("SetDKIMAlgorithm: %v", err)
+	}
+	if err := mail.AddDomain("example.org"); err != nil {
+		t.Fatalf("AddDomain: %v", err)
+	}
+	if keys, _ := mail.DKIMKeys("example.org"); len(keys) != 0 {
+		t.Errorf("key created with algorithm none: %+v", keys)
+	}
+}
+
+func TestDKIMRotation(t *testing.T) {
+	mail, fake := newTestMailService(t)
+	mail.SetDKIMAlgorithm("none")
+	if err := mail.AddDomain("example.com"); err != nil {
+		t.Fatalf("AddDomain: %v", err)
+	}
+
+	if _, err := mail.CreateDKIMKey("example.net", "", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("key for unknown domain: %v", err)
+	}
+	if _, err := mail.CreateDKIMKey("example.com", "Bad_Selector", ""); !errors.Is(err, ErrInvalid) {
+		t.Errorf("invalid selector: %v", err)
+	}
+
+	first, err := mail.CreateDKIMKey("example.com", "one", "ed25519")
+	if err != nil || first.Status != DKIMStatusActive {
+		t.Fatalf("first key: %+v %v", first, err)
+	}
+	second, err := mail.CreateDKIMKey("example.com", "two", "rsa")
+	if err != nil || second.Status != DKIMStatusPending {
+		t.Fatalf("second key: %+v %v", second, err)
+	}
+	if _, err := mail.CreateDKIMKey("example.com", "two", ""); !errors.Is(err, ErrExists) {
+		t.Errorf("duplicate selector: %v", err)
+	}
+	if record := second.ZoneRecord(); !strings.HasPrefix(record, "two._domainkey.example.com. IN TXT ( \"v=DKIM1; k=rsa; p=") || !strings.Contains(record, `" "`) {
+		t.Errorf("RSA zone record not split: %s", record)
+	}
+
+	// The pending key is published, not used for signing
+	conf, _ := fake.File(dkimSigningConf)
+	if !strings.Contains(conf, `selector = "one"`) || strings.Contains(conf, `selector = "two"`) {
+		t.Errorf("signing config before rotation:\n%s", conf)
+	}
+	if err := mail.RemoveDKIMKey("example.com", "one"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("removed the active key: %v", err)
+	}
+
+	if err := mail.ActivateDKIMKey("example.com", "two"); err != nil {
+		t.Fatalf("ActivateDKIMKey: %v", err)
+	}
+	keys, _ := mail.DKIMKeys("example.com")
+	if len(keys) != 2 || keys[0].Status != DKIMStatusRetired || keys[1].Status != DKIMStatusActive || keys[0].RetiredAt == nil {
+		t.Fatalf("keys after rotation: %+v", keys)
+	}
+	conf, _ = fake.File(dkimSigningConf)
+	if strings.Contains(conf, `selector = "one"`) || !strings.Contains(conf, `selector = "two"`) {
+		t.Errorf("signing config after rotation:\n%s", conf)
+	}
+	if _, ok := fake.File(first.KeyPath()); !ok {
+		t.Error("retired key removed before its DNS record")
+	}
+
+	if err := mail.RemoveDKIMKey("example.com", "one"); err != nil {
+		t.Fatalf("RemoveDKIMKey: %v", err)
+	}
+	if _, ok := fake.File(first.KeyPath()); ok {
+		t.Error("retired key file left behind")
+	}
+
+	// A failed reload rolls the activation back
+	if _, err := mail.CreateDKIMKey("example.com", "three", "ed25519"); err != nil {
+		t.Fatalf("third key: %v", err)
+	}
+	fake.FailOn("rc-service rspamd reload", "rspamd: reload failed")
+	if err := mail.ActivateDKIMKey("example.com", "three"); err == nil {
+		t.Fatal("expected activation to fail")
+	}
+	if after, _ := fake.File(dkimSigningConf); after != conf {
+		t.Errorf("signing config not restored:\n%s", after)
+	}
+}
+
+func TestDeleteDomainRemovesDKIMKeys(t *testing.T) {
+	mail, fake := newTestMailService(t)
+	mail.SetDKIMAlgorithm("ed25519")
+	mail.AddDomain("example.com")
+	mail.AddDomain("example.org")
+	keys, _ := mail.DKIMKeys("example.com")
+
+	plan, err := mail.DeleteDomain("example.com", DeleteDomainOptions{Mode: DeleteModeCascade, Confirm: "example.com"})
+	if err != nil {
+		t.Fatalf("DeleteDomain: %v", err)
+	}
+	if len(plan.DKIMKeys) != 1 || plan.DKIMKeys[0] != keys[0].KeyPath() {
+		t.Errorf("plan DKIM keys %v", plan.DKIMKeys)
+	}
+	if _, ok := fake.File(keys[0].KeyPath()); ok {
+		t.Error("key file left behind")
+	}
+	conf, _ := fake.File(dkimSigningConf)
+	if strings.Contains(conf, "example.com") || !strings.Contains(conf, "example.org") {
+		t.Errorf("signing config after delete:\n%s", conf)
+	}
+}
@@ -0,0 +1,460 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Resolver is the part of *net.Resolver the DNS checks use. Tests point it
+// at a stub DNS server with NewDNSResolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// NewDNSResolver returns a resolver that sends every query to server
+// (host:port), or the system resolver if server is empty. A public resolver
+// avoids the split-horizon answers of cluster DNS.
+func NewDNSResolver(server string) Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// DNS check results, from best to worst
+const (
+	DNSPass = "pass"
+	DNSWarn = "warn"
+	DNSFail = "fail"
+)
+
+// DNSCheck is the verdict on one record of a domain
+type DNSCheck struct {
+	Check    string   `json:"check"` // MX, SPF, DKIM, DMARC, MTA-STS, PTR
+	Name     string   `json:"name"`  // the DNS name that was queried
+	Status   string   `json:"status"`
+	Found    []string `json:"found"`
+	Expected string   `json:"expected,omitempty"`
+	Detail   string   `json:"detail"`
+	Fix      string   `json:"fix,omitempty"`
+}
+
+// DNSReport is the DNS readiness of a domain for mail through the hub
+type DNSReport struct {
+	Domain    string     `json:"domain"`
+	Hub       string     `json:"hub"`
+	HubAddrs  []string   `json:"hub_addresses"`
+	Status    string     `json:"status"` // the worst check status
+	Checks    []DNSCheck `json:"checks"`
+	CheckedAt time.Time  `json:"checked_at"`
+}
+
+// DNSChecker compares the DNS records of domains with what the hub expects
+type DNSChecker struct {
+	resolver Resolver
+	timeout  time.Duration
+}
+
+// NewDNSChecker creates a checker that queries resolver, or the system
+// resolver if nil
+func NewDNSChecker(resolver Resolver) *DNSChecker {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &DNSChecker{resolver: resolver, timeout: 15 * time.Second}
+}
+
+// MailHostname returns the name the hub announces (postfix myhostname),
+// which MX records and reverse DNS must point to
+func (m *MailService) MailHostname() (string, error) {
+	output, err := m.exec.Execute("postconf -h myhostname")
+	if err != nil {
+		return "", fmt.Errorf("failed to read postfix myhostname: %w", err)
+	}
+	name := strings.TrimSpace(output)
+	if name == "" {
+		return "", fmt.Errorf("postfix myhostname is empty")
+	}
+	return name, nil
+}
+
+// Check resolves the mail records of domain: MX, SPF, the DKIM selectors
+// of keys, DMARC, MTA-STS, and the reverse DNS of hub, the hub's hostname
+func (c *DNSChecker) Check(ctx context.Context, domain, hub string, keys []DKIMKey) *DNSReport {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	hub = canonicalName(hub)
+	report := &DNSReport{Domain: domain, Hub: hub, CheckedAt: time.Now().UTC()}
+
+	addrs, addrErr := c.resolver.LookupHost(ctx, hub)
+	report.HubAddrs = addrs
+
+	mx := c.checkMX(ctx, domain, hub)
+	report.Checks = append(report.Checks, mx)
+	report.Checks = append(report.Checks, c.checkSPF(ctx, domain, hub, addrs, mx.Status == DNSPass))
+	report.Checks = append(report.Checks, c.checkDKIM(ctx, domain, keys)...)
+	report.Checks = append(report.Checks, c.checkDMARC(ctx, domain))
+	report.Checks = append(report.Checks, c.checkMTASTS(ctx, domain, hub))
+	report.Checks = append(report.Checks, c.checkPTR(ctx, hub, addrs, addrErr)...)
+
+	report.Status = DNSPass
+	for _, check := range report.Checks {
+		report.Status = worseStatus(report.Status, check.Status)
+	}
+	return report
+}
+
+func worseStatus(a, b string) string {
+	rank := map[string]int{DNSPass: 0, DNSWarn: 1, DNSFail: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// canonicalName lowercases a host name and drops the trailing dot
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// lookupFailed reports whether err is a real failure rather than a name
+// without records
+func lookupFailed(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+	return err != nil
+}
+
+// lookupTXT returns the TXT records at name that start with prefix
+// (case-insensitively); a missing name is no records
+func (c *DNSChecker) lookupTXT(ctx context.Context, name, prefix string) ([]string, error) {
+	records, err := c.resolver.LookupTXT(ctx, name)
+	if lookupFailed(err) {
+		return nil, err
+	}
+	var matched []string
+	for _, r := range records {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(r)), strings.ToLower(prefix)) {
+			matched = append(matched, r)
+		}
+	}
+	return matched, nil
+}
+
+// lookupError is the verdict when a query itself failed
+func lookupError(check DNSCheck, err error) DNSCheck {
+	check.Status = DNSFail
+	check.Detail = "lookup failed: " + err.Error()
+	return check
+}
+
+func (c *DNSChecker) checkMX(ctx context.Context, domain, hub string) DNSCheck {
+	check := DNSCheck{Check: "MX", Name: domain, Expected: hub}
+	fix := fmt.Sprintf("%s. IN MX 10 %s.", domain, hub)
+
+	records, err := c.resolver.LookupMX(ctx, domain)
+	if lookupFailed(err) {
+		return lookupError(check, err)
+	}
+	// best is the hub's preference, lowest the domain's; the resolver need
+	// not return the records sorted
+	best, lowest := -1, -1
+	for _, r := range records {
+		host := canonicalName(r.Host)
+		check.Found = append(check.Found, fmt.Sprintf("%d %s", r.Pref, host))
+		if host == hub && (best < 0 || int(r.Pref) < best) {
+			best = int(r.Pref)
+		}
+		if lowest < 0 || int(r.Pref) < lowest {
+			lowest = int(r.Pref)
+		}
+	}
+
+	switch {
+	case len(records) == 0:
+		check.Status, check.Detail, check.Fix = DNSFail, "no MX record: mail for the domain cannot be delivered", fix
+	case best < 0:
+		check.Status, check.Detail, check.Fix = DNSFail, "MX records do not point to the hub", fix
+	case best > lowest:
+		check.Status, check.Detail = DNSWarn, "the hub is a backup MX; mail goes to another server first"
+		check.Fix = fmt.Sprintf("give %s the lowest MX preference", hub)
+	default:
+		check.Status, check.Detail = DNSPass, "mail is delivered to the hub"
+	}
+	return check
+}
+
+func (c *DNSChecker) checkSPF(ctx context.Context, domain, hub string, hubAddrs []string, mxIsHub bool) DNSCheck {
+	check := DNSCheck{Check: "SPF", Name: domain, Expected: fmt.Sprintf("v=spf1 mx a:%s -all", hub)}
+
+	records, err := c.lookupTXT(ctx, domain, "v=spf1")
+	if err != nil {
+		return lookupError(check, err)
+	}
+	check.Found = records
+	switch len(records) {
+	case 0:
+		check.Status, check.Detail = DNSFail, "no SPF record: receivers cannot tell the hub may send for the domain"
+		check.Fix = fmt.Sprintf(`%s. IN TXT "%s"`, domain, check.Expected)
+		return check
+	case 1:
+	default:
+		check.Status, check.Detail = DNSFail, "more than one SPF record: SPF evaluates to permerror"
+		check.Fix = "merge the records into one"
+		return check
+	}
+
+	authorized, indirect, all := false, false, ""
+	for _, term := range strings.Fields(records[0])[1:] {
+		term = strings.ToLower(term)
+		qualifier := "+"
+		if strings.ContainsAny(term[:1], "+-~?") {
+			qualifier, term = term[:1], term[1:]
+		}
+		name, value, _ := strings.Cut(term, ":")
+		switch name {
+		case "all":
+			all = qualifier
+		case "mx":
+			authorized = authorized || (qualifier == "+" && value == "" && mxIsHub)
+		case "a":
+			authorized = authorized || (qualifier == "+" && canonicalName(value) == hub)
+		case "ip4", "ip6":
+			authorized = authorized || (qualifier == "+" && spfIPMatches(value, hubAddrs))
+		case "include", "redirect", "exists":
+			indirect = true
+		}
+		if strings.HasPrefix(term, "redirect=") {
+			indirect = true
+		}
+	}
+
+	switch {
+	case all == "+":
+		check.Status, check.Detail = DNSFail, "+all lets any server send for the domain"
+		check.Fix = "end the record with -all or ~all"
+	case !authorized && indirect:
+		check.Status, check.Detail = DNSWarn, "the hub is not listed directly; it may be authorized through an include, which is not followed"
+		check.Fix = fmt.Sprintf("add a:%s before the all mechanism", hub)
+	case !authorized:
+		check.Status, check.Detail = DNSFail, "the SPF record does not authorize the hub"
+		check.Fix = fmt.Sprintf("add a:%s before the all mechanism", hub)
+	case all == "" || all == "?":
+		check.Status, check.Detail = DNSWarn, "the record does not end with -all or ~all, so it does not protect the domain"
+		check.Fix = "end the record with -all or ~all"
+	default:
+		check.Status, check.Detail = DNSPass, "the hub is authorized to send"
+	}
+	return check
+}
+
+// spfIPMatches reports whether an ip4/ip6 mechanism value covers one of
+// addrs
+func spfIPMatches(value string, addrs []string) bool {
+	if !strings.Contains(value, "/") {
+		if ip := net.ParseIP(value); ip != nil {
+			if ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dkimTags parses the tag=value list of a DKIM record
+func dkimTags(record string) map[string]string {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(record, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.ToLower(strings.TrimSpace(name))] = strings.Join(strings.Fields(value), "")
+	}
+	return tags
+}
+
+func (c *DNSChecker) checkDKIM(ctx context.Context, domain string, keys []DKIMKey) []DNSCheck {
+	var checks []DNSCheck
+	for _, key := range keys {
+		if key.Status == DKIMStatusRetired {
+			continue
+		}
+		check := DNSCheck{Check: "DKIM", Name: key.RecordName(), Expected: key.RecordValue()}
+		records, err := c.lookupTXT(ctx, key.RecordName(), "")
+		if err != nil {
+			checks = append(checks, lookupError(check, err))
+			continue
+		}
+		check.Found = records
+
+		published, stale := false, false
+		for _, r := range records {
+			if dkimTags(r)["p"] == key.PublicKey {
+				published = true
+			} else {
+				stale = true
+			}
+		}
+		fix := key.ZoneRecord()
+		switch {
+		case published && !stale:
+			check.Status, check.Detail = DNSPass, "the "+key.Status+" key is published"
+		case published:
+			check.Status, check.Detail = DNSWarn, "the key is published next to other records at the selector"
+			check.Fix = "remove the other TXT records at " + key.RecordName()
+		case key.Status == DKIMStatusPending:
+			check.Status, check.Detail, check.Fix = DNSWarn, "the pending key is not published yet; publish it before activating it", fix
+		case stale:
+			check.Status, check.Detail, check.Fix = DNSFail, "the published key does not match the signing key: signatures fail", fix
+		default:
+			check.Status, check.Detail, check.Fix = DNSFail, "the signing key is not published: signatures cannot be verified", fix
+		}
+		checks = append(checks, check)
+	}
+
+	if len(checks) == 0 {
+		checks = append(checks, DNSCheck{
+			Check:  "DKIM",
+			Name:   "_domainkey." + domain,
+			Status: DNSFail,
+			Detail: "the domain has no DKIM key: its mail is sent unsigned",
+			Fix:    "create a key on the DKIM page of the domain",
+		})
+	}
+	return checks
+}
+
+func (c *DNSChecker) checkDMARC(ctx context.Context, domain string) DNSCheck {
+	name := "_dmarc." + domain
+	check := DNSCheck{Check: "DMARC", Name: name, Expected: "v=DMARC1; p=quarantine"}
+	fix := fmt.Sprintf(`%s. IN TXT "v=DMARC1; p=none; rua=mailto:postmaster@%s"`, name, domain)
+
+	records, err := c.lookupTXT(ctx, name, "v=DMARC1")
+	if err != nil {
+		return lookupError(check, err)
+	}
+	check.Found = records
+	switch len(records) {
+	case 0:
+		check.Status, check.Detail, check.Fix = DNSFail, "no DMARC record: large mailbox providers reject or junk the domain's mail", fix
+		return check
+	case 1:
+	default:
+		check.Status, check.Detail, check.Fix = DNSFail, "more than one DMARC record: receivers ignore them all", "keep a single record"
+		return check
+	}
+
+	switch policy := dkimTags(records[0])["p"]; policy {
+	case "quarantine", "reject":
+		check.Status, check.Detail = DNSPass, "policy "+policy
+	case "none":
+		check.Status, check.Detail = DNSWarn, "policy none only monitors; spoofed mail is still delivered"
+		check.Fix = "raise the policy to p=quarantine once the reports show SPF and DKIM pass"
+	default:
+		check.Status, check.Detail, check.Fix = DNSFail, "the record has no valid p= policy", fix
+	}
+	return check
+}
+
+func (c *DNSChecker) checkMTASTS(ctx context.Context, domain, hub string) DNSCheck {
+	name := "_mta-sts." + domain
+	check := DNSCheck{Check: "MTA-STS", Name: name, Expected: "v=STSv1; id=<policy version>"}
+
+	records, err := c.lookupTXT(ctx, name, "v=STSv1")
+	if err != nil {
+		return lookupError(check, err)
+	}
+	check.Found = records
+	switch {
+	case len(records) == 0:
+		check.Status, check.Detail = DNSWarn, "no MTA-STS: senders may deliver to the hub without TLS"
+		check.Fix = fmt.Sprintf(`serve "version: STSv1, mode: enforce, mx: %s, max_age: 604800" at https://mta-sts.%s/.well-known/mta-sts.txt, then publish %s. IN TXT "v=STSv1; id=%s"`,
+			hub, domain, name, time.Now().UTC().Format("20060102"))
+	case len(records) > 1:
+		check.Status, check.Detail, check.Fix = DNSFail, "more than one MTA-STS record: senders ignore them all", "keep a single record"
+	case dkimTags(records[0])["id"] == "":
+		check.Status, check.Detail, check.Fix = DNSFail, "the record has no id", "add id=<policy version> to the record"
+	default:
+		check.Status, check.Detail = DNSPass, "published; the policy file itself is not fetched"
+	}
+	return check
+}
+
+func (c *DNSChecker) checkPTR(ctx context.Context, hub string, addrs []string, addrErr error) []DNSCheck {
+	if len(addrs) == 0 {
+		check := DNSCheck{Check: "PTR", Name: hub, Status: DNSFail, Detail: "the hub hostname does not resolve", Fix: "publish an A record for " + hub}
+		if lookupFailed(addrErr) {
+			check.Detail = "lookup failed: " + addrErr.Error()
+		}
+		return []DNSCheck{check}
+	}
+
+	var checks []DNSCheck
+	for _, addr := range addrs {
+		check := DNSCheck{Check: "PTR", Name: addr, Expected: hub}
+		names, err := c.resolver.LookupAddr(ctx, addr)
+		if lookupFailed(err) {
+			checks = append(checks, lookupError(check, err))
+			continue
+		}
+		for _, n := range names {
+			check.Found = append(check.Found, canonicalName(n))
+			if canonicalName(n) == hub {
+				check.Status = DNSPass
+			}
+		}
+		if check.Status == DNSPass {
+			check.Detail = "reverse DNS matches the hub hostname"
+		} else {
+			check.Status = DNSFail
+			check.Detail = "reverse DNS does not match the hub hostname: receivers distrust the hub"
+			check.Fix = fmt.Sprintf("set the PTR record of %s to %s. with the provider of the address", addr, hub)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// CheckDomain checks a domain configured on mail against the hub behind it
+func (c *DNSChecker) CheckDomain(ctx context.Context, mail *MailService, domain string) (*DNSReport, error) {
+	if err := mail.requireDomain(domain); err != nil {
+		return nil, err
+	}
+	hub, err := mail.MailHostname()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := mail.DKIMKeys(domain)
+	if err != nil {
+		return nil, err
+	}
+	return c.Check(ctx, domain, hub, keys), nil
+}
@@ -0,0 +1,271 @@
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// DNS record types served by stubDNS
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeMX  = 15
+	dnsTypeTXT = 16
+)
+
+// stubDNS is a UDP DNS server answering from a fixed record set. Records
+// are keyed by lowercase name without the trailing dot; each value is the
+// encoded rdata of one record.
+type stubDNS struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	records map[string]map[uint16][][]byte
+}
+
+func newStubDNS(t *testing.T) *stubDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on UDP: %v", err)
+	}
+	s := &stubDNS{conn: conn, records: make(map[string]map[uint16][][]byte)}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *stubDNS) add(name string, typ uint16, rdata []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records[name] == nil {
+		s.records[name] = make(map[uint16][][]byte)
+	}
+	s.records[name][typ] = append(s.records[name][typ], rdata)
+}
+
+func (s *stubDNS) A(name, ip string) { s.add(name, dnsTypeA, net.ParseIP(ip).To4()) }
+
+func (s *stubDNS) MX(name string, pref uint16, host string) {
+	s.add(name, dnsTypeMX, append(binary.BigEndian.AppendUint16(nil, pref), encodeDNSName(host)...))
+}
+
+func (s *stubDNS) PTR(ip, host string) {
+	p := net.ParseIP(ip).To4()
+	name := fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", p[3], p[2], p[1], p[0])
+	s.add(name, dnsTypePTR, encodeDNSName(host))
+}
+
+// TXT splits value into character strings of at most 255 bytes
+func (s *stubDNS) TXT(name, value string) {
+	var rdata []byte
+	for len(value) > 255 {
+		rdata = append(append(rdata, 255), value[:255]...)
+		value = value[255:]
+	}
+	s.add(name, dnsTypeTXT, append(append(rdata, byte(len(value))), value...))
+}
+
+func encodeDNSName(name string) []byte {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		out = append(append(out, byte(len(label))), label...)
+	}
+	return append(out, 0)
+}
+
+func (s *stubDNS) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(buf[:n]); resp != nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// answer builds the response to a single-question query
+func (s *stubDNS) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	var labels []string
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		l := int(query[i])
+		if i+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i+1:i+1+l]))
+		i += 1 + l
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	question := query[12 : i+5]
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	// Authoritative with recursion available, so an empty answer is a
+	// definite "no records" rather than a lame referral
+	flags := uint16(0x8580)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	types, known := s.records[name]
+	if !known {
+		flags |= 3 // NXDOMAIN
+	}
+	answers := types[qtype]
+
+	resp := append([]byte(nil), query[:2]...)
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+	resp = append(resp, 0, 0, 0, 0)
+	resp = append(resp, question...)
+	for _, rdata := range answers {
+		resp = append(resp, 0xc0, 12) // pointer to the question name
+		resp = binary.BigEndian.AppendUint16(resp, qtype)
+		resp = binary.BigEndian.AppendUint16(resp, 1)
+		resp = binary.BigEndian.AppendUint32(resp, 300)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+	return resp
+}
+
+func checkByName(report *DNSReport, check string) []DNSCheck {
+	var found []DNSCheck
+	for _, c := range report.Checks {
+		if c.Check == check {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+func TestDNSCheckReadyDomain(t *testing.T) {
+	dns := newStubDNS(t)
+	mail, _ := newTestMailService(t)
+	mail.SetDKIMAlgorithm("rsa")
+	if err := mail.AddDomain("example.com"); err != nil {
+		t.Fatalf("AddDomain: %v", err)
+	}
+	keys, _ := mail.DKIMKeys("example.com")
+
+	dns.A("mail.example.net", "192.0.2.10")
+	dns.PTR("192.0.2.10", "mail.example.net")
+	dns.MX("example.com", 10, "mail.example.net")
+	dns.TXT("example.com", "v=spf1 mx -all")
+	dns.TXT("example.com", "google-site-verification=abc")
+	dns.TXT(keys[0].RecordName(), keys[0].RecordValue())
+	dns.TXT("_dmarc.example.com", "v=DMARC1; p=reject; rua=mailto:dmarc@example.com")
+	dns.TXT("_mta-sts.example.com", "v=STSv1; id=20261001")
+
+	checker := NewDNSChecker(NewDNSResolver(dns.conn.LocalAddr().String()))
+	report := checker.Check(context.Background(), "example.com", "Mail.Example.Net.", keys)
+	if report.Hub != "mail.example.net" || len(report.HubAddrs) != 1 {
+		t.Errorf("hub %s %v", report.Hub, report.HubAddrs)
+	}
+	for _, c := range report.Checks {
+		if c.Status != DNSPass {
+			t.Errorf("%s %s: %s (%s) found %q", c.Check, c.Name, c.Status, c.Detail, c.Found)
+		}
+	}
+	if report.Status != DNSPass || len(report.Checks) != 6 {
+		t.Errorf("report %s with %d checks", report.Status, len(report.Checks))
+	}
+}
+
+func TestDNSCheckFindsProblems(t *testing.T) {
+	dns := newStubDNS(t)
+	key := DKIMKey{Domain: "example.org", Selector: "mh202610", Algorithm: DKIMAlgorithmEd25519, Status: DKIMStatusActive, PublicKey: "bmV3"}
+	pending := DKIMKey{Domain: "example.org", Selector: "mh202611", Algorithm: DKIMAlgorithmEd25519, Status: DKIMStatusPending, PublicKey: "bmV4"}
+
+	dns.A("mail.example.net", "192.0.2.10")
+	dns.PTR("192.0.2.10", "vps-123.provider.example")
+	dns.MX("example.org", 10, "mx.other.example")
+	dns.MX("example.org", 20, "mail.example.net")
+	dns.TXT("example.org", "v=spf1 include:_spf.other.example ~all")
+	dns.TXT(key.RecordName(), "v=DKIM1; k=ed25519; p=b2xk")
+	dns.TXT("_dmarc.example.org", "v=DMARC1; p=none")
+
+	checker := NewDNSChecker(NewDNSResolver(dns.conn.LocalAddr().String()))
+	report := checker.Check(context.Background(), "example.org", "mail.example.net", []DKIMKey{key, pending})
+
+	want := map[string][]string{
+		"MX":      {DNSWarn},
+		"SPF":     {DNSWarn},
+		"DKIM":    {DNSFail, DNSWarn},
+		"DMARC":   {DNSWarn},
+		"MTA-STS": {DNSWarn},
+		"PTR":     {DNSFail},
+	}
+	for name, statuses := range want {
+		checks := checkByName(report, name)
+		if len(checks) != len(statuses) {
+			t.Errorf("%s: %d checks, want %d", name, len(checks), len(statuses))
+			continue
+		}
+		for i, c := range checks {
+			if c.Status != statuses[i] {
+				t.Errorf("%s %s: %s (%s), want %s", name, c.Name, c.Status, c.Detail, statuses[i])
+			}
+			if c.Fix == "" && c.Status != DNSPass {
+				t.Errorf("%s %s: no fix", name, c.Name)
+			}
+		}
+	}
+	if dkim := checkByName(report, "DKIM")[0]; !strings.Contains(dkim.Fix, "p=bmV3") {
+		t.Errorf("DKIM fix does not carry the key: %s", dkim.Fix)
+	}
+	if report.Status != DNSFail {
+		t.Errorf("report status %s", report.Status)
+	}
+
+	// A domain without any record
+	report = checker.Check(context.Background(), "nothing.example", "mail.example.net", nil)
+	for _, name := range []string{"MX", "SPF", "DKIM", "DMARC"} {
+		if c := checkByName(report, name)[0]; c.Status != DNSFail || !strings.Contains(c.Detail, "no ") {
+			t.Errorf("%s: %s (%s)", name, c.Status, c.Detail)
+		}
+	}
+}
+
+func TestMailHostname(t *testing.T) {
+	mail, fake := newTestMailService(t)
+	fake.SetPostconf("myhostname", "cmh.example.net")
+	if name, err := mail.MailHostname(); err != nil || name != "cmh.example.net" {
+		t.Errorf("MailHostname = %q, %v", name, err)
+	}
+}
+
+// reversedMX returns MX records highest preference first, unlike net.Resolver
+type reversedMX struct{ Resolver }
+
+func (r reversedMX) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, err := r.Resolver.LookupMX(ctx, name)
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, err
+}
+
+func TestDNSCheckUnsortedMX(t *testing.T) {
+	dns := newStubDNS(t)
+	dns.MX("example.org", 10, "mx.other.example")
+	dns.MX("example.org", 20, "mail.example.net")
+
+	checker := NewDNSChecker(reversedMX{NewDNSResolver(dns.conn.LocalAddr().String())})
+	report := checker.Check(context.Background(), "example.org", "mail.example.net", nil)
+	if mx := checkByName(report, "MX")[0]; mx.Status != DNSWarn || mx.Found[0] != "20 mail.example.net" {
+		t.Errorf("backup MX: %s (%s) %v", mx.Status, mx.Detail, mx.Found)
+	}
+}
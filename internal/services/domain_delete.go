@@ -0,0 +1,321 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Ingasti/mailhub-admin/internal/postfixmap"
+)
+
+// Domain deletion modes
+const (
+	// DeleteModeCascade removes the domain, its mailboxes, aliases and maildirs
+	DeleteModeCascade = "cascade"
+	// DeleteModeArchive does the same after taring the maildirs to the
+	// archive directory
+	DeleteModeArchive = "archive"
+)
+
+// DefaultArchiveDir is where archive mode stores domain tarballs on the host
+const DefaultArchiveDir = "/var/mail/archive"
+
+// PlannedChange is one configuration line a domain deletion removes or
+// rewrites. Replacement is empty when the line is removed.
+type PlannedChange struct {
+	File        string `json:"file"`
+	Line        string `json:"line"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// DomainDeletionPlan lists everything a domain deletion will touch
+type DomainDeletionPlan struct {
+	Domain    string          `json:"domain"`
+	Mode      string          `json:"mode"`
+	Mailboxes []string        `json:"mailboxes"`
+	Aliases   []string        `json:"aliases"`
+	Changes   []PlannedChange `json:"changes"`
+	Maildir   string          `json:"maildir,omitempty"` // empty if the domain has no maildir
+	Maildirs  []string        `json:"maildirs"`          // per-mailbox directories under Maildir
+	Archive   string          `json:"archive,omitempty"` // tarball written in archive mode
+	DKIMKeys  []string        `json:"dkim_keys"`         // private key files of the domain's DKIM keys
+}
+
+// DeleteDomainOptions controls a domain deletion. Confirm must repeat the
+// domain name.
+type DeleteDomainOptions struct {
+	Mode    string
+	Confirm string
+}
+
+// SetArchiveDir sets the directory on the mail host used by archive mode
+func (m *MailService) SetArchiveDir(dir string) error {
+	if !strings.HasPrefix(dir, "/") {
+		return fmt.Errorf("archive directory must be an absolute path: %s", dir)
+	}
+	m.archiveDir = strings.TrimSuffix(dir, "/")
+	return nil
+}
+
+// ValidDeleteMode reports whether mode is a supported domain deletion mode
+func ValidDeleteMode(mode string) bool {
+	return mode == DeleteModeCascade || mode == DeleteModeArchive
+}
+
+// domainFiles are the files a domain deletion edits, in the order they are
+// changed
+var domainFiles = []string{virtualAliasFile, virtualMailboxFile, dovecotUsersFile, domainQuotaFile, virtualDomainsFile}
+
+// domainEdit applies the deletion of domain to the content of file,
+// returning the new content and the lines that change. Postfix maps and
+// domain_quotas are edited entry by entry, the dovecot users file line by
+// line.
+func domainEdit(file, content, domain string) (string, []PlannedChange) {
+	if file == dovecotUsersFile {
+		return domainEditUsers(content, domain)
+	}
+
+	suffix := "@" + domain
+	pm := postfixmap.Parse(content)
+	var changes []PlannedChange
+	pm.RemoveFunc(func(e *postfixmap.Entry) bool {
+		line := e.Text()
+		remove := false
+		switch file {
+		case virtualDomainsFile:
+			remove = e.Key == domain
+		case virtualMailboxFile, domainQuotaFile:
+			remove = e.Key == domain || strings.HasSuffix(e.Key, suffix)
+		case virtualAliasFile:
+			// Aliases of the domain go; aliases elsewhere lose the targets
+			// that pointed into the domain
+			a, ok := aliasFromEntry(e)
+			if !ok {
+				return false
+			}
+			if a.Domain == domain {
+				remove = true
+				break
+			}
+			var kept []string
+			for _, t := range a.Targets {
+				if !strings.HasSuffix(strings.ToLower(t), suffix) {
+					kept = append(kept, t)
+				}
+			}
+			if len(kept) == len(a.Targets) {
+				return false
+			}
+			if len(kept) > 0 {
+				e.Value = strings.Join(kept, ",")
+				changes = append(changes, PlannedChange{File: file, Line: line, Replacement: e.Format()})
+				return false
+			}
+			remove = true
+		}
+		if remove {
+			changes = append(changes, PlannedChange{File: file, Line: line})
+		}
+		return remove
+	})
+	return pm.String(), changes
+}
+
+// domainEditUsers removes the users of domain from the dovecot users file
+func domainEditUsers(content, domain string) (string, []PlannedChange) {
+	var lines []string
+	var changes []PlannedChange
+	for _, line := range strings.Split(content, "\n") {
+		if u, ok := parseDovecotUser(line); ok && strings.HasSuffix(u.Email, "@"+domain) {
+			changes = append(changes, PlannedChange{File: dovecotUsersFile, Line: line})
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), changes
+}
+
+// PlanDomainDeletion is a dry run of DeleteDomain: it lists every
+// configuration line and directory the deletion would remove or change,
+// without modifying anything
+func (m *MailService) PlanDomainDeletion(domain, mode string) (*DomainDeletionPlan, error) {
+	if !isValidDomain(domain) {
+		return nil, invalidf("invalid domain format: %s", domain)
+	}
+	if !ValidDeleteMode(mode) {
+		return nil, invalidf("unsupported deletion mode: %s", mode)
+	}
+
+	plan := &DomainDeletionPlan{Domain: domain, Mode: mode}
+
+	for _, file := range domainFiles {
+		exists, err := fileExists(m.exec, file)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		content, err := m.exec.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		_, changes := domainEdit(file, content, domain)
+		plan.Changes = append(plan.Changes, changes...)
+	}
+
+	found := false
+	for _, c := range plan.Changes {
+		switch c.File {
+		case virtualDomainsFile:
+			found = true
+		case virtualMailboxFile:
+			plan.Mailboxes = append(plan.Mailboxes, strings.Fields(c.Line)[0])
+		case virtualAliasFile:
+			if c.Replacement == "" && strings.HasSuffix(strings.Fields(c.Line)[0], "@"+domain) {
+				plan.Aliases = append(plan.Aliases, strings.Fields(c.Line)[0])
+			}
+		}
+	}
+	if !found {
+		return nil, notFoundf("domain not found: %s", domain)
+	}
+
+	maildir := fmt.Sprintf("%s/%s", virtualMailboxBase, domain)
+	exists, err := fileExists(m.exec, maildir)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		plan.Maildir = maildir
+		output, err := m.exec.Execute(fmt.Sprintf("doas ls -1 %s", shellQuote(maildir)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list maildirs: %w", err)
+		}
+		for _, name := range strings.Split(output, "\n") {
+			if name = strings.TrimSpace(name); name != "" {
+				plan.Maildirs = append(plan.Maildirs, maildir+"/"+name)
+			}
+		}
+		if mode == DeleteModeArchive {
+			plan.Archive = fmt.Sprintf("%s/%s-%s.tar.gz", m.archiveDir, domain, time.Now().UTC().Format("20060102T150405Z"))
+		}
+	}
+
+	keys, err := m.DKIMKeys(domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		plan.DKIMKeys = append(plan.DKIMKeys, k.KeyPath())
+	}
+
+	return plan, nil
+}
+
+// DeleteDomain removes a mail domain with its mailboxes, aliases, quota
+// default, DKIM keys and maildirs, as listed by PlanDomainDeletion. In
+// archive mode the maildirs are tarred to the archive directory first. The
+// returned plan records what was removed.
+func (m *MailService) DeleteDomain(domain string, opts DeleteDomainOptions) (*DomainDeletionPlan, error) {
+	if opts.Confirm != domain {
+		return nil, invalidf("confirmation does not match domain name %s", domain)
+	}
+
+	plan, err := m.PlanDomainDeletion(domain, opts.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]bool)
+	for _, c := range plan.Changes {
+		changed[c.File] = true
+	}
+	var files []string
+	for _, file := range domainFiles {
+		if changed[file] {
+			files = append(files, file)
+		}
+	}
+
+	cs := m.changeSet("delete_domain", domain, files...)
+
+	// Archive before anything is changed, so a failed tar aborts cleanly
+	if plan.Archive != "" {
+		archive := plan.Archive
+		cs.StepWithUndo("archive maildirs", func() error {
+			cmd := fmt.Sprintf("doas mkdir -p %s && doas tar -czf %s -C %s %s",
+				shellQuote(m.archiveDir), shellQuote(archive), shellQuote(virtualMailboxBase), shellQuote(domain))
+			if _, err := m.exec.Execute(cmd); err != nil {
+				return fmt.Errorf("failed to archive maildirs: %w", err)
+			}
+			return nil
+		}, func() error {
+			_, err := m.exec.Execute(fmt.Sprintf("doas rm -f %s", shellQuote(archive)))
+			return err
+		})
+	}
+
+	for _, file := range files {
+		file := file
+		cs.Step("update "+file, func() error {
+			err := editFile(m.exec, file, func(content string) (string, error) {
+				updated, _ := domainEdit(file, content, domain)
+				return updated, nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to update %s: %w", file, err)
+			}
+			return nil
+		})
+	}
+
+	if changed[virtualMailboxFile] {
+		cs.Step("postmap virtual_mailbox", m.postmap(virtualMailboxFile))
+	}
+	if changed[virtualAliasFile] {
+		cs.Step("postmap virtual_alias", m.postmap(virtualAliasFile))
+	}
+	cs.Step("reload services", m.reloadServices)
+
+	if len(plan.DKIMKeys) > 0 {
+		cs.Snapshot(dkimStateFile, dkimSigningConf).OnRollback("doas rc-service rspamd reload")
+		cs.Step("update DKIM keys", m.updateDKIM(func(st *dkimState) error {
+			kept := st.Keys[:0]
+			for _, k := range st.Keys {
+				if k.Domain != domain {
+					kept = append(kept, k)
+				}
+			}
+			st.Keys = kept
+			return nil
+		}))
+		cs.Step("reload rspamd", m.reloadRspamd)
+	}
+
+	// The maildir is removed last, once nothing else can fail and force a
+	// rollback that could not bring the mail back
+	if plan.Maildir != "" {
+		maildir := plan.Maildir
+		cs.Step("remove maildir", func() error {
+			if _, err := m.exec.Execute(fmt.Sprintf("doas rm -rf %s", shellQuote(maildir))); err != nil {
+				return fmt.Errorf("failed to remove maildir: %w", err)
+			}
+			return nil
+		})
+	}
+	for _, path := range plan.DKIMKeys {
+		path := path
+		cs.Step("remove DKIM key", func() error {
+			if _, err := m.exec.Execute("doas rm -f " + shellQuote(path)); err != nil {
+				return fmt.Errorf("failed to remove DKIM key: %w", err)
+			}
+			return nil
+		})
+	}
+
+	if err := cs.Run(); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// dovecotUser is one line of the dovecot passwd-file
+// (user:password:uid:gid:gecos:home:shell:extra_fields)
+type dovecotUser struct {
+	Email    string
+	Password string
+	Rest     string // everything after the password field, without the leading colon
+}
+
+func parseDovecotUser(line string) (dovecotUser, bool) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return dovecotUser{}, false
+	}
+
+	parts := strings.SplitN(trimmed, ":", 3)
+	if len(parts) < 2 {
+		return dovecotUser{}, false
+	}
+
+	u := dovecotUser{Email: parts[0], Password: parts[1]}
+	if len(parts) == 3 {
+		u.Rest = parts[2]
+	}
+	return u, true
+}
+
+func (u dovecotUser) String() string {
+	if u.Rest == "" {
+		return u.Email + ":" + u.Password
+	}
+	return u.Email + ":" + u.Password + ":" + u.Rest
+}
+
+// fields splits Rest into uid, gid, gecos, home, shell and extra fields
+func (u dovecotUser) fields() []string {
+	fields := strings.SplitN(u.Rest, ":", 6)
+	for len(fields) < 6 {
+		fields = append(fields, "")
+	}
+	return fields
+}
+
+// Extra returns the value of a userdb extra field such as userdb_quota_rule
+func (u dovecotUser) Extra(key string) (string, bool) {
+	for _, kv := range strings.Fields(u.fields()[5]) {
+		if k, v, _ := strings.Cut(kv, "="); k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// SetExtra sets a userdb extra field, or removes it when value is empty.
+// Other fields and extra fields are kept in order.
+func (u *dovecotUser) SetExtra(key, value string) {
+	fields := u.fields()
+
+	var extras []string
+	found := false
+	for _, kv := range strings.Fields(fields[5]) {
+		if k, _, _ := strings.Cut(kv, "="); k == key {
+			if value != "" && !found {
+				extras = append(extras, key+"="+value)
+			}
+			found = true
+			continue
+		}
+		extras = append(extras, kv)
+	}
+	if value != "" && !found {
+		extras = append(extras, key+"="+value)
+	}
+	fields[5] = strings.Join(extras, " ")
+
+	// Drop trailing empty fields so plain user:password lines stay short
+	for len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	u.Rest = strings.Join(fields, ":")
+}
+
+// rewriteDovecotUsers rewrites the dovecot users file, calling fn for every
+// user entry. fn may modify the entry in place; returning false drops it.
+func (m *MailService) rewriteDovecotUsers(fn func(u *dovecotUser) bool) error {
+	return m.editDovecotUsers(func(u *dovecotUser) (bool, error) {
+		return fn(u), nil
+	})
+}
+
+// editDovecotUsers is rewriteDovecotUsers with a callback that can fail;
+// an error leaves the file untouched
+func (m *MailService) editDovecotUsers(fn func(u *dovecotUser) (bool, error)) error {
+	err := editFile(m.exec, dovecotUsersFile, func(content string) (string, error) {
+		var lines []string
+		for _, line := range strings.Split(content, "\n") {
+			u, ok := parseDovecotUser(line)
+			if !ok {
+				lines = append(lines, line)
+				continue
+			}
+			keep, err := fn(&u)
+			if err != nil {
+				return "", err
+			}
+			if keep {
+				lines = append(lines, u.String())
+			}
+		}
+		return strings.Join(lines, "\n"), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update dovecot users: %w", err)
+	}
+	return nil
+}
+
+// PasswordMigrationReport summarises a PLAIN password migration run
+type PasswordMigrationReport struct {
+	Scheme     string
+	DryRun     bool
+	Migrated   []string
+	StillPlain []string
+	Schemes    map[string]int // scheme counts after the run
+}
+
+// MigratePlainPasswords rehashes every {PLAIN} entry in the dovecot users
+// file with the configured scheme. With dryRun set nothing is written and
+// the report lists the accounts that would be migrated as still on PLAIN.
+func (m *MailService) MigratePlainPasswords(dryRun bool) (*PasswordMigrationReport, error) {
+	report := &PasswordMigrationReport{
+		Scheme:  m.passwordScheme,
+		DryRun:  dryRun,
+		Schemes: make(map[string]int),
+	}
+
+	count := func(u *dovecotUser) {
+		scheme := PasswordScheme(u.Password)
+		report.Schemes[scheme]++
+		if scheme == SchemePlain {
+			report.StillPlain = append(report.StillPlain, u.Email)
+		}
+	}
+
+	if dryRun {
+		content, err := m.exec.ReadFile(dovecotUsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dovecot users: %w", err)
+		}
+		for _, line := range strings.Split(content, "\n") {
+			if u, ok := parseDovecotUser(line); ok {
+				count(&u)
+			}
+		}
+	} else {
+		// A hashing failure aborts the rewrite, so the file is either fully
+		// migrated or left as it was
+		err := m.editDovecotUsers(func(u *dovecotUser) (bool, error) {
+			if plain, isPlain := plainPassword(u.Password); isPlain {
+				hashed, err := HashPassword(m.passwordScheme, plain)
+				if err != nil {
+					return false, fmt.Errorf("hashing password of %s: %w", u.Email, err)
+				}
+				u.Password = hashed
+				report.Migrated = append(report.Migrated, u.Email)
+			}
+			count(u)
+			return true, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("no password was migrated: %w", err)
+		}
+		if len(report.Migrated) > 0 {
+			if _, err := m.exec.Execute("doas doveadm reload"); err != nil {
+				return nil, fmt.Errorf("failed to reload dovecot: %w", err)
+			}
+		}
+	}
+
+	sort.Strings(report.Migrated)
+	sort.Strings(report.StillPlain)
+	return report, nil
+}
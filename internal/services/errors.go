@@ -0,0 +1,36 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds returned by the mail services. Errors keep their descriptive
+// message and can be classified with errors.Is, e.g. to pick an HTTP status.
+var (
+	ErrInvalid  = errors.New("invalid input")
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+)
+
+// kindError is an error message tagged with one of the error kinds
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
+func invalidf(format string, args ...interface{}) error {
+	return &kindError{kind: ErrInvalid, msg: fmt.Sprintf(format, args...)}
+}
+
+func notFoundf(format string, args ...interface{}) error {
+	return &kindError{kind: ErrNotFound, msg: fmt.Sprintf(format, args...)}
+}
+
+func existsf(format string, args ...interface{}) error {
+	return &kindError{kind: ErrExists, msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Executor runs commands and file operations on a mail host. SSHClient is
+// the production implementation; FakeExecutor emulates a host in memory.
+type Executor interface {
+	Execute(cmd string) (string, error)
+	ReadFile(path string) (string, error)
+	WriteFile(path, content string) error
+}
+
+// FileEditor is implemented by executors that can edit a file as a single
+// transaction (see SSHClient.EditFile)
+type FileEditor interface {
+	EditFile(path string, fn func(content string) (string, error)) error
+}
+
+// editFile edits a file through the executor's transactional API when it
+// has one, and falls back to read-modify-write otherwise. A missing file is
+// passed to fn as "", and only created if fn returns content.
+func editFile(exec Executor, path string, fn func(content string) (string, error)) error {
+	if editor, ok := exec.(FileEditor); ok {
+		return editor.EditFile(path, fn)
+	}
+
+	exists, err := fileExists(exec, path)
+	if err != nil {
+		return err
+	}
+	content := ""
+	if exists {
+		if content, err = exec.ReadFile(path); err != nil {
+			return err
+		}
+	}
+
+	updated, err := fn(content)
+	if err != nil {
+		return err
+	}
+	if updated == content {
+		return nil
+	}
+	return exec.WriteFile(path, updated)
+}
+
+// appendLine appends a line to a file, adding a newline to the previous
+// last line if it lacks one
+func appendLine(exec Executor, path, line string) error {
+	return editFile(exec, path, func(current string) (string, error) {
+		if current != "" && !strings.HasSuffix(current, "\n") {
+			current += "\n"
+		}
+		return current + line + "\n", nil
+	})
+}
+
+// deleteLines removes lines matching pattern (anchored at line start)
+func deleteLines(exec Executor, path, pattern string) error {
+	re, err := regexp.Compile("^" + pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	return editFile(exec, path, func(current string) (string, error) {
+		lines := strings.SplitAfter(current, "\n")
+		kept := lines[:0]
+		for _, line := range lines {
+			if re.MatchString(strings.TrimSuffix(line, "\n")) {
+				continue
+			}
+			kept = append(kept, line)
+		}
+		return strings.Join(kept, ""), nil
+	})
+}
+
+// fileExists reports whether path exists on the host. Command failures are
+// returned as errors rather than being mistaken for a missing file.
+func fileExists(exec Executor, path string) (bool, error) {
+	out, err := exec.Execute(fmt.Sprintf("doas test -e %s && echo yes || echo no", shellQuote(path)))
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s: %w", path, err)
+	}
+	return strings.TrimSpace(out) == "yes", nil
+}
+
+// shellQuote quotes s for use as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
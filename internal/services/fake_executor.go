@@ -0,0 +1,633 @@
+package services
+
+import (
+	"fmt"
+	"net/mail"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakeExecutor is an in-memory mail host for tests. It keeps a fake
+// filesystem and emulates the commands the services run: postmap, postconf,
+// postfix/doveadm reload, doveadm quota get and fetch, rc-service, mkdir,
+// rm, ls, tar, test and a few shell built-ins joined with && and ||.
+type FakeExecutor struct {
+	mu       sync.Mutex
+	files    map[string]string
+	dirs     map[string]bool
+	services map[string]bool
+	reloads  map[string]int
+	failures map[string]string
+	usage    map[string]int64
+	postconf map[string]string
+	messages map[string][]string // "email/folder" to raw messages, UID = index+1
+	commands []string
+}
+
+// NewFakeExecutor creates an empty fake host with rspamd running
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{
+		files:    make(map[string]string),
+		dirs:     make(map[string]bool),
+		services: map[string]bool{"rspamd": true},
+		reloads:  make(map[string]int),
+		failures: make(map[string]string),
+		usage:    make(map[string]int64),
+		postconf: map[string]string{"myhostname": "fake-mailhub.example.com"},
+		messages: make(map[string][]string),
+	}
+}
+
+// SetFile creates or replaces a file
+func (f *FakeExecutor) SetFile(path, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[path] = content
+}
+
+// File returns a file's content and whether it exists
+func (f *FakeExecutor) File(path string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, ok := f.files[path]
+	return content, ok
+}
+
+// HasDir reports whether a directory exists
+func (f *FakeExecutor) HasDir(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dirs[path]
+}
+
+// Reloads returns how many times a service (postfix, dovecot, rspamd) was
+// reloaded or restarted
+func (f *FakeExecutor) Reloads(service string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reloads[service]
+}
+
+// ServiceRunning reports whether an rc-service is started
+func (f *FakeExecutor) ServiceRunning(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.services[name]
+}
+
+// SetQuotaUsage sets the storage in bytes doveadm reports for a mailbox
+func (f *FakeExecutor) SetQuotaUsage(email string, bytes int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.usage[email] = bytes
+}
+
+// SetPostconf sets a postfix parameter reported by postconf -h
+func (f *FakeExecutor) SetPostconf(name, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.postconf[name] = value
+}
+
+// AddMessage stores a raw message in a mailbox folder and returns its UID
+func (f *FakeExecutor) AddMessage(email, folder, raw string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := email + "/" + folder
+	f.messages[key] = append(f.messages[key], raw)
+	return len(f.messages[key])
+}
+
+// FailOn makes any command starting with prefix (without "doas") fail
+// with the given message until cleared with an empty message
+func (f *FakeExecutor) FailOn(prefix, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if message == "" {
+		delete(f.failures, prefix)
+		return
+	}
+	f.failures[prefix] = message
+}
+
+// Commands returns every command line executed so far
+func (f *FakeExecutor) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// ReadFile returns a file's content
+func (f *FakeExecutor) ReadFile(path string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, ok := f.files[path]
+	if !ok {
+		return "", fmt.Errorf("cat: can't open '%s': No such file or directory", path)
+	}
+	return content, nil
+}
+
+// WriteFile replaces a file's content
+func (f *FakeExecutor) WriteFile(path, content string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	f.files[path] = content
+	return nil
+}
+
+// EditFile edits a file atomically with respect to other fake operations
+func (f *FakeExecutor) EditFile(path string, fn func(content string) (string, error)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content := f.files[path]
+	updated, err := fn(content)
+	if err != nil {
+		return err
+	}
+	if updated != content {
+		f.files[path] = updated
+	}
+	return nil
+}
+
+// Execute runs a command line against the fake host
+func (f *FakeExecutor) Execute(cmd string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, cmd)
+
+	words, err := splitShellWords(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	var out, stderr strings.Builder
+	status := 0
+	op := ""
+	var simple []string
+	flush := func() {
+		run := op == "" || (op == "&&" && status == 0) || (op == "||" && status != 0)
+		if run && len(simple) > 0 {
+			o, e, s := f.run(simple)
+			out.WriteString(o)
+			stderr.WriteString(e)
+			status = s
+		}
+		simple = nil
+	}
+	for _, w := range words {
+		switch w {
+		case "&&", "||":
+			flush()
+			op = w
+		case "|", ";":
+			return "", fmt.Errorf("fake executor: unsupported operator %q in %q", w, cmd)
+		default:
+			simple = append(simple, w)
+		}
+	}
+	flush()
+
+	if status != 0 {
+		return "", fmt.Errorf("command failed: exit status %d: %s", status, stderr.String())
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// run executes a single command and returns stdout, stderr and exit status
+func (f *FakeExecutor) run(args []string) (string, string, int) {
+	// Drop redirections and privilege escalation
+	var argv []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == ">" || a == "2>" {
+			i++
+			continue
+		}
+		if strings.HasPrefix(a, ">") || strings.HasPrefix(a, "2>") {
+			continue
+		}
+		argv = append(argv, a)
+	}
+	for len(argv) > 0 && argv[0] == "doas" {
+		argv = argv[1:]
+	}
+	if len(argv) == 0 {
+		return "", "", 0
+	}
+
+	line := strings.Join(argv, " ")
+	for prefix, message := range f.failures {
+		if strings.HasPrefix(line, prefix) {
+			return "", message, 1
+		}
+	}
+
+	switch argv[0] {
+	case "true":
+		return "", "", 0
+	case "false":
+		return "", "", 1
+	case "echo":
+		return strings.Join(argv[1:], " ") + "\n", "", 0
+	case "hostname":
+		return "fake-mailhub\n", "", 0
+	case "test":
+		return "", "", f.test(argv[1:])
+	case "cat":
+		var sb strings.Builder
+		for _, p := range argv[1:] {
+			content, ok := f.files[p]
+			if !ok {
+				return "", fmt.Sprintf("cat: can't open '%s': No such file or directory", p), 1
+			}
+			sb.WriteString(content)
+		}
+		return sb.String(), "", 0
+	case "tail":
+		return f.tail(argv[1:])
+	case "mkdir":
+		for _, p := range argv[1:] {
+			if strings.HasPrefix(p, "-") {
+				continue
+			}
+			for d := path.Clean(p); d != "/" && d != "."; d = path.Dir(d) {
+				f.dirs[d] = true
+			}
+		}
+		return "", "", 0
+	case "ls":
+		return f.ls(argv[1:])
+	case "tar":
+		return f.tar(argv[1:])
+	case "chown", "chmod":
+		return "", "", 0
+	case "rm":
+		for _, p := range argv[1:] {
+			if strings.HasPrefix(p, "-") {
+				continue
+			}
+			f.remove(path.Clean(p))
+		}
+		return "", "", 0
+	case "postmap":
+		if len(argv) < 2 {
+			return "", "postmap: fatal: usage", 1
+		}
+		content, ok := f.files[argv[1]]
+		if !ok {
+			return "", fmt.Sprintf("postmap: fatal: open %s: No such file or directory", argv[1]), 1
+		}
+		f.files[argv[1]+".db"] = content
+		return "", "", 0
+	case "postfix":
+		if len(argv) > 1 && argv[1] == "reload" {
+			f.reloads["postfix"]++
+			return "postfix/postfix-script: refreshing the Postfix mail system\n", "", 0
+		}
+	case "doveadm":
+		if len(argv) > 1 && argv[1] == "reload" {
+			f.reloads["dovecot"]++
+			return "", "", 0
+		}
+		if len(argv) == 7 && argv[3] == "quota" && argv[4] == "get" && argv[5] == "-u" {
+			return f.quotaGet(argv[6]), "", 0
+		}
+		if len(argv) >= 9 && argv[3] == "fetch" && argv[4] == "-u" && argv[7] == "mailbox" {
+			return f.fetch(argv[2], argv[5], argv[6], argv[8], argv[9:])
+		}
+	case "postconf":
+		if len(argv) == 3 && argv[1] == "-h" {
+			if value, ok := f.postconf[argv[2]]; ok {
+				return value + "\n", "", 0
+			}
+			return "", fmt.Sprintf("postconf: warning: %s: unknown parameter", argv[2]), 0
+		}
+	case "rc-service":
+		if len(argv) == 3 {
+			return f.rcService(argv[1], argv[2])
+		}
+	}
+
+	return "", fmt.Sprintf("fake executor: unsupported command: %s", line), 127
+}
+
+func (f *FakeExecutor) test(args []string) int {
+	if len(args) != 2 {
+		return 2
+	}
+	p := path.Clean(args[1])
+	_, isFile := f.files[p]
+	switch args[0] {
+	case "-e":
+		if isFile || f.dirs[p] {
+			return 0
+		}
+	case "-f":
+		if isFile {
+			return 0
+		}
+	case "-d":
+		if f.dirs[p] {
+			return 0
+		}
+	default:
+		return 2
+	}
+	return 1
+}
+
+// quotaGet prints doveadm -f tab quota get output for the users matching
+// pattern
+func (f *FakeExecutor) quotaGet(pattern string) string {
+	var emails []string
+	for email := range f.usage {
+		if ok, _ := path.Match(pattern, email); ok {
+			emails = append(emails, email)
+		}
+	}
+	sort.Strings(emails)
+
+	var sb strings.Builder
+	sb.WriteString("Username\tQuota name\tType\tValue\tLimit\t%\n")
+	for _, email := range emails {
+		fmt.Fprintf(&sb, "%s\tUser quota\tSTORAGE\t%d\t-\t0\n", email, f.usage[email]/1024)
+		fmt.Fprintf(&sb, "%s\tUser quota\tMESSAGE\t0\t-\t0\n", email)
+	}
+	return sb.String()
+}
+
+// fetch prints doveadm fetch output of a folder in the tab or pager format.
+// The query after the mailbox may only be "uid N".
+func (f *FakeExecutor) fetch(format, email, fieldList, folder string, query []string) (string, string, int) {
+	messages := f.messages[email+"/"+folder]
+	uids := make([]int, 0, len(messages))
+	for i := range messages {
+		uids = append(uids, i+1)
+	}
+	if len(query) == 2 && query[0] == "uid" {
+		uid, err := strconv.Atoi(query[1])
+		if err != nil {
+			return "", "doveadm: invalid uid", 1
+		}
+		uids = nil
+		if uid >= 1 && uid <= len(messages) {
+			uids = []int{uid}
+		}
+	} else if len(query) != 0 {
+		return "", fmt.Sprintf("fake executor: unsupported fetch query %q", query), 127
+	}
+
+	fields := strings.Fields(fieldList)
+	value := func(uid int, field string) string {
+		raw := messages[uid-1]
+		switch {
+		case field == "uid":
+			return strconv.Itoa(uid)
+		case field == "text":
+			return raw
+		case field == "size.physical":
+			return strconv.Itoa(len(raw))
+		case field == "date.received":
+			return "2026-10-01 12:00:00"
+		case strings.HasPrefix(field, "hdr."):
+			if msg, err := mail.ReadMessage(strings.NewReader(raw)); err == nil {
+				return msg.Header.Get(strings.TrimPrefix(field, "hdr."))
+			}
+		}
+		return ""
+	}
+
+	var sb strings.Builder
+	switch format {
+	case "tab":
+		sb.WriteString(strings.Join(fields, "\t") + "\n")
+		for _, uid := range uids {
+			var row []string
+			for _, field := range fields {
+				row = append(row, value(uid, field))
+			}
+			sb.WriteString(strings.Join(row, "\t") + "\n")
+		}
+	case "pager":
+		for _, uid := range uids {
+			for _, field := range fields {
+				fmt.Fprintf(&sb, "%s:\n%s\n", field, value(uid, field))
+			}
+			sb.WriteString("\f\n")
+		}
+	default:
+		return "", "doveadm: unknown formatter " + format, 1
+	}
+	return sb.String(), "", 0
+}
+
+func (f *FakeExecutor) tail(args []string) (string, string, int) {
+	n := 10
+	var file string
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") {
+			if v, err := strconv.Atoi(strings.TrimLeft(a, "-n")); err == nil {
+				n = v
+			}
+			continue
+		}
+		file = a
+	}
+	content, ok := f.files[file]
+	if !ok {
+		return "", fmt.Sprintf("tail: can't open '%s': No such file or directory", file), 1
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(content, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "") + "\n", "", 0
+}
+
+// ls lists the names directly inside a directory, one per line
+func (f *FakeExecutor) ls(args []string) (string, string, int) {
+	var dir string
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			dir = path.Clean(a)
+		}
+	}
+	if !f.dirs[dir] {
+		return "", fmt.Sprintf("ls: %s: No such file or directory", dir), 1
+	}
+
+	seen := make(map[string]bool)
+	for _, names := range []map[string]bool{f.dirs, f.fileSet()} {
+		for name := range names {
+			if path.Dir(name) == dir {
+				seen[path.Base(name)] = true
+			}
+		}
+	}
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\n") + "\n", "", 0
+}
+
+// tar emulates "tar -czf archive -C base name": the archive lists the
+// archived paths
+func (f *FakeExecutor) tar(args []string) (string, string, int) {
+	var archive, base, name string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-czf":
+			i++
+			if i < len(args) {
+				archive = args[i]
+			}
+		case "-C":
+			i++
+			if i < len(args) {
+				base = args[i]
+			}
+		default:
+			name = args[i]
+		}
+	}
+	src := path.Join(base, name)
+	if archive == "" || name == "" || !f.dirs[src] {
+		return "", fmt.Sprintf("tar: %s: Cannot stat: No such file or directory", src), 2
+	}
+	if !f.dirs[path.Dir(archive)] {
+		return "", fmt.Sprintf("tar: %s: Cannot open: No such file or directory", archive), 2
+	}
+
+	var entries []string
+	for _, names := range []map[string]bool{f.dirs, f.fileSet()} {
+		for p := range names {
+			if p == src || strings.HasPrefix(p, src+"/") {
+				entries = append(entries, strings.TrimPrefix(p, base+"/"))
+			}
+		}
+	}
+	sort.Strings(entries)
+	f.files[archive] = strings.Join(entries, "\n") + "\n"
+	return "", "", 0
+}
+
+// fileSet returns the file paths as a set
+func (f *FakeExecutor) fileSet() map[string]bool {
+	set := make(map[string]bool, len(f.files))
+	for name := range f.files {
+		set[name] = true
+	}
+	return set
+}
+
+func (f *FakeExecutor) remove(p string) {
+	delete(f.files, p)
+	delete(f.dirs, p)
+	prefix := p + "/"
+	for name := range f.files {
+		if strings.HasPrefix(name, prefix) {
+			delete(f.files, name)
+		}
+	}
+	for name := range f.dirs {
+		if strings.HasPrefix(name, prefix) {
+			delete(f.dirs, name)
+		}
+	}
+}
+
+func (f *FakeExecutor) rcService(name, action string) (string, string, int) {
+	switch action {
+	case "status":
+		if f.services[name] {
+			return " * status: started\n", "", 0
+		}
+		return " * status: stopped\n", "", 3
+	case "start":
+		f.services[name] = true
+	case "stop":
+		f.services[name] = false
+	case "restart", "reload":
+		if action == "reload" && !f.services[name] {
+			return "", fmt.Sprintf(" * %s: cannot reload, service not started", name), 1
+		}
+		f.services[name] = true
+		f.reloads[name]++
+	default:
+		return "", fmt.Sprintf("rc-service: unknown action %s", action), 1
+	}
+	return "", "", 0
+}
+
+// Files returns the sorted list of file paths on the fake host
+func (f *FakeExecutor) Files() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitShellWords splits a command line into words, honouring single and
+// double quotes and treating && and || as separate words
+func splitShellWords(cmd string) ([]string, error) {
+	var words []string
+	var cur strings.Builder
+	inWord := false
+	emit := func() {
+		if inWord {
+			words = append(words, cur.String())
+			cur.Reset()
+			inWord = false
+		}
+	}
+
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case c == '\'':
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("fake executor: unterminated quote in %q", cmd)
+			}
+			cur.WriteString(cmd[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+		case c == '"':
+			end := strings.IndexByte(cmd[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("fake executor: unterminated quote in %q", cmd)
+			}
+			cur.WriteString(cmd[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+		case c == ' ' || c == '\t' || c == '\n':
+			emit()
+		case (c == '&' || c == '|') && i+1 < len(cmd) && cmd[i+1] == c:
+			emit()
+			words = append(words, string([]byte{c, c}))
+			i++
+		case c == '|' || c == ';':
+			emit()
+			words = append(words, string(c))
+		default:
+			cur.WriteByte(c)
+			inWord = true
+		}
+	}
+	emit()
+	return words, nil
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSH hops whose host keys are verified
+const (
+	HopJump   = "jump"
+	HopTarget = "target"
+)
+
+// HostKeyPolicy describes how the host key of one hop is verified: against
+// a pinned SHA256 fingerprint if set, otherwise against a known_hosts file
+type HostKeyPolicy struct {
+	KnownHostsPath string
+	Fingerprint    string
+}
+
+// PresentedKey is a host key offered by a server that is not trusted yet
+type PresentedKey struct {
+	Hop         string
+	Address     string
+	Type        string
+	Fingerprint string
+	SeenAt      time.Time
+
+	key ssh.PublicKey
+}
+
+// HostKeyStatus describes the verification state of one hop
+type HostKeyStatus struct {
+	Hop            string
+	Address        string
+	Mode           string
+	KnownHostsPath string
+	Fingerprint    string
+	Pending        *PresentedKey
+}
+
+// ErrHostKeyUnknown is returned when a server presents a host key that is
+// neither pinned nor in known_hosts. The key is kept so an admin can trust it.
+var ErrHostKeyUnknown = errors.New("host key is not trusted")
+
+// HostKeyMismatchError is returned when a server presents a different key
+// than the one pinned or recorded in known_hosts
+type HostKeyMismatchError struct {
+	Hop     string
+	Address string
+	Got     string
+	Want    string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s host %s: presented %s, expected %s (possible man-in-the-middle, refusing to connect)",
+		e.Hop, e.Address, e.Got, e.Want)
+}
+
+// hostKeyCallback returns a callback that fails closed: only a matching
+// pinned fingerprint or known_hosts entry is accepted
+func (c *SSHClient) hostKeyCallback(hop string, policy HostKeyPolicy) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		presented := ssh.FingerprintSHA256(key)
+
+		if policy.Fingerprint != "" {
+			if presented != policy.Fingerprint {
+				return &HostKeyMismatchError{Hop: hop, Address: hostname, Got: presented, Want: policy.Fingerprint}
+			}
+			return nil
+		}
+
+		if policy.KnownHostsPath != "" {
+			check, err := knownhosts.New(policy.KnownHostsPath)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to load known_hosts for %s host: %w", hop, err)
+			}
+			if err == nil {
+				err = check(hostname, remote, key)
+				if err == nil {
+					return nil
+				}
+
+				var keyErr *knownhosts.KeyError
+				if !errors.As(err, &keyErr) {
+					return fmt.Errorf("failed to verify %s host key: %w", hop, err)
+				}
+				if len(keyErr.Want) > 0 {
+					var want []string
+					for _, k := range keyErr.Want {
+						want = append(want, ssh.FingerprintSHA256(k.Key))
+					}
+					return &HostKeyMismatchError{Hop: hop, Address: hostname, Got: presented, Want: strings.Join(want, ", ")}
+				}
+			}
+		}
+
+		// Unknown host: remember the key so it can be reviewed and trusted
+		c.pendingMu.Lock()
+		c.pending[hop] = &PresentedKey{
+			Hop:         hop,
+			Address:     hostname,
+			Type:        key.Type(),
+			Fingerprint: presented,
+			SeenAt:      time.Now(),
+			key:         key,
+		}
+		c.pendingMu.Unlock()
+
+		return fmt.Errorf("%w: %s host %s presented %s %s; review and trust it under Settings > Host Keys",
+			ErrHostKeyUnknown, hop, hostname, key.Type(), presented)
+	}
+}
+
+// HostKeyStatus reports how each hop's host key is verified and any key
+// waiting to be trusted
+func (c *SSHClient) HostKeyStatus() []HostKeyStatus {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	var hops []HostKeyStatus
+	if c.jumpHost != "" {
+		hops = append(hops, c.hopStatus(HopJump, fmt.Sprintf("%s:22", c.jumpHost), c.jumpHostKeys))
+	}
+	hops = append(hops, c.hopStatus(HopTarget, fmt.Sprintf("%s:%d", c.host, c.port), c.hostKeys))
+	return hops
+}
+
+func (c *SSHClient) hopStatus(hop, addr string, policy HostKeyPolicy) HostKeyStatus {
+	status := HostKeyStatus{
+		Hop:            hop,
+		Address:        addr,
+		KnownHostsPath: policy.KnownHostsPath,
+		Fingerprint:    policy.Fingerprint,
+		Pending:        c.pending[hop],
+	}
+	switch {
+	case policy.Fingerprint != "":
+		status.Mode = "pinned fingerprint"
+	case policy.KnownHostsPath != "":
+		status.Mode = "known_hosts"
+	default:
+		status.Mode = "not configured"
+	}
+	return status
+}
+
+// TrustHostKey records the pending key of a hop in its known_hosts file.
+// The fingerprint must match the pending key, so an admin only ever trusts
+// the exact key they reviewed.
+func (c *SSHClient) TrustHostKey(hop, fingerprint string) error {
+	policy := c.hostKeys
+	if hop == HopJump {
+		policy = c.jumpHostKeys
+	}
+	if policy.Fingerprint != "" {
+		return fmt.Errorf("%s host key is pinned by fingerprint in configuration", hop)
+	}
+	if policy.KnownHostsPath == "" {
+		return fmt.Errorf("no known_hosts file configured for %s host", hop)
+	}
+
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	pending := c.pending[hop]
+	if pending == nil {
+		return fmt.Errorf("no pending host key for %s host", hop)
+	}
+	if pending.Fingerprint != fingerprint {
+		return fmt.Errorf("fingerprint %s does not match the key presented by %s", fingerprint, pending.Address)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(policy.KnownHostsPath), 0700); err != nil {
+		return fmt.Errorf("failed to create known_hosts directory: %w", err)
+	}
+	f, err := os.OpenFile(policy.KnownHostsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known_hosts: %w", err)
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(pending.Address)}, pending.key)
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("failed to write known_hosts: %w", err)
+	}
+
+	delete(c.pending, hop)
+	return nil
+}
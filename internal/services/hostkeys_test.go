@@ -0,0 +1,84 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v", err)
+	}
+	return key
+}
+
+func TestHostKeyPinnedFingerprint(t *testing.T) {
+	key := newTestHostKey(t)
+	other := newTestHostKey(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}
+
+	c := NewSSHClient(SSHConfig{Host: "mail.example.com", Port: 22,
+		HostKeys: HostKeyPolicy{Fingerprint: ssh.FingerprintSHA256(key)}})
+	check := c.hostKeyCallback(HopTarget, c.hostKeys)
+
+	if err := check("mail.example.com:22", addr, key); err != nil {
+		t.Fatalf("pinned key rejected: %v", err)
+	}
+	var mismatch *HostKeyMismatchError
+	if err := check("mail.example.com:22", addr, other); !errors.As(err, &mismatch) {
+		t.Fatalf("expected HostKeyMismatchError, got %v", err)
+	}
+	if err := c.TrustHostKey(HopTarget, ssh.FingerprintSHA256(other)); err == nil {
+		t.Fatal("trusting a key over a pinned fingerprint should fail")
+	}
+}
+
+func TestHostKeyTrustFlow(t *testing.T) {
+	key := newTestHostKey(t)
+	other := newTestHostKey(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 2223}
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	c := NewSSHClient(SSHConfig{Host: "mail.example.com", Port: 2223,
+		HostKeys: HostKeyPolicy{KnownHostsPath: knownHosts}})
+	check := c.hostKeyCallback(HopTarget, c.hostKeys)
+
+	// Unknown host is refused and its key kept for review
+	if err := check("mail.example.com:2223", addr, key); !errors.Is(err, ErrHostKeyUnknown) {
+		t.Fatalf("expected ErrHostKeyUnknown, got %v", err)
+	}
+	status := c.HostKeyStatus()
+	if len(status) != 1 || status[0].Pending == nil || status[0].Mode != "known_hosts" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	if err := c.TrustHostKey(HopTarget, ssh.FingerprintSHA256(other)); err == nil {
+		t.Fatal("trusting a fingerprint other than the presented one should fail")
+	}
+	if err := c.TrustHostKey(HopTarget, ssh.FingerprintSHA256(key)); err != nil {
+		t.Fatalf("TrustHostKey: %v", err)
+	}
+	if c.HostKeyStatus()[0].Pending != nil {
+		t.Error("pending key not cleared after trust")
+	}
+
+	if err := check("mail.example.com:2223", addr, key); err != nil {
+		t.Fatalf("trusted key rejected: %v", err)
+	}
+	var mismatch *HostKeyMismatchError
+	if err := check("mail.example.com:2223", addr, other); !errors.As(err, &mismatch) {
+		t.Fatalf("expected HostKeyMismatchError for changed key, got %v", err)
+	}
+}
@@ -2,36 +2,69 @@ package services
 
 import (
 	"fmt"
+	"regexp"
 	"sort"
 	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/postfixmap"
 )
 
 // MailService provides mail server management operations
 type MailService struct {
-	ssh *SSHClient
+	exec           Executor
+	passwordScheme string
+	archiveDir     string
+	dkimAlgorithm  string
 }
 
 // Domain represents a mail domain
 type Domain struct {
-	Name      string
-	UserCount int
+	Name      string `json:"name"`
+	UserCount int    `json:"user_count"`
 }
 
 // Mailbox represents an email account
 type Mailbox struct {
-	Email    string
-	Username string
-	Domain   string
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	Domain   string `json:"domain"`
+
+	// Quota is the storage limit in bytes (0 = unlimited). QuotaInherited
+	// is set when the mailbox follows the domain default.
+	Quota          int64 `json:"quota_bytes"`
+	QuotaInherited bool  `json:"quota_inherited"`
+
+	// UsedBytes is the storage in use as reported by doveadm; UsageKnown is
+	// false when usage was not queried or not available
+	UsedBytes  int64 `json:"used_bytes"`
+	UsageKnown bool  `json:"usage_known"`
 }
 
 // NewMailService creates a new mail service
-func NewMailService(sshClient *SSHClient) *MailService {
-	return &MailService{ssh: sshClient}
+func NewMailService(exec Executor) *MailService {
+	return &MailService{exec: exec, passwordScheme: DefaultPasswordScheme, archiveDir: DefaultArchiveDir, dkimAlgorithm: DefaultDKIMAlgorithm}
+}
+
+// SetPasswordScheme selects the dovecot scheme used for new passwords
+func (m *MailService) SetPasswordScheme(scheme string) error {
+	if !ValidPasswordScheme(scheme) {
+		return fmt.Errorf("unsupported password scheme: %s", scheme)
+	}
+	m.passwordScheme = strings.ToUpper(scheme)
+	return nil
+}
+
+// GetExecutor returns the executor used to reach the mail host
+func (m *MailService) GetExecutor() Executor {
+	return m.exec
 }
 
-// GetSSHClient returns the underlying SSH client
-func (m *MailService) GetSSHClient() *SSHClient {
-	return m.ssh
+// WithExecutor returns a copy of the service that runs through exec, e.g.
+// a FileRecorder around the shared executor
+func (m *MailService) WithExecutor(exec Executor) *MailService {
+	c := *m
+	c.exec = exec
+	return &c
 }
 
 // Mail configuration file paths on CMH
@@ -45,26 +78,15 @@ const (
 
 // ListDomains returns all configured mail domains
 func (m *MailService) ListDomains() ([]Domain, error) {
-	content, err := m.ssh.ReadFile(virtualDomainsFile)
+	domainMap, err := readMap(m.exec, virtualDomainsFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read domains: %w", err)
 	}
 
 	// Get mailbox counts per domain
-	mailboxes, err := m.ssh.ReadFile(virtualMailboxFile)
-	if err != nil {
-		mailboxes = ""
-	}
-
 	domainCounts := make(map[string]int)
-	for _, line := range strings.Split(mailboxes, "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		parts := strings.Fields(line)
-		if len(parts) >= 1 {
-			email := parts[0]
+	if mailboxMap, err := readMap(m.exec, virtualMailboxFile); err == nil {
+		for _, email := range mailboxMap.Keys() {
 			if at := strings.Index(email, "@"); at > 0 {
 				domain := email[at+1:]
 				domainCounts[domain]++
@@ -73,14 +95,10 @@ func (m *MailService) ListDomains() ([]Domain, error) {
 	}
 
 	var domains []Domain
-	for _, line := range strings.Split(content, "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
+	for _, name := range domainMap.Keys() {
 		domains = append(domains, Domain{
-			Name:      line,
-			UserCount: domainCounts[line],
+			Name:      name,
+			UserCount: domainCounts[name],
 		})
 	}
 
@@ -91,11 +109,12 @@ func (m *MailService) ListDomains() ([]Domain, error) {
 	return domains, nil
 }
 
-// AddDomain adds a new mail domain
+// AddDomain adds a new mail domain with a DKIM key of the configured
+// algorithm, unless that is "none"
 func (m *MailService) AddDomain(domain string) error {
 	// Validate domain format
 	if !isValidDomain(domain) {
-		return fmt.Errorf("invalid domain format: %s", domain)
+		return invalidf("invalid domain format: %s", domain)
 	}
 
 	// Check if domain already exists
@@ -105,89 +124,70 @@ func (m *MailService) AddDomain(domain string) error {
 	}
 	for _, d := range domains {
 		if d.Name == domain {
-			return fmt.Errorf("domain already exists: %s", domain)
+			return existsf("domain already exists: %s", domain)
 		}
 	}
 
-	// Add to virtual_domains
-	if err := m.ssh.AppendToFile(virtualDomainsFile, domain); err != nil {
-		return fmt.Errorf("failed to add domain: %w", err)
-	}
-
-	// Create maildir base for domain
 	maildir := fmt.Sprintf("%s/%s", virtualMailboxBase, domain)
-	if _, err := m.ssh.Execute(fmt.Sprintf("doas mkdir -p %s && doas chown 5000:5000 %s", maildir, maildir)); err != nil {
-		return fmt.Errorf("failed to create maildir: %w", err)
-	}
-
-	// Reload postfix
-	if _, err := m.ssh.Execute("doas postfix reload"); err != nil {
-		return fmt.Errorf("failed to reload postfix: %w", err)
-	}
-
-	return nil
-}
-
-// DeleteDomain removes a mail domain and all its users
-func (m *MailService) DeleteDomain(domain string) error {
-	// Get all users for this domain first
-	users, err := m.ListMailboxes(domain)
-	if err != nil {
-		return err
-	}
-
-	// Delete all users first
-	for _, user := range users {
-		if err := m.DeleteMailbox(domain, user.Username); err != nil {
-			return fmt.Errorf("failed to delete user %s: %w", user.Email, err)
+	createMaildir, removeMaildir := m.createMaildir(maildir)
+
+	cs := m.changeSet("add_domain", domain, virtualDomainsFile).
+		Step("add domain", func() error {
+			err := editMap(m.exec, virtualDomainsFile, func(pm *postfixmap.Map) error {
+				pm.Add(domain, "")
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add domain: %w", err)
+			}
+			return nil
+		}).
+		StepWithUndo("create maildir", createMaildir, removeMaildir).
+		Step("reload postfix", m.reloadPostfix)
+
+	// New domains sign their mail from the start
+	if m.dkimAlgorithm != DKIMAlgorithmNone {
+		selector, err := m.nextDKIMSelector(domain)
+		if err != nil {
+			return err
+		}
+		cs = cs.Snapshot(dkimStateFile, dkimSigningConf).OnRollback("doas rc-service rspamd reload")
+		if cs, err = m.dkimKeySteps(cs, domain, selector, m.dkimAlgorithm, &DKIMKey{}); err != nil {
+			return err
 		}
 	}
-
-	// Remove domain from virtual_domains
-	if err := m.ssh.DeleteLine(virtualDomainsFile, domain); err != nil {
-		return fmt.Errorf("failed to remove domain: %w", err)
-	}
-
-	// Remove maildir
-	maildir := fmt.Sprintf("%s/%s", virtualMailboxBase, domain)
-	if _, err := m.ssh.Execute(fmt.Sprintf("doas rm -rf %s", maildir)); err != nil {
-		return fmt.Errorf("failed to remove maildir: %w", err)
-	}
-
-	// Reload postfix
-	if _, err := m.ssh.Execute("doas postfix reload"); err != nil {
-		return fmt.Errorf("failed to reload postfix: %w", err)
-	}
-
-	return nil
+	return cs.Run()
 }
 
 // ListMailboxes returns all mailboxes for a domain
 func (m *MailService) ListMailboxes(domain string) ([]Mailbox, error) {
-	content, err := m.ssh.ReadFile(virtualMailboxFile)
+	mailboxMap, err := readMap(m.exec, virtualMailboxFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read mailboxes: %w", err)
 	}
 
-	var mailboxes []Mailbox
-	for _, line := range strings.Split(content, "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
+	quotas, err := m.mailboxQuotas()
+	if err != nil {
+		return nil, err
+	}
+	defaultQuota, err := m.DomainQuota(domain)
+	if err != nil {
+		return nil, err
+	}
 
-		parts := strings.Fields(line)
-		if len(parts) >= 1 {
-			email := parts[0]
-			if at := strings.Index(email, "@"); at > 0 {
-				mailDomain := email[at+1:]
-				if mailDomain == domain {
-					mailboxes = append(mailboxes, Mailbox{
-						Email:    email,
-						Username: email[:at],
-						Domain:   mailDomain,
-					})
-				}
+	var mailboxes []Mailbox
+	for _, email := range mailboxMap.Keys() {
+		if at := strings.Index(email, "@"); at > 0 {
+			mailDomain := email[at+1:]
+			if mailDomain == domain {
+				quota, hasQuota := quotas[email]
+				mailboxes = append(mailboxes, Mailbox{
+					Email:          email,
+					Username:       email[:at],
+					Domain:         mailDomain,
+					Quota:          quota,
+					QuotaInherited: (defaultQuota == 0 && !hasQuota) || (defaultQuota > 0 && hasQuota && quota == defaultQuota),
+				})
 			}
 		}
 	}
@@ -205,10 +205,10 @@ func (m *MailService) AddMailbox(domain, username, password string) error {
 
 	// Validate
 	if !isValidUsername(username) {
-		return fmt.Errorf("invalid username: %s", username)
+		return invalidf("invalid username: %s", username)
 	}
 	if len(password) < 8 {
-		return fmt.Errorf("password must be at least 8 characters")
+		return invalidf("password must be at least 8 characters")
 	}
 
 	// Check if user already exists
@@ -218,72 +218,93 @@ func (m *MailService) AddMailbox(domain, username, password string) error {
 	}
 	for _, mb := range existing {
 		if mb.Username == username {
-			return fmt.Errorf("user already exists: %s", email)
+			return existsf("user already exists: %s", email)
 		}
 	}
 
-	// Add to postfix virtual_mailbox
-	mailboxEntry := fmt.Sprintf("%s    %s/%s/", email, domain, username)
-	if err := m.ssh.AppendToFile(virtualMailboxFile, mailboxEntry); err != nil {
-		return fmt.Errorf("failed to add mailbox to postfix: %w", err)
-	}
-
-	// Regenerate postfix map
-	if _, err := m.ssh.Execute(fmt.Sprintf("doas postmap %s", virtualMailboxFile)); err != nil {
-		return fmt.Errorf("failed to postmap: %w", err)
-	}
-
-	// Create maildir
-	maildir := fmt.Sprintf("%s/%s/%s", virtualMailboxBase, domain, username)
-	if _, err := m.ssh.Execute(fmt.Sprintf("doas mkdir -p %s && doas chown -R 5000:5000 %s", maildir, maildir)); err != nil {
-		return fmt.Errorf("failed to create maildir: %w", err)
+	hashed, err := HashPassword(m.passwordScheme, password)
+	if err != nil {
+		return err
 	}
+	user := dovecotUser{Email: email, Password: hashed}
 
-	// Add to dovecot users
-	dovecotEntry := fmt.Sprintf("%s:{PLAIN}%s", email, password)
-	if err := m.ssh.AppendToFile(dovecotUsersFile, dovecotEntry); err != nil {
-		return fmt.Errorf("failed to add user to dovecot: %w", err)
+	// New mailboxes start on the domain default quota
+	defaultQuota, err := m.DomainQuota(domain)
+	if err != nil {
+		return err
 	}
-
-	// Reload services
-	if _, err := m.ssh.Execute("doas postfix reload && doas doveadm reload"); err != nil {
-		return fmt.Errorf("failed to reload services: %w", err)
+	if defaultQuota > 0 {
+		user.SetExtra(quotaRuleField, quotaRule(defaultQuota))
 	}
 
-	return nil
+	maildir := fmt.Sprintf("%s/%s/%s", virtualMailboxBase, domain, username)
+	createMaildir, removeMaildir := m.createMaildir(maildir)
+
+	return m.changeSet("add_mailbox", email, virtualMailboxFile, dovecotUsersFile).
+		Step("add mailbox to postfix", func() error {
+			err := editMap(m.exec, virtualMailboxFile, func(pm *postfixmap.Map) error {
+				pm.Add(email, fmt.Sprintf("%s/%s/", domain, username))
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add mailbox to postfix: %w", err)
+			}
+			return nil
+		}).
+		Step("postmap", m.postmap(virtualMailboxFile)).
+		StepWithUndo("create maildir", createMaildir, removeMaildir).
+		Step("add user to dovecot", func() error {
+			if err := appendLine(m.exec, dovecotUsersFile, user.String()); err != nil {
+				return fmt.Errorf("failed to add user to dovecot: %w", err)
+			}
+			return nil
+		}).
+		Step("reload services", m.reloadServices).
+		Run()
 }
 
 // DeleteMailbox removes an email account
 func (m *MailService) DeleteMailbox(domain, username string) error {
 	email := fmt.Sprintf("%s@%s", username, domain)
 
+	// Maildir is preserved to keep the mail
+	return m.changeSet("delete_mailbox", email, dovecotUsersFile, virtualMailboxFile, virtualAliasFile).
+		Step("remove mailbox", func() error { return m.removeMailboxEntries(email) }).
+		Step("postmap virtual_mailbox", m.postmap(virtualMailboxFile)).
+		Step("postmap virtual_alias", m.postmap(virtualAliasFile)).
+		Step("reload services", m.reloadServices).
+		Run()
+}
+
+// removeMailboxEntries removes a mailbox from dovecot users, virtual_mailbox
+// and any aliases pointing at it
+func (m *MailService) removeMailboxEntries(email string) error {
 	// Remove from dovecot users
-	if err := m.ssh.DeleteLine(dovecotUsersFile, fmt.Sprintf("%s:", email)); err != nil {
+	if err := deleteLines(m.exec, dovecotUsersFile, regexp.QuoteMeta(email+":")); err != nil {
 		return fmt.Errorf("failed to remove from dovecot: %w", err)
 	}
 
 	// Remove from postfix virtual_mailbox
-	if err := m.ssh.DeleteLine(virtualMailboxFile, email); err != nil {
+	err := editMap(m.exec, virtualMailboxFile, func(pm *postfixmap.Map) error {
+		pm.RemoveFunc(func(e *postfixmap.Entry) bool { return e.Key == email })
+		return nil
+	})
+	if err != nil {
 		return fmt.Errorf("failed to remove from postfix: %w", err)
 	}
 
-	// Remove any aliases for this user
-	if err := m.ssh.DeleteLine(virtualAliasFile, fmt.Sprintf(".*%s$", email)); err != nil {
-		// Ignore alias errors - user might not have any
-	}
-
-	// Regenerate postfix maps
-	if _, err := m.ssh.Execute(fmt.Sprintf("doas postmap %s", virtualMailboxFile)); err != nil {
-		return fmt.Errorf("failed to postmap: %w", err)
-	}
-
-	// Optionally remove maildir (commented out to preserve mail)
-	// maildir := fmt.Sprintf("%s/%s/%s", virtualMailboxBase, domain, username)
-	// m.ssh.Execute(fmt.Sprintf("doas rm -rf %s", maildir))
-
-	// Reload services
-	if _, err := m.ssh.Execute("doas postfix reload && doas doveadm reload"); err != nil {
-		return fmt.Errorf("failed to reload services: %w", err)
+	// Remove the mailbox from alias targets, and aliases left without any
+	err = m.rewriteAliases(func(a Alias) ([]string, bool) {
+		var kept []string
+		for _, t := range a.Targets {
+			if !strings.EqualFold(t, email) {
+				kept = append(kept, t)
+			}
+		}
+		return kept, len(kept) != len(a.Targets)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove from aliases: %w", err)
 	}
 
 	return nil
@@ -294,32 +315,101 @@ func (m *MailService) ChangePassword(domain, username, newPassword string) error
 	email := fmt.Sprintf("%s@%s", username, domain)
 
 	if len(newPassword) < 8 {
-		return fmt.Errorf("password must be at least 8 characters")
+		return invalidf("password must be at least 8 characters")
+	}
+
+	hashed, err := HashPassword(m.passwordScheme, newPassword)
+	if err != nil {
+		return err
 	}
 
-	// Update dovecot users file using sed
-	newEntry := fmt.Sprintf("%s:{PLAIN}%s", email, newPassword)
-	escaped := strings.ReplaceAll(newEntry, "/", "\\/")
-	cmd := fmt.Sprintf("doas sed -i 's/^%s:.*/%s/' %s", 
-		strings.ReplaceAll(email, "@", "\\@"),
-		escaped,
-		dovecotUsersFile)
-	
-	if _, err := m.ssh.Execute(cmd); err != nil {
-		return fmt.Errorf("failed to update password: %w", err)
+	return m.changeSet("change_password", email, dovecotUsersFile).
+		Step("update password", func() error {
+			// Update the entry in the dovecot users file, keeping any extra fields
+			found := false
+			err := m.rewriteDovecotUsers(func(u *dovecotUser) bool {
+				if u.Email == email {
+					u.Password = hashed
+					found = true
+				}
+				return true
+			})
+			if err != nil {
+				return fmt.Errorf("failed to update password: %w", err)
+			}
+			if !found {
+				return notFoundf("user not found: %s", email)
+			}
+			return nil
+		}).
+		Step("reload dovecot", m.reloadDovecot).
+		Run()
+}
+
+// changeSet starts a change set that snapshots the given files and, on
+// rollback, rebuilds the affected postfix maps and reloads services
+func (m *MailService) changeSet(op, target string, files ...string) *ChangeSet {
+	cs := NewChangeSet(m.exec, op, target).Snapshot(files...)
+	for _, f := range files {
+		if f == virtualMailboxFile || f == virtualAliasFile {
+			cs.OnRollback(fmt.Sprintf("doas postmap %s", f))
+		}
+	}
+	return cs.OnRollback("doas postfix reload && doas doveadm reload")
+}
+
+// postmap returns a step that regenerates a postfix lookup table
+func (m *MailService) postmap(file string) func() error {
+	return func() error {
+		if _, err := m.exec.Execute(fmt.Sprintf("doas postmap %s", file)); err != nil {
+			return fmt.Errorf("failed to postmap: %w", err)
+		}
+		return nil
 	}
+}
 
-	// Reload dovecot
-	if _, err := m.ssh.Execute("doas doveadm reload"); err != nil {
-		return fmt.Errorf("failed to reload dovecot: %w", err)
+// reloadPostfix reloads postfix
+func (m *MailService) reloadPostfix() error {
+	if _, err := m.exec.Execute("doas postfix reload"); err != nil {
+		return fmt.Errorf("failed to reload postfix: %w", err)
 	}
+	return nil
+}
 
+// reloadServices reloads postfix and dovecot
+func (m *MailService) reloadServices() error {
+	if _, err := m.exec.Execute("doas postfix reload && doas doveadm reload"); err != nil {
+		return fmt.Errorf("failed to reload services: %w", err)
+	}
 	return nil
 }
 
+// createMaildir returns do/undo actions that create a maildir owned by the
+// vmail user. The undo only removes the directory if this step created it.
+func (m *MailService) createMaildir(dir string) (func() error, func() error) {
+	created := false
+	do := func() error {
+		if _, err := m.exec.Execute(fmt.Sprintf("test -d %s", shellQuote(dir))); err != nil {
+			created = true
+		}
+		if _, err := m.exec.Execute(fmt.Sprintf("doas mkdir -p %s && doas chown -R 5000:5000 %s", shellQuote(dir), shellQuote(dir))); err != nil {
+			return fmt.Errorf("failed to create maildir: %w", err)
+		}
+		return nil
+	}
+	undo := func() error {
+		if !created {
+			return nil
+		}
+		_, err := m.exec.Execute(fmt.Sprintf("doas rm -rf %s", shellQuote(dir)))
+		return err
+	}
+	return do, undo
+}
+
 // TestConnection verifies SSH connectivity to mail server
 func (m *MailService) TestConnection() error {
-	output, err := m.ssh.Execute("hostname")
+	output, err := m.exec.Execute("hostname")
 	if err != nil {
 		return fmt.Errorf("connection test failed: %w", err)
 	}
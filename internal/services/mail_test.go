@@ -0,0 +1,343 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestMailService(t *testing.T) (*MailService, *FakeExecutor) {
+	t.Helper()
+	fake := NewFakeExecutor()
+	fake.SetFile(virtualDomainsFile, "# hosted domains\n")
+	fake.SetFile(virtualMailboxFile, "")
+	fake.SetFile(virtualAliasFile, "")
+	fake.SetFile(dovecotUsersFile, "")
+	return NewMailService(fake), fake
+}
+
+func TestDomainLifecycle(t *testing.T) {
+	mail, fake := newTestMailService(t)
+
+	if err := mail.AddDomain("example.com"); err != nil {
+		t.Fatalf("AddDomain: %v", err)
+	}
+	if err := mail.AddDomain("example.com"); err == nil {
+		t.Fatal("expected duplicate domain to be rejected")
+	}
+	if err := mail.AddDomain("not a domain"); err == nil {
+		t.Fatal("expected invalid domain to be rejected")
+	}
+
+	domains, err := mail.ListDomains()
+	if err != nil {
+		t.Fatalf("ListDomains: %v", err)
+	}
+	if len(domains) != 1 || domains[0].Name != "example.com" {
+		t.Fatalf("unexpected domains: %+v", domains)
+	}
+	if !fake.HasDir(virtualMailboxBase + "/example.com") {
+		t.Error("domain maildir was not created")
+	}
+	if fake.Reloads("postfix") == 0 {
+		t.Error("postfix was not reloaded")
+	}
+
+	if err := mail.AddMailbox("example.com", "alice", "s3cretpass"); err != nil {
+		t.Fatalf("AddMailbox: %v", err)
+	}
+	if _, err := mail.DeleteDomain("example.com", DeleteDomainOptions{Mode: DeleteModeCascade, Confirm: "example.org"}); err == nil {
+		t.Fatal("expected mismatched confirmation to be rejected")
+	}
+	if _, err := mail.DeleteDomain("example.com", DeleteDomainOptions{Mode: DeleteModeCascade, Confirm: "example.com"}); err != nil {
+		t.Fatalf("DeleteDomain: %v", err)
+	}
+
+	domains, _ = mail.ListDomains()
+	if len(domains) != 0 {
+		t.Fatalf("domain still listed after delete: %+v", domains)
+	}
+	if users, _ := fake.File(dovecotUsersFile); strings.Contains(users, "alice@example.com") {
+		t.Error("dovecot user left behind after domain delete")
+	}
+	if fake.HasDir(virtualMailboxBase + "/example.com") {
+		t.Error("domain maildir left behind after delete")
+	}
+	if content, _ := fake.File(virtualDomainsFile); !strings.Contains(content, "# hosted domains") {
+		t.Error("comment in virtual_domains was lost")
+	}
+}
+
+func TestMailboxLifecycle(t *testing.T) {
+	mail, fake := newTestMailService(t)
+	if err := mail.AddDomain("example.com"); err != nil {
+		t.Fatalf("AddDomain: %v", err)
+	}
+
+	if err := mail.AddMailbox("example.com", "bob", "short"); err == nil {
+		t.Fatal("expected short password to be rejected")
+	}
+	if err := mail.AddMailbox("example.com", "bob", "correct-horse"); err != nil {
+		t.Fatalf("AddMailbox: %v", err)
+	}
+	if err := mail.AddMailbox("example.com", "bob", "correct-horse"); err == nil {
+		t.Fatal("expected duplicate mailbox to be rejected")
+	}
+
+	boxes, err := mail.ListMailboxes("example.com")
+	if err != nil {
+		t.Fatalf("ListMailboxes: %v", err)
+	}
+	if len(boxes) != 1 || boxes[0].Email != "bob@example.com" {
+		t.Fatalf("unexpected mailboxes: %+v", boxes)
+	}
+
+	db, ok := fake.File(virtualMailboxFile + ".db")
+	if !ok || !strings.Contains(db, "bob@example.com") {
+		t.Error("virtual_mailbox was not postmapped")
+	}
+	if !fake.HasDir(virtualMailboxBase + "/example.com/bob") {
+		t.Error("maildir was not created")
+	}
+
+	users, _ := fake.File(dovecotUsersFile)
+	if !strings.HasPrefix(users, "bob@example.com:{SHA512-CRYPT}$6$") {
+		t.Fatalf("password not stored hashed: %q", users)
+	}
+	if strings.Contains(users, "correct-horse") {
+		t.Fatal("cleartext password written to dovecot users")
+	}
+
+	if err := mail.ChangePassword("example.com", "bob", "battery-staple"); err != nil {
+		t.Fatalf("ChangePassword: %v", err)
+	}
+	if updated, _ := fake.File(dovecotUsersFile); updated == users {
+		t.Error("password hash did not change")
+	}
+	if err := mail.ChangePassword("example.com", "nobody", "battery-staple"); err == nil {
+		t.Error("expected password change for unknown user to fail")
+	}
+
+	if err := mail.DeleteMailbox("example.com", "bob"); err != nil {
+		t.Fatalf("DeleteMailbox: %v", err)
+	}
+	if boxes, _ := mail.ListMailboxes("example.com"); len(boxes) != 0 {
+		t.Fatalf("mailbox still listed after delete: %+v", boxes)
+	}
+	if !fake.HasDir(virtualMailboxBase + "/example.com/bob") {
+		t.Error("maildir should be preserved on mailbox delete")
+	}
+}
+
+func TestDeleteMailboxPostmapsAliases(t *testing.T) {
+	mail, fake := newTestMailService(t)
+	mail.SetDKIMAlgorithm(DKIMAlgorithmNone)
+	if err := mail.AddDomain("example.com"); err != nil {
+		t.Fatalf("AddDomain: %v", err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if err := mail.AddMailbox("example.com", user, "correct-horse"); err != nil {
+			t.Fatalf("AddMailbox %s: %v", user, err)
+		}
+	}
+	if err := mail.AddAlias("example.com", "team", []string{"alice@example.com", "bob@example.com"}); err != nil {
+		t.Fatalf("AddAlias: %v", err)
+	}
+
+	if err := mail.DeleteMailbox("example.com", "bob"); err != nil {
+		t.Fatalf("DeleteMailbox: %v", err)
+	}
+	for _, file := range []string{virtualMailboxFile, virtualAliasFile} {
+		source, _ := fake.File(file)
+		db, ok := fake.File(file + ".db")
+		if !ok || db != source || strings.Contains(db, "bob@example.com") {
+			t.Errorf("%s not postmapped after delete: %q", file, db)
+		}
+	}
+}
+
+func TestAddMailboxRollsBack(t *testing.T) {
+	mail, fake := newTestMailService(t)
+	if err := mail.AddDomain("example.com"); err != nil {
+		t.Fatalf("AddDomain: %v", err)
+	}
+	before, _ := fake.File(virtualMailboxFile)
+
+	fake.FailOn("doveadm reload", "doveadm: reload failed")
+	err := mail.AddMailbox("example.com", "carol", "correct-horse")
+
+	var rb *RollbackError
+	if !errors.As(err, &rb) {
+		t.Fatalf("expected RollbackError, got %v", err)
+	}
+	if rb.Step != "reload services" {
+		t.Errorf("unexpected failed step %q", rb.Step)
+	}
+	if rb.RollbackErr == nil {
+		// The rollback reload also hits the injected failure
+		t.Error("expected rollback reload failure to be reported")
+	}
+
+	if after, _ := fake.File(virtualMailboxFile); after != before {
+		t.Errorf("virtual_mailbox not restored: %q", after)
+	}
+	if users, _ := fake.File(dovecotUsersFile); strings.Contains(users, "carol@") {
+		t.Error("dovecot users not restored")
+	}
+	if fake.HasDir(virtualMailboxBase + "/example.com/carol") {
+		t.Error("maildir created by the failed change was not removed")
+	}
+}
+
+func TestAliases(t *testing.T) {
+	mail, fake := newTestMailService(t)
+
+	if err := mail.AddAlias("example.com", "info", []string{"alice@example.com", "bob@example.org"}); err != nil {
+		t.Fatalf("AddAlias: %v", err)
+	}
+	if err := mail.AddAlias("example.com", "", []string{"alice@example.com"}); err != nil {
+		t.Fatalf("AddAlias catch-all: %v", err)
+	}
+	if err := mail.AddAlias("example.com", "info", []string{"x@example.com"}); err == nil {
+		t.Fatal("expected duplicate alias to be rejected")
+	}
+	if err := mail.AddAlias("example.com", "bad", []string{"not-an-address"}); err == nil {
+		t.Fatal("expected invalid target to be rejected")
+	}
+
+	aliases, err := mail.ListAliases("example.com")
+	if err != nil {
+		t.Fatalf("ListAliases: %v", err)
+	}
+	if len(aliases) != 2 || aliases[0].Source != "info@example.com" || !aliases[1].CatchAll {
+		t.Fatalf("unexpected aliases: %+v", aliases)
+	}
+	if len(aliases[0].Targets) != 2 {
+		t.Errorf("expected two targets, got %v", aliases[0].Targets)
+	}
+
+	if err := mail.UpdateAlias("example.com", "info@example.com", []string{"carol@example.com"}); err != nil {
+		t.Fatalf("UpdateAlias: %v", err)
+	}
+	if err := mail.DeleteAlias("example.com", "@example.com"); err != nil {
+		t.Fatalf("DeleteAlias: %v", err)
+	}
+
+	content, _ := fake.File(virtualAliasFile)
+	if content != "info@example.com    carol@example.com\n" {
+		t.Fatalf("unexpected virtual_alias content: %q", content)
+	}
+	if db, _ := fake.File(virtualAliasFile + ".db"); db != content {
+		t.Error("virtual_alias was not postmapped after the last change")
+	}
+}
+
+func TestHandWrittenMapsKeptIntact(t *testing.T) {
+	mail, fake := newTestMailService(t)
+	fake.SetFile(virtualDomainsFile, "# hosted domains\nexample.com\t# primary\n")
+	fake.SetFile(virtualMailboxFile, "alice@example.com\texample.com/alice/  # since 2019\r\nbob@example.com   example.com/bob/\r\n")
+	aliases := "# team list\n" +
+		"team@example.com    alice@example.com,\n" +
+		"        bob@example.com   # on leave\n" +
+		"\n" +
+		"sales@example.com alice@example.com"
+	fake.SetFile(virtualAliasFile, aliases)
+	fake.SetFile(dovecotUsersFile, "alice@example.com:{PLAIN}x\nbob@example.com:{PLAIN}y\n")
+
+	domains, err := mail.ListDomains()
+	if err != nil || len(domains) != 1 || domains[0].Name != "example.com" || domains[0].UserCount != 2 {
+		t.Fatalf("domains %+v, %v", domains, err)
+	}
+	list, err := mail.ListAliases("example.com")
+	if err != nil || len(list) != 2 || strings.Join(list[1].Targets, " ") != "alice@example.com bob@example.com" {
+		t.Fatalf("aliases %+v, %v", list, err)
+	}
+
+	if err := mail.DeleteMailbox("example.com", "bob"); err != nil {
+		t.Fatalf("DeleteMailbox: %v", err)
+	}
+	if got, _ := fake.File(virtualMailboxFile); got != "alice@example.com\texample.com/alice/  # since 2019\r\n" {
+		t.Errorf("virtual_mailbox %q", got)
+	}
+	want := "# team list\n" +
+		"team@example.com    alice@example.com # on leave\n" +
+		"\n" +
+		"sales@example.com alice@example.com"
+	if got, _ := fake.File(virtualAliasFile); got != want {
+		t.Errorf("virtual_alias\n%q\nwant\n%q", got, want)
+	}
+
+	if err := mail.AddAlias("example.com", "info", []string{"alice@example.com"}); err != nil {
+		t.Fatalf("AddAlias: %v", err)
+	}
+	if got, _ := fake.File(virtualAliasFile); got != want+"\ninfo@example.com    alice@example.com\n" {
+		t.Errorf("virtual_alias after add %q", got)
+	}
+}
+
+func TestDeleteDomainPlanAndArchive(t *testing.T) {
+	mail, fake := newTestMailService(t)
+	for _, d := range []string{"example.com", "example.org"} {
+		if err := mail.AddDomain(d); err != nil {
+			t.Fatalf("AddDomain: %v", err)
+		}
+	}
+	if err := mail.AddMailbox("example.com", "alice", "correct-horse"); err != nil {
+		t.Fatalf("AddMailbox: %v", err)
+	}
+	if err := mail.AddMailbox("example.org", "bob", "correct-horse"); err != nil {
+		t.Fatalf("AddMailbox: %v", err)
+	}
+	if err := mail.AddAlias("example.com", "info", []string{"alice@example.com"}); err != nil {
+		t.Fatalf("AddAlias: %v", err)
+	}
+	if err := mail.AddAlias("example.org", "team", []string{"bob@example.org", "alice@example.com"}); err != nil {
+		t.Fatalf("AddAlias: %v", err)
+	}
+	if err := mail.SetDomainQuota("example.com", 1<<30); err != nil {
+		t.Fatalf("SetDomainQuota: %v", err)
+	}
+	fake.SetFile(virtualMailboxBase+"/example.com/alice/cur/1.eml", "Subject: hi\n")
+
+	before := fake.Files()
+	plan, err := mail.PlanDomainDeletion("example.com", DeleteModeArchive)
+	if err != nil {
+		t.Fatalf("PlanDomainDeletion: %v", err)
+	}
+	if after := fake.Files(); strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Fatal("dry run changed files")
+	}
+	if len(plan.Mailboxes) != 1 || len(plan.Aliases) != 1 || len(plan.Maildirs) != 1 {
+		t.Fatalf("unexpected plan: %+v", plan)
+	}
+	var rewrites int
+	for _, c := range plan.Changes {
+		if c.Replacement != "" {
+			rewrites++
+			if c.Replacement != "team@example.org    bob@example.org" {
+				t.Errorf("unexpected rewrite %q", c.Replacement)
+			}
+		}
+	}
+	if rewrites != 1 || len(plan.Changes) != 6 {
+		t.Fatalf("unexpected changes: %+v", plan.Changes)
+	}
+
+	plan, err = mail.DeleteDomain("example.com", DeleteDomainOptions{Mode: DeleteModeArchive, Confirm: "example.com"})
+	if err != nil {
+		t.Fatalf("DeleteDomain: %v", err)
+	}
+	archive, ok := fake.File(plan.Archive)
+	if !ok || !strings.Contains(archive, "example.com/alice/cur/1.eml") {
+		t.Fatalf("maildir not archived to %s: %q", plan.Archive, archive)
+	}
+	if fake.HasDir(virtualMailboxBase + "/example.com") {
+		t.Error("maildir left behind after delete")
+	}
+	if aliases, _ := fake.File(virtualAliasFile); aliases != "team@example.org    bob@example.org\n" {
+		t.Errorf("unexpected virtual_alias: %q", aliases)
+	}
+	if users, _ := fake.File(dovecotUsersFile); strings.Contains(users, "example.com") || !strings.Contains(users, "bob@example.org") {
+		t.Errorf("unexpected dovecot users: %q", users)
+	}
+}
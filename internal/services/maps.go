@@ -0,0 +1,27 @@
+package services
+
+import (
+	"github.com/Ingasti/mailhub-admin/internal/postfixmap"
+)
+
+// readMap parses a Postfix lookup table on the mail host
+func readMap(exec Executor, path string) (*postfixmap.Map, error) {
+	content, err := exec.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return postfixmap.Parse(content), nil
+}
+
+// editMap lets fn change a Postfix lookup table on the mail host. Entries
+// fn does not touch are written back exactly as they were, with their
+// comments and layout.
+func editMap(exec Executor, path string, fn func(pm *postfixmap.Map) error) error {
+	return editFile(exec, path, func(content string) (string, error) {
+		pm := postfixmap.Parse(content)
+		if err := fn(pm); err != nil {
+			return "", err
+		}
+		return pm.String(), nil
+	})
+}
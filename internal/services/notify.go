@@ -0,0 +1,606 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Notification channels
+const (
+	ChannelWebhook = "webhook"
+	ChannelEmail   = "email"
+)
+
+// NotifyEvent is an audit action that can be subscribed to
+type NotifyEvent struct {
+	Action string
+	Label  string
+}
+
+// NotifyEvents lists the subscribable actions. Only successful actions
+// are notified.
+var NotifyEvents = []NotifyEvent{
+	{"add_domain", "Domain created"},
+	{"delete_domain", "Domain deleted"},
+	{"add_user", "Mailbox created"},
+	{"delete_user", "Mailbox deleted"},
+	{"update_rspamd_config", "Rspamd configuration changed"},
+	{"rspamd_stop", "Rspamd stopped"},
+	{"rspamd_restart", "Rspamd restarted"},
+	{"assign_role", "Role assigned"},
+	{"remove_role", "Role removed"},
+	{"trust_host_key", "SSH host key trusted"},
+}
+
+// Delivery retries back off exponentially from notifyBackoff up to
+// notifyMaxBackoff; after notifyMaxAttempts a delivery is given up
+const (
+	notifyMaxAttempts = 8
+	notifyBackoff     = 30 * time.Second
+	notifyMaxBackoff  = time.Hour
+)
+
+// NotificationEvent is the JSON body of a webhook
+type NotificationEvent struct {
+	Event     string    `json:"event"`
+	Target    string    `json:"target"`
+	User      string    `json:"user"`
+	Details   string    `json:"details,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Server    string    `json:"server,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NotificationSubscription sends the listed events to a webhook URL or an
+// email address. Secret signs webhook bodies.
+type NotificationSubscription struct {
+	ID        int64
+	Channel   string
+	Target    string
+	Events    []string
+	Secret    string
+	CreatedAt time.Time
+	CreatedBy string
+}
+
+// Wants reports whether the subscription includes event
+func (s *NotificationSubscription) Wants(event string) bool {
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// NotificationDelivery is one event queued for one subscription
+type NotificationDelivery struct {
+	ID             int64
+	SubscriptionID int64
+	Channel        string
+	Target         string
+	Event          NotificationEvent
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastError      string
+	DeliveredAt    time.Time // zero until delivered
+	FailedAt       time.Time // zero unless given up
+}
+
+// Status is delivered, failed or pending
+func (d *NotificationDelivery) Status() string {
+	switch {
+	case !d.DeliveredAt.IsZero():
+		return "delivered"
+	case !d.FailedAt.IsZero():
+		return "failed"
+	}
+	return "pending"
+}
+
+// MailSender sends a message over SMTP; see SMTPSender
+type MailSender func(from string, to []string, msg []byte) error
+
+// SMTPSender sends through the SMTP server at addr (host:port), with PLAIN
+// auth if username is set. STARTTLS is used when the server offers it.
+func SMTPSender(addr, username, password string) MailSender {
+	return func(from string, to []string, msg []byte) error {
+		var auth smtp.Auth
+		if username != "" {
+			host := addr
+			if i := strings.LastIndex(addr, ":"); i > 0 {
+				host = addr[:i]
+			}
+			auth = smtp.PlainAuth("", username, password, host)
+		}
+		return smtp.SendMail(addr, auth, from, to, msg)
+	}
+}
+
+// NotificationService keeps subscriptions and a persistent outbox in the
+// application database. Publish queues events; Run delivers them, with
+// retries, until they succeed or are given up.
+type NotificationService struct {
+	store  *Store
+	now    func() time.Time
+	client *http.Client
+	from   string
+	send   MailSender // nil disables email
+	wake   chan struct{}
+}
+
+// NewNotificationService creates the notification tables if needed
+func NewNotificationService(store *Store) (*NotificationService, error) {
+	err := store.migrate(`
+		CREATE TABLE IF NOT EXISTS notification_subscriptions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel TEXT NOT NULL,
+			target TEXT NOT NULL,
+			events TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			created_by TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS notification_outbox (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			subscription_id INTEGER NOT NULL,
+			event TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at INTEGER NOT NULL,
+			last_error TEXT NOT NULL DEFAULT '',
+			delivered_at DATETIME,
+			failed_at DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_notification_outbox_due ON notification_outbox(next_attempt_at)
+			WHERE delivered_at IS NULL AND failed_at IS NULL`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &NotificationService{
+		store:  store,
+		now:    time.Now,
+		client: &http.Client{Timeout: 10 * time.Second},
+		wake:   make(chan struct{}, 1),
+	}, nil
+}
+
+// SetMailer enables email notifications, sent from from
+func (s *NotificationService) SetMailer(from string, send MailSender) {
+	s.from, s.send = from, send
+}
+
+// EmailEnabled reports whether email subscriptions can be delivered
+func (s *NotificationService) EmailEnabled() bool {
+	return s.send != nil
+}
+
+// Subscribe adds a subscription. Webhooks get a random signing secret.
+func (s *NotificationService) Subscribe(channel, target string, events []string, by string) (*NotificationSubscription, error) {
+	target = strings.TrimSpace(target)
+	switch channel {
+	case ChannelWebhook:
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, invalidf("webhook URL must be an http(s) URL")
+		}
+	case ChannelEmail:
+		if !s.EmailEnabled() {
+			return nil, invalidf("email notifications are not configured (CMH_SMTP_ADDR)")
+		}
+		addr, err := mail.ParseAddress(target)
+		if err != nil {
+			return nil, invalidf("invalid email address %q", target)
+		}
+		target = addr.Address
+	default:
+		return nil, invalidf("unknown channel %q", channel)
+	}
+
+	events, err := normalizeNotifyEvents(events)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	sub := &NotificationSubscription{
+		Channel:   channel,
+		Target:    target,
+		Events:    events,
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: s.now().UTC(),
+		CreatedBy: by,
+	}
+	if channel == ChannelEmail {
+		sub.Secret = ""
+	}
+
+	res, err := s.store.db.Exec(`
+		INSERT INTO notification_subscriptions (channel, target, events, secret, created_at, created_by)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		sub.Channel, sub.Target, strings.Join(sub.Events, ","), sub.Secret, sub.CreatedAt, sub.CreatedBy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store subscription: %w", err)
+	}
+	sub.ID, _ = res.LastInsertId()
+	return sub, nil
+}
+
+// normalizeNotifyEvents checks events against NotifyEvents and sorts them
+func normalizeNotifyEvents(events []string) ([]string, error) {
+	known := make(map[string]bool)
+	for _, e := range NotifyEvents {
+		known[e.Action] = true
+	}
+	seen := make(map[string]bool)
+	var out []string
+	for _, e := range events {
+		if !known[e] {
+			return nil, invalidf("unknown event %q", e)
+		}
+		if !seen[e] {
+			seen[e] = true
+			out = append(out, e)
+		}
+	}
+	if len(out) == 0 {
+		return nil, invalidf("select at least one event")
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Unsubscribe deletes a subscription and its queued deliveries
+func (s *NotificationService) Unsubscribe(id int64) (*NotificationSubscription, error) {
+	sub, err := s.subscription(id)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM notification_outbox WHERE subscription_id = ?`, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM notification_subscriptions WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	return sub, tx.Commit()
+}
+
+// Subscriptions returns every subscription, oldest first
+func (s *NotificationService) Subscriptions() ([]NotificationSubscription, error) {
+	rows, err := s.store.db.Query(`
+		SELECT id, channel, target, events, secret, created_at, created_by
+		FROM notification_subscriptions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []NotificationSubscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *NotificationService) subscription(id int64) (*NotificationSubscription, error) {
+	sub, err := scanSubscription(s.store.db.QueryRow(`
+		SELECT id, channel, target, events, secret, created_at, created_by
+		FROM notification_subscriptions WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFoundf("subscription not found")
+	}
+	return sub, err
+}
+
+func scanSubscription(row rowScanner) (*NotificationSubscription, error) {
+	var sub NotificationSubscription
+	var events string
+	if err := row.Scan(&sub.ID, &sub.Channel, &sub.Target, &events, &sub.Secret, &sub.CreatedAt, &sub.CreatedBy); err != nil {
+		return nil, err
+	}
+	sub.Events = strings.Split(events, ",")
+	return &sub, nil
+}
+
+// Publish queues e for every subscription that wants it
+func (s *NotificationService) Publish(e NotificationEvent) error {
+	subs, err := s.Subscriptions()
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for _, sub := range subs {
+		if sub.Wants(e.Event) {
+			ids = append(ids, sub.ID)
+		}
+	}
+	return s.enqueue(e, ids...)
+}
+
+// SendTest queues a test event for one subscription
+func (s *NotificationService) SendTest(id int64, by string) error {
+	if _, err := s.subscription(id); err != nil {
+		return err
+	}
+	return s.enqueue(NotificationEvent{
+		Event:     "test",
+		Target:    "notifications",
+		User:      by,
+		Details:   "test notification from mailhub-admin",
+		Timestamp: s.now().UTC(),
+	}, id)
+}
+
+func (s *NotificationService) enqueue(e NotificationEvent, subscriptionIDs ...int64) error {
+	if len(subscriptionIDs) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := s.now().Unix()
+	for _, id := range subscriptionIDs {
+		if _, err := tx.Exec(`INSERT INTO notification_outbox (subscription_id, event, next_attempt_at) VALUES (?, ?, ?)`,
+			id, string(body), now); err != nil {
+			return fmt.Errorf("failed to queue notification: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Deliveries returns the latest deliveries, newest first
+func (s *NotificationService) Deliveries(limit int) ([]NotificationDelivery, error) {
+	return s.queryDeliveries(`ORDER BY d.id DESC LIMIT ?`, limit)
+}
+
+func (s *NotificationService) queryDeliveries(clause string, args ...interface{}) ([]NotificationDelivery, error) {
+	rows, err := s.store.db.Query(`
+		SELECT d.id, d.subscription_id, n.channel, n.target, n.secret, d.event, d.attempts, d.next_attempt_at,
+			d.last_error, d.delivered_at, d.failed_at
+		FROM notification_outbox d JOIN notification_subscriptions n ON n.id = d.subscription_id `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []NotificationDelivery
+	for rows.Next() {
+		var d NotificationDelivery
+		var secret, event string
+		var next int64
+		var delivered, failed sql.NullTime
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.Channel, &d.Target, &secret, &event, &d.Attempts, &next,
+			&d.LastError, &delivered, &failed); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(event), &d.Event); err != nil {
+			return nil, fmt.Errorf("corrupt notification %d: %w", d.ID, err)
+		}
+		d.NextAttemptAt = time.Unix(next, 0).UTC()
+		d.DeliveredAt, d.FailedAt = delivered.Time, failed.Time
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// Run delivers due notifications every interval, and as soon as an event
+// is published, until stop is closed
+func (s *NotificationService) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.DeliverDue(); err != nil {
+			log.Printf("Notifications: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// DeliverDue makes one delivery attempt for every due notification.
+// Webhooks are posted one event at a time; the events due for an email
+// subscription are sent as one summary mail.
+func (s *NotificationService) DeliverDue() error {
+	due, err := s.queryDeliveries(`WHERE d.delivered_at IS NULL AND d.failed_at IS NULL AND d.next_attempt_at <= ?
+		ORDER BY d.id LIMIT 100`, s.now().Unix())
+	if err != nil {
+		return err
+	}
+
+	subs := make(map[int64]*NotificationSubscription)
+	emails := make(map[int64][]NotificationDelivery)
+	var order []int64
+	for _, d := range due {
+		if _, ok := subs[d.SubscriptionID]; !ok {
+			sub, err := s.subscription(d.SubscriptionID)
+			if err != nil {
+				return err
+			}
+			subs[d.SubscriptionID] = sub
+		}
+		sub := subs[d.SubscriptionID]
+
+		if sub.Channel == ChannelEmail {
+			if _, ok := emails[sub.ID]; !ok {
+				order = append(order, sub.ID)
+			}
+			emails[sub.ID] = append(emails[sub.ID], d)
+			continue
+		}
+		if err := s.finish([]NotificationDelivery{d}, s.postWebhook(sub, d)); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range order {
+		batch := emails[id]
+		if err := s.finish(batch, s.sendSummary(subs[id], batch)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish records the outcome of one attempt for the deliveries
+func (s *NotificationService) finish(batch []NotificationDelivery, sendErr error) error {
+	now := s.now().UTC()
+	for _, d := range batch {
+		var err error
+		switch {
+		case sendErr == nil:
+			_, err = s.store.db.Exec(`UPDATE notification_outbox SET attempts = attempts + 1, last_error = '', delivered_at = ? WHERE id = ?`,
+				now, d.ID)
+		case d.Attempts+1 >= notifyMaxAttempts:
+			log.Printf("Notifications: giving up %s to %s after %d attempts: %v", d.Event.Event, d.Target, d.Attempts+1, sendErr)
+			_, err = s.store.db.Exec(`UPDATE notification_outbox SET attempts = attempts + 1, last_error = ?, failed_at = ? WHERE id = ?`,
+				sendErr.Error(), now, d.ID)
+		default:
+			_, err = s.store.db.Exec(`UPDATE notification_outbox SET attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE id = ?`,
+				sendErr.Error(), now.Add(notifyRetryDelay(d.Attempts+1)).Unix(), d.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update notification %d: %w", d.ID, err)
+		}
+	}
+	return nil
+}
+
+// notifyRetryDelay is the wait after the given number of failed attempts
+func notifyRetryDelay(attempts int) time.Duration {
+	delay := notifyBackoff
+	for i := 1; i < attempts && delay < notifyMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > notifyMaxBackoff {
+		delay = notifyMaxBackoff
+	}
+	return delay
+}
+
+// SignWebhook returns the X-MailHub-Signature header for a body sent at
+// ts: "t=<unix>,v1=<hex HMAC-SHA256 of "<unix>.<body>">"
+func SignWebhook(secret string, ts time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts.Unix())
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", ts.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (s *NotificationService) postWebhook(sub *NotificationSubscription, d NotificationDelivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sub.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mailhub-admin")
+	req.Header.Set("X-MailHub-Event", d.Event.Event)
+	req.Header.Set("X-MailHub-Delivery", fmt.Sprint(d.ID))
+	req.Header.Set("X-MailHub-Signature", SignWebhook(sub.Secret, s.now(), body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *NotificationService) sendSummary(sub *NotificationSubscription, batch []NotificationDelivery) error {
+	if s.send == nil {
+		return errors.New("email notifications are not configured")
+	}
+
+	subject := fmt.Sprintf("[MailHub] %s %s", batch[0].Event.Event, batch[0].Event.Target)
+	if len(batch) > 1 {
+		subject = fmt.Sprintf("[MailHub] %d administrative events", len(batch))
+	}
+
+	var body strings.Builder
+	for _, d := range batch {
+		e := d.Event
+		fmt.Fprintf(&body, "%s  %s  %s  by %s\r\n", e.Timestamp.UTC().Format("2006-01-02 15:04:05 UTC"), e.Event, e.Target, e.User)
+		if e.Server != "" {
+			fmt.Fprintf(&body, "    on %s\r\n", e.Server)
+		}
+		if e.Details != "" {
+			fmt.Fprintf(&body, "    %s\r\n", strings.ReplaceAll(e.Details, "\n", "\r\n    "))
+		}
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", sub.Target)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mimeHeader(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", s.now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nAuto-Submitted: auto-generated\r\n\r\n")
+	msg.WriteString(body.String())
+
+	return s.send(s.from, []string{sub.Target}, msg.Bytes())
+}
+
+// mimeHeader strips line breaks and encodes non-ASCII text
+func mimeHeader(v string) string {
+	v = strings.NewReplacer("\r", " ", "\n", " ").Replace(v)
+	for _, c := range v {
+		if c > 127 {
+			return mime.QEncoding.Encode("utf-8", v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestNotifications(t *testing.T) *NotificationService {
+	t.Helper()
+	store, err := OpenStore(t.TempDir() + "/mailhub.db")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	notify, err := NewNotificationService(store)
+	if err != nil {
+		t.Fatalf("notification service: %v", err)
+	}
+	return notify
+}
+
+func TestNotificationWebhookSignedAndRetried(t *testing.T) {
+	notify := newTestNotifications(t)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	notify.now = func() time.Time { return now }
+
+	var mu sync.Mutex
+	var bodies [][]byte
+	var headers []http.Header
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, body)
+		headers = append(headers, r.Header.Clone())
+		if fail {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	sub, err := notify.Subscribe(ChannelWebhook, srv.URL, []string{"add_domain"}, "admin@example.com")
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if len(sub.Secret) != 64 {
+		t.Fatalf("secret %q", sub.Secret)
+	}
+
+	if err := notify.Publish(NotificationEvent{Event: "delete_user", Target: "a@example.com", Timestamp: now}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := notify.Publish(NotificationEvent{Event: "add_domain", Target: "example.org", User: "admin@example.com", Timestamp: now}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	if err := notify.DeliverDue(); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	deliveries, _ := notify.Deliveries(10)
+	if len(deliveries) != 1 || deliveries[0].Status() != "pending" || deliveries[0].Attempts != 1 ||
+		!deliveries[0].NextAttemptAt.Equal(now.Add(notifyBackoff)) || !strings.Contains(deliveries[0].LastError, "503") {
+		t.Fatalf("after failure: %+v", deliveries)
+	}
+
+	// not due yet
+	notify.DeliverDue()
+	if len(bodies) != 1 {
+		t.Fatalf("retried early: %d requests", len(bodies))
+	}
+
+	now = now.Add(notifyBackoff)
+	fail = false
+	if err := notify.DeliverDue(); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	deliveries, _ = notify.Deliveries(10)
+	if deliveries[0].Status() != "delivered" || deliveries[0].Attempts != 2 {
+		t.Fatalf("after retry: %+v", deliveries[0])
+	}
+
+	h := headers[1]
+	if h.Get("X-MailHub-Event") != "add_domain" || h.Get("Content-Type") != "application/json" {
+		t.Fatalf("headers %v", h)
+	}
+	if got, want := h.Get("X-MailHub-Signature"), SignWebhook(sub.Secret, now, bodies[1]); got != want {
+		t.Fatalf("signature %q, want %q", got, want)
+	}
+	var e NotificationEvent
+	if err := json.Unmarshal(bodies[1], &e); err != nil || e.Target != "example.org" || e.User != "admin@example.com" {
+		t.Fatalf("body %s: %v", bodies[1], err)
+	}
+}
+
+func TestNotificationGivesUp(t *testing.T) {
+	notify := newTestNotifications(t)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	notify.now = func() time.Time { return now }
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	sub, _ := notify.Subscribe(ChannelWebhook, srv.URL, []string{"add_domain"}, "admin@example.com")
+	if err := notify.SendTest(sub.ID, "admin@example.com"); err != nil {
+		t.Fatalf("test: %v", err)
+	}
+	for i := 0; i < notifyMaxAttempts; i++ {
+		notify.DeliverDue()
+		now = now.Add(notifyMaxBackoff)
+	}
+	deliveries, _ := notify.Deliveries(10)
+	if deliveries[0].Status() != "failed" || deliveries[0].Attempts != notifyMaxAttempts {
+		t.Fatalf("delivery %+v", deliveries[0])
+	}
+
+	if got := notifyRetryDelay(3); got != 4*notifyBackoff {
+		t.Fatalf("delay after 3 attempts %v", got)
+	}
+	if got := notifyRetryDelay(20); got != notifyMaxBackoff {
+		t.Fatalf("delay after 20 attempts %v", got)
+	}
+}
+
+func TestNotificationEmailSummary(t *testing.T) {
+	notify := newTestNotifications(t)
+	if _, err := notify.Subscribe(ChannelEmail, "ops@example.com", []string{"add_user"}, "admin@example.com"); err == nil {
+		t.Fatal("email subscription accepted without SMTP")
+	}
+
+	var sent []string
+	notify.SetMailer("mailhub@example.com", func(from string, to []string, msg []byte) error {
+		sent = append(sent, string(msg))
+		if from != "mailhub@example.com" || len(to) != 1 || to[0] != "ops@example.com" {
+			t.Errorf("envelope %s %v", from, to)
+		}
+		return nil
+	})
+	sub, err := notify.Subscribe(ChannelEmail, "Ops <ops@example.com>", []string{"add_user", "delete_user"}, "admin@example.com")
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if sub.Target != "ops@example.com" || sub.Secret != "" {
+		t.Fatalf("subscription %+v", sub)
+	}
+
+	notify.Publish(NotificationEvent{Event: "add_user", Target: "a@example.com", User: "admin@example.com", Timestamp: time.Now()})
+	notify.Publish(NotificationEvent{Event: "delete_user", Target: "b@example.com", User: "admin@example.com", Timestamp: time.Now()})
+	if err := notify.DeliverDue(); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("sent %d mails, want one summary", len(sent))
+	}
+	for _, want := range []string{"Subject: [MailHub] 2 administrative events", "add_user  a@example.com", "delete_user  b@example.com"} {
+		if !strings.Contains(sent[0], want) {
+			t.Errorf("mail lacks %q:\n%s", want, sent[0])
+		}
+	}
+
+	if _, err := notify.Unsubscribe(sub.ID); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+	if deliveries, _ := notify.Deliveries(10); len(deliveries) != 0 {
+		t.Fatalf("deliveries left: %+v", deliveries)
+	}
+}
+
+func TestNotificationSubscribeValidation(t *testing.T) {
+	notify := newTestNotifications(t)
+	for _, tc := range []struct {
+		channel, target string
+		events          []string
+	}{
+		{ChannelWebhook, "ftp://example.com", []string{"add_domain"}},
+		{ChannelWebhook, "https://example.com/hook", nil},
+		{ChannelWebhook, "https://example.com/hook", []string{"drop_tables"}},
+		{"sms", "+100", []string{"add_domain"}},
+	} {
+		if _, err := notify.Subscribe(tc.channel, tc.target, tc.events, "admin@example.com"); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s %s %v: err = %v", tc.channel, tc.target, tc.events, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported dovecot password schemes
+const (
+	SchemeSHA512Crypt = "SHA512-CRYPT"
+	SchemeBlowfish    = "BLF-CRYPT"
+	SchemeArgon2ID    = "ARGON2ID"
+	SchemePlain       = "PLAIN"
+)
+
+// DefaultPasswordScheme is used when no scheme is configured
+const DefaultPasswordScheme = SchemeSHA512Crypt
+
+// Argon2id parameters: 3 passes over 64 MiB, libsodium's "moderate" time
+// cost with its "interactive" memory limit to suit a small container.
+// Dovecot reads the parameters from each hash, so they can be raised later.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 1
+	argon2KeyLen  = 32
+)
+
+// ValidPasswordScheme reports whether scheme can be used for new passwords
+func ValidPasswordScheme(scheme string) bool {
+	switch strings.ToUpper(scheme) {
+	case SchemeSHA512Crypt, SchemeBlowfish, SchemeArgon2ID:
+		return true
+	}
+	return false
+}
+
+// HashPassword hashes a password for dovecot and returns it with its
+// {SCHEME} prefix, ready to be written to the users file
+func HashPassword(scheme, password string) (string, error) {
+	scheme = strings.ToUpper(scheme)
+
+	switch scheme {
+	case SchemeSHA512Crypt:
+		salt, err := cryptSalt(16)
+		if err != nil {
+			return "", err
+		}
+		return "{" + scheme + "}" + sha512Crypt(password, salt), nil
+
+	case SchemeBlowfish:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %w", err)
+		}
+		// dovecot expects the $2y$ prefix used by crypt(3)
+		return "{" + scheme + "}" + strings.Replace(string(hash), "$2a$", "$2y$", 1), nil
+
+	case SchemeArgon2ID:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", fmt.Errorf("failed to generate salt: %w", err)
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("{%s}$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			scheme, argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+
+	return "", fmt.Errorf("unsupported password scheme: %s", scheme)
+}
+
+// PasswordScheme returns the scheme of a stored dovecot password. Entries
+// without a {SCHEME} prefix are reported as PLAIN, which is dovecot's default.
+func PasswordScheme(stored string) string {
+	if strings.HasPrefix(stored, "{") {
+		if end := strings.Index(stored, "}"); end > 0 {
+			return strings.ToUpper(stored[1:end])
+		}
+	}
+	return SchemePlain
+}
+
+// plainPassword returns the cleartext of a {PLAIN} entry
+func plainPassword(stored string) (string, bool) {
+	if PasswordScheme(stored) != SchemePlain {
+		return "", false
+	}
+	if strings.HasPrefix(stored, "{") {
+		return stored[strings.Index(stored, "}")+1:], true
+	}
+	return stored, true
+}
+
+// crypt(3) uses its own base64 alphabet
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func cryptSalt(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	for i, b := range buf {
+		buf[i] = cryptAlphabet[int(b)%len(cryptAlphabet)]
+	}
+	return string(buf), nil
+}
+
+// sha512Crypt implements the SHA-512 based crypt(3) scheme ($6$) as
+// specified by Ulrich Drepper, using the default 5000 rounds
+func sha512Crypt(password, salt string) string {
+	const rounds = 5000
+	pw := []byte(password)
+	s := []byte(salt)
+	if len(s) > 16 {
+		s = s[:16]
+	}
+
+	// Digest B
+	hb := sha512.New()
+	hb.Write(pw)
+	hb.Write(s)
+	hb.Write(pw)
+	digestB := hb.Sum(nil)
+
+	// Digest A
+	ha := sha512.New()
+	ha.Write(pw)
+	ha.Write(s)
+	for i := len(pw); i > 0; i -= 64 {
+		if i > 64 {
+			ha.Write(digestB)
+		} else {
+			ha.Write(digestB[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ha.Write(digestB)
+		} else {
+			ha.Write(pw)
+		}
+	}
+	digestA := ha.Sum(nil)
+
+	// Sequence P
+	hp := sha512.New()
+	for i := 0; i < len(pw); i++ {
+		hp.Write(pw)
+	}
+	dp := hp.Sum(nil)
+	p := make([]byte, 0, len(pw))
+	for i := len(pw); i > 0; i -= 64 {
+		if i > 64 {
+			p = append(p, dp...)
+		} else {
+			p = append(p, dp[:i]...)
+		}
+	}
+
+	// Sequence S
+	hs := sha512.New()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		hs.Write(s)
+	}
+	ds := hs.Sum(nil)
+	sseq := make([]byte, 0, len(s))
+	for i := len(s); i > 0; i -= 64 {
+		if i > 64 {
+			sseq = append(sseq, ds...)
+		} else {
+			sseq = append(sseq, ds[:i]...)
+		}
+	}
+
+	// Rounds
+	c := digestA
+	for i := 0; i < rounds; i++ {
+		hc := sha512.New()
+		if i&1 != 0 {
+			hc.Write(p)
+		} else {
+			hc.Write(c)
+		}
+		if i%3 != 0 {
+			hc.Write(sseq)
+		}
+		if i%7 != 0 {
+			hc.Write(p)
+		}
+		if i&1 != 0 {
+			hc.Write(c)
+		} else {
+			hc.Write(p)
+		}
+		c = hc.Sum(nil)
+	}
+
+	// Final encoding with the crypt byte permutation
+	order := [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+	var out strings.Builder
+	out.WriteString("$6$")
+	out.Write(s)
+	out.WriteString("$")
+	for _, o := range order {
+		encodeCrypt64(&out, uint(c[o[0]])<<16|uint(c[o[1]])<<8|uint(c[o[2]]), 4)
+	}
+	encodeCrypt64(&out, uint(c[63]), 2)
+
+	return out.String()
+}
+
+func encodeCrypt64(sb *strings.Builder, v uint, n int) {
+	for ; n > 0; n-- {
+		sb.WriteByte(cryptAlphabet[v&0x3f])
+		v >>= 6
+	}
+}
@@ -0,0 +1,341 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Ingasti/mailhub-admin/internal/postfixmap"
+)
+
+// domainQuotaFile holds the default quota per domain ("domain quota" lines).
+// Dovecot itself only reads the per-user rules in the users file; the
+// defaults are applied to those rules when mailboxes are created or the
+// default changes.
+const domainQuotaFile = "/etc/dovecot/domain_quotas"
+
+// quotaRuleField is the dovecot userdb extra field carrying the quota
+const quotaRuleField = "userdb_quota_rule"
+
+// QuotaWarnPercent is the usage above which a mailbox is flagged
+const QuotaWarnPercent = 90
+
+// UsagePercent returns the quota usage in percent, or 0 when unlimited or
+// unknown
+func (mb Mailbox) UsagePercent() float64 {
+	if mb.Quota <= 0 || !mb.UsageKnown {
+		return 0
+	}
+	return float64(mb.UsedBytes) * 100 / float64(mb.Quota)
+}
+
+// QuotaWarning reports whether the mailbox is above QuotaWarnPercent
+func (mb Mailbox) QuotaWarning() bool {
+	return mb.UsagePercent() > QuotaWarnPercent
+}
+
+var quotaSizeRe = regexp.MustCompile(`^(\d+)\s*([kmgt]?)(i?b)?$`)
+
+// ParseQuota parses a storage size such as "500M" or "2G" into bytes.
+// "0", "unlimited" and "-" mean no limit and return 0.
+func ParseQuota(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "unlimited" || s == "-" {
+		return 0, nil
+	}
+	m := quotaSizeRe.FindStringSubmatch(s)
+	if m == nil {
+		return 0, invalidf("invalid quota: %q (use e.g. 500M or 2G)", s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, invalidf("invalid quota: %q", s)
+	}
+	shift := map[string]uint{"": 0, "k": 10, "m": 20, "g": 30, "t": 40}[m[2]]
+	if n > (1<<62)>>shift {
+		return 0, invalidf("quota too large: %q", s)
+	}
+	return n << shift, nil
+}
+
+// FormatQuota formats bytes in the largest unit that divides them exactly,
+// as dovecot writes them (e.g. 2G, 512M). 0 is "unlimited".
+func FormatQuota(bytes int64) string {
+	if bytes <= 0 {
+		return "unlimited"
+	}
+	for _, u := range []struct {
+		suffix string
+		shift  uint
+	}{{"T", 40}, {"G", 30}, {"M", 20}, {"K", 10}} {
+		if bytes%(1<<u.shift) == 0 {
+			return fmt.Sprintf("%d%s", bytes>>u.shift, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", bytes)
+}
+
+// FormatBytes formats a size for display (e.g. 1.5 GB)
+func FormatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGT"[exp])
+}
+
+// quotaRule returns the userdb_quota_rule value for a limit in bytes
+func quotaRule(bytes int64) string {
+	if bytes <= 0 {
+		return "*:storage=0"
+	}
+	return "*:storage=" + FormatQuota(bytes)
+}
+
+// parseQuotaRule extracts the storage limit from a quota rule value
+func parseQuotaRule(rule string) int64 {
+	for _, part := range strings.Split(rule, ":") {
+		if v, ok := strings.CutPrefix(part, "storage="); ok {
+			if n, err := ParseQuota(v); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// DomainQuota returns the default quota of a domain in bytes (0 = none)
+func (m *MailService) DomainQuota(domain string) (int64, error) {
+	quotas, err := m.domainQuotas()
+	if err != nil {
+		return 0, err
+	}
+	return quotas[domain], nil
+}
+
+// domainQuotas reads the default quota of every domain
+func (m *MailService) domainQuotas() (map[string]int64, error) {
+	quotas := make(map[string]int64)
+
+	exists, err := fileExists(m.exec, domainQuotaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read domain quotas: %w", err)
+	}
+	if !exists {
+		return quotas, nil
+	}
+	quotaMap, err := readMap(m.exec, domainQuotaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read domain quotas: %w", err)
+	}
+
+	for _, e := range quotaMap.Entries() {
+		if n, err := ParseQuota(e.Value); err == nil && e.Value != "" {
+			quotas[e.Key] = n
+		}
+	}
+	return quotas, nil
+}
+
+// mailboxQuotas reads the quota rule of every dovecot user. Users without a
+// rule are not included.
+func (m *MailService) mailboxQuotas() (map[string]int64, error) {
+	content, err := m.exec.ReadFile(dovecotUsersFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dovecot users: %w", err)
+	}
+
+	quotas := make(map[string]int64)
+	for _, line := range strings.Split(content, "\n") {
+		u, ok := parseDovecotUser(line)
+		if !ok {
+			continue
+		}
+		if rule, ok := u.Extra(quotaRuleField); ok {
+			quotas[u.Email] = parseQuotaRule(rule)
+		}
+	}
+	return quotas, nil
+}
+
+// SetDomainQuota changes the default quota of a domain. Mailboxes that
+// follow the old default are moved to the new one; mailboxes with their
+// own quota keep it. A quota of 0 removes the default.
+func (m *MailService) SetDomainQuota(domain string, bytes int64) error {
+	if !isValidDomain(domain) {
+		return invalidf("invalid domain format: %s", domain)
+	}
+	if bytes < 0 {
+		return invalidf("quota cannot be negative")
+	}
+
+	old, err := m.DomainQuota(domain)
+	if err != nil {
+		return err
+	}
+
+	return m.changeSet("set_domain_quota", domain, domainQuotaFile, dovecotUsersFile).
+		Step("update domain default", func() error {
+			return editMap(m.exec, domainQuotaFile, func(pm *postfixmap.Map) error {
+				entry := pm.Lookup(domain)
+				switch {
+				case bytes == 0:
+					pm.RemoveFunc(func(e *postfixmap.Entry) bool { return e.Key == domain })
+				case entry != nil:
+					entry.Value = FormatQuota(bytes)
+				default:
+					pm.Add(domain, FormatQuota(bytes))
+				}
+				return nil
+			})
+		}).
+		Step("update inheriting mailboxes", func() error {
+			return m.rewriteDovecotUsers(func(u *dovecotUser) bool {
+				if !strings.HasSuffix(u.Email, "@"+domain) {
+					return true
+				}
+				rule, has := u.Extra(quotaRuleField)
+				inherits := (!has && old == 0) || (has && old > 0 && parseQuotaRule(rule) == old)
+				if inherits {
+					if bytes > 0 {
+						u.SetExtra(quotaRuleField, quotaRule(bytes))
+					} else {
+						u.SetExtra(quotaRuleField, "")
+					}
+				}
+				return true
+			})
+		}).
+		Step("reload dovecot", m.reloadDovecot).
+		Run()
+}
+
+// SetMailboxQuota sets the quota of a mailbox. With inherit set the
+// mailbox follows the domain default and bytes is ignored; otherwise
+// bytes is an explicit limit, 0 meaning unlimited.
+func (m *MailService) SetMailboxQuota(domain, username string, bytes int64, inherit bool) error {
+	email := fmt.Sprintf("%s@%s", username, domain)
+	if bytes < 0 {
+		return invalidf("quota cannot be negative")
+	}
+
+	rule := quotaRule(bytes)
+	if inherit {
+		def, err := m.DomainQuota(domain)
+		if err != nil {
+			return err
+		}
+		rule = ""
+		if def > 0 {
+			rule = quotaRule(def)
+		}
+	}
+
+	return m.changeSet("set_quota", email, dovecotUsersFile).
+		Step("update quota", func() error {
+			found := false
+			err := m.rewriteDovecotUsers(func(u *dovecotUser) bool {
+				if u.Email == email {
+					u.SetExtra(quotaRuleField, rule)
+					found = true
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+			if !found {
+				return notFoundf("user not found: %s", email)
+			}
+			return nil
+		}).
+		Step("reload dovecot", m.reloadDovecot).
+		Run()
+}
+
+// QuotaUsage returns the storage used per mailbox of a domain in bytes, as
+// reported by doveadm quota get
+func (m *MailService) QuotaUsage(domain string) (map[string]int64, error) {
+	output, err := m.exec.Execute(fmt.Sprintf("doas doveadm -f tab quota get -u %s", shellQuote("*@"+domain)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quota usage: %w", err)
+	}
+	return parseQuotaGet(output), nil
+}
+
+// parseQuotaGet parses tab separated doveadm quota get output. Storage
+// values are reported in KiB.
+func parseQuotaGet(output string) map[string]int64 {
+	usage := make(map[string]int64)
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		return usage
+	}
+	col := make(map[string]int)
+	for i, name := range strings.Split(lines[0], "\t") {
+		col[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	userCol, hasUser := col["username"]
+	typeCol, hasType := col["type"]
+	valueCol, hasValue := col["value"]
+	if !hasUser || !hasType || !hasValue {
+		return usage
+	}
+
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) <= userCol || len(fields) <= typeCol || len(fields) <= valueCol {
+			continue
+		}
+		if !strings.EqualFold(fields[typeCol], "STORAGE") {
+			continue
+		}
+		kb, err := strconv.ParseInt(strings.TrimSpace(fields[valueCol]), 10, 64)
+		if err != nil {
+			continue
+		}
+		// Several quota roots: report the fullest
+		user := fields[userCol]
+		if prev, seen := usage[user]; !seen || kb*1024 > prev {
+			usage[user] = kb * 1024
+		}
+	}
+	return usage
+}
+
+// ListMailboxesWithUsage returns the mailboxes of a domain with their
+// current usage. If doveadm cannot report usage the mailboxes are returned
+// without it and the error is logged by the caller.
+func (m *MailService) ListMailboxesWithUsage(domain string) ([]Mailbox, error) {
+	mailboxes, err := m.ListMailboxes(domain)
+	if err != nil || len(mailboxes) == 0 {
+		return mailboxes, err
+	}
+
+	usage, err := m.QuotaUsage(domain)
+	if err != nil {
+		return mailboxes, err
+	}
+	for i := range mailboxes {
+		if used, ok := usage[mailboxes[i].Email]; ok {
+			mailboxes[i].UsedBytes = used
+			mailboxes[i].UsageKnown = true
+		}
+	}
+	return mailboxes, nil
+}
+
+// reloadDovecot reloads dovecot
+func (m *MailService) reloadDovecot() error {
+	if _, err := m.exec.Execute("doas doveadm reload"); err != nil {
+		return fmt.Errorf("failed to reload dovecot: %w", err)
+	}
+	return nil
+}
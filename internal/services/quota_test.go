@@ -0,0 +1,130 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseQuota(t *testing.T) {
+	cases := map[string]int64{
+		"0":         0,
+		"unlimited": 0,
+		"1024":      1024,
+		"500M":      500 << 20,
+		"2g":        2 << 30,
+		"1GB":       1 << 30,
+		"10 MiB":    10 << 20,
+	}
+	for in, want := range cases {
+		got, err := ParseQuota(in)
+		if err != nil || got != want {
+			t.Errorf("ParseQuota(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "-5M", "2X", "lots"} {
+		if _, err := ParseQuota(in); err == nil {
+			t.Errorf("ParseQuota(%q) should fail", in)
+		}
+	}
+
+	if got := FormatQuota(1536 << 20); got != "1536M" {
+		t.Errorf("FormatQuota = %q", got)
+	}
+	if got := FormatQuota(2 << 30); got != "2G" {
+		t.Errorf("FormatQuota = %q", got)
+	}
+}
+
+func TestDovecotExtraFields(t *testing.T) {
+	u, _ := parseDovecotUser("a@example.com:{PLAIN}x::::::userdb_mail=maildir:~/Maildir")
+	u.SetExtra(quotaRuleField, "*:storage=1G")
+	if want := "a@example.com:{PLAIN}x::::::userdb_mail=maildir:~/Maildir userdb_quota_rule=*:storage=1G"; u.String() != want {
+		t.Fatalf("got %q, want %q", u.String(), want)
+	}
+	if v, ok := u.Extra(quotaRuleField); !ok || v != "*:storage=1G" {
+		t.Fatalf("Extra = %q, %v", v, ok)
+	}
+
+	u.SetExtra("userdb_mail", "")
+	u.SetExtra(quotaRuleField, "")
+	if u.String() != "a@example.com:{PLAIN}x" {
+		t.Fatalf("empty extra fields not trimmed: %q", u.String())
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	mail, fake := newTestMailService(t)
+	if err := mail.AddDomain("example.com"); err != nil {
+		t.Fatalf("AddDomain: %v", err)
+	}
+	if err := mail.AddMailbox("example.com", "alice", "correct-horse"); err != nil {
+		t.Fatalf("AddMailbox: %v", err)
+	}
+	if err := mail.AddMailbox("example.com", "bob", "correct-horse"); err != nil {
+		t.Fatalf("AddMailbox: %v", err)
+	}
+
+	// bob gets his own quota, alice follows the domain default
+	if err := mail.SetMailboxQuota("example.com", "bob", 5<<30, false); err != nil {
+		t.Fatalf("SetMailboxQuota: %v", err)
+	}
+	if err := mail.SetDomainQuota("example.com", 1<<30); err != nil {
+		t.Fatalf("SetDomainQuota: %v", err)
+	}
+	if err := mail.AddMailbox("example.com", "carol", "correct-horse"); err != nil {
+		t.Fatalf("AddMailbox: %v", err)
+	}
+
+	users, _ := fake.File(dovecotUsersFile)
+	for _, want := range []string{
+		"alice@example.com:",
+		"bob@example.com:",
+		"carol@example.com:",
+	} {
+		if !strings.Contains(users, want) {
+			t.Fatalf("missing %s in users file:\n%s", want, users)
+		}
+	}
+	if strings.Count(users, "userdb_quota_rule=*:storage=1G") != 2 ||
+		strings.Count(users, "userdb_quota_rule=*:storage=5G") != 1 {
+		t.Fatalf("unexpected quota rules:\n%s", users)
+	}
+
+	fake.SetQuotaUsage("alice@example.com", 950<<20)
+	fake.SetQuotaUsage("bob@example.com", 1<<30)
+	fake.SetQuotaUsage("dave@example.org", 1<<30)
+
+	boxes, err := mail.ListMailboxesWithUsage("example.com")
+	if err != nil {
+		t.Fatalf("ListMailboxesWithUsage: %v", err)
+	}
+	byUser := make(map[string]Mailbox)
+	for _, mb := range boxes {
+		byUser[mb.Username] = mb
+	}
+	if alice := byUser["alice"]; !alice.QuotaInherited || alice.Quota != 1<<30 || !alice.QuotaWarning() {
+		t.Errorf("unexpected alice: %+v (%.1f%%)", alice, alice.UsagePercent())
+	}
+	if bob := byUser["bob"]; bob.QuotaInherited || bob.Quota != 5<<30 || bob.QuotaWarning() {
+		t.Errorf("unexpected bob: %+v", bob)
+	}
+	if carol := byUser["carol"]; carol.UsageKnown {
+		t.Errorf("carol has no reported usage: %+v", carol)
+	}
+
+	// Raising the default moves inheriting mailboxes only; removing it
+	// clears their rule
+	if err := mail.SetDomainQuota("example.com", 2<<30); err != nil {
+		t.Fatalf("SetDomainQuota: %v", err)
+	}
+	if err := mail.SetDomainQuota("example.com", 0); err != nil {
+		t.Fatalf("SetDomainQuota: %v", err)
+	}
+	users, _ = fake.File(dovecotUsersFile)
+	if strings.Count(users, quotaRuleField) != 1 || !strings.Contains(users, "storage=5G") {
+		t.Fatalf("unexpected quota rules after removing default:\n%s", users)
+	}
+	if content, _ := fake.File(domainQuotaFile); content != "" {
+		t.Errorf("domain default not removed: %q", content)
+	}
+}
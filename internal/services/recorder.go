@@ -0,0 +1,142 @@
+package services
+
+import (
+	"strings"
+	"sync"
+)
+
+// maxRecordedDiff bounds the diff kept for one operation
+const maxRecordedDiff = 64 << 10
+
+// FileRecorder wraps an executor and remembers the content of every file
+// written through it, before the first write and after the last, so an
+// operation's config changes can be diffed into its audit entry
+type FileRecorder struct {
+	Executor
+
+	mu        sync.Mutex
+	order     []string
+	changes   map[string]*fileChange
+	observers []*func(path, before, after string)
+}
+
+type fileChange struct {
+	before, after string
+	existed       bool
+}
+
+// NewFileRecorder wraps exec
+func NewFileRecorder(exec Executor) *FileRecorder {
+	return &FileRecorder{Executor: exec, changes: make(map[string]*fileChange)}
+}
+
+// WriteFile writes through to the wrapped executor, reading the old
+// content first the first time path is written
+func (f *FileRecorder) WriteFile(path, content string) error {
+	var before string
+	existed, err := fileExists(f.Executor, path)
+	if err != nil {
+		return err
+	}
+	if existed {
+		if before, err = f.Executor.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	if err := f.Executor.WriteFile(path, content); err != nil {
+		return err
+	}
+	f.record(path, before, content, existed)
+	return nil
+}
+
+// EditFile edits through the wrapped executor's transactional API when it
+// has one; the change is recorded once the edit committed
+func (f *FileRecorder) EditFile(path string, fn func(content string) (string, error)) error {
+	editor, ok := f.Executor.(FileEditor)
+	if !ok {
+		return editFile(writeThrough{f}, path, fn)
+	}
+
+	// EditFile passes a missing file as "", like an empty one
+	existed, err := fileExists(f.Executor, path)
+	if err != nil {
+		return err
+	}
+	var before, after string
+	err = editor.EditFile(path, func(content string) (string, error) {
+		updated, err := fn(content)
+		before, after = content, updated
+		return updated, err
+	})
+	if err != nil {
+		return err
+	}
+	// Unchanged content is not written, not even for a missing file
+	if after != before {
+		f.record(path, before, after, existed)
+	}
+	return nil
+}
+
+// writeThrough hides FileRecorder's EditFile from editFile, so the
+// read-modify-write fallback records through WriteFile instead
+type writeThrough struct{ rec *FileRecorder }
+
+func (w writeThrough) Execute(cmd string) (string, error)   { return w.rec.Execute(cmd) }
+func (w writeThrough) ReadFile(path string) (string, error) { return w.rec.ReadFile(path) }
+func (w writeThrough) WriteFile(path, content string) error { return w.rec.WriteFile(path, content) }
+
+func (f *FileRecorder) record(path, before, after string, existed bool) {
+	f.mu.Lock()
+	if c, ok := f.changes[path]; ok {
+		c.after = after
+	} else {
+		f.order = append(f.order, path)
+		f.changes[path] = &fileChange{before: before, after: after, existed: existed}
+	}
+	observers := append([]*func(string, string, string){}, f.observers...)
+	f.mu.Unlock()
+
+	for _, fn := range observers {
+		(*fn)(path, before, after)
+	}
+}
+
+// Observe calls fn with every write committed through the recorder, and
+// the content it replaced, until the returned stop function is called
+func (f *FileRecorder) Observe(fn func(path, before, after string)) (stop func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.observers = append(f.observers, &fn)
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, o := range f.observers {
+			if o == &fn {
+				f.observers = append(f.observers[:i], f.observers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Diff returns the unified diffs of the recorded files, in the order they
+// were first written, with secrets redacted. Files whose content ended up
+// unchanged, e.g. after a rollback, are left out.
+func (f *FileRecorder) Diff() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var sb strings.Builder
+	for _, path := range f.order {
+		c := f.changes[path]
+		sb.WriteString(UnifiedDiff(path, c.before, c.after, c.existed, true))
+	}
+	diff := RedactSecrets(sb.String())
+	if len(diff) > maxRecordedDiff {
+		cut := strings.LastIndex(diff[:maxRecordedDiff], "\n") + 1
+		diff = diff[:cut] + "[diff truncated]\n"
+	}
+	return diff
+}
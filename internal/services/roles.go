@@ -0,0 +1,277 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Roles that can be assigned to SSO users
+const (
+	RoleSuperadmin  = "superadmin"
+	RoleDomainAdmin = "domain_admin"
+	RoleHelpdesk    = "helpdesk"
+	RoleReadOnly    = "readonly"
+)
+
+// Roles lists the assignable roles, most privileged first
+var Roles = []string{RoleSuperadmin, RoleDomainAdmin, RoleHelpdesk, RoleReadOnly}
+
+// Permission is an action a role may be allowed to perform
+type Permission string
+
+const (
+	// PermView reads domains, mailboxes and aliases
+	PermView Permission = "view"
+	// PermResetPassword changes mailbox passwords
+	PermResetPassword Permission = "reset_password"
+	// PermManageMailboxes adds and deletes mailboxes, aliases and quotas
+	PermManageMailboxes Permission = "manage_mailboxes"
+	// PermTrainBayes learns mailbox messages into the shared Bayes
+	// classifier, which affects every domain on the server
+	PermTrainBayes Permission = "train_bayes"
+	// PermManageDomains adds and deletes domains and sets domain quotas
+	PermManageDomains Permission = "manage_domains"
+	// PermViewAudit reads the audit log
+	PermViewAudit Permission = "view_audit"
+	// PermViewServer reads Rspamd and SSH host key state
+	PermViewServer Permission = "view_server"
+	// PermManageServer changes Rspamd and trusts SSH host keys
+	PermManageServer Permission = "manage_server"
+	// PermManageRoles assigns roles to users
+	PermManageRoles Permission = "manage_roles"
+)
+
+// rolePermissions maps roles to what they may do. Superadmin may do
+// everything; domain_admin permissions apply only within its domains.
+var rolePermissions = map[string][]Permission{
+	RoleDomainAdmin: {PermView, PermResetPassword, PermManageMailboxes},
+	RoleHelpdesk:    {PermView, PermResetPassword, PermTrainBayes},
+	RoleReadOnly:    {PermView, PermViewAudit, PermViewServer},
+}
+
+// RoleAssignment is the role of one SSO user
+type RoleAssignment struct {
+	Email     string
+	Role      string
+	Domains   []string // domain_admin only
+	UpdatedAt time.Time
+	UpdatedBy string
+
+	// Bootstrap is set for superadmins from configuration, which cannot be
+	// changed from the UI
+	Bootstrap bool
+}
+
+// Can reports whether the role grants perm. A non-empty domain restricts
+// the check to that domain; domain admins only have PermView without one
+// (used for lists, which they see filtered).
+func (a *RoleAssignment) Can(perm Permission, domain string) bool {
+	if a == nil {
+		return false
+	}
+	if a.Role == RoleSuperadmin {
+		return true
+	}
+
+	granted := false
+	for _, p := range rolePermissions[a.Role] {
+		if p == perm {
+			granted = true
+			break
+		}
+	}
+	if !granted || a.Role != RoleDomainAdmin {
+		return granted
+	}
+
+	if domain == "" {
+		return perm == PermView
+	}
+	return a.HasDomain(domain)
+}
+
+// HasDomain reports whether domain is visible to the role
+func (a *RoleAssignment) HasDomain(domain string) bool {
+	if a == nil {
+		return false
+	}
+	if a.Role != RoleDomainAdmin {
+		return true
+	}
+	domain = strings.ToLower(domain)
+	for _, d := range a.Domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleService stores role assignments in the application database
+type RoleService struct {
+	store       *Store
+	superadmins map[string]bool
+}
+
+// NewRoleService creates the role table if needed. The given superadmins
+// always have the superadmin role, so the first login can assign the rest.
+func NewRoleService(store *Store, superadmins []string) (*RoleService, error) {
+	err := store.migrate(`
+		CREATE TABLE IF NOT EXISTS user_roles (
+			email TEXT PRIMARY KEY,
+			role TEXT NOT NULL,
+			domains TEXT NOT NULL DEFAULT '',
+			updated_at DATETIME NOT NULL,
+			updated_by TEXT NOT NULL
+		)`)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RoleService{store: store, superadmins: make(map[string]bool)}
+	for _, email := range superadmins {
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			s.superadmins[email] = true
+		}
+	}
+	return s, nil
+}
+
+// Resolve returns the role of email, or nil if it has none
+func (s *RoleService) Resolve(email string) (*RoleAssignment, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if s.superadmins[email] {
+		return &RoleAssignment{Email: email, Role: RoleSuperadmin, Bootstrap: true}, nil
+	}
+
+	row := s.store.db.QueryRow(`SELECT email, role, domains, updated_at, updated_by FROM user_roles WHERE email = ?`, email)
+	a, err := scanRole(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return a, err
+}
+
+// List returns all role assignments, bootstrap superadmins first
+func (s *RoleService) List() ([]RoleAssignment, error) {
+	var result []RoleAssignment
+	var bootstrap []string
+	for email := range s.superadmins {
+		bootstrap = append(bootstrap, email)
+	}
+	sort.Strings(bootstrap)
+	for _, email := range bootstrap {
+		result = append(result, RoleAssignment{Email: email, Role: RoleSuperadmin, Bootstrap: true})
+	}
+
+	rows, err := s.store.db.Query(`SELECT email, role, domains, updated_at, updated_by FROM user_roles ORDER BY email`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		if !s.superadmins[a.Email] {
+			result = append(result, *a)
+		}
+	}
+	return result, rows.Err()
+}
+
+// Assign sets the role of email. Domains are required for domain_admin and
+// ignored otherwise.
+func (s *RoleService) Assign(email, role string, domains []string, by string) (*RoleAssignment, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !isValidEmail(email) {
+		return nil, invalidf("invalid email: %s", email)
+	}
+	if s.superadmins[email] {
+		return nil, invalidf("%s is a superadmin by configuration", email)
+	}
+	if !validRole(role) {
+		return nil, invalidf("unknown role: %s", role)
+	}
+	if strings.EqualFold(email, by) {
+		return nil, invalidf("you cannot change your own role")
+	}
+
+	var cleaned []string
+	if role == RoleDomainAdmin {
+		seen := make(map[string]bool)
+		for _, d := range domains {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d == "" || seen[d] {
+				continue
+			}
+			if !isValidDomain(d) {
+				return nil, invalidf("invalid domain format: %s", d)
+			}
+			seen[d] = true
+			cleaned = append(cleaned, d)
+		}
+		if len(cleaned) == 0 {
+			return nil, invalidf("a domain admin needs at least one domain")
+		}
+		sort.Strings(cleaned)
+	}
+
+	a := &RoleAssignment{Email: email, Role: role, Domains: cleaned, UpdatedAt: time.Now().UTC(), UpdatedBy: by}
+	_, err := s.store.db.Exec(`
+		INSERT INTO user_roles (email, role, domains, updated_at, updated_by) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(email) DO UPDATE SET role = excluded.role, domains = excluded.domains,
+			updated_at = excluded.updated_at, updated_by = excluded.updated_by`,
+		a.Email, a.Role, strings.Join(a.Domains, ","), a.UpdatedAt, a.UpdatedBy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store role: %w", err)
+	}
+	return a, nil
+}
+
+// Remove revokes the role of email
+func (s *RoleService) Remove(email, by string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if s.superadmins[email] {
+		return invalidf("%s is a superadmin by configuration", email)
+	}
+	if strings.EqualFold(email, by) {
+		return invalidf("you cannot remove your own role")
+	}
+
+	res, err := s.store.db.Exec(`DELETE FROM user_roles WHERE email = ?`, email)
+	if err != nil {
+		return fmt.Errorf("failed to remove role: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return notFoundf("no role assigned to %s", email)
+	}
+	return nil
+}
+
+func validRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func scanRole(row rowScanner) (*RoleAssignment, error) {
+	var a RoleAssignment
+	var domains string
+	if err := row.Scan(&a.Email, &a.Role, &domains, &a.UpdatedAt, &a.UpdatedBy); err != nil {
+		return nil, err
+	}
+	if domains != "" {
+		a.Domains = strings.Split(domains, ",")
+	}
+	return &a, nil
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRolePermissions(t *testing.T) {
+	admin := &RoleAssignment{Role: RoleDomainAdmin, Domains: []string{"example.com"}}
+	help := &RoleAssignment{Role: RoleHelpdesk}
+	ro := &RoleAssignment{Role: RoleReadOnly}
+	super := &RoleAssignment{Role: RoleSuperadmin}
+
+	tests := []struct {
+		role   *RoleAssignment
+		perm   Permission
+		domain string
+		want   bool
+	}{
+		{super, PermManageRoles, "", true},
+		{admin, PermView, "", true},
+		{admin, PermManageMailboxes, "example.com", true},
+		{admin, PermManageMailboxes, "Example.COM", true},
+		{admin, PermManageMailboxes, "example.org", false},
+		{admin, PermManageMailboxes, "", false},
+		{admin, PermManageDomains, "example.com", false},
+		{help, PermResetPassword, "example.org", true},
+		{help, PermManageMailboxes, "example.org", false},
+		{help, PermTrainBayes, "example.org", true},
+		{super, PermTrainBayes, "example.org", true},
+		{admin, PermTrainBayes, "example.com", false},
+		{ro, PermTrainBayes, "example.com", false},
+		{ro, PermViewAudit, "", true},
+		{ro, PermResetPassword, "example.com", false},
+		{nil, PermView, "", false},
+	}
+	for _, tt := range tests {
+		role := "<nil>"
+		if tt.role != nil {
+			role = tt.role.Role
+		}
+		if got := tt.role.Can(tt.perm, tt.domain); got != tt.want {
+			t.Errorf("%s.Can(%s, %q) = %v, want %v", role, tt.perm, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestRoleAssignments(t *testing.T) {
+	store, err := OpenStore(t.TempDir() + "/mailhub.db")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer store.Close()
+	roles, err := NewRoleService(store, []string{"Root@Example.com"})
+	if err != nil {
+		t.Fatalf("role service: %v", err)
+	}
+
+	if a, _ := roles.Resolve("root@example.com"); a == nil || a.Role != RoleSuperadmin || !a.Bootstrap {
+		t.Fatalf("bootstrap superadmin not resolved: %+v", a)
+	}
+	if a, err := roles.Resolve("nobody@example.com"); a != nil || err != nil {
+		t.Fatalf("unassigned user resolved to %+v, %v", a, err)
+	}
+
+	invalid := []struct {
+		email, role string
+		domains     []string
+	}{
+		{"root@example.com", RoleReadOnly, nil},
+		{"bob@example.com", "owner", nil},
+		{"bob@example.com", RoleDomainAdmin, nil},
+		{"bob@example.com", RoleDomainAdmin, []string{"not a domain"}},
+		{"admin@example.com", RoleReadOnly, nil},
+	}
+	for _, tt := range invalid {
+		if _, err := roles.Assign(tt.email, tt.role, tt.domains, "admin@example.com"); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Assign(%s, %s, %v) = %v, want ErrInvalid", tt.email, tt.role, tt.domains, err)
+		}
+	}
+
+	if _, err := roles.Assign("Bob@example.com", RoleDomainAdmin, []string{" Example.org", "example.com", "example.org"}, "root@example.com"); err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+	a, err := roles.Resolve("bob@example.com")
+	if err != nil || a.Role != RoleDomainAdmin || len(a.Domains) != 2 || a.Domains[0] != "example.com" {
+		t.Fatalf("resolve: %+v %v", a, err)
+	}
+
+	list, err := roles.List()
+	if err != nil || len(list) != 2 || list[0].Email != "root@example.com" {
+		t.Fatalf("list: %+v %v", list, err)
+	}
+
+	if err := roles.Remove("bob@example.com", "root@example.com"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := roles.Remove("bob@example.com", "root@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second remove: %v", err)
+	}
+}
@@ -1,14 +1,20 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
 // RspamdService provides Rspamd management operations
 type RspamdService struct {
-	ssh *SSHClient
+	exec       Executor
+	controller *RspamdController
 }
 
 // RspamdStatus represents the current status of Rspamd
@@ -33,6 +39,14 @@ type RspamdMetrics struct {
 	LearnedHam        int64   `json:"learned_ham"`
 	FuzzyMatches      int64   `json:"fuzzy_matches"`
 	DNSBLMatches      int64   `json:"dnsbl_matches"`
+
+	// Messages per action since rspamd started, and its uptime in seconds
+	Actions map[string]int64 `json:"actions"`
+	Uptime  int64            `json:"uptime"`
+
+	// HistorySize is the number of recent scans AverageScore, FuzzyMatches
+	// and DNSBLMatches are computed over
+	HistorySize int `json:"history_size"`
 }
 
 // RspamdConfig represents Rspamd configuration
@@ -74,15 +88,27 @@ const (
 )
 
 // NewRspamdService creates a new Rspamd service
-func NewRspamdService(sshClient *SSHClient) *RspamdService {
-	return &RspamdService{ssh: sshClient}
+func NewRspamdService(exec Executor) *RspamdService {
+	return &RspamdService{exec: exec}
+}
+
+// WithController sets the controller client used for statistics and
+// learning; without one GetMetrics fails
+func (r *RspamdService) WithController(c *RspamdController) *RspamdService {
+	r.controller = c
+	return r
+}
+
+// Controller returns the controller client, or nil
+func (r *RspamdService) Controller() *RspamdController {
+	return r.controller
 }
 
 // GetStatus returns the current status of Rspamd
 func (r *RspamdService) GetStatus() (*RspamdStatus, error) {
 	// Check if Rspamd is running
 	cmd := "doas rc-service rspamd status && echo 'RUNNING' || echo 'STOPPED'"
-	output, err := r.ssh.Execute(cmd)
+	output, err := r.exec.Execute(cmd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check Rspamd status: %w", err)
 	}
@@ -97,12 +123,12 @@ func (r *RspamdService) GetStatus() (*RspamdStatus, error) {
 
 	// Get version
 	versionCmd := "rspamd --version | head -1"
-	versionOut, _ := r.ssh.Execute(versionCmd)
+	versionOut, _ := r.exec.Execute(versionCmd)
 	status.Version = strings.TrimSpace(versionOut)
 
 	// Get process info
 	psCmd := "doas ps aux | grep '[r]spawmd' | head -1 | awk '{print $2, $6}'"
-	psOut, _ := r.ssh.Execute(psCmd)
+	psOut, _ := r.exec.Execute(psCmd)
 	if psOut != "" {
 		parts := strings.Fields(psOut)
 		if len(parts) >= 2 {
@@ -113,74 +139,85 @@ func (r *RspamdService) GetStatus() (*RspamdStatus, error) {
 
 	// Get CPU usage from top
 	topCmd := "doas top -bn 1 | grep -E '^[%]|rspamd' | tail -1 | awk '{print $9}'"
-	topOut, _ := r.ssh.Execute(topCmd)
+	topOut, _ := r.exec.Execute(topCmd)
 	status.CPU = strings.TrimSpace(topOut) + "%"
 
 	return status, nil
 }
 
-// GetMetrics returns Rspamd metrics
+// GetMetrics returns Rspamd metrics from the controller's /stat counters.
+// The average score and the fuzzy and DNSBL hits come from /history, so
+// they cover only the recent scans it keeps.
 func (r *RspamdService) GetMetrics() (*RspamdMetrics, error) {
-	// Try to get metrics from Rspamd HTTP interface
-	cmd := `doas wget -q -O - http://127.0.0.1:11334/stat | grep -E '"(scanned|spam|ham|score)"|Total:' | head -20`
-	output, err := r.ssh.Execute(cmd)
-	if err != nil {
-		// Fallback: parse from logs
-		return r.getMetricsFromLogs()
+	if r.controller == nil {
+		return nil, fmt.Errorf("rspamd controller not configured")
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	metrics := &RspamdMetrics{}
+	stat, err := r.controller.Stat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metrics := &RspamdMetrics{
+		MessageCount: stat.Scanned,
+		SpamCount:    stat.SpamCount,
+		HamCount:     stat.HamCount,
+		Actions:      stat.Actions,
+		Uptime:       stat.Uptime,
+	}
+	if metrics.MessageCount > 0 {
+		metrics.SpamPercentage = float64(metrics.SpamCount) / float64(metrics.MessageCount) * 100
+	}
+	// The revision of a Bayes statfile counts the messages learned into it
+	for _, sf := range stat.Statfiles {
+		if strings.Contains(strings.ToUpper(sf.Symbol), "SPAM") {
+			metrics.LearnedSpam += sf.Revision
+		} else if strings.Contains(strings.ToUpper(sf.Symbol), "HAM") {
+			metrics.LearnedHam += sf.Revision
+		}
+	}
 
-	// Parse output (simplified parsing for common metrics)
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.Contains(line, "scanned") {
-			fmt.Sscanf(line, "%d", &metrics.MessageCount)
+	// The history only adds detail; without it the counters are still worth
+	// showing, with the history-derived fields left at zero
+	history, err := r.controller.History(ctx)
+	if err != nil {
+		log.Printf("Rspamd metrics: history unavailable: %v", err)
+	}
+	var total float64
+	for _, e := range history {
+		total += e.Score
+		fuzzy, dnsbl := false, false
+		for name := range e.Symbols {
+			fuzzy = fuzzy || strings.HasPrefix(name, "FUZZY_")
+			dnsbl = dnsbl || isDNSBLSymbol(name)
 		}
-		if strings.Contains(line, "spam") && !strings.Contains(line, "learned") {
-			fmt.Sscanf(line, "%d", &metrics.SpamCount)
+		if fuzzy {
+			metrics.FuzzyMatches++
 		}
-		if strings.Contains(line, "ham") {
-			fmt.Sscanf(line, "%d", &metrics.HamCount)
+		if dnsbl {
+			metrics.DNSBLMatches++
 		}
 	}
-
-	// Calculate spam percentage
-	if metrics.MessageCount > 0 {
-		metrics.SpamPercentage = float64(metrics.SpamCount) / float64(metrics.MessageCount) * 100
+	metrics.HistorySize = len(history)
+	if len(history) > 0 {
+		metrics.AverageScore = total / float64(len(history))
 	}
 
 	return metrics, nil
 }
 
-// getMetricsFromLogs extracts metrics from log file
-func (r *RspamdService) getMetricsFromLogs() (*RspamdMetrics, error) {
-	metrics := &RspamdMetrics{}
+// dnsblSymbolPrefixes name the symbols of the rbl and surbl modules
+var dnsblSymbolPrefixes = []string{"RBL_", "RECEIVED_", "URIBL_", "SURBL_", "DBL_", "SEM_", "MAILSPIKE_"}
 
-	// Get last 1000 log lines
-	cmd := fmt.Sprintf("doas tail -1000 %s", rspamdLogFile)
-	output, err := r.ssh.Execute(cmd)
-	if err != nil {
-		return metrics, fmt.Errorf("failed to read Rspamd logs: %w", err)
-	}
-
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "spam") {
-			metrics.SpamCount++
-		}
-		if strings.Contains(line, "ham") {
-			metrics.HamCount++
+// isDNSBLSymbol reports whether a symbol is a DNS blocklist hit
+func isDNSBLSymbol(name string) bool {
+	for _, p := range dnsblSymbolPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
 		}
-		metrics.MessageCount++
 	}
-
-	if metrics.MessageCount > 0 {
-		metrics.SpamPercentage = float64(metrics.SpamCount) / float64(metrics.MessageCount) * 100
-	}
-
-	return metrics, nil
+	return false
 }
 
 // GetConfig returns current Rspamd configuration
@@ -198,19 +235,19 @@ func (r *RspamdService) GetConfig() (*RspamdConfig, error) {
 	}
 
 	// Read worker config
-	workerContent, err := r.ssh.ReadFile(rspamdWorkerConf)
+	workerContent, err := r.exec.ReadFile(rspamdWorkerConf)
 	if err == nil {
 		r.parseWorkerConfig(workerContent, config)
 	}
 
 	// Read options config
-	optionsContent, err := r.ssh.ReadFile(rspamdOptionsConf)
+	optionsContent, err := r.exec.ReadFile(rspamdOptionsConf)
 	if err == nil {
 		r.parseOptionsConfig(optionsContent, config)
 	}
 
 	// Read Redis config
-	redisContent, err := r.ssh.ReadFile(redisConf)
+	redisContent, err := r.exec.ReadFile(redisConf)
 	if err == nil {
 		r.parseRedisConfig(redisContent, config)
 	}
@@ -275,13 +312,13 @@ worker "normal" {
 }
 `, config.WorkerMaxTasks, config.WorkerCount, config.WorkerTimeout)
 
-	if err := r.ssh.WriteFile(rspamdWorkerConf, workerConf); err != nil {
+	if err := r.exec.WriteFile(rspamdWorkerConf, workerConf); err != nil {
 		return fmt.Errorf("failed to update worker config: %w", err)
 	}
 
 	// Reload Rspamd
 	cmd := "doas rc-service rspamd reload"
-	if _, err := r.ssh.Execute(cmd); err != nil {
+	if _, err := r.exec.Execute(cmd); err != nil {
 		return fmt.Errorf("failed to reload Rspamd: %w", err)
 	}
 
@@ -290,7 +327,7 @@ worker "normal" {
 
 // GetWhitelist returns the current SPF whitelist
 func (r *RspamdService) GetWhitelist() (*RspamdWhitelist, error) {
-	content, err := r.ssh.ReadFile(rspamdWhitelistTxt)
+	content, err := r.exec.ReadFile(rspamdWhitelistTxt)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read whitelist: %w", err)
 	}
@@ -350,8 +387,7 @@ func (r *RspamdService) AddToWhitelist(entry string) error {
 	}
 
 	// Append to whitelist file
-	cmd := fmt.Sprintf("echo '%s' | doas tee -a %s", entry, rspamdWhitelistTxt)
-	if _, err := r.ssh.Execute(cmd); err != nil {
+	if err := appendLine(r.exec, rspamdWhitelistTxt, entry); err != nil {
 		return fmt.Errorf("failed to add to whitelist: %w", err)
 	}
 
@@ -364,9 +400,8 @@ func (r *RspamdService) RemoveFromWhitelist(entry string) error {
 		return fmt.Errorf("whitelist entry cannot be empty")
 	}
 
-	// Use sed to remove the entry
-	cmd := fmt.Sprintf("doas sed -i '/%s/d' %s", entry, rspamdWhitelistTxt)
-	if _, err := r.ssh.Execute(cmd); err != nil {
+	// Remove exact matches only
+	if err := deleteLines(r.exec, rspamdWhitelistTxt, regexp.QuoteMeta(entry)+`\s*$`); err != nil {
 		return fmt.Errorf("failed to remove from whitelist: %w", err)
 	}
 
@@ -380,7 +415,7 @@ func (r *RspamdService) GetLogs(lines int) ([]RspamdLog, error) {
 	}
 
 	cmd := fmt.Sprintf("doas tail -%d %s", lines, rspamdLogFile)
-	output, err := r.ssh.Execute(cmd)
+	output, err := r.exec.Execute(cmd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read logs: %w", err)
 	}
@@ -416,10 +451,71 @@ func (r *RspamdService) GetLogs(lines int) ([]RspamdLog, error) {
 	return logs, nil
 }
 
+// RspamdHistoryFilter selects scans from the history. Empty Action and nil
+// score bounds match everything.
+type RspamdHistoryFilter struct {
+	Action   string
+	MinScore *float64
+	MaxScore *float64
+}
+
+// Match reports whether a scan passes the filter
+func (f RspamdHistoryFilter) Match(e RspamdHistoryEntry) bool {
+	if f.Action != "" && !strings.EqualFold(e.Action, f.Action) {
+		return false
+	}
+	if f.MinScore != nil && e.Score < *f.MinScore {
+		return false
+	}
+	if f.MaxScore != nil && e.Score > *f.MaxScore {
+		return false
+	}
+	return true
+}
+
+// GetHistory returns the recent scans from the controller that match
+// filter, newest first
+func (r *RspamdService) GetHistory(filter RspamdHistoryFilter) ([]RspamdHistoryEntry, error) {
+	if filter.Action != "" && !isRspamdAction(filter.Action) {
+		return nil, invalidf("unknown action: %s", filter.Action)
+	}
+	if filter.MinScore != nil && filter.MaxScore != nil && *filter.MinScore > *filter.MaxScore {
+		return nil, invalidf("minimum score %g is above maximum %g", *filter.MinScore, *filter.MaxScore)
+	}
+	if r.controller == nil {
+		return nil, fmt.Errorf("rspamd controller not configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	history, err := r.controller.History(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scans := []RspamdHistoryEntry{}
+	for _, e := range history {
+		if filter.Match(e) {
+			scans = append(scans, e)
+		}
+	}
+	sort.SliceStable(scans, func(i, j int) bool { return scans[i].UnixTime > scans[j].UnixTime })
+	return scans, nil
+}
+
+// isRspamdAction reports whether action is one rspamd applies to messages
+func isRspamdAction(action string) bool {
+	for _, a := range RspamdGraphActions {
+		if strings.EqualFold(a, action) {
+			return true
+		}
+	}
+	return false
+}
+
 // TestConnection tests the Rspamd connection
 func (r *RspamdService) TestConnection() error {
 	cmd := "doas rc-service rspamd status | grep -q 'started'"
-	_, err := r.ssh.Execute(cmd)
+	_, err := r.exec.Execute(cmd)
 	return err
 }
 
@@ -444,7 +540,7 @@ func isValidIP(ip string) bool {
 // RestartService restarts the Rspamd service
 func (r *RspamdService) RestartService() error {
 	cmd := "doas rc-service rspamd restart"
-	_, err := r.ssh.Execute(cmd)
+	_, err := r.exec.Execute(cmd)
 	if err != nil {
 		return fmt.Errorf("failed to restart Rspamd: %w", err)
 	}
@@ -454,7 +550,7 @@ func (r *RspamdService) RestartService() error {
 // StopService stops the Rspamd service
 func (r *RspamdService) StopService() error {
 	cmd := "doas rc-service rspamd stop"
-	_, err := r.ssh.Execute(cmd)
+	_, err := r.exec.Execute(cmd)
 	if err != nil {
 		return fmt.Errorf("failed to stop Rspamd: %w", err)
 	}
@@ -464,7 +560,7 @@ func (r *RspamdService) StopService() error {
 // StartService starts the Rspamd service
 func (r *RspamdService) StartService() error {
 	cmd := "doas rc-service rspamd start"
-	_, err := r.ssh.Execute(cmd)
+	_, err := r.exec.Execute(cmd)
 	if err != nil {
 		return fmt.Errorf("failed to start Rspamd: %w", err)
 	}
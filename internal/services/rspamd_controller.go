@@ -0,0 +1,306 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultRspamdController is the address of the controller worker on the
+// mail host
+const DefaultRspamdController = "127.0.0.1:11334"
+
+// DialFunc opens a connection to addr, e.g. SSHClient.DialContext to reach
+// the controller from the mail host
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// RspamdController is a client for the Rspamd controller HTTP API. Requests
+// are sent through dial, so the controller does not have to listen beyond
+// the mail host's loopback interface.
+type RspamdController struct {
+	addr     string
+	password string
+	client   *http.Client
+}
+
+// NewRspamdController creates a client for the controller at addr
+// (host:port) that authenticates with password
+func NewRspamdController(dial DialFunc, addr, password string) *RspamdController {
+	if addr == "" {
+		addr = DefaultRspamdController
+	}
+	return &RspamdController{
+		addr:     addr,
+		password: password,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				DialContext:     dial,
+				MaxIdleConns:    2,
+				IdleConnTimeout: time.Minute,
+			},
+		},
+	}
+}
+
+// RspamdStatfile is a statistics backend, e.g. the Bayes spam or ham class
+type RspamdStatfile struct {
+	Symbol   string `json:"symbol"`
+	Type     string `json:"type"`
+	Revision int64  `json:"revision"` // number of messages learned
+	Used     int64  `json:"used"`
+	Total    int64  `json:"total"`
+	Size     int64  `json:"size"`
+	Users    int64  `json:"users"`
+}
+
+// RspamdStat is the /stat counters of the controller
+type RspamdStat struct {
+	ReadOnly    bool             `json:"read_only"`
+	Uptime      int64            `json:"uptime"`
+	Scanned     int64            `json:"scanned"`
+	Learned     int64            `json:"learned"`
+	SpamCount   int64            `json:"spam_count"`
+	HamCount    int64            `json:"ham_count"`
+	Connections int64            `json:"connections"`
+	Actions     map[string]int64 `json:"actions"`
+	Statfiles   []RspamdStatfile `json:"statfiles"`
+	FuzzyHashes map[string]int64 `json:"fuzzy_hashes"`
+	TotalLearns int64            `json:"total_learns"`
+	ConfigID    string           `json:"config_id"`
+}
+
+// RspamdGraphActions are the series of /graph, in order
+var RspamdGraphActions = []string{"reject", "soft reject", "rewrite subject", "add header", "greylist", "no action"}
+
+// RspamdGraphPoint is one sample of a graph series: X is a Unix time, Y the
+// number of messages per minute
+type RspamdGraphPoint struct {
+	X int64   `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// RspamdGraphSeries is the throughput of one action
+type RspamdGraphSeries struct {
+	Action string             `json:"action"`
+	Points []RspamdGraphPoint `json:"points"`
+}
+
+// RspamdSymbolResult is a symbol that matched a scanned message
+type RspamdSymbolResult struct {
+	Name        string   `json:"name"`
+	Score       float64  `json:"score"`
+	Options     []string `json:"options,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// RspamdHistoryEntry is a scanned message from /history
+type RspamdHistoryEntry struct {
+	MessageID     string                        `json:"message-id"`
+	QueueID       string                        `json:"qid"`
+	IP            string                        `json:"ip"`
+	User          string                        `json:"user"`
+	UnixTime      float64                       `json:"unix_time"`
+	Action        string                        `json:"action"`
+	Score         float64                       `json:"score"`
+	RequiredScore float64                       `json:"required_score"`
+	Size          int64                         `json:"size"`
+	Subject       string                        `json:"subject"`
+	SenderMIME    string                        `json:"sender_mime"`
+	SenderSMTP    string                        `json:"sender_smtp"`
+	RcptMIME      []string                      `json:"rcpt_mime"`
+	RcptSMTP      []string                      `json:"rcpt_smtp"`
+	TimeReal      float64                       `json:"time_real"`
+	Symbols       map[string]RspamdSymbolResult `json:"symbols"`
+}
+
+// Time returns when the message was scanned
+func (e RspamdHistoryEntry) Time() time.Time {
+	sec := int64(e.UnixTime)
+	return time.Unix(sec, int64((e.UnixTime-float64(sec))*1e9)).UTC()
+}
+
+// RspamdSymbol is a configured symbol with its weight and statistics
+type RspamdSymbol struct {
+	Symbol      string  `json:"symbol"`
+	Weight      float64 `json:"weight"`
+	Description string  `json:"description"`
+	Frequency   float64 `json:"frequency"`
+	Time        float64 `json:"time"`
+}
+
+// RspamdSymbolGroup is a group of symbols from /symbols
+type RspamdSymbolGroup struct {
+	Group string         `json:"group"`
+	Rules []RspamdSymbol `json:"rules"`
+}
+
+// RspamdAction is an action threshold from /actions
+type RspamdAction struct {
+	Action string  `json:"action"`
+	Value  float64 `json:"value"`
+}
+
+// ControllerError is an error response of the Rspamd controller
+type ControllerError struct {
+	Status  int
+	Message string
+}
+
+func (e *ControllerError) Error() string {
+	if e.Status == http.StatusForbidden || e.Status == http.StatusUnauthorized {
+		return fmt.Sprintf("rspamd controller refused the password (HTTP %d)", e.Status)
+	}
+	return fmt.Sprintf("rspamd controller: %s (HTTP %d)", e.Message, e.Status)
+}
+
+// do sends a request and decodes the JSON response into out
+func (c *RspamdController) do(ctx context.Context, method, path string, body io.Reader, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+c.addr+path, body)
+	if err != nil {
+		return err
+	}
+	if c.password != "" {
+		req.Header.Set("Password", c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("rspamd controller: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+	if err != nil {
+		return fmt.Errorf("rspamd controller: %w", err)
+	}
+
+	// 208 Already Reported comes with an error body too
+	if resp.StatusCode >= 300 || resp.StatusCode == http.StatusAlreadyReported {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(data))
+		}
+		return &ControllerError{Status: resp.StatusCode, Message: e.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("rspamd controller: invalid %s response: %w", path, err)
+	}
+	return nil
+}
+
+// Stat returns the scan and learn counters
+func (c *RspamdController) Stat(ctx context.Context) (*RspamdStat, error) {
+	var stat RspamdStat
+	if err := c.do(ctx, http.MethodGet, "/stat", nil, &stat); err != nil {
+		return nil, err
+	}
+	return &stat, nil
+}
+
+// Graph returns the throughput per action over period: hourly, daily,
+// weekly or monthly
+func (c *RspamdController) Graph(ctx context.Context, period string) ([]RspamdGraphSeries, error) {
+	switch period {
+	case "hourly", "daily", "weekly", "monthly":
+	default:
+		return nil, invalidf("invalid graph period: %s", period)
+	}
+	var raw [][]RspamdGraphPoint
+	if err := c.do(ctx, http.MethodGet, "/graph?type="+url.QueryEscape(period), nil, &raw); err != nil {
+		return nil, err
+	}
+	series := make([]RspamdGraphSeries, len(raw))
+	for i, points := range raw {
+		series[i].Points = points
+		if i < len(RspamdGraphActions) {
+			series[i].Action = RspamdGraphActions[i]
+		}
+	}
+	return series, nil
+}
+
+// History returns the most recent scans, newest first. It accepts both the
+// {"version": 2, "rows": [...]} format and the older bare array.
+func (c *RspamdController) History(ctx context.Context) ([]RspamdHistoryEntry, error) {
+	var raw json.RawMessage
+	if err := c.do(ctx, http.MethodGet, "/history", nil, &raw); err != nil {
+		return nil, err
+	}
+	var rows []RspamdHistoryEntry
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(raw, &rows); err != nil {
+			return nil, fmt.Errorf("rspamd controller: invalid /history response: %w", err)
+		}
+		return rows, nil
+	}
+	var v2 struct {
+		Version int                  `json:"version"`
+		Rows    []RspamdHistoryEntry `json:"rows"`
+	}
+	if err := json.Unmarshal(raw, &v2); err != nil {
+		return nil, fmt.Errorf("rspamd controller: invalid /history response: %w", err)
+	}
+	return v2.Rows, nil
+}
+
+// Symbols returns the configured symbols by group
+func (c *RspamdController) Symbols(ctx context.Context) ([]RspamdSymbolGroup, error) {
+	var groups []RspamdSymbolGroup
+	if err := c.do(ctx, http.MethodGet, "/symbols", nil, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// Actions returns the action thresholds
+func (c *RspamdController) Actions(ctx context.Context) ([]RspamdAction, error) {
+	var actions []RspamdAction
+	if err := c.do(ctx, http.MethodGet, "/actions", nil, &actions); err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
+
+// LearnSpam trains the Bayes classifier with message as spam
+func (c *RspamdController) LearnSpam(ctx context.Context, message []byte) error {
+	return c.learn(ctx, "/learnspam", message)
+}
+
+// LearnHam trains the Bayes classifier with message as ham
+func (c *RspamdController) LearnHam(ctx context.Context, message []byte) error {
+	return c.learn(ctx, "/learnham", message)
+}
+
+// learn posts a message to a learn endpoint. A message the classifier
+// already learned is reported by rspamd with 208 and returned as ErrExists.
+func (c *RspamdController) learn(ctx context.Context, path string, message []byte) error {
+	var result struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	err := c.do(ctx, http.MethodPost, path, bytes.NewReader(message), &result)
+	var cerr *ControllerError
+	if errors.As(err, &cerr) && cerr.Status == http.StatusAlreadyReported {
+		return existsf("%s", cerr.Message)
+	}
+	if err != nil {
+		return err
+	}
+	if !result.Success {
+		return fmt.Errorf("rspamd controller: learning failed: %s", result.Error)
+	}
+	return nil
+}
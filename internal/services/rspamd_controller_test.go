@@ -0,0 +1,205 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeController serves canned controller responses and checks the
+// password like rspamd does
+func fakeController(t *testing.T, password string) (*RspamdController, *[]string) {
+	t.Helper()
+	var learned []string
+	mux := http.NewServeMux()
+	responses := map[string]string{
+		"/stat": `{"read_only": false, "scanned": 1200, "learned": 30, "spam_count": 180, "ham_count": 1020,
+			"actions": {"reject": 100, "add header": 80, "no action": 1020}, "uptime": 3600,
+			"statfiles": [{"revision": 20, "used": 5000, "total": 0, "symbol": "BAYES_SPAM", "type": "redis"},
+			              {"revision": 10, "used": 4000, "total": 0, "symbol": "BAYES_HAM", "type": "redis"}],
+			"fuzzy_hashes": {"rspamd.com": 12345}, "total_learns": 30}`,
+		"/history": `{"version": 2, "rows": [
+			{"message-id": "a@x", "unix_time": 1760000000.5, "action": "reject", "score": 16.5, "required_score": 15,
+			 "symbols": {"RBL_SPAMHAUS_XBL": {"name": "RBL_SPAMHAUS_XBL", "score": 4}, "FUZZY_DENIED": {"name": "FUZZY_DENIED", "score": 12.5}},
+			 "rcpt_mime": ["bob@example.com"]},
+			{"message-id": "b@x", "unix_time": 1760000001, "action": "no action", "score": -0.5, "required_score": 15, "symbols": {}}]}`,
+		"/graph":   `[[{"x": 1760000000, "y": 0.5}, {"x": 1760000060, "y": null}], [], [], [], [], [{"x": 1760000000, "y": 3}]]`,
+		"/symbols": `[{"group": "rbl", "rules": [{"symbol": "RBL_SPAMHAUS_XBL", "weight": 4, "description": "From address is listed in XBL", "frequency": 0.02, "time": 0.1}]}]`,
+		"/actions": `[{"action": "reject", "value": 15}, {"action": "add header", "value": 6}]`,
+	}
+	for path, body := range responses {
+		body := body
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		})
+	}
+	for _, path := range []string{"/learnspam", "/learnham"} {
+		path := path
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			msg, _ := io.ReadAll(r.Body)
+			for _, l := range learned {
+				if l == path+" "+string(msg) {
+					w.WriteHeader(http.StatusAlreadyReported)
+					w.Write([]byte(`{"error": "<m@x> has been already learned as spam, ignore it"}`))
+					return
+				}
+			}
+			learned = append(learned, path+" "+string(msg))
+			w.Write([]byte(`{"success": true}`))
+		})
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Password") != password {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "Unauthorized"}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	// Stand-in for SSHClient.DialContext: the controller address is
+	// resolved on the "mail host", here the test server
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != DefaultRspamdController {
+			t.Errorf("dialed %s", addr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	return NewRspamdController(dial, "", password), &learned
+}
+
+func TestRspamdController(t *testing.T) {
+	ctx := context.Background()
+	c, learned := fakeController(t, "s3cret")
+
+	stat, err := c.Stat(ctx)
+	if err != nil || stat.Scanned != 1200 || stat.Actions["reject"] != 100 || len(stat.Statfiles) != 2 {
+		t.Fatalf("Stat: %+v %v", stat, err)
+	}
+	history, err := c.History(ctx)
+	if err != nil || len(history) != 2 || history[0].Symbols["FUZZY_DENIED"].Score != 12.5 || history[0].Time().Unix() != 1760000000 {
+		t.Fatalf("History: %+v %v", history, err)
+	}
+	graph, err := c.Graph(ctx, "hourly")
+	if err != nil || len(graph) != 6 || graph[0].Action != "reject" || graph[5].Points[0].Y != 3 {
+		t.Fatalf("Graph: %+v %v", graph, err)
+	}
+	if _, err := c.Graph(ctx, "yearly"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("invalid period: %v", err)
+	}
+	if groups, err := c.Symbols(ctx); err != nil || groups[0].Rules[0].Weight != 4 {
+		t.Errorf("Symbols: %+v %v", groups, err)
+	}
+	if actions, err := c.Actions(ctx); err != nil || len(actions) != 2 || actions[0].Value != 15 {
+		t.Errorf("Actions: %+v %v", actions, err)
+	}
+
+	if err := c.LearnSpam(ctx, []byte("Subject: buy now\r\n\r\nspam")); err != nil {
+		t.Fatalf("LearnSpam: %v", err)
+	}
+	if err := c.LearnSpam(ctx, []byte("Subject: buy now\r\n\r\nspam")); !errors.Is(err, ErrExists) {
+		t.Errorf("relearn: %v", err)
+	}
+	if err := c.LearnHam(ctx, []byte("Subject: hi\r\n\r\nham")); err != nil || len(*learned) != 2 {
+		t.Errorf("LearnHam: %v %v", err, *learned)
+	}
+
+	wrong := NewRspamdController(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return c.client.Transport.(*http.Transport).DialContext(ctx, network, DefaultRspamdController)
+	}, "", "wrong")
+	var cerr *ControllerError
+	if _, err := wrong.Stat(ctx); !errors.As(err, &cerr) || cerr.Status != http.StatusForbidden || !strings.Contains(err.Error(), "password") {
+		t.Errorf("wrong password: %v", err)
+	}
+}
+
+func TestRspamdMetricsFromController(t *testing.T) {
+	c, _ := fakeController(t, "")
+	if _, err := NewRspamdService(NewFakeExecutor()).GetMetrics(); err == nil {
+		t.Error("metrics without a controller")
+	}
+
+	m, err := NewRspamdService(NewFakeExecutor()).WithController(c).GetMetrics()
+	if err != nil {
+		t.Fatalf("GetMetrics: %v", err)
+	}
+	if m.MessageCount != 1200 || m.SpamCount != 180 || m.HamCount != 1020 || m.SpamPercentage != 15 {
+		t.Errorf("counts %+v", m)
+	}
+	if m.LearnedSpam != 20 || m.LearnedHam != 10 || m.Uptime != 3600 || m.Actions["add header"] != 80 {
+		t.Errorf("learned/actions %+v", m)
+	}
+	if m.HistorySize != 2 || m.AverageScore != 8 || m.FuzzyMatches != 1 || m.DNSBLMatches != 1 {
+		t.Errorf("history metrics %+v", m)
+	}
+}
+
+func TestRspamdMetricsWithoutHistory(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stat" {
+			http.Error(w, `{"error": "history is disabled"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"scanned": 10, "spam_count": 5, "ham_count": 5, "actions": {"reject": 5}}`))
+	}))
+	t.Cleanup(srv.Close)
+	c := NewRspamdController(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, srv.Listener.Addr().String())
+	}, "", "")
+
+	m, err := NewRspamdService(NewFakeExecutor()).WithController(c).GetMetrics()
+	if err != nil {
+		t.Fatalf("GetMetrics: %v", err)
+	}
+	if m.MessageCount != 10 || m.SpamPercentage != 50 || m.HistorySize != 0 || m.AverageScore != 0 {
+		t.Errorf("metrics %+v", m)
+	}
+}
+
+func TestRspamdHistoryFilter(t *testing.T) {
+	c, _ := fakeController(t, "")
+	rspamd := NewRspamdService(NewFakeExecutor()).WithController(c)
+	score := func(v float64) *float64 { return &v }
+
+	all, err := rspamd.GetHistory(RspamdHistoryFilter{})
+	if err != nil || len(all) != 2 || all[0].MessageID != "b@x" {
+		t.Fatalf("unfiltered history, newest first: %+v %v", all, err)
+	}
+	for _, tc := range []struct {
+		filter RspamdHistoryFilter
+		want   []string
+	}{
+		{RspamdHistoryFilter{Action: "Reject"}, []string{"a@x"}},
+		{RspamdHistoryFilter{Action: "greylist"}, nil},
+		{RspamdHistoryFilter{MinScore: score(0)}, []string{"a@x"}},
+		{RspamdHistoryFilter{MaxScore: score(16.5)}, []string{"b@x", "a@x"}},
+		{RspamdHistoryFilter{Action: "no action", MinScore: score(-1), MaxScore: score(1)}, []string{"b@x"}},
+	} {
+		got, err := rspamd.GetHistory(tc.filter)
+		if err != nil {
+			t.Errorf("%+v: %v", tc.filter, err)
+			continue
+		}
+		var ids []string
+		for _, e := range got {
+			ids = append(ids, e.MessageID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%+v: got %v, want %v", tc.filter, ids, tc.want)
+		}
+	}
+
+	for _, bad := range []RspamdHistoryFilter{{Action: "quarantine"}, {MinScore: score(5), MaxScore: score(1)}} {
+		if _, err := rspamd.GetHistory(bad); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%+v: %v", bad, err)
+		}
+	}
+}
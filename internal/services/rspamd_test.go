@@ -0,0 +1,90 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWhitelist(t *testing.T) {
+	fake := NewFakeExecutor()
+	fake.SetFile(rspamdWhitelistTxt, "# SPF whitelist\n*.example.com\n")
+	rspamd := NewRspamdService(fake)
+
+	for _, entry := range []string{"user@example.org", "192.168.1.10"} {
+		if err := rspamd.AddToWhitelist(entry); err != nil {
+			t.Fatalf("AddToWhitelist(%s): %v", entry, err)
+		}
+	}
+	if err := rspamd.AddToWhitelist("*.example.com"); err == nil {
+		t.Fatal("expected duplicate entry to be rejected")
+	}
+	if err := rspamd.AddToWhitelist(""); err == nil {
+		t.Fatal("expected empty entry to be rejected")
+	}
+
+	wl, err := rspamd.GetWhitelist()
+	if err != nil {
+		t.Fatalf("GetWhitelist: %v", err)
+	}
+	if len(wl.Domains) != 1 || len(wl.Emails) != 1 || len(wl.IPs) != 1 {
+		t.Fatalf("unexpected whitelist: %+v", wl)
+	}
+
+	// Removing an entry must not remove others that merely contain it
+	if err := rspamd.AddToWhitelist("192.168.1.100"); err != nil {
+		t.Fatalf("AddToWhitelist: %v", err)
+	}
+	if err := rspamd.RemoveFromWhitelist("192.168.1.10"); err != nil {
+		t.Fatalf("RemoveFromWhitelist: %v", err)
+	}
+
+	content, _ := fake.File(rspamdWhitelistTxt)
+	want := "# SPF whitelist\n*.example.com\nuser@example.org\n192.168.1.100\n"
+	if content != want {
+		t.Fatalf("unexpected whitelist file:\n%s", content)
+	}
+}
+
+func TestRspamdServiceControl(t *testing.T) {
+	fake := NewFakeExecutor()
+	rspamd := NewRspamdService(fake)
+
+	if err := rspamd.StopService(); err != nil {
+		t.Fatalf("StopService: %v", err)
+	}
+	status, err := rspamd.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+	if status.IsRunning {
+		t.Fatal("rspamd reported running after stop")
+	}
+
+	if err := rspamd.StartService(); err != nil {
+		t.Fatalf("StartService: %v", err)
+	}
+	if status, _ := rspamd.GetStatus(); !status.IsRunning {
+		t.Fatal("rspamd reported stopped after start")
+	}
+
+	cfg := &RspamdConfig{WorkerMaxTasks: 40, WorkerCount: 2, WorkerTimeout: 60}
+	if err := rspamd.UpdateConfig(cfg); err != nil {
+		t.Fatalf("UpdateConfig: %v", err)
+	}
+	if fake.Reloads("rspamd") != 1 {
+		t.Error("rspamd was not reloaded after config update")
+	}
+
+	got, err := rspamd.GetConfig()
+	if err != nil {
+		t.Fatalf("GetConfig: %v", err)
+	}
+	if got.WorkerMaxTasks != 40 || got.WorkerCount != 2 || got.WorkerTimeout != 60 {
+		t.Fatalf("config not read back: %+v", got)
+	}
+
+	worker, _ := fake.File(rspamdWorkerConf)
+	if !strings.Contains(worker, "max_tasks = 40;") {
+		t.Fatalf("unexpected worker config:\n%s", worker)
+	}
+}
@@ -0,0 +1,379 @@
+package services
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where a server definition comes from. Only database servers can be
+// changed from the UI.
+const (
+	ServerSourceEnv      = "env"
+	ServerSourceFile     = "file"
+	ServerSourceDatabase = "database"
+)
+
+// ServerSpec defines a mail server and how to reach it. Empty connection
+// fields take the inventory defaults (the CMH_SSH_* settings).
+type ServerSpec struct {
+	Name                string `json:"name"`
+	Host                string `json:"host"`
+	Port                int    `json:"port,omitempty"`
+	User                string `json:"user,omitempty"`
+	KeyPath             string `json:"key_path,omitempty"`
+	JumpHost            string `json:"jump_host,omitempty"`
+	JumpUser            string `json:"jump_user,omitempty"`
+	JumpKeyPath         string `json:"jump_key_path,omitempty"`
+	KnownHostsPath      string `json:"known_hosts,omitempty"`
+	HostFingerprint     string `json:"host_fingerprint,omitempty"`
+	JumpKnownHostsPath  string `json:"jump_known_hosts,omitempty"`
+	JumpHostFingerprint string `json:"jump_host_fingerprint,omitempty"`
+
+	// Rspamd controller on the mail host, reached through SSH
+	RspamdController string `json:"rspamd_controller,omitempty"`
+	RspamdPassword   string `json:"rspamd_password,omitempty"`
+}
+
+// withDefaults fills empty connection fields from d
+func (s ServerSpec) withDefaults(d ServerSpec) ServerSpec {
+	fill := func(v *string, def string) {
+		if *v == "" {
+			*v = def
+		}
+	}
+	if s.Port == 0 {
+		s.Port = d.Port
+	}
+	if s.Port == 0 {
+		s.Port = 22
+	}
+	fill(&s.User, d.User)
+	fill(&s.KeyPath, d.KeyPath)
+	fill(&s.KnownHostsPath, d.KnownHostsPath)
+	fill(&s.JumpHost, d.JumpHost)
+	fill(&s.JumpUser, d.JumpUser)
+	fill(&s.JumpKeyPath, d.JumpKeyPath)
+	fill(&s.JumpKnownHostsPath, d.JumpKnownHostsPath)
+	fill(&s.JumpHostFingerprint, d.JumpHostFingerprint)
+	fill(&s.RspamdController, d.RspamdController)
+	fill(&s.RspamdPassword, d.RspamdPassword)
+	fill(&s.RspamdController, DefaultRspamdController)
+	return s
+}
+
+// SSHConfig returns the SSH client settings of the server
+func (s ServerSpec) SSHConfig() SSHConfig {
+	return SSHConfig{
+		Host:        s.Host,
+		Port:        s.Port,
+		User:        s.User,
+		KeyPath:     s.KeyPath,
+		JumpHost:    s.JumpHost,
+		JumpUser:    s.JumpUser,
+		JumpKeyPath: s.JumpKeyPath,
+		HostKeys: HostKeyPolicy{
+			KnownHostsPath: s.KnownHostsPath,
+			Fingerprint:    s.HostFingerprint,
+		},
+		JumpHostKeys: HostKeyPolicy{
+			KnownHostsPath: s.JumpKnownHostsPath,
+			Fingerprint:    s.JumpHostFingerprint,
+		},
+	}
+}
+
+var serverNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// validate checks the fields an operator has to provide
+func (s ServerSpec) validate() error {
+	if !serverNameRe.MatchString(s.Name) {
+		return invalidf("server name must be 1-32 lowercase letters, digits or dashes: %q", s.Name)
+	}
+	if s.Host == "" || strings.ContainsAny(s.Host, " /@") {
+		return invalidf("invalid server host %q", s.Host)
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return invalidf("invalid server port %d", s.Port)
+	}
+	return nil
+}
+
+// Server is one managed mail hub with its own connection and mail service
+type Server struct {
+	Name   string `json:"name"`
+	Host   string `json:"host"`
+	Source string `json:"source"`
+
+	spec       ServerSpec
+	ssh        *SSHClient // nil for servers registered with an executor
+	mail       *MailService
+	controller *RspamdController
+}
+
+// Mail returns the mail service of the server
+func (s *Server) Mail() *MailService {
+	return s.mail
+}
+
+// SSH returns the SSH client of the server, or nil if it is reached
+// through another executor
+func (s *Server) SSH() *SSHClient {
+	return s.ssh
+}
+
+// RspamdController returns the client for the server's Rspamd controller,
+// or nil if the server is not reached through SSH
+func (s *Server) RspamdController() *RspamdController {
+	return s.controller
+}
+
+// Spec returns the connection settings, with defaults applied
+func (s *Server) Spec() ServerSpec {
+	return s.spec
+}
+
+// ServerInventory holds the managed mail servers: those defined in the
+// environment or the servers file, in order, followed by the servers added
+// from the UI, which are stored in the application database.
+type ServerInventory struct {
+	store    *Store
+	now      func() time.Time
+	defaults ServerSpec
+	setup    func(*MailService) error
+
+	mu    sync.Mutex
+	fixed []*Server
+	added map[string]*Server // database servers connected so far
+}
+
+// NewServerInventory creates the server table if needed. defaults fills
+// the connection settings servers leave empty; setup configures each
+// server's mail service (password scheme, archive directory).
+func NewServerInventory(store *Store, defaults ServerSpec, setup func(*MailService) error) (*ServerInventory, error) {
+	err := store.migrate(`
+		CREATE TABLE IF NOT EXISTS servers (
+			name TEXT PRIMARY KEY,
+			spec TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			created_by TEXT NOT NULL
+		)`)
+	if err != nil {
+		return nil, err
+	}
+	if setup == nil {
+		setup = func(*MailService) error { return nil }
+	}
+	return &ServerInventory{
+		store:    store,
+		now:      time.Now,
+		defaults: defaults,
+		setup:    setup,
+		added:    make(map[string]*Server),
+	}, nil
+}
+
+// LoadServerFile reads server definitions from a JSON file:
+// {"servers": [{"name": "cmh2", "host": "10.0.0.2", ...}]}
+func LoadServerFile(path string) ([]ServerSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Servers []ServerSpec `json:"servers"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid servers file %s: %w", path, err)
+	}
+	return file.Servers, nil
+}
+
+// Register adds a server defined in the environment or the servers file.
+// The first registered server is the default.
+func (inv *ServerInventory) Register(spec ServerSpec, source string) (*Server, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	spec = spec.withDefaults(inv.defaults)
+	ssh := NewSSHClient(spec.SSHConfig())
+	srv, err := inv.newServer(spec, source, ssh, ssh)
+	if err != nil {
+		return nil, err
+	}
+	return srv, inv.addFixed(srv)
+}
+
+// RegisterExecutor adds a fixed server reached through exec instead of
+// SSH, e.g. a FakeExecutor in tests
+func (inv *ServerInventory) RegisterExecutor(name string, exec Executor) (*Server, error) {
+	if !serverNameRe.MatchString(name) {
+		return nil, invalidf("invalid server name %q", name)
+	}
+	srv, err := inv.newServer(ServerSpec{Name: name, Host: name}, ServerSourceEnv, exec, nil)
+	if err != nil {
+		return nil, err
+	}
+	return srv, inv.addFixed(srv)
+}
+
+func (inv *ServerInventory) newServer(spec ServerSpec, source string, exec Executor, ssh *SSHClient) (*Server, error) {
+	mail := NewMailService(exec)
+	if err := inv.setup(mail); err != nil {
+		return nil, err
+	}
+	srv := &Server{Name: spec.Name, Host: spec.Host, Source: source, spec: spec, ssh: ssh, mail: mail}
+	if ssh != nil {
+		srv.controller = NewRspamdController(ssh.DialContext, spec.RspamdController, spec.RspamdPassword)
+	}
+	return srv, nil
+}
+
+func (inv *ServerInventory) addFixed(srv *Server) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	for _, s := range inv.fixed {
+		if s.Name == srv.Name {
+			return existsf("server already defined: %s", srv.Name)
+		}
+	}
+	inv.fixed = append(inv.fixed, srv)
+	return nil
+}
+
+// Default returns the first fixed server, or nil if there is none
+func (inv *ServerInventory) Default() *Server {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if len(inv.fixed) == 0 {
+		return nil
+	}
+	return inv.fixed[0]
+}
+
+// Servers returns the fixed servers followed by the database servers,
+// sorted by name
+func (inv *ServerInventory) Servers() ([]*Server, error) {
+	rows, err := inv.store.db.Query(`SELECT name, spec FROM servers ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	servers := append([]*Server(nil), inv.fixed...)
+	for rows.Next() {
+		var name, spec string
+		if err := rows.Scan(&name, &spec); err != nil {
+			return nil, err
+		}
+		srv, err := inv.connectAdded(name, spec)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, srv)
+	}
+	return servers, rows.Err()
+}
+
+// Get returns the server called name
+func (inv *ServerInventory) Get(name string) (*Server, error) {
+	inv.mu.Lock()
+	for _, s := range inv.fixed {
+		if s.Name == name {
+			inv.mu.Unlock()
+			return s, nil
+		}
+	}
+	inv.mu.Unlock()
+
+	var spec string
+	err := inv.store.db.QueryRow(`SELECT spec FROM servers WHERE name = ?`, name).Scan(&spec)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFoundf("server not found: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.connectAdded(name, spec)
+}
+
+// connectAdded returns the cached database server, creating its client on
+// first use. Callers hold inv.mu.
+func (inv *ServerInventory) connectAdded(name, specJSON string) (*Server, error) {
+	if srv, ok := inv.added[name]; ok {
+		return srv, nil
+	}
+	var spec ServerSpec
+	if err := json.Unmarshal([]byte(specJSON), &spec); err != nil {
+		return nil, fmt.Errorf("corrupt server %s: %w", name, err)
+	}
+	spec = spec.withDefaults(inv.defaults)
+	ssh := NewSSHClient(spec.SSHConfig())
+	srv, err := inv.newServer(spec, ServerSourceDatabase, ssh, ssh)
+	if err != nil {
+		return nil, err
+	}
+	inv.added[name] = srv
+	return srv, nil
+}
+
+// Add stores a new server in the database
+func (inv *ServerInventory) Add(spec ServerSpec, by string) (*Server, error) {
+	spec.Name = strings.ToLower(strings.TrimSpace(spec.Name))
+	spec.Host = strings.TrimSpace(spec.Host)
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := inv.Get(spec.Name); err == nil {
+		return nil, existsf("server already exists: %s", spec.Name)
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := inv.store.db.Exec(`INSERT INTO servers (name, spec, created_at, created_by) VALUES (?, ?, ?, ?)`,
+		spec.Name, string(data), inv.now().UTC(), by); err != nil {
+		return nil, fmt.Errorf("failed to store server: %w", err)
+	}
+	return inv.Get(spec.Name)
+}
+
+// Remove deletes a database server and closes its connection. Servers from
+// the environment or the servers file cannot be removed.
+func (inv *ServerInventory) Remove(name string) (*Server, error) {
+	srv, err := inv.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if srv.Source != ServerSourceDatabase {
+		return nil, invalidf("server %s is defined in the %s and cannot be removed here", name, srv.Source)
+	}
+	if _, err := inv.store.db.Exec(`DELETE FROM servers WHERE name = ?`, name); err != nil {
+		return nil, fmt.Errorf("failed to remove server: %w", err)
+	}
+
+	inv.mu.Lock()
+	delete(inv.added, name)
+	inv.mu.Unlock()
+	if srv.ssh != nil {
+		srv.ssh.Close()
+	}
+	return srv, nil
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerInventory(t *testing.T) {
+	store, err := OpenStore(t.TempDir() + "/mailhub.db")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	defaults := ServerSpec{Port: 2222, User: "postman", KeyPath: "/secrets/key", JumpHost: "jump.example.com", JumpUser: "ubuntu"}
+	inv, err := NewServerInventory(store, defaults, nil)
+	if err != nil {
+		t.Fatalf("inventory: %v", err)
+	}
+	if inv.Default() != nil {
+		t.Fatal("empty inventory has a default server")
+	}
+
+	if _, err := inv.Register(ServerSpec{Name: "cmh", Host: "10.0.0.1"}, ServerSourceEnv); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if _, err := inv.Register(ServerSpec{Name: "cmh", Host: "10.0.0.9"}, ServerSourceFile); !errors.Is(err, ErrExists) {
+		t.Errorf("duplicate fixed server: %v", err)
+	}
+
+	added, err := inv.Add(ServerSpec{Name: " Edge ", Host: "10.0.0.2", User: "mail"}, "admin@example.com")
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if spec := added.Spec(); added.Name != "edge" || spec.User != "mail" || spec.Port != 2222 || spec.JumpHost != "jump.example.com" {
+		t.Errorf("added server %+v with spec %+v", added, spec)
+	}
+	if _, err := inv.Add(ServerSpec{Name: "cmh", Host: "10.0.0.3"}, "admin@example.com"); !errors.Is(err, ErrExists) {
+		t.Errorf("add over a fixed server: %v", err)
+	}
+	if _, err := inv.Add(ServerSpec{Name: "bad name", Host: "10.0.0.3"}, "admin@example.com"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("invalid name: %v", err)
+	}
+
+	servers, err := inv.Servers()
+	if err != nil || len(servers) != 2 || servers[0].Name != "cmh" || servers[1].Name != "edge" {
+		t.Fatalf("servers: %v %v", servers, err)
+	}
+	if got, _ := inv.Get("edge"); got != added {
+		t.Error("Get does not reuse the connected server")
+	}
+
+	// A new inventory on the same database sees the added server
+	inv2, _ := NewServerInventory(store, defaults, nil)
+	if got, err := inv2.Get("edge"); err != nil || got.Source != ServerSourceDatabase || got.Host != "10.0.0.2" {
+		t.Errorf("reloaded server: %+v %v", got, err)
+	}
+
+	if _, err := inv.Remove("cmh"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("removed a fixed server: %v", err)
+	}
+	if _, err := inv.Remove("edge"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := inv.Get("edge"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("removed server still found: %v", err)
+	}
+}
+
+func TestLoadServerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.json")
+	os.WriteFile(path, []byte(`{"servers": [{"name": "edge", "host": "10.0.0.2", "jump_host": "bastion", "host_fingerprint": "SHA256:abc"}]}`), 0o600)
+	specs, err := LoadServerFile(path)
+	if err != nil || len(specs) != 1 {
+		t.Fatalf("load: %v %v", specs, err)
+	}
+	if s := specs[0]; s.Name != "edge" || s.JumpHost != "bastion" || s.SSHConfig().HostKeys.Fingerprint != "SHA256:abc" {
+		t.Errorf("spec %+v", s)
+	}
+
+	os.WriteFile(path, []byte(`{"servers": [{"name": "edge", "hostname": "x"}]}`), 0o600)
+	if _, err := LoadServerFile(path); err == nil {
+		t.Error("unknown field accepted")
+	}
+}
@@ -1,8 +1,15 @@
 package services
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"strings"
 	"sync"
@@ -20,8 +27,14 @@ type SSHClient struct {
 	jumpUser    string
 	jumpKeyPath string
 
+	hostKeys     HostKeyPolicy
+	jumpHostKeys HostKeyPolicy
+
 	mu     sync.Mutex
 	client *ssh.Client
+
+	pendingMu sync.Mutex
+	pending   map[string]*PresentedKey
 }
 
 // SSHConfig holds SSH connection configuration
@@ -33,6 +46,10 @@ type SSHConfig struct {
 	JumpHost    string
 	JumpUser    string
 	JumpKeyPath string
+
+	// Host key verification for the target and the jump host
+	HostKeys     HostKeyPolicy
+	JumpHostKeys HostKeyPolicy
 }
 
 // NewSSHClient creates a new SSH client
@@ -45,6 +62,10 @@ func NewSSHClient(cfg SSHConfig) *SSHClient {
 		jumpHost:    cfg.JumpHost,
 		jumpUser:    cfg.JumpUser,
 		jumpKeyPath: cfg.JumpKeyPath,
+
+		hostKeys:     cfg.HostKeys,
+		jumpHostKeys: cfg.JumpHostKeys,
+		pending:      make(map[string]*PresentedKey),
 	}
 }
 
@@ -79,7 +100,7 @@ func (c *SSHClient) connect() error {
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: c.hostKeyCallback(HopTarget, c.hostKeys),
 	}
 
 	// Connect through jump host if configured
@@ -105,7 +126,7 @@ func (c *SSHClient) connect() error {
 			Auth: []ssh.AuthMethod{
 				ssh.PublicKeys(jumpSigner),
 			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			HostKeyCallback: c.hostKeyCallback(HopJump, c.jumpHostKeys),
 		}
 
 		jumpAddr := fmt.Sprintf("%s:22", c.jumpHost)
@@ -145,6 +166,16 @@ func (c *SSHClient) connect() error {
 
 // Execute runs a command on the remote host
 func (c *SSHClient) Execute(cmd string) (string, error) {
+	output, err := c.execute(cmd, nil)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// execute runs a command, optionally feeding it stdin, and returns its
+// untrimmed output. Exit errors are wrapped so callers can inspect them.
+func (c *SSHClient) execute(cmd string, stdin io.Reader) (string, error) {
 	if err := c.connect(); err != nil {
 		return "", err
 	}
@@ -158,43 +189,179 @@ func (c *SSHClient) Execute(cmd string) (string, error) {
 	var stdout, stderr bytes.Buffer
 	session.Stdout = &stdout
 	session.Stderr = &stderr
+	session.Stdin = stdin
 
 	if err := session.Run(cmd); err != nil {
 		return "", fmt.Errorf("command failed: %w: %s", err, stderr.String())
 	}
 
-	return strings.TrimSpace(stdout.String()), nil
+	return stdout.String(), nil
 }
 
-// ReadFile reads a file from the remote host
+// ReadFile reads a file from the remote host, byte for byte
 func (c *SSHClient) ReadFile(path string) (string, error) {
-	return c.Execute(fmt.Sprintf("doas cat %s 2>/dev/null || cat %s", path, path))
+	p := shellQuote(path)
+	return c.execute(fmt.Sprintf("doas cat %s 2>/dev/null || cat %s", p, p), nil)
 }
 
-// AppendToFile appends content to a file on the remote host
+// Remote file edits are serialized with flock on this file
+const remoteLockFile = "/run/mailhub-admin.lock"
+
+// Exit code used by the replace script when the file changed under us
+const exitFileChanged = 76
+
+// ErrFileChanged is returned when a file was modified between reading it
+// and writing the new version
+var ErrFileChanged = errors.New("file was modified concurrently")
+
+// EditFile performs a transactional edit of a remote file: it takes the
+// remote edit lock, reads the file, lets fn compute the new content, and
+// atomically replaces the file (temp file, fsync, rename) if the content
+// still matches what was read. A missing file is passed to fn as "", and
+// only created if fn returns content.
+func (c *SSHClient) EditFile(path string, fn func(content string) (string, error)) error {
+	release, err := c.lockRemote()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	content, checksum, err := c.readForEdit(path)
+	if err != nil {
+		return err
+	}
+
+	updated, err := fn(content)
+	if err != nil {
+		return err
+	}
+	// A missing file is only created when fn produced content
+	if updated == content {
+		return nil
+	}
+
+	return c.replaceFile(path, checksum, updated)
+}
+
+// lockRemote acquires the remote edit lock. The lock is held by a session
+// that blocks on stdin, so it is released when the returned function closes
+// stdin or when the connection drops.
+func (c *SSHClient) lockRemote() (func(), error) {
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+
+	session, err := c.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open lock session: %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open lock session: %w", err)
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	cmd := fmt.Sprintf("doas flock -w 30 %s sh -c 'echo locked; cat >/dev/null'", remoteLockFile)
+	if err := session.Start(cmd); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to acquire remote lock: %w", err)
+	}
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "locked" {
+		stdin.Close()
+		session.Wait()
+		session.Close()
+		return nil, fmt.Errorf("failed to acquire remote lock: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	return func() {
+		stdin.Close()
+		session.Wait()
+		session.Close()
+	}, nil
+}
+
+// readForEdit returns the file content and its SHA-256 checksum, or
+// "absent" when the file does not exist
+func (c *SSHClient) readForEdit(path string) (string, string, error) {
+	// The leading marker distinguishes an empty file from a missing one
+	cmd := fmt.Sprintf("doas sh -c 'if [ -e \"$1\" ]; then printf x; cat \"$1\"; fi' sh %s", shellQuote(path))
+	output, err := c.execute(cmd, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if !strings.HasPrefix(output, "x") {
+		return "", "absent", nil
+	}
+
+	content := output[1:]
+	sum := sha256.Sum256([]byte(content))
+	return content, hex.EncodeToString(sum[:]), nil
+}
+
+// replaceScript writes stdin to a temp file next to $1, fsyncs it, copies
+// ownership and mode from the original, and renames it into place, but only
+// if the current checksum still equals $2
+const replaceScript = `set -e
+f="$1"
+if [ -e "$f" ]; then cur=$(sha256sum "$f" | cut -d' ' -f1); else cur=absent; fi
+[ "$cur" = "$2" ] || exit 76
+tmp=$(mktemp "$f.mailhub.XXXXXX")
+trap 'rm -f "$tmp"' EXIT
+dd of="$tmp" conv=fsync 2>/dev/null
+if [ -e "$f" ]; then
+  chown "$(stat -c %u:%g "$f")" "$tmp"
+  chmod "$(stat -c %a "$f")" "$tmp"
+else
+  chmod 644 "$tmp"
+fi
+mv -f "$tmp" "$f"
+trap - EXIT
+sync`
+
+// replaceFile atomically replaces path with content if its checksum still
+// matches the expected one
+func (c *SSHClient) replaceFile(path, expected, content string) error {
+	cmd := fmt.Sprintf("doas sh -c %s sh %s %s", shellQuote(replaceScript), shellQuote(path), shellQuote(expected))
+	_, err := c.execute(cmd, strings.NewReader(content))
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitStatus() == exitFileChanged {
+		return fmt.Errorf("failed to write %s: %w", path, ErrFileChanged)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// AppendToFile appends a line to a file on the remote host
 func (c *SSHClient) AppendToFile(path, content string) error {
-	// Escape single quotes in content
-	escaped := strings.ReplaceAll(content, "'", "'\"'\"'")
-	cmd := fmt.Sprintf("echo '%s' | doas tee -a %s > /dev/null", escaped, path)
-	_, err := c.Execute(cmd)
-	return err
+	return appendLine(c, path, content)
 }
 
 // WriteFile writes content to a file (overwrites)
 func (c *SSHClient) WriteFile(path, content string) error {
-	escaped := strings.ReplaceAll(content, "'", "'\"'\"'")
-	cmd := fmt.Sprintf("echo '%s' | doas tee %s > /dev/null", escaped, path)
-	_, err := c.Execute(cmd)
-	return err
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return c.EditFile(path, func(string) (string, error) {
+		return content, nil
+	})
 }
 
-// DeleteLine removes a line matching pattern from a file
+// DeleteLine removes lines matching pattern (anchored at line start) from a file
 func (c *SSHClient) DeleteLine(path, pattern string) error {
-	// Escape for sed
-	escaped := strings.ReplaceAll(pattern, "/", "\\/")
-	cmd := fmt.Sprintf("doas sed -i '/^%s/d' %s", escaped, path)
-	_, err := c.Execute(cmd)
-	return err
+	return deleteLines(c, path, pattern)
 }
 
 // Close closes the SSH connection
@@ -209,3 +376,22 @@ func (c *SSHClient) Close() error {
 	}
 	return nil
 }
+
+// DialContext opens a TCP connection from the mail host to addr through
+// the SSH connection, e.g. to reach services bound to its loopback
+func (c *SSHClient) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+	if client == nil {
+		return nil, fmt.Errorf("SSH connection closed")
+	}
+	conn, err := client.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s through SSH: %w", addr, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite"
+)
+
+// Store is the application database (DATABASE_PATH). It holds settings
+// managed from the UI such as API tokens; each service creates its own
+// tables on first use.
+type Store struct {
+	db *sql.DB
+}
+
+// OpenStore opens (and creates if needed) the SQLite database at path
+func OpenStore(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// migrate runs schema statements, all idempotent (CREATE ... IF NOT EXISTS)
+func (s *Store) migrate(statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to migrate database: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
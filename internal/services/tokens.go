@@ -0,0 +1,253 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// API token scopes. A write token can also read.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// tokenPrefix marks mailhub-admin tokens so they are easy to spot in logs
+// and secret scanners
+const tokenPrefix = "mha_"
+
+// MinTokenLifetime and MaxTokenLifetime bound token expiry
+const (
+	MinTokenLifetime = 24 * time.Hour
+	MaxTokenLifetime = 366 * 24 * time.Hour
+)
+
+// ErrInvalidToken is returned for unknown, expired or revoked tokens
+var ErrInvalidToken = errors.New("invalid or expired API token")
+
+// APIToken is a personal API token. Only a SHA-256 hash of the secret is
+// stored; Prefix identifies the token in the UI.
+type APIToken struct {
+	ID         int64
+	Owner      string
+	Name       string
+	Prefix     string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time // zero if never used
+	RevokedAt  time.Time // zero if active
+}
+
+// HasScope reports whether the token grants scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || (s == ScopeWrite && scope == ScopeRead) {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether the token can still be used
+func (t *APIToken) Active(now time.Time) bool {
+	return t.RevokedAt.IsZero() && now.Before(t.ExpiresAt)
+}
+
+// TokenService manages API tokens in the application database
+type TokenService struct {
+	store *Store
+	now   func() time.Time
+}
+
+// NewTokenService creates the token table if needed
+func NewTokenService(store *Store) (*TokenService, error) {
+	err := store.migrate(`
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			owner TEXT NOT NULL,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			scopes TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			last_used_at DATETIME,
+			revoked_at DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_tokens_owner ON api_tokens(owner)`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenService{store: store, now: time.Now}, nil
+}
+
+// hashToken returns the stored form of a token secret
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create issues a token for owner. The plaintext token is returned once
+// and cannot be recovered later.
+func (s *TokenService) Create(owner, name string, scopes []string, lifetime time.Duration) (string, *APIToken, error) {
+	name = strings.TrimSpace(name)
+	if owner == "" {
+		return "", nil, invalidf("token owner is required")
+	}
+	if name == "" || len(name) > 64 {
+		return "", nil, invalidf("token name must be 1-64 characters")
+	}
+	if lifetime < MinTokenLifetime || lifetime > MaxTokenLifetime {
+		return "", nil, invalidf("token lifetime must be between 1 day and 1 year")
+	}
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	prefix := tokenPrefix + hex.EncodeToString(id)
+	plaintext := prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	now := s.now().UTC()
+	token := &APIToken{
+		Owner:     owner,
+		Name:      name,
+		Prefix:    prefix,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+	}
+
+	res, err := s.store.db.Exec(`
+		INSERT INTO api_tokens (owner, name, prefix, token_hash, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		owner, name, prefix, hashToken(plaintext), strings.Join(scopes, ","), now, token.ExpiresAt)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to store token: %w", err)
+	}
+	token.ID, _ = res.LastInsertId()
+	return plaintext, token, nil
+}
+
+// Authenticate returns the active token matching plaintext and records its
+// use
+func (s *TokenService) Authenticate(plaintext string) (*APIToken, error) {
+	if !strings.HasPrefix(plaintext, tokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+
+	row := s.store.db.QueryRow(`
+		SELECT id, owner, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at
+		FROM api_tokens WHERE token_hash = ?`, hashToken(plaintext))
+	token, err := scanToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now().UTC()
+	if !token.Active(now) {
+		return nil, ErrInvalidToken
+	}
+
+	if _, err := s.store.db.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, now, token.ID); err != nil {
+		return nil, fmt.Errorf("failed to record token use: %w", err)
+	}
+	token.LastUsedAt = now
+	return token, nil
+}
+
+// List returns the tokens of owner, newest first
+func (s *TokenService) List(owner string) ([]APIToken, error) {
+	rows, err := s.store.db.Query(`
+		SELECT id, owner, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at
+		FROM api_tokens WHERE owner = ? ORDER BY created_at DESC, id DESC`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+// Revoke revokes a token of owner and returns it
+func (s *TokenService) Revoke(owner string, id int64) (*APIToken, error) {
+	res, err := s.store.db.Exec(`
+		UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND owner = ? AND revoked_at IS NULL`,
+		s.now().UTC(), id, owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke token: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, notFoundf("token not found or already revoked")
+	}
+
+	row := s.store.db.QueryRow(`
+		SELECT id, owner, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at
+		FROM api_tokens WHERE id = ?`, id)
+	return scanToken(row)
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanToken(row rowScanner) (*APIToken, error) {
+	var t APIToken
+	var scopes string
+	var lastUsed, revoked sql.NullTime
+	if err := row.Scan(&t.ID, &t.Owner, &t.Name, &t.Prefix, &scopes, &t.CreatedAt, &t.ExpiresAt, &lastUsed, &revoked); err != nil {
+		return nil, err
+	}
+	t.Scopes = strings.Split(scopes, ",")
+	t.LastUsedAt = lastUsed.Time
+	t.RevokedAt = revoked.Time
+	return &t, nil
+}
+
+// normalizeScopes validates and de-duplicates token scopes
+func normalizeScopes(scopes []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var result []string
+	for _, s := range scopes {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" || seen[s] {
+			continue
+		}
+		if s != ScopeRead && s != ScopeWrite {
+			return nil, invalidf("unknown token scope: %s", s)
+		}
+		seen[s] = true
+		result = append(result, s)
+	}
+	if len(result) == 0 {
+		return nil, invalidf("at least one token scope is required")
+	}
+	return result, nil
+}
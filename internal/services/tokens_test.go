@@ -0,0 +1,95 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTokens(t *testing.T) *TokenService {
+	t.Helper()
+	store, err := OpenStore(t.TempDir() + "/mailhub.db")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	tokens, err := NewTokenService(store)
+	if err != nil {
+		t.Fatalf("token service: %v", err)
+	}
+	return tokens
+}
+
+func TestTokenLifecycle(t *testing.T) {
+	tokens := newTestTokens(t)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tokens.now = func() time.Time { return now }
+
+	plaintext, token, err := tokens.Create("alice@example.com", "deploy", []string{"write", "read", "write"}, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !strings.HasPrefix(plaintext, token.Prefix+"_") || len(token.Scopes) != 2 {
+		t.Fatalf("unexpected token %q %+v", plaintext, token)
+	}
+
+	var stored int
+	tokens.store.db.QueryRow(`SELECT COUNT(*) FROM api_tokens WHERE token_hash = ?`, plaintext).Scan(&stored)
+	if stored != 0 {
+		t.Fatal("token stored in plaintext")
+	}
+
+	got, err := tokens.Authenticate(plaintext)
+	if err != nil || got.Owner != "alice@example.com" || !got.HasScope(ScopeRead) {
+		t.Fatalf("authenticate: %+v %v", got, err)
+	}
+	if _, err := tokens.Authenticate(plaintext + "x"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("tampered token accepted: %v", err)
+	}
+
+	list, err := tokens.List("alice@example.com")
+	if err != nil || len(list) != 1 || !list[0].LastUsedAt.Equal(now) {
+		t.Fatalf("list: %+v %v", list, err)
+	}
+
+	now = now.Add(25 * time.Hour)
+	if _, err := tokens.Authenticate(plaintext); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expired token accepted: %v", err)
+	}
+
+	if _, err := tokens.Revoke("bob@example.com", token.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoked another user's token: %v", err)
+	}
+	revoked, err := tokens.Revoke("alice@example.com", token.ID)
+	if err != nil || revoked.RevokedAt.IsZero() {
+		t.Fatalf("revoke: %+v %v", revoked, err)
+	}
+}
+
+func TestTokenValidation(t *testing.T) {
+	tokens := newTestTokens(t)
+
+	tests := []struct {
+		name     string
+		scopes   []string
+		lifetime time.Duration
+	}{
+		{"", []string{ScopeRead}, MinTokenLifetime},
+		{"ci", nil, MinTokenLifetime},
+		{"ci", []string{"admin"}, MinTokenLifetime},
+		{"ci", []string{ScopeRead}, 0},
+		{"ci", []string{ScopeRead}, time.Hour},
+		{"ci", []string{ScopeRead}, 2 * MaxTokenLifetime},
+	}
+	for _, tt := range tests {
+		if _, _, err := tokens.Create("alice@example.com", tt.name, tt.scopes, tt.lifetime); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Create(%q, %v, %v) = %v, want ErrInvalid", tt.name, tt.scopes, tt.lifetime, err)
+		}
+	}
+
+	read := &APIToken{Scopes: []string{ScopeRead}}
+	if read.HasScope(ScopeWrite) {
+		t.Error("read token grants write")
+	}
+}
@@ -189,7 +189,8 @@ tr:hover {
     font-weight: 500;
     color: #333;
 }
-.form-group input {
+.form-group input,
+.form-group textarea {
     width: 100%;
     padding: 12px 14px;
     border: 1px solid #ddd;
@@ -197,7 +198,12 @@ tr:hover {
     font-size: 1rem;
     transition: border-color 0.2s;
 }
-.form-group input:focus {
+.form-group textarea {
+    font-family: inherit;
+    resize: vertical;
+}
+.form-group input:focus,
+.form-group textarea:focus {
     outline: none;
     border-color: #1a73e8;
     box-shadow: 0 0 0 3px rgba(26,115,232,0.1);
@@ -251,11 +257,36 @@ tr:hover {
     background: #fee2e2;
     color: #dc2626;
 }
+.badge-warning {
+    background: #fef3c7;
+    color: #b45309;
+}
 .actions {
     display: flex;
     gap: 8px;
 }
 
+/* Quota usage */
+.quota-bar {
+    width: 160px;
+    height: 8px;
+    background: #e5e7eb;
+    border-radius: 4px;
+    overflow: hidden;
+    margin-bottom: 4px;
+}
+.quota-bar-fill {
+    height: 100%;
+    background: #1a73e8;
+}
+.quota-bar-fill.warn {
+    background: #dc2626;
+}
+.quota-text {
+    font-size: 0.8rem;
+    color: #666;
+}
+
 /* Mail Config Card */
 .config-grid {
     display: grid;
@@ -156,6 +156,76 @@ const RspamdDashboardHTML = `
         .log-line.warn {
             color: #fbbc04;
         }
+        .history-filters {
+            display: flex;
+            gap: 10px;
+            margin-bottom: 15px;
+            flex-wrap: wrap;
+        }
+        .history-filters select,
+        .history-filters input[type="number"] {
+            padding: 10px;
+            border: 1px solid #ddd;
+            border-radius: 6px;
+            font-size: 0.95rem;
+        }
+        .history-filters input[type="number"] {
+            width: 120px;
+        }
+        .history-table {
+            width: 100%;
+            border-collapse: collapse;
+            font-size: 0.85rem;
+        }
+        .history-table th,
+        .history-table td {
+            padding: 8px;
+            text-align: left;
+            border-bottom: 1px solid #eee;
+            vertical-align: top;
+        }
+        .history-table tr.history-row {
+            cursor: pointer;
+        }
+        .history-table tr.history-row:hover {
+            background: #f9f9f9;
+        }
+        .history-table tr.history-detail td {
+            background: #f5f5f5;
+        }
+        .history-action {
+            display: inline-block;
+            padding: 2px 8px;
+            border-radius: 10px;
+            font-size: 0.8rem;
+            font-weight: 600;
+            white-space: nowrap;
+            background: #e8f5e9;
+            color: #2e7d32;
+        }
+        .history-action.reject {
+            background: #ffebee;
+            color: #c62828;
+        }
+        .history-action.warn {
+            background: #fff8e1;
+            color: #f57f17;
+        }
+        .symbol-chip {
+            display: inline-block;
+            margin: 2px 4px 2px 0;
+            padding: 1px 6px;
+            border-radius: 4px;
+            background: #eef3fb;
+            font-family: 'Monaco', 'Courier New', monospace;
+            font-size: 0.75rem;
+        }
+        .symbol-chip.positive {
+            background: #ffebee;
+        }
+        .symbol-chip.negative {
+            background: #e8f5e9;
+        }
         .input-group {
             display: flex;
             gap: 10px;
@@ -266,7 +336,7 @@ const RspamdDashboardHTML = `
                         <span class="metric-value" id="cpuValue">--</span>
                     </div>
                 </div>
-                <div class="button-group">
+                <div class="button-group requires-manage">
                     <button class="btn-primary" onclick="startService()">Start</button>
                     <button class="btn-secondary" onclick="restartService()">Restart</button>
                     <button class="btn-danger" onclick="stopService()">Stop</button>
@@ -296,6 +366,14 @@ const RspamdDashboardHTML = `
                         <span class="metric-label">Average Score</span>
                         <span class="metric-value" id="scoreValue">--</span>
                     </div>
+                    <div class="metric">
+                        <span class="metric-label">Learned Spam</span>
+                        <span class="metric-value" id="learnedSpamValue">0</span>
+                    </div>
+                    <div class="metric">
+                        <span class="metric-label">Learned Ham</span>
+                        <span class="metric-value" id="learnedHamValue">0</span>
+                    </div>
                 </div>
                 <button class="btn-primary" style="width: 100%; margin-top: 15px;" onclick="refreshMetrics()">Refresh</button>
             </div>
@@ -324,7 +402,7 @@ const RspamdDashboardHTML = `
                         <span class="metric-value" id="redisMemValue">256mb</span>
                     </div>
                 </div>
-                <button class="btn-primary" style="width: 100%; margin-top: 15px;" onclick="openConfigEditor()">Edit</button>
+                <button class="btn-primary requires-manage" style="width: 100%; margin-top: 15px;" onclick="openConfigEditor()">Edit</button>
             </div>
         </div>
 
@@ -334,7 +412,7 @@ const RspamdDashboardHTML = `
                 <span class="icon">✅</span>
                 SPF Whitelist Management
             </h2>
-            <div class="input-group">
+            <div class="input-group requires-manage">
                 <input type="text" id="whitelistInput" placeholder="Enter domain, email, or IP to whitelist (e.g., *.example.com, user@example.com, 192.168.1.1)">
                 <button class="btn-primary" onclick="addToWhitelist()">Add</button>
             </div>
@@ -355,6 +433,48 @@ const RspamdDashboardHTML = `
             <button class="btn-secondary" style="width: 100%; margin-top: 15px;" onclick="refreshLogs()">Refresh Logs</button>
         </div>
 
+        <!-- Training Card -->
+        <div class="card full-width requires-manage">
+            <h2>
+                <span class="icon">🎓</span>
+                Bayes Training
+            </h2>
+            <p style="color: #666; margin-bottom: 15px;">
+                Upload a message saved as .eml (with all its headers) to teach the Bayes filter.
+                To learn from a mailbox's Junk or Inbox, use the training button of the mailbox in its domain.
+            </p>
+            <div class="input-group">
+                <input type="file" id="learnFile" accept=".eml,message/rfc822">
+                <button class="btn-danger" onclick="learnUpload('spam')">Learn as Spam</button>
+                <button class="btn-primary" onclick="learnUpload('ham')">Learn as Ham</button>
+            </div>
+        </div>
+
+        <!-- History Card -->
+        <div class="card full-width">
+            <h2>
+                <span class="icon">🔎</span>
+                Scan History
+            </h2>
+            <div class="history-filters">
+                <select id="historyAction">
+                    <option value="">All actions</option>
+                    <option value="reject">reject</option>
+                    <option value="soft reject">soft reject</option>
+                    <option value="rewrite subject">rewrite subject</option>
+                    <option value="add header">add header</option>
+                    <option value="greylist">greylist</option>
+                    <option value="no action">no action</option>
+                </select>
+                <input type="number" id="historyMinScore" step="0.1" placeholder="Min score">
+                <input type="number" id="historyMaxScore" step="0.1" placeholder="Max score">
+                <button class="btn-primary" onclick="fetchHistory()">Filter</button>
+            </div>
+            <div id="historyContainer">
+                <p style="color: #999; text-align: center;">Loading history...</p>
+            </div>
+        </div>
+
         <!-- Export Card -->
         <div class="card full-width">
             <h2>
@@ -398,6 +518,8 @@ const RspamdDashboardHTML = `
                     document.getElementById('spamValue').textContent = metrics.spam_count || '0';
                     document.getElementById('spamPercentValue').textContent = (metrics.spam_percentage || 0).toFixed(2) + '%';
                     document.getElementById('scoreValue').textContent = (metrics.average_score || 0).toFixed(2);
+                    document.getElementById('learnedSpamValue').textContent = metrics.learned_spam || '0';
+                    document.getElementById('learnedHamValue').textContent = metrics.learned_ham || '0';
                 }
             } catch (error) {
                 console.error('Error fetching metrics:', error);
@@ -439,7 +561,7 @@ const RspamdDashboardHTML = `
                         html += '<li style="text-align: center; color: #999; padding: 15px;">No entries in whitelist</li>';
                     } else {
                         items.forEach(item => {
-                            html += '<li class="whitelist-item"><span>' + item + '</span><button class="btn-danger" onclick="removeFromWhitelist(\'' + item.replace(/'/g, "\\'") + '\')">Remove</button></li>';
+                            html += '<li class="whitelist-item"><span>' + item + '</span><button class="btn-danger requires-manage" onclick="removeFromWhitelist(\'' + item.replace(/'/g, "\\'") + '\')">Remove</button></li>';
                         });
                     }
                     html += '</ul>';
@@ -469,6 +591,115 @@ const RspamdDashboardHTML = `
             }
         }
 
+        function escapeHtml(value) {
+            return String(value == null ? '' : value).replace(/[&<>"']/g, c => ({
+                '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+            })[c]);
+        }
+
+        function actionClass(action) {
+            if (action === 'reject') return 'reject';
+            if (action === 'no action') return '';
+            return 'warn';
+        }
+
+        // Symbols of a scan, heaviest first
+        function sortedSymbols(entry) {
+            return Object.values(entry.symbols || {}).sort((a, b) => Math.abs(b.score) - Math.abs(a.score));
+        }
+
+        async function fetchHistory() {
+            const params = new URLSearchParams();
+            const action = document.getElementById('historyAction').value;
+            const minScore = document.getElementById('historyMinScore').value;
+            const maxScore = document.getElementById('historyMaxScore').value;
+            if (action) params.set('action', action);
+            if (minScore !== '') params.set('min_score', minScore);
+            if (maxScore !== '') params.set('max_score', maxScore);
+
+            const container = document.getElementById('historyContainer');
+            try {
+                const response = await fetch(API_BASE + '/history?' + params.toString());
+                const data = await response.json();
+                if (!data.success) {
+                    container.innerHTML = '<div class="alert alert-error">' + escapeHtml(data.error) + '</div>';
+                    return;
+                }
+                const entries = data.data || [];
+                if (entries.length === 0) {
+                    container.innerHTML = '<p style="color: #999; text-align: center;">No scans match</p>';
+                    return;
+                }
+                let html = '<table class="history-table"><thead><tr>' +
+                    '<th>Time</th><th>Sender</th><th>Recipients</th><th>Subject</th><th>Action</th><th>Score</th><th>Symbols</th>' +
+                    '</tr></thead><tbody>';
+                entries.forEach((entry, i) => {
+                    const symbols = sortedSymbols(entry);
+                    const top = symbols.filter(s => s.score !== 0).slice(0, 4).map(s =>
+                        '<span class="symbol-chip ' + (s.score > 0 ? 'positive' : 'negative') + '">' +
+                        escapeHtml(s.name) + ' ' + s.score.toFixed(2) + '</span>').join('');
+                    const more = symbols.length > 4 ? ' <small>+' + (symbols.length - 4) + '</small>' : '';
+                    html += '<tr class="history-row" onclick="toggleHistoryDetail(' + i + ')">' +
+                        '<td style="white-space: nowrap;">' + new Date(entry.unix_time * 1000).toLocaleString() + '</td>' +
+                        '<td>' + escapeHtml(entry.sender_mime || entry.sender_smtp) + '</td>' +
+                        '<td>' + escapeHtml((entry.rcpt_mime || entry.rcpt_smtp || []).join(', ')) + '</td>' +
+                        '<td>' + escapeHtml(entry.subject) + '</td>' +
+                        '<td><span class="history-action ' + actionClass(entry.action) + '">' + escapeHtml(entry.action) + '</span></td>' +
+                        '<td style="white-space: nowrap;">' + entry.score.toFixed(2) + ' / ' + entry.required_score.toFixed(2) + '</td>' +
+                        '<td>' + top + more + '</td>' +
+                        '</tr>';
+
+                    let detail = '<tr><th>Symbol</th><th>Weight</th><th>Options</th><th>Description</th></tr>';
+                    symbols.forEach(s => {
+                        detail += '<tr><td><code>' + escapeHtml(s.name) + '</code></td>' +
+                            '<td>' + s.score.toFixed(2) + '</td>' +
+                            '<td>' + escapeHtml((s.options || []).join(', ')) + '</td>' +
+                            '<td>' + escapeHtml(s.description) + '</td></tr>';
+                    });
+                    html += '<tr class="history-detail" id="historyDetail' + i + '" style="display: none;"><td colspan="7">' +
+                        '<p style="margin-bottom: 8px;">Message-ID <code>' + escapeHtml(entry['message-id']) + '</code>' +
+                        (entry.qid ? ', queue ID <code>' + escapeHtml(entry.qid) + '</code>' : '') +
+                        (entry.ip ? ', from ' + escapeHtml(entry.ip) : '') +
+                        (entry.user ? ', user ' + escapeHtml(entry.user) : '') +
+                        ', ' + entry.size + ' bytes</p>' +
+                        '<table class="history-table">' + detail + '</table></td></tr>';
+                });
+                html += '</tbody></table>';
+                container.innerHTML = html;
+            } catch (error) {
+                console.error('Error fetching history:', error);
+            }
+        }
+
+        async function learnUpload(cls) {
+            const input = document.getElementById('learnFile');
+            if (!input.files.length) {
+                alert('Please choose an .eml file');
+                return;
+            }
+            const form = new FormData();
+            form.append('class', cls);
+            form.append('message', input.files[0]);
+            try {
+                const response = await fetch(API_BASE + '/learn', { method: 'POST', body: form });
+                const data = await response.json();
+                if (data.success) {
+                    input.value = '';
+                    fetchMetrics();
+                    alert(data.message);
+                } else {
+                    alert('Error: ' + data.error);
+                }
+            } catch (error) {
+                alert('Error: ' + error.message);
+            }
+        }
+
+        function toggleHistoryDetail(i) {
+            const row = document.getElementById('historyDetail' + i);
+            row.style.display = row.style.display === 'none' ? '' : 'none';
+        }
+
         async function startService() {
             if (confirm('Start Rspamd service?')) {
                 try {
@@ -592,6 +823,7 @@ const RspamdDashboardHTML = `
             fetchConfig();
             fetchWhitelist();
             fetchLogs();
+            fetchHistory();
 
             // Refresh every 30 seconds
             setInterval(() => {